@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogConfig writes one JSON line per finished miner session, apart
+// from the log of errors and events.
+type AccessLogConfig struct {
+	Path string `json:"path"` // "" disables the access log
+}
+
+// accessRecord is the summary of one session.
+type accessRecord struct {
+	Time       string  `json:"time"` // when the session ended
+	ClientIP   string  `json:"client_ip"`
+	Worker     string  `json:"worker"`
+	PoolWorker string  `json:"pool_worker"`
+	Pool       string  `json:"pool"`
+	Duration   float64 `json:"duration_seconds"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	// Shares by result: accepted, rejected, stale and dropped.
+	Shares map[string]int `json:"shares"`
+	Reason string         `json:"reason"`
+}
+
+// accessWriter appends access records to the log.
+type accessWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// accessLog is nil when no access log is configured.
+var accessLog *accessWriter
+
+func openAccessLog(cfg AccessLogConfig) (*accessWriter, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessWriter{file: file}, nil
+}
+
+func (aw *accessWriter) record(r accessRecord) {
+	if aw == nil {
+		return
+	}
+	line, _ := json.Marshal(r)
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	aw.file.Write(append(line, '\n'))
+}
+
+func (aw *accessWriter) close() {
+	if aw == nil {
+		return
+	}
+	aw.file.Close()
+}
+
+// ending records why the session ends; the first reason given wins.
+func (s *session) ending(reason string) {
+	s.endMu.Lock()
+	defer s.endMu.Unlock()
+	if s.endReason == "" {
+		s.endReason = reason
+	}
+}
+
+// countShare counts a share of the session by its result.
+func (s *session) countShare(result string) {
+	s.endMu.Lock()
+	defer s.endMu.Unlock()
+	if s.shares == nil {
+		s.shares = make(map[string]int)
+	}
+	s.shares[result]++
+}
+
+// logAccess writes the summary of the finished session.
+func (s *session) logAccess() {
+	if accessLog == nil {
+		return
+	}
+	s.endMu.Lock()
+	reason, shares := s.endReason, s.shares
+	s.endMu.Unlock()
+	if reason == "" {
+		reason = "closed"
+	}
+	if shares == nil {
+		shares = map[string]int{}
+	}
+	var poolWorker string
+	if s.worker != "" {
+		poolWorker = s.poolWorker(s.worker)
+	}
+	now := time.Now()
+	accessLog.record(accessRecord{
+		Time:       now.UTC().Format(time.RFC3339Nano),
+		ClientIP:   s.clientIP,
+		Worker:     s.worker,
+		PoolWorker: poolWorker,
+		Pool:       s.up.Load().target.Address,
+		Duration:   now.Sub(s.connected).Seconds(),
+		BytesIn:    s.traffic.in.Load(),
+		BytesOut:   s.traffic.out.Load(),
+		Shares:     shares,
+		Reason:     reason,
+	})
+}
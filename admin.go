@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminConfig enables the HTTP admin API.
+type AdminConfig struct {
+	// Listen is a TCP address or "unix:/path", as for the proxy listeners.
+	Listen string `json:"listen"`
+	// CaptureDir receives the traffic captures started with /capture;
+	// "" disables them.
+	CaptureDir string `json:"capture_dir"`
+	// Token must be sent as "Authorization: Bearer <token>" to kick or
+	// curtail miners, or capture their traffic, which holds their
+	// credentials. Without one, only clients on the loopback or a unix
+	// socket may.
+	Token string `json:"token"`
+}
+
+// startAdmin serves the admin API until the server stops.
+func (p *proxyServer) startAdmin() error {
+	address := p.config.Load().Admin.Listen
+	if address == "" {
+		return nil
+	}
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", p.handleHealth)
+	mux.HandleFunc("/targets", p.handleTargets)
+	mux.HandleFunc("/metrics", p.handleMetrics)
+	mux.HandleFunc("/sessions", p.handleSessions)
+	mux.HandleFunc("/miners", p.handleMiners)
+	mux.HandleFunc("/discovery", p.handleDiscovery)
+	mux.HandleFunc("/deviations", p.handleDeviations)
+	mux.HandleFunc("/shares", p.handleShares)
+	mux.HandleFunc("/kick", p.handleKick)
+	mux.HandleFunc("/curtail", p.handleCurtail)
+	mux.HandleFunc("/cluster", p.handleCluster)
+	mux.HandleFunc("/capture", p.handleCapture)
+	p.admin = &http.Server{Handler: mux}
+	go func() {
+		if err := p.admin.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin API stopped: %v", err)
+		}
+	}()
+	log.Printf("Admin API on %s", address)
+	return nil
+}
+
+// handleHealth answers 200 when all health conditions hold and 503 with the
+// failing ones otherwise.
+func (p *proxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	var failing []string
+	if !clock.ok() {
+		failing = append(failing, "clock_skew")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(failing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": len(failing) == 0, "failing": failing})
+}
+
+// targetStatus is a target as /targets lists it: its job negotiation policy
+// and, when health checks run, its health.
+type targetStatus struct {
+	Address          string `json:"address"`
+	JobNegotiation   string `json:"job_negotiation"`
+	TemplateProvider string `json:"template_provider,omitempty"`
+	*targetHealth
+}
+
+func (p *proxyServer) handleTargets(w http.ResponseWriter, r *http.Request) {
+	checked := make(map[string]*targetHealth)
+	for _, status := range health.snapshot() {
+		status := status
+		checked[status.Address] = &status
+	}
+	list := []targetStatus{}
+	for _, t := range allTargets(p.config.Load()) {
+		list = append(list, targetStatus{
+			Address:          t.Address,
+			JobNegotiation:   t.jobNegotiation(),
+			TemplateProvider: t.TemplateProvider,
+			targetHealth:     checked[t.Address],
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (p *proxyServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions.snapshot())
+}
+
+// handleMiners lists what the cgminer API of each connected miner reported.
+func (p *proxyServer) handleMiners(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(minerAPI.snapshot())
+}
+
+// handleDiscovery lists the miners found on the network by the last scan.
+func (p *proxyServer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discovery.snapshot())
+}
+
+// handleDeviations lists the workers running below their expected hashrate.
+func (p *proxyServer) handleDeviations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	list := stats.belowSpec(time.Now(), p.config.Load().ExpectedHashrate)
+	json.NewEncoder(w).Encode(append([]hashrateDeviation{}, list...))
+}
+
+// handleShares returns the last shares of the worker named by
+// /shares?worker=name, or of all workers by name.
+func (p *proxyServer) handleShares(w http.ResponseWriter, r *http.Request) {
+	worker := r.FormValue("worker")
+	if worker == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.shareHistories())
+		return
+	}
+	history, ok := stats.shareHistory(worker)
+	if !ok {
+		http.Error(w, "unknown worker", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// handleCurtail reports the curtailment state and past curtailments, and on
+// POST /curtail?minutes=n curtails for n minutes, or resumes for 0.
+func (p *proxyServer) handleCurtail(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !p.allowed(w, r) {
+			return
+		}
+		minutes, err := strconv.Atoi(r.FormValue("minutes"))
+		if err != nil || minutes < 0 {
+			http.Error(w, "minutes missing or invalid", http.StatusBadRequest)
+			return
+		}
+		curtailment.curtail(p.config.Load().Curtailment, minutes)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(curtailment.state())
+}
+
+// allowed reports whether the request may change the state of the proxy,
+// and answers it when not.
+func (p *proxyServer) allowed(w http.ResponseWriter, r *http.Request) bool {
+	if token := p.config.Load().Admin.Token; token != "" {
+		sent, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1 {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "token missing or wrong", http.StatusUnauthorized)
+		return false
+	}
+	// Unix socket peers have no host and port.
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip != nil && ip.IsLoopback() {
+		return true
+	}
+	http.Error(w, "only allowed from the loopback without a token", http.StatusForbidden)
+	return false
+}
+
+// handleKick disconnects the worker named by POST /kick?worker=name, so it
+// reconnects with the current routing and configuration.
+func (p *proxyServer) handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.allowed(w, r) {
+		return
+	}
+	worker := r.FormValue("worker")
+	if worker == "" {
+		http.Error(w, "worker missing", http.StatusBadRequest)
+		return
+	}
+	kicked := sessions.kick(worker)
+	w.Header().Set("Content-Type", "application/json")
+	if kicked == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"worker": worker, "kicked": kicked})
+}
+
+// handleCapture lists the IPs being captured on GET, starts capturing the
+// sessions of an IP on POST /capture?ip=address and stops on DELETE.
+func (p *proxyServer) handleCapture(w http.ResponseWriter, r *http.Request) {
+	dir := p.config.Load().Admin.CaptureDir
+	if dir == "" {
+		http.Error(w, "no capture_dir configured", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"dir": dir, "ips": captures.list()})
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.allowed(w, r) {
+		return
+	}
+	ip := r.FormValue("ip")
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "ip missing or invalid", http.StatusBadRequest)
+		return
+	}
+	ip = net.ParseIP(ip).String()
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodDelete {
+		if !captures.stop(ip) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ip": ip, "capturing": false})
+		return
+	}
+	running := captures.start(ip, dir)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ip": ip, "capturing": true, "sessions": running})
+}
+
+// handleCluster lists the state of every proxy of the cluster.
+func (p *proxyServer) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil {
+		http.Error(w, "not in a cluster", http.StatusNotFound)
+		return
+	}
+	nodes, err := cluster.nodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
+
+func (p *proxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.writeMetrics(w)
+}
+
+// The share results in the order of statsRow's counts.
+var shareResults = []string{"accepted", "rejected", "stale", "dropped"}
+
+// writeMetrics writes the proxy's metrics in the Prometheus text format.
+func (p *proxyServer) writeMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE stratum_proxy_connections gauge\nstratum_proxy_connections %d\n", p.active.Load())
+	if state := ha.state(); state != "" {
+		active := 0
+		if state == "active" {
+			active = 1
+		}
+		fmt.Fprintf(w, "# TYPE stratum_proxy_ha_active gauge\nstratum_proxy_ha_active %d\n", active)
+	}
+
+	fmt.Fprintf(w, "# TYPE stratum_proxy_target_up gauge\n")
+	for _, status := range health.snapshot() {
+		up := 0
+		if status.Up {
+			up = 1
+		}
+		fmt.Fprintf(w, "stratum_proxy_target_up{target=%q} %d\n", status.Address, up)
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_target_check_seconds gauge\n")
+	for _, status := range health.snapshot() {
+		fmt.Fprintf(w, "stratum_proxy_target_check_seconds{target=%q} %g\n", status.Address, status.Latency.Seconds())
+	}
+
+	clockOK := 0
+	if clock.ok() {
+		clockOK = 1
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_clock_ok gauge\nstratum_proxy_clock_ok %d\n", clockOK)
+	fmt.Fprintf(w, "# TYPE stratum_proxy_clock_skew_seconds gauge\n")
+	for source, skew := range clock.skews() {
+		fmt.Fprintf(w, "stratum_proxy_clock_skew_seconds{source=%q} %g\n", source, skew.Seconds())
+	}
+
+	failovers.mu.Lock()
+	fmt.Fprintf(w, "# TYPE stratum_proxy_failovers_total counter\nstratum_proxy_failovers_total %d\n", failovers.events)
+	fmt.Fprintf(w, "# TYPE stratum_proxy_failovers_failed_total counter\nstratum_proxy_failovers_failed_total %d\n", failovers.failed)
+	fmt.Fprintf(w, "# TYPE stratum_proxy_failover_shares_total counter\n")
+	fmt.Fprintf(w, "stratum_proxy_failover_shares_total{fate=\"dropped\"} %d\n", failovers.dropped)
+	fmt.Fprintf(w, "stratum_proxy_failover_shares_total{fate=\"buffered\"} %d\n", failovers.buffered)
+	fmt.Fprintf(w, "stratum_proxy_failover_shares_total{fate=\"stale\"} %d\n", failovers.stale)
+	fmt.Fprintf(w, "# TYPE stratum_proxy_failover_work_lost_seconds_total counter\nstratum_proxy_failover_work_lost_seconds_total %g\n", failovers.workLost.Seconds())
+	failovers.mu.Unlock()
+
+	scannerStats.Lock()
+	fmt.Fprintf(w, "# TYPE stratum_proxy_scanner_probes_total counter\n")
+	for _, kind := range []string{"http", "tls", "other"} {
+		fmt.Fprintf(w, "stratum_proxy_scanner_probes_total{kind=%q} %d\n", kind, scannerStats.total[kind])
+	}
+	scannerStats.Unlock()
+
+	staleStats.Lock()
+	fmt.Fprintf(w, "# TYPE stratum_proxy_stale_shares_total counter\n")
+	for name, c := range staleStats.m {
+		fmt.Fprintf(w, "stratum_proxy_stale_shares_total{policy=%q,outcome=\"filtered\"} %d\n", name, c.filtered)
+		fmt.Fprintf(w, "stratum_proxy_stale_shares_total{policy=%q,outcome=\"old_accepted\"} %d\n", name, c.oldAccepted)
+		fmt.Fprintf(w, "stratum_proxy_stale_shares_total{policy=%q,outcome=\"old_rejected\"} %d\n", name, c.oldRejected)
+	}
+	staleStats.Unlock()
+
+	workers, pools := stats.totals()
+	fmt.Fprintf(w, "# TYPE stratum_proxy_worker_shares_total counter\n")
+	for _, row := range workers {
+		for i, n := range []int{row.Accepted, row.Rejected, row.Stale, row.Dropped} {
+			fmt.Fprintf(w, "stratum_proxy_worker_shares_total{worker=%q,result=%q} %d\n", row.Name, shareResults[i], n)
+		}
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_worker_online_seconds_total counter\n")
+	for _, row := range workers {
+		fmt.Fprintf(w, "stratum_proxy_worker_online_seconds_total{worker=%q} %g\n", row.Name, row.Uptime)
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_worker_info gauge\n")
+	for _, row := range workers {
+		if row.Model != "" {
+			fmt.Fprintf(w, "stratum_proxy_worker_info{worker=%q,model=%q} 1\n", row.Name, row.Model)
+		}
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_pool_shares_total counter\n")
+	for _, row := range pools {
+		for i, n := range []int{row.Accepted, row.Rejected, row.Stale, row.Dropped} {
+			fmt.Fprintf(w, "stratum_proxy_pool_shares_total{pool=%q,result=%q} %d\n", row.Name, shareResults[i], n)
+		}
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_worker_bytes_total counter\n")
+	for _, row := range workers {
+		fmt.Fprintf(w, "stratum_proxy_worker_bytes_total{worker=%q,direction=\"in\"} %d\n", row.Name, row.BytesIn)
+		fmt.Fprintf(w, "stratum_proxy_worker_bytes_total{worker=%q,direction=\"out\"} %d\n", row.Name, row.BytesOut)
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_pool_bytes_total counter\n")
+	for _, row := range pools {
+		fmt.Fprintf(w, "stratum_proxy_pool_bytes_total{pool=%q,direction=\"in\"} %d\n", row.Name, row.BytesIn)
+		fmt.Fprintf(w, "stratum_proxy_pool_bytes_total{pool=%q,direction=\"out\"} %d\n", row.Name, row.BytesOut)
+	}
+	minerAPI.writeMetrics(w)
+	discovery.writeMetrics(w)
+	profit.writeMetrics(w)
+	curtailment.writeMetrics(w)
+	writeExpectedMetrics(w, p.config.Load().ExpectedHashrate)
+	submitLatency.write(w)
+}
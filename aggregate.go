@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A target with aggregate settings is reached over pool connections its
+// miners share, for pools that cap the connections of an account or an
+// address. Each shared connection subscribes once and splits the
+// extranonce2 space the pool gives it: every miner on it gets a number,
+// which the proxy puts in front of the extranonce2 of its shares. The
+// miner is answered its subscribe with the number appended to extranonce1
+// and an extranonce2 as much shorter, so no two miners of a connection
+// hash the same work. Miners authorize and submit under their own
+// usernames, as pools take several workers on a connection. Sessions use
+// the target like any other, failover included.
+
+// AggregateConfig sets how miners share the connections to a target.
+type AggregateConfig struct {
+	// PrefixBytes of extranonce2 number the miners of a connection, 1 by
+	// default, for up to 256 miners. The pool must leave them at least one
+	// byte of extranonce2 of their own.
+	PrefixBytes int `json:"prefix_bytes,omitempty"`
+	// MaxMiners caps the miners of a connection, beyond which another is
+	// opened; as many as PrefixBytes can number when 0.
+	MaxMiners int `json:"max_miners,omitempty"`
+}
+
+const (
+	defaultAggregatePrefixBytes = 1
+	// How long a connection no miner uses is kept for the next one.
+	aggregateIdleTimeout  = time.Minute
+	aggregateWriteTimeout = 10 * time.Second
+)
+
+// Request ids of the handshake of a shared connection; the requests of its
+// miners are numbered after them.
+const (
+	aggregateConfigureID    = 1
+	aggregateSubscribeID    = 2
+	aggregateExtranonceID   = 3
+	aggregateFirstRequestID = 10
+)
+
+func validateAggregate(t Target) error {
+	a := t.Aggregate
+	if a == nil {
+		return nil
+	}
+	if a.PrefixBytes < 0 || a.PrefixBytes > 4 {
+		return fmt.Errorf("target %s: aggregate prefix_bytes must be 1 to 4", t.Address)
+	}
+	if a.MaxMiners < 0 {
+		return fmt.Errorf("target %s: negative aggregate max_miners", t.Address)
+	}
+	if t.Solo != nil {
+		return fmt.Errorf("target %s: solo targets cannot be aggregated", t.Address)
+	}
+	if t.Sequenced || t.ResumeSession {
+		return fmt.Errorf("target %s: aggregated connections are neither sequenced nor resumed", t.Address)
+	}
+	return nil
+}
+
+func (a *AggregateConfig) prefixBytes() int {
+	if a.PrefixBytes == 0 {
+		return defaultAggregatePrefixBytes
+	}
+	return a.PrefixBytes
+}
+
+// capacity is how many miners a connection takes. Four prefix bytes number
+// more miners than an int holds on 32-bit platforms, so the count is taken
+// in uint64 and capped.
+func (a *AggregateConfig) capacity() int {
+	n := uint64(1) << (8 * uint(a.prefixBytes()))
+	if a.MaxMiners > 0 && uint64(a.MaxMiners) < n {
+		return a.MaxMiners
+	}
+	if n > math.MaxInt {
+		return math.MaxInt
+	}
+	return int(n)
+}
+
+// aggregateRegistry holds the shared connections, by target address.
+type aggregateRegistry struct {
+	mu     sync.Mutex
+	groups map[string][]*aggregateGroup
+}
+
+var aggregates = &aggregateRegistry{groups: make(map[string][]*aggregateGroup)}
+
+// dial returns a connection for one miner to the pool at target, over a
+// shared connection with room for it, opening one when none has.
+func (r *aggregateRegistry) dial(target Target) (net.Conn, error) {
+	client, server := net.Pipe()
+	r.mu.Lock()
+	for _, g := range r.groups[target.Address] {
+		if c := g.attach(server); c != nil {
+			r.mu.Unlock()
+			go c.serve()
+			return client, nil
+		}
+	}
+	r.mu.Unlock()
+
+	// Dialed outside the lock: a slow pool holds up only its own miners.
+	g, err := dialAggregateGroup(target)
+	if err != nil {
+		client.Close()
+		server.Close()
+		return nil, err
+	}
+	c := g.attach(server)
+	if c == nil {
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("shared connection to %s lost", target.Address)
+	}
+	r.mu.Lock()
+	r.groups[target.Address] = append(r.groups[target.Address], g)
+	r.mu.Unlock()
+	go c.serve()
+	return client, nil
+}
+
+func (r *aggregateRegistry) remove(g *aggregateGroup) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	groups := r.groups[g.target.Address]
+	for i, other := range groups {
+		if other == g {
+			r.groups[g.target.Address] = append(groups[:i:i], groups[i+1:]...)
+			break
+		}
+	}
+	if len(r.groups[g.target.Address]) == 0 {
+		delete(r.groups, g.target.Address)
+	}
+}
+
+// aggregateGroup is a pool connection shared by miners.
+type aggregateGroup struct {
+	target     Target
+	prefix     int // bytes of extranonce2 numbering the miners
+	conn       net.Conn
+	writeMu    sync.Mutex
+	subscribed chan struct{} // closed once the pool answered the subscribe
+	subscribe  sync.Once
+
+	mu              sync.Mutex
+	closed          bool
+	extranonce1     string
+	extranonce2Size int
+	versionMask     string // granted by the pool, "" without version rolling
+	difficulty      string // last mining.set_difficulty
+	notify          string // last mining.notify
+	miners          map[int]*aggregateConn
+	nextID          uint64
+	pending         map[string]aggregateRequest // by pool request id
+	idleSince       time.Time
+}
+
+// aggregateRequest is a request of a miner the pool has yet to answer.
+type aggregateRequest struct {
+	c  *aggregateConn
+	id json.RawMessage
+}
+
+// dialAggregateGroup connects to the pool at target and subscribes.
+func dialAggregateGroup(target Target) (*aggregateGroup, error) {
+	plain := target
+	plain.Aggregate = nil
+	conn, err := dialAddresses(plain)
+	if err != nil {
+		return nil, err
+	}
+	g := &aggregateGroup{
+		target:     target,
+		prefix:     target.Aggregate.prefixBytes(),
+		conn:       conn,
+		subscribed: make(chan struct{}),
+		miners:     make(map[int]*aggregateConn),
+		nextID:     aggregateFirstRequestID,
+		pending:    make(map[string]aggregateRequest),
+	}
+	go g.readLoop()
+
+	// Version rolling is asked for within the BIP 320 bits; the miners get
+	// what the pool grants.
+	handshake := []string{
+		fmt.Sprintf(`{"id":%d,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"%08x","version-rolling.min-bit-count":2}]}`,
+			aggregateConfigureID, versionRollingMask),
+		fmt.Sprintf(`{"id":%d,"method":"mining.subscribe","params":[]}`, aggregateSubscribeID),
+		fmt.Sprintf(`{"id":%d,"method":"mining.extranonce.subscribe","params":[]}`, aggregateExtranonceID),
+	}
+	for _, line := range handshake {
+		if err := g.write(line); err != nil {
+			g.fail(err)
+			return nil, err
+		}
+	}
+	timeout := defaultDialTimeout
+	if target.DialTimeoutMs > 0 {
+		timeout = time.Duration(target.DialTimeoutMs) * time.Millisecond
+	}
+	select {
+	case <-g.subscribed:
+	case <-time.After(timeout):
+		g.fail(fmt.Errorf("no answer to the subscribe"))
+		return nil, fmt.Errorf("%s did not answer the subscribe", target.Address)
+	}
+
+	g.mu.Lock()
+	closed, extranonce1, size := g.closed, g.extranonce1, g.extranonce2Size
+	g.mu.Unlock()
+	switch {
+	case closed || extranonce1 == "":
+		g.fail(fmt.Errorf("subscribe refused"))
+		return nil, fmt.Errorf("%s refused the subscribe", target.Address)
+	case size <= g.prefix:
+		g.fail(fmt.Errorf("extranonce2 too short"))
+		return nil, fmt.Errorf("%s leaves %d bytes of extranonce2, not enough to share", target.Address, size)
+	}
+	log.Printf("Shared connection to %s: extranonce1 %s, up to %d miners with %d bytes of extranonce2 each",
+		target.Address, extranonce1, target.Aggregate.capacity(), size-g.prefix)
+	return g, nil
+}
+
+func (g *aggregateGroup) write(line string) error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	_, err := writeLine(g.conn, line)
+	return err
+}
+
+// attach gives conn the lowest free number of the connection, so numbers
+// are reused rather than run out, or returns nil when it is full or lost.
+func (g *aggregateGroup) attach(conn net.Conn) *aggregateConn {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed || len(g.miners) >= g.target.Aggregate.capacity() {
+		return nil
+	}
+	n := 0
+	for g.miners[n] != nil {
+		n++
+	}
+	c := &aggregateConn{group: g, conn: conn, number: n}
+	g.miners[n] = c
+	return c
+}
+
+func (g *aggregateGroup) detach(c *aggregateConn) {
+	g.mu.Lock()
+	delete(g.miners, c.number)
+	for key, req := range g.pending {
+		if req.c == c {
+			delete(g.pending, key)
+		}
+	}
+	idle := len(g.miners) == 0
+	if idle {
+		g.idleSince = time.Now()
+	}
+	g.mu.Unlock()
+	if idle {
+		time.AfterFunc(aggregateIdleTimeout, g.closeIdle)
+	}
+}
+
+// closeIdle closes the connection once no miner used it for the idle
+// timeout.
+func (g *aggregateGroup) closeIdle() {
+	g.mu.Lock()
+	idle := !g.closed && len(g.miners) == 0 && time.Since(g.idleSince) >= aggregateIdleTimeout
+	if idle {
+		g.closed = true
+	}
+	g.mu.Unlock()
+	if idle {
+		aggregates.remove(g)
+		g.conn.Close()
+	}
+}
+
+// fail closes the connection and those of its miners, which fail over as
+// from any lost pool.
+func (g *aggregateGroup) fail(err error) {
+	g.mu.Lock()
+	closed := g.closed
+	g.closed = true
+	miners := make([]*aggregateConn, 0, len(g.miners))
+	for _, c := range g.miners {
+		miners = append(miners, c)
+	}
+	g.mu.Unlock()
+	g.subscribe.Do(func() { close(g.subscribed) })
+	aggregates.remove(g)
+	g.conn.Close()
+	if !closed && len(miners) > 0 {
+		log.Printf("Shared connection to %s lost with %d miners: %v", g.target.Address, len(miners), err)
+	}
+	for _, c := range miners {
+		c.conn.Close()
+	}
+}
+
+// extranonceOf returns the extranonce1 and extranonce2 size miner number n
+// works with. Callers hold g.mu.
+func (g *aggregateGroup) extranonceOf(n int) (string, int) {
+	return g.extranonce1 + fmt.Sprintf("%0*x", 2*g.prefix, n), g.extranonce2Size - g.prefix
+}
+
+func (g *aggregateGroup) readLoop() {
+	reader := bufio.NewReader(g.conn)
+	for {
+		line, err := readLine(reader, defaultMaxPoolMessage)
+		if err != nil {
+			g.fail(err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		var msg stratumResponse
+		if json.Unmarshal([]byte(line), &msg) != nil {
+			continue
+		}
+
+		switch msg.Method {
+		case "":
+			g.answered(&msg, line)
+		case "mining.set_extranonce":
+			var extranonce1 string
+			var size int
+			if len(msg.Params) < 2 || json.Unmarshal(msg.Params[0], &extranonce1) != nil || json.Unmarshal(msg.Params[1], &size) != nil {
+				continue
+			}
+			if size <= g.prefix {
+				g.fail(fmt.Errorf("new extranonce2 of %d bytes is too short to share", size))
+				return
+			}
+			g.mu.Lock()
+			g.extranonce1, g.extranonce2Size = extranonce1, size
+			lines := make(map[*aggregateConn]string)
+			for _, c := range g.miners {
+				if c.subscribed {
+					e1, e2Size := g.extranonceOf(c.number)
+					lines[c] = fmt.Sprintf(`{"id":null,"method":"mining.set_extranonce","params":["%s",%d]}`, e1, e2Size)
+				}
+			}
+			g.mu.Unlock()
+			for c, line := range lines {
+				c.send(line)
+			}
+		default:
+			// Jobs and difficulty, and client.reconnect and the like, are
+			// for every miner.
+			g.mu.Lock()
+			switch msg.Method {
+			case "mining.set_difficulty":
+				g.difficulty = line
+			case "mining.notify":
+				g.notify = line
+			}
+			miners := g.subscribedMiners()
+			g.mu.Unlock()
+			for _, c := range miners {
+				c.send(line)
+			}
+		}
+	}
+}
+
+// subscribedMiners lists the miners that subscribed. Callers hold g.mu.
+func (g *aggregateGroup) subscribedMiners() []*aggregateConn {
+	miners := make([]*aggregateConn, 0, len(g.miners))
+	for _, c := range g.miners {
+		if c.subscribed {
+			miners = append(miners, c)
+		}
+	}
+	return miners
+}
+
+// answered handles an answer of the pool: to the handshake, or to a miner,
+// which gets it under the id of its own request.
+func (g *aggregateGroup) answered(msg *stratumResponse, line string) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(line), &fields) != nil {
+		return
+	}
+	key := string(fields["id"])
+	switch key {
+	case strconv.Itoa(aggregateConfigureID):
+		var result map[string]interface{}
+		if json.Unmarshal(msg.Result, &result) == nil && result["version-rolling"] == true {
+			mask, _ := result["version-rolling.mask"].(string)
+			g.mu.Lock()
+			g.versionMask = mask
+			g.mu.Unlock()
+		}
+		return
+	case strconv.Itoa(aggregateSubscribeID):
+		var result []json.RawMessage
+		if json.Unmarshal(msg.Result, &result) == nil && len(result) >= 3 {
+			g.mu.Lock()
+			json.Unmarshal(result[1], &g.extranonce1)
+			json.Unmarshal(result[2], &g.extranonce2Size)
+			g.mu.Unlock()
+		}
+		g.subscribe.Do(func() { close(g.subscribed) })
+		return
+	case strconv.Itoa(aggregateExtranonceID):
+		return
+	}
+
+	g.mu.Lock()
+	req, ok := g.pending[key]
+	delete(g.pending, key)
+	g.mu.Unlock()
+	if !ok {
+		return
+	}
+	fields["id"] = req.id
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	req.c.send(string(data))
+}
+
+// forward sends a request of a miner to the pool under an id of the shared
+// connection.
+func (g *aggregateGroup) forward(c *aggregateConn, id json.RawMessage, method string, params []json.RawMessage) {
+	g.mu.Lock()
+	g.nextID++
+	key := strconv.FormatUint(g.nextID, 10)
+	if len(id) > 0 && string(id) != "null" {
+		g.pending[key] = aggregateRequest{c: c, id: id}
+	}
+	g.mu.Unlock()
+	data, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	if err := g.write(fmt.Sprintf(`{"id":%s,"method":%q,"params":%s}`, key, method, data)); err != nil {
+		g.fail(err)
+	}
+}
+
+// configureResult answers the mining.configure of a miner with the version
+// rolling the pool granted, within the mask the miner asked for.
+func (g *aggregateGroup) configureResult(params []json.RawMessage) map[string]interface{} {
+	g.mu.Lock()
+	granted := g.versionMask
+	g.mu.Unlock()
+	result := make(map[string]interface{})
+	var extensions []string
+	var options map[string]interface{}
+	if len(params) > 0 {
+		json.Unmarshal(params[0], &extensions)
+	}
+	if len(params) > 1 {
+		json.Unmarshal(params[1], &options)
+	}
+	for _, extension := range extensions {
+		mask, err := strconv.ParseUint(granted, 16, 32)
+		if extension != "version-rolling" || err != nil {
+			result[extension] = false
+			continue
+		}
+		if requested, ok := options["version-rolling.mask"].(string); ok {
+			if m, err := strconv.ParseUint(requested, 16, 32); err == nil {
+				mask &= m
+			}
+		}
+		result["version-rolling"] = true
+		result["version-rolling.mask"] = fmt.Sprintf("%08x", mask)
+	}
+	return result
+}
+
+// aggregateConn is the connection of one miner over a shared connection.
+type aggregateConn struct {
+	group      *aggregateGroup
+	conn       net.Conn
+	number     int
+	writeMu    sync.Mutex
+	subscribed bool // guarded by group.mu
+}
+
+// send writes lines to the miner, in order. A miner too slow to take them
+// is disconnected rather than holding up the others.
+func (c *aggregateConn) send(lines ...string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(aggregateWriteTimeout))
+	for _, line := range lines {
+		if _, err := writeLine(c.conn, line); err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func (c *aggregateConn) answer(id json.RawMessage, result interface{}) {
+	data, _ := json.Marshal(map[string]interface{}{"id": id, "result": result, "error": nil})
+	c.send(string(data))
+}
+
+func (c *aggregateConn) reject(id json.RawMessage, code int, message string) {
+	data, _ := json.Marshal(map[string]interface{}{"id": id, "result": nil, "error": []interface{}{code, message, nil}})
+	c.send(string(data))
+}
+
+func (c *aggregateConn) serve() {
+	defer func() {
+		c.conn.Close()
+		c.group.detach(c)
+	}()
+	g := c.group
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := readLine(reader, defaultMaxClientMessage)
+		if err != nil {
+			return
+		}
+		var msg stratumMessage
+		var head struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if json.Unmarshal([]byte(line), &msg) != nil || json.Unmarshal([]byte(line), &head) != nil {
+			continue
+		}
+
+		switch msg.Method {
+		case "mining.configure":
+			c.answer(head.ID, g.configureResult(msg.Params))
+		case "mining.subscribe":
+			c.subscribe(head.ID)
+		case "mining.extranonce.subscribe", "mining.suggest_difficulty":
+			// The connection gets extranonce changes for all its miners,
+			// and a difficulty one of them suggested would be for all.
+			c.answer(head.ID, true)
+		case "mining.submit":
+			params, ok := c.prefixed(msg.Params)
+			if !ok {
+				c.reject(head.ID, 20, "Invalid extranonce2 size")
+				continue
+			}
+			g.forward(c, head.ID, msg.Method, params)
+		case "mining.authorize":
+			g.forward(c, head.ID, msg.Method, msg.Params)
+		default:
+			if len(head.ID) > 0 && string(head.ID) != "null" {
+				c.reject(head.ID, 20, "Unsupported method")
+			}
+		}
+	}
+}
+
+// subscribe answers a subscribe with the extranonce of the miner, then
+// sends the current difficulty and job. Writes hold c.writeMu from before
+// the miner counts as subscribed, so newer jobs come after these.
+func (c *aggregateConn) subscribe(id json.RawMessage) {
+	g := c.group
+	c.writeMu.Lock()
+	g.mu.Lock()
+	c.subscribed = true
+	extranonce1, size := g.extranonceOf(c.number)
+	difficulty, notify := g.difficulty, g.notify
+	g.mu.Unlock()
+
+	answer, _ := json.Marshal(map[string]interface{}{"id": id, "error": nil, "result": []interface{}{
+		[][]string{{"mining.set_difficulty", extranonce1}, {"mining.notify", extranonce1}}, extranonce1, size,
+	}})
+	lines := []string{string(answer)}
+	if difficulty != "" {
+		lines = append(lines, difficulty)
+	}
+	if notify != "" {
+		lines = append(lines, cleanJobsNotify(notify))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(aggregateWriteTimeout))
+	for _, line := range lines {
+		if _, err := writeLine(c.conn, line); err != nil {
+			c.conn.Close()
+			break
+		}
+	}
+	c.writeMu.Unlock()
+}
+
+// prefixed returns the params of a mining.submit with the number of the
+// miner in front of its extranonce2, or false when that is not of the size
+// the miner was given.
+func (c *aggregateConn) prefixed(params []json.RawMessage) ([]json.RawMessage, bool) {
+	var extranonce2 string
+	if len(params) < 3 || json.Unmarshal(params[2], &extranonce2) != nil {
+		return nil, false
+	}
+	g := c.group
+	g.mu.Lock()
+	extranonce1, size := g.extranonceOf(c.number)
+	g.mu.Unlock()
+	if len(extranonce2) != 2*size {
+		return nil, false
+	}
+	prefix := extranonce1[len(extranonce1)-2*g.prefix:]
+	prefixed := append([]json.RawMessage{}, params...)
+	prefixed[2], _ = json.Marshal(prefix + extranonce2)
+	return prefixed, true
+}
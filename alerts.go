@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AlertsConfig sets which conditions raise alerts and where they are sent
+// besides the log.
+type AlertsConfig struct {
+	// WorkerOfflineMinutes alerts when a worker stays disconnected that
+	// long; 0 disables.
+	WorkerOfflineMinutes int `json:"worker_offline_minutes"`
+	// WorkerSilentMinutes alerts when a connected worker submits no share
+	// that long, as miners with hung boards keep their connection; 0
+	// disables.
+	WorkerSilentMinutes int `json:"worker_silent_minutes"`
+	// HashrateDropPercent alerts when the hashrate of all workers over
+	// the last ten minutes is this much below the ten minutes before;
+	// 0 disables.
+	HashrateDropPercent float64 `json:"hashrate_drop_percent"`
+	// WorkerHashrateDropPercent alerts when the hashrate of a worker over
+	// the last WorkerHashrateDropMinutes (10 by default) is this much
+	// below its own over the rest of the hour, as when a board died;
+	// 0 disables.
+	WorkerHashrateDropPercent float64 `json:"worker_hashrate_drop_percent"`
+	WorkerHashrateDropMinutes int     `json:"worker_hashrate_drop_minutes"`
+	// RepeatMinutes is how long the same alert is not sent again.
+	RepeatMinutes int             `json:"repeat_minutes"`
+	Webhooks      []WebhookConfig `json:"webhooks"`
+	Telegram      TelegramConfig  `json:"telegram"`
+}
+
+// WebhookConfig posts alerts to an HTTP endpoint.
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Events limits the webhook to these events; empty means all.
+	Events []string `json:"events"`
+	// Template is a text/template producing the JSON body, with .Event,
+	// .Subject, .Message and .Time, and a json function to quote values,
+	// e.g. {"text": {{json .Message}}}. Empty sends the alert as a JSON
+	// object with those fields.
+	Template string            `json:"template"`
+	Headers  map[string]string `json:"headers"`
+}
+
+// Alert events.
+const (
+	eventAllTargetsDown = "all_targets_down"
+	eventPoolDown       = "pool_down"
+	eventHashrateDrop   = "hashrate_drop"
+	eventWorkerHashrate = "worker_hashrate_drop"
+	eventWorkerOffline  = "worker_offline"
+	eventWorkerOnline   = "worker_online"
+	eventWorkerSilent   = "worker_silent"
+	eventBelowSpec      = "below_spec"
+	eventRejectRate     = "reject_rate"
+	eventHAActive       = "ha_active"
+	eventBlockFound     = "block_found"
+	eventSubmitFlood    = "submit_flood"
+	eventCurtailStart   = "curtailment_start"
+	eventCurtailEnd     = "curtailment_end"
+	// A discovered miner that does not mine through the proxy.
+	eventMinerNotConnected = "miner_not_connected"
+)
+
+const (
+	defaultAlertRepeatMinutes = 10
+	webhookTimeout            = 10 * time.Second
+	alertCheckInterval        = 30 * time.Second
+	hashrateWindowMinutes     = 10
+)
+
+// A worker's hashrate is compared over its last minutes with the rest of
+// the hour, which needs some of the hour left.
+const (
+	defaultWorkerHashrateDropMinutes = 10
+	maxWorkerHashrateDropMinutes     = 30
+)
+
+// alertEvent is what webhook templates are executed with.
+type alertEvent struct {
+	Event   string    `json:"event"`
+	Subject string    `json:"subject"` // the pool or worker, if any
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type webhook struct {
+	WebhookConfig
+	template *template.Template
+}
+
+// alerter sends alerts to the configured sinks.
+type alerter struct {
+	repeat   time.Duration
+	webhooks []webhook
+	telegram *telegramBot
+	client   *http.Client
+	mu       sync.Mutex
+	lastSent map[string]time.Time // by event and subject
+}
+
+var alerts = newAlerter(AlertsConfig{})
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func newAlerter(cfg AlertsConfig) *alerter {
+	repeat := cfg.RepeatMinutes
+	if repeat <= 0 {
+		repeat = defaultAlertRepeatMinutes
+	}
+	a := &alerter{
+		repeat:   time.Duration(repeat) * time.Minute,
+		client:   &http.Client{Timeout: webhookTimeout},
+		lastSent: make(map[string]time.Time),
+	}
+	for _, hook := range cfg.Webhooks {
+		// validateAlerts has parsed the templates already.
+		t, _ := parseWebhookTemplate(hook.Template)
+		a.webhooks = append(a.webhooks, webhook{WebhookConfig: hook, template: t})
+	}
+	a.telegram = newTelegramBot(cfg.Telegram)
+	return a
+}
+
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("webhook").Funcs(templateFuncs).Parse(text)
+}
+
+func validateAlerts(config *Config) error {
+	for _, hook := range config.Alerts.Webhooks {
+		if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+			return fmt.Errorf("webhook URL %q is not http or https", hook.URL)
+		}
+		if _, err := parseWebhookTemplate(hook.Template); err != nil {
+			return fmt.Errorf("webhook %s: %v", hook.URL, err)
+		}
+	}
+	if drop := config.Alerts.WorkerHashrateDropPercent; drop < 0 || drop > 100 {
+		return fmt.Errorf("worker_hashrate_drop_percent %g is not between 0 and 100", drop)
+	}
+	if minutes := config.Alerts.WorkerHashrateDropMinutes; minutes < 0 || minutes > maxWorkerHashrateDropMinutes {
+		return fmt.Errorf("worker_hashrate_drop_minutes %d is not between 0 and %d", minutes, maxWorkerHashrateDropMinutes)
+	}
+	if telegram := config.Alerts.Telegram; (telegram.BotToken == "") != (telegram.ChatID == 0) {
+		return fmt.Errorf("telegram needs both bot_token and chat_id")
+	}
+	return nil
+}
+
+// alert reports a condition an operator has to act on: it is logged and
+// sent to the webhooks and Telegram, unless the same event for the same subject was
+// reported recently.
+func alert(event, subject, format string, args ...interface{}) {
+	now := time.Now()
+	if !alerts.due(event+" "+subject, now) {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	log.Printf("ALERT: %s", message)
+	alerts.send(alertEvent{Event: event, Subject: subject, Message: message, Time: now})
+}
+
+func (a *alerter) due(key string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if last, ok := a.lastSent[key]; ok && now.Sub(last) < a.repeat {
+		return false
+	}
+	a.lastSent[key] = now
+	return true
+}
+
+func (a *alerter) send(e alertEvent) {
+	for _, hook := range a.webhooks {
+		if len(hook.Events) > 0 && !containsString(hook.Events, e.Event) {
+			continue
+		}
+		go a.post(hook, e)
+	}
+	if a.telegram != nil && (len(a.telegram.cfg.Events) == 0 || containsString(a.telegram.cfg.Events, e.Event)) {
+		go a.telegram.notify(e)
+	}
+}
+
+func (a *alerter) post(hook webhook, e alertEvent) {
+	var body bytes.Buffer
+	if hook.template != nil {
+		if err := hook.template.Execute(&body, e); err != nil {
+			log.Printf("Webhook %s: %v", hook.URL, err)
+			return
+		}
+	} else {
+		json.NewEncoder(&body).Encode(e)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, &body)
+	if err != nil {
+		log.Printf("Webhook %s: %v", hook.URL, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		log.Printf("Webhook %s: %v", hook.URL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Webhook %s: %s", hook.URL, resp.Status)
+	}
+}
+
+// watchStats alerts on workers that stayed offline or silent too long, on
+// hashrate drops and on workers below spec until stop is closed.
+func watchStats(config *Config, stop <-chan struct{}) {
+	cfg := config.Alerts
+	after := time.Duration(cfg.WorkerOfflineMinutes) * time.Minute
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if cfg.WorkerOfflineMinutes > 0 {
+			for _, name := range stats.offlineWorkers(after) {
+				alert(eventWorkerOffline, name, "Worker %s has been offline for more than %s", name, after)
+			}
+		}
+		if cfg.WorkerSilentMinutes > 0 {
+			silent := time.Duration(cfg.WorkerSilentMinutes) * time.Minute
+			for _, name := range stats.silentWorkers(time.Now(), silent) {
+				alert(eventWorkerSilent, name, "Worker %s is connected but submitted no share for more than %s", name, silent)
+			}
+		}
+		if cfg.HashrateDropPercent > 0 {
+			now := time.Now()
+			current := stats.hashrate(now, 0, hashrateWindowMinutes)
+			previous := stats.hashrate(now, hashrateWindowMinutes, hashrateWindowMinutes)
+			if previous > 0 && current < previous*(1-cfg.HashrateDropPercent/100) {
+				alert(eventHashrateDrop, "", "Hashrate dropped from %s to %s over the last %d minutes",
+					formatHashrate(previous), formatHashrate(current), hashrateWindowMinutes)
+			}
+		}
+		if config.ExpectedHashrate.Alert {
+			for _, d := range stats.belowSpec(time.Now(), config.ExpectedHashrate) {
+				alert(eventBelowSpec, d.Worker, "Worker %s runs at %s, %.0f%% below its expected %s",
+					d.Worker, formatHashrate(d.Actual), d.Below, formatHashrate(d.Expected))
+			}
+		}
+		if cfg.WorkerHashrateDropPercent > 0 {
+			for _, drop := range stats.hashrateDrops(time.Now(), cfg.WorkerHashrateDropPercent, cfg.workerDropMinutes()) {
+				alert(eventWorkerHashrate, drop.worker, "Hashrate of worker %s dropped from %s to %s over the last %d minutes",
+					drop.worker, formatHashrate(drop.baseline), formatHashrate(drop.current), cfg.workerDropMinutes())
+			}
+		}
+	}
+}
+
+// workerDropMinutes is how long the hashrate of a worker has to stay low
+// to be alerted on.
+func (cfg AlertsConfig) workerDropMinutes() int {
+	if cfg.WorkerHashrateDropMinutes > 0 {
+		return cfg.WorkerHashrateDropMinutes
+	}
+	return defaultWorkerHashrateDropMinutes
+}
+
+// formatHashrate returns hashes per second with an SI prefix, e.g. "1.25 TH/s".
+func formatHashrate(rate float64) string {
+	for _, prefix := range []string{"", "k", "M", "G", "T", "P"} {
+		if rate < 1000 || prefix == "P" {
+			return fmt.Sprintf("%.2f %sH/s", rate, prefix)
+		}
+		rate /= 1000
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
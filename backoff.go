@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDialTimeout    = 5 * time.Second
+	defaultDialBackoff    = 250 * time.Millisecond
+	defaultDialBackoffMax = 30 * time.Second
+)
+
+// backoff is the delay before the given retry of a target, doubling from
+// its initial backoff up to its maximum.
+func (t Target) backoff(retry int) time.Duration {
+	initial, max := defaultDialBackoff, defaultDialBackoffMax
+	if t.BackoffMs > 0 {
+		initial = time.Duration(t.BackoffMs) * time.Millisecond
+	}
+	if t.BackoffMaxMs > 0 {
+		max = time.Duration(t.BackoffMaxMs) * time.Millisecond
+	}
+	delay := initial
+	for i := 1; i < retry && delay < max; i++ {
+		delay *= 2
+	}
+	return min(delay, max)
+}
+
+// jitter spreads a delay over its second half, so miners cut off together
+// do not all dial again at the same moment.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// targetBackoff remembers targets whose dials keep failing. Each failure in
+// a row doubles how long a target stays at the end of the dial order.
+type targetBackoff struct {
+	mu      sync.Mutex
+	targets map[string]*dialFailures
+}
+
+type dialFailures struct {
+	count int
+	until time.Time
+}
+
+var dialBackoff = &targetBackoff{targets: make(map[string]*dialFailures)}
+
+func (b *targetBackoff) failed(target Target) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.targets[target.Address]
+	if !ok {
+		f = &dialFailures{}
+		b.targets[target.Address] = f
+	}
+	f.count++
+	f.until = time.Now().Add(jitter(target.backoff(f.count)))
+}
+
+func (b *targetBackoff) succeeded(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.targets, address)
+}
+
+// waiting reports whether a target is backing off after failed dials.
+func (b *targetBackoff) waiting(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.targets[address]
+	return ok && time.Now().Before(f.until)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type BanConfig struct {
+	// MaxInvalid is the number of malformed or unknown messages tolerated per window.
+	MaxInvalid int `json:"max_invalid"`
+	// MaxRejects is the number of rejected shares tolerated per window.
+	MaxRejects    int `json:"max_rejects"`
+	WindowSeconds int `json:"window_seconds"`
+	BanSeconds    int `json:"ban_seconds"`
+}
+
+// Methods a miner may legitimately send upstream.
+var clientMethods = map[string]bool{
+	"mining.subscribe":            true,
+	"mining.authorize":            true,
+	"mining.submit":               true,
+	"mining.configure":            true,
+	"mining.extranonce.subscribe": true,
+	"mining.suggest_difficulty":   true,
+	"mining.suggest_target":       true,
+	"mining.get_transactions":     true,
+	"mining.multi_version":        true,
+	"mining.hashrate":             true,
+	"eth_submitLogin":             true,
+	"eth_login":                   true,
+	"eth_getWork":                 true,
+	"eth_submitWork":              true,
+	"eth_submitHashrate":          true,
+}
+
+type strikes struct {
+	since   time.Time
+	invalid int
+	rejects int
+}
+
+type banList struct {
+	mu      sync.Mutex
+	cfg     BanConfig
+	path    string
+	until   map[string]time.Time
+	strikes map[string]*strikes
+	calls   int
+}
+
+var bans *banList
+
+// newBanList creates the ban list, restoring active bans from path if set.
+func newBanList(cfg BanConfig, path string) *banList {
+	if cfg.WindowSeconds <= 0 {
+		cfg.WindowSeconds = 60
+	}
+	if cfg.BanSeconds <= 0 {
+		cfg.BanSeconds = 600
+	}
+	b := &banList{
+		cfg:     cfg,
+		path:    path,
+		until:   make(map[string]time.Time),
+		strikes: make(map[string]*strikes),
+	}
+	if err := readStateFile(path, &b.until); err != nil {
+		log.Printf("Error loading bans: %v", err)
+	}
+	return b
+}
+
+func (b *banList) banned(ip string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.until[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.until, ip)
+		return false
+	}
+	return true
+}
+
+// invalid records a malformed message or unknown method and reports whether
+// the client is now banned.
+func (b *banList) invalid(ip string) bool {
+	if b == nil || b.cfg.MaxInvalid <= 0 {
+		return false
+	}
+	return b.strike(ip, func(s *strikes) bool {
+		s.invalid++
+		return s.invalid > b.cfg.MaxInvalid
+	}, "too many invalid messages")
+}
+
+// reject records a rejected share and reports whether the client is now banned.
+func (b *banList) reject(ip string) bool {
+	if b == nil || b.cfg.MaxRejects <= 0 {
+		return false
+	}
+	return b.strike(ip, func(s *strikes) bool {
+		s.rejects++
+		return s.rejects > b.cfg.MaxRejects
+	}, "too many rejected shares")
+}
+
+func (b *banList) strike(ip string, count func(*strikes) bool, reason string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	window := time.Duration(b.cfg.WindowSeconds) * time.Second
+	// Strikes of IPs that stopped misbehaving are dropped once their
+	// window passed, so a scan from many addresses does not pile them up.
+	b.calls++
+	if b.calls%1024 == 0 {
+		for other, s := range b.strikes {
+			if now.Sub(s.since) > window {
+				delete(b.strikes, other)
+			}
+		}
+	}
+	s, ok := b.strikes[ip]
+	if !ok || now.Sub(s.since) > window {
+		s = &strikes{since: now}
+		b.strikes[ip] = s
+	}
+	if !count(s) {
+		return false
+	}
+
+	delete(b.strikes, ip)
+	duration := time.Duration(b.cfg.BanSeconds) * time.Second
+	b.until[ip] = now.Add(duration)
+	log.Printf("Banning %s for %s: %s", ip, duration, reason)
+	for banned, until := range b.until {
+		if now.After(until) {
+			delete(b.until, banned)
+		}
+	}
+	if err := writeStateFile(b.path, b.until); err != nil {
+		log.Printf("Error saving bans: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the replies to a batch are collected before those in are sent
+// as they are.
+const batchReplyTimeout = 30 * time.Second
+
+// replyBatch collects the replies to a batch from the miner, to send them
+// back as one batch.
+type replyBatch struct {
+	mu      sync.Mutex
+	pending map[string]bool // ids not answered yet
+	replies []string
+	sent    bool
+	timer   *time.Timer
+}
+
+// handleBatch takes the messages of a batch one by one, as if the miner had
+// sent them on their own lines, and reports whether the session continues.
+func (s *session) handleBatch(clientData string) bool {
+	s.spoke = true
+	var elements []json.RawMessage
+	if !validBatch(clientData) || json.Unmarshal([]byte(clientData), &elements) != nil {
+		if bans.invalid(s.clientIP) {
+			s.ending("banned for invalid messages")
+			s.up.Load().close()
+			return false
+		}
+		return true
+	}
+
+	// A batch still waiting for replies goes out with those it has.
+	if previous := s.batch.Load(); previous != nil {
+		s.flushBatch(previous)
+	}
+	b := &replyBatch{pending: make(map[string]bool)}
+	for _, element := range elements {
+		var msg stratumMessage
+		if json.Unmarshal(element, &msg) == nil && msg.ID != nil {
+			b.pending[idKey(msg.ID)] = true
+		}
+	}
+	if len(b.pending) > 0 {
+		s.batch.Store(b)
+		b.timer = time.AfterFunc(batchReplyTimeout, func() { s.flushBatch(b) })
+	}
+	for _, element := range elements {
+		if !s.handleClientMessage(string(element)) {
+			return false
+		}
+	}
+	return true
+}
+
+// take keeps line when it answers a message of the batch. It returns
+// whether it did, and the whole batch once the last reply is in.
+func (b *replyBatch) take(line string) (bool, string) {
+	var resp stratumResponse
+	if json.Unmarshal([]byte(line), &resp) != nil || !resp.isResponse() {
+		return false, ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := idKey(resp.ID)
+	if b.sent || !b.pending[key] {
+		return false, ""
+	}
+	delete(b.pending, key)
+	b.replies = append(b.replies, strings.TrimSpace(line))
+	if len(b.pending) > 0 {
+		return true, ""
+	}
+	return true, b.line()
+}
+
+// line returns the replies as a batch, once. Callers hold b.mu.
+func (b *replyBatch) line() string {
+	if b.sent || len(b.replies) == 0 {
+		b.sent = true
+		return ""
+	}
+	b.sent = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return "[" + strings.Join(b.replies, ",") + "]"
+}
+
+// flushBatch sends the replies of b in so far, and lets later ones through
+// on their own.
+func (s *session) flushBatch(b *replyBatch) {
+	s.batch.CompareAndSwap(b, nil)
+	b.mu.Lock()
+	line := b.line()
+	b.mu.Unlock()
+	if line != "" {
+		s.sendClient(line)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bench connects synthetic miners to a running proxy, each subscribing,
+// authorizing and then submitting at an interval, to find how many
+// connections the proxy holds on given hardware and what a share costs.
+// With -pid it reads the proxy's CPU time from /proc as well.
+func bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	address := fs.String("a", "127.0.0.1:3333", "Proxy to connect the miners to")
+	miners := fs.Int("miners", 100, "Number of miners")
+	ramp := fs.Float64("ramp", 100, "New connections per second; 0 connects all at once")
+	submitEvery := fs.Duration("submit", time.Second, "Interval between the shares of each miner")
+	duration := fs.Duration("d", time.Minute, "How long to run once all miners are started")
+	user := fs.String("user", "bench", "Username prefix; miners authorize as user0, user1 and so on")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long to wait for each answer")
+	pid := fs.Int("pid", 0, "Process id of the proxy, to measure its CPU time (Linux only)")
+	reportEvery := fs.Duration("report", 10*time.Second, "Interval between progress reports")
+	fs.Parse(args)
+	if *miners <= 0 || *ramp < 0 || *submitEvery <= 0 || *reportEvery <= 0 {
+		return fmt.Errorf("miners, submit and report must be positive and ramp not negative")
+	}
+
+	var (
+		stop      atomic.Bool
+		connected atomic.Int64
+		peak      atomic.Int64
+		dialFails atomic.Int64
+		loginFail atomic.Int64
+		lost      atomic.Int64
+		accepted  atomic.Int64
+		rejected  atomic.Int64
+		lastErr   atomic.Value
+		latencies latencyLog
+		wg        sync.WaitGroup
+	)
+	fail := func(counter *atomic.Int64, err error) {
+		counter.Add(1)
+		lastErr.Store(err.Error())
+	}
+
+	startCPU := procCPU(*pid)
+	start := time.Now()
+	fmt.Printf("bench: %d miners against %s, %g connections/s, a share every %s each\n", *miners, *address, *ramp, *submitEvery)
+	for i := 0; i < *miners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if *ramp > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(i) / *ramp * float64(time.Second)))))
+			}
+			m, err := dialFakeMiner("tcp", *address, *timeout)
+			if err != nil {
+				fail(&dialFails, err)
+				return
+			}
+			defer m.Close()
+			name := *user + strconv.Itoa(i)
+			if err := m.handshake("bench/1.0", name); err != nil {
+				fail(&loginFail, err)
+				return
+			}
+			n := connected.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			defer connected.Add(-1)
+
+			// Spread the first shares over the interval.
+			time.Sleep(time.Duration(rand.Int63n(int64(*submitEvery))))
+			for !stop.Load() {
+				sent := time.Now()
+				ok, err := m.submit(name, rand.Uint32())
+				if err != nil {
+					fail(&lost, err)
+					return
+				}
+				latencies.add(time.Since(sent))
+				if ok {
+					accepted.Add(1)
+				} else {
+					rejected.Add(1)
+				}
+				time.Sleep(time.Until(sent.Add(*submitEvery)))
+			}
+		}(i)
+	}
+
+	rampTime := time.Duration(0)
+	if *ramp > 0 {
+		rampTime = time.Duration(float64(*miners) / *ramp * float64(time.Second))
+	}
+	ticker := time.NewTicker(*reportEvery)
+	end := time.After(rampTime + *duration)
+	lastShares, lastReport := int64(0), start
+	for running := true; running; {
+		select {
+		case <-end:
+			running = false
+		case now := <-ticker.C:
+			shares := accepted.Load() + rejected.Load()
+			window := latencies.since(lastReport)
+			fmt.Printf("bench: %s connected=%d shares/s=%.1f latency p50=%s p99=%s failures=%d\n",
+				now.Sub(start).Round(time.Second), connected.Load(),
+				float64(shares-lastShares)/now.Sub(lastReport).Seconds(), percentile(window, 50), percentile(window, 99),
+				dialFails.Load()+loginFail.Load()+lost.Load())
+			lastShares, lastReport = shares, now
+		}
+	}
+	ticker.Stop()
+	elapsed := time.Since(start)
+	endCPU := procCPU(*pid)
+	stop.Store(true)
+
+	shares := accepted.Load() + rejected.Load()
+	all := latencies.since(start)
+	fmt.Printf("bench: peak %d of %d miners connected, %d dial failures, %d login failures, %d connections lost\n",
+		peak.Load(), *miners, dialFails.Load(), loginFail.Load(), lost.Load())
+	fmt.Printf("bench: %d shares (%d accepted, %d rejected) in %s, %.1f/s\n",
+		shares, accepted.Load(), rejected.Load(), elapsed.Round(time.Second), float64(shares)/elapsed.Seconds())
+	fmt.Printf("bench: submit latency p50=%s p90=%s p99=%s max=%s\n",
+		percentile(all, 50), percentile(all, 90), percentile(all, 99), percentile(all, 100))
+	if startCPU >= 0 && endCPU >= 0 {
+		cpu := endCPU - startCPU
+		fmt.Printf("bench: proxy used %s of CPU, %.1f%% of a core", cpu.Round(time.Millisecond), 100*cpu.Seconds()/elapsed.Seconds())
+		if shares > 0 {
+			fmt.Printf(", %s per share", (cpu / time.Duration(shares)).Round(time.Microsecond))
+		}
+		fmt.Println()
+	} else if *pid != 0 {
+		fmt.Printf("bench: cannot read the CPU time of process %d\n", *pid)
+	}
+	if err, ok := lastErr.Load().(string); ok {
+		fmt.Printf("bench: last error: %s\n", err)
+	}
+
+	// Miners blocked on an answer give up after the timeout.
+	wg.Wait()
+	return nil
+}
+
+// latencyLog collects submit latencies with the time they were measured.
+type latencyLog struct {
+	mu      sync.Mutex
+	at      []time.Time
+	samples []time.Duration
+}
+
+func (l *latencyLog) add(d time.Duration) {
+	l.mu.Lock()
+	l.at = append(l.at, time.Now())
+	l.samples = append(l.samples, d)
+	l.mu.Unlock()
+}
+
+// since returns the latencies measured from t on, sorted.
+func (l *latencyLog) since(t time.Time) []time.Duration {
+	l.mu.Lock()
+	i := sort.Search(len(l.at), func(i int) bool { return !l.at[i].Before(t) })
+	samples := append([]time.Duration(nil), l.samples[i:]...)
+	l.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples
+}
+
+// percentile returns the p-th percentile of sorted latencies, 0 for none.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i].Round(time.Microsecond)
+}
+
+// procCPU returns the user and system CPU time of process pid from /proc,
+// or -1 where it cannot be read.
+func procCPU(pid int) time.Duration {
+	if pid == 0 {
+		return -1
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return -1
+	}
+	// The command name in parentheses may hold spaces; utime and stime
+	// are the 12th and 13th fields after it, in ticks of 1/100 s.
+	text := string(data)
+	fields := strings.Fields(text[strings.LastIndexByte(text, ')')+1:])
+	if len(fields) < 13 {
+		return -1
+	}
+	utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+	stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return -1
+	}
+	return time.Duration(utime+stime) * 10 * time.Millisecond
+}
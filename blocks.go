@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// A share whose hash also meets the network target of its job solves a
+// block. The proxy hashes the shares of sha256 coins to catch those and
+// alerts at once, which matters to operators mining solo or on small pools.
+// Scrypt and ethash shares are not checked.
+
+// versionRollingMask is the BIP 320 mask of the version bits a miner may
+// roll, which is what pools hand out.
+const versionRollingMask = 0x1fffe000
+
+// checksBlocks reports whether the shares of coin can be hashed by the
+// proxy to find blocks.
+func (coin *CoinConfig) checksBlocks() bool {
+	return coin == nil || coin.Algorithm != "scrypt"
+}
+
+// networkTarget returns the target the compact nbits of a header encodes.
+func networkTarget(nbits uint32) *big.Int {
+	exponent := uint(nbits >> 24)
+	mantissa := big.NewInt(int64(nbits & 0x007fffff))
+	if exponent <= 3 {
+		return mantissa.Rsh(mantissa, 8*(3-exponent))
+	}
+	return mantissa.Lsh(mantissa, 8*(exponent-3))
+}
+
+// solvesBlock hashes an 80 byte header and reports whether it meets the
+// network target of its nbits, with the hash as block explorers show it.
+func solvesBlock(header []byte) (bool, string) {
+	value := new(big.Int).SetBytes(reversed(doubleSHA256(header)))
+	return value.Cmp(networkTarget(binary.LittleEndian.Uint32(header[72:76]))) <= 0, fmt.Sprintf("%064x", value)
+}
+
+// reversed returns the bytes of b in reverse order.
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
+
+// solvedBlock returns the hash of the block a mining.submit solves on up,
+// or "" when it solves none or cannot be checked.
+func (s *session) solvedBlock(up *upstream, msg *stratumMessage) string {
+	var id string
+	if len(msg.Params) < 5 || json.Unmarshal(msg.Params[1], &id) != nil || !s.config.coinOf(up.target.Address).checksBlocks() {
+		return ""
+	}
+	job, extranonce1 := up.job(id)
+	if job == nil || extranonce1 == "" {
+		return ""
+	}
+	header, err := submitHeader(job, extranonce1, msg.Params)
+	if err != nil {
+		return ""
+	}
+	if solved, hash := solvesBlock(header); solved {
+		return hash
+	}
+	return ""
+}
+
+// submitHeader returns the header the params of a mining.submit for job
+// hash: the job's header with the submitted extranonce2, ntime and nonce,
+// and the version bits the miner rolled.
+func submitHeader(job *stratumJob, extranonce1 string, params []json.RawMessage) ([]byte, error) {
+	var extranonce2, ntime, nonce, versionBits string
+	if len(params) < 5 {
+		return nil, fmt.Errorf("submit with %d params", len(params))
+	}
+	for i, field := range []*string{&extranonce2, &ntime, &nonce} {
+		if json.Unmarshal(params[i+2], field) != nil {
+			return nil, fmt.Errorf("submit param %d is not a string", i+2)
+		}
+	}
+	if len(params) > 5 {
+		json.Unmarshal(params[5], &versionBits)
+	}
+	header, err := job.header(extranonce1, extranonce2)
+	if err != nil {
+		return nil, err
+	}
+	ntimeValue, err1 := strconv.ParseUint(ntime, 16, 32)
+	nonceValue, err2 := strconv.ParseUint(nonce, 16, 32)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("bad ntime %q or nonce %q", ntime, nonce)
+	}
+	binary.LittleEndian.PutUint32(header[68:72], uint32(ntimeValue))
+	binary.LittleEndian.PutUint32(header[76:80], uint32(nonceValue))
+	if bits, err := strconv.ParseUint(versionBits, 16, 32); err == nil && versionBits != "" {
+		version := binary.LittleEndian.Uint32(header[0:4])
+		binary.LittleEndian.PutUint32(header[0:4], version&^versionRollingMask|uint32(bits)&versionRollingMask)
+	}
+	return header, nil
+}
+
+// reportBlock raises the alert for a share that solves a block once the
+// pool has answered it.
+func reportBlock(hash, worker, poolWorker, pool string, accepted bool, reason string) {
+	if accepted {
+		alert(eventBlockFound, hash, "Block %s found by %s (%s) on %s", hash, worker, poolWorker, pool)
+		return
+	}
+	alert(eventBlockFound, hash, "Block %s found by %s (%s) but rejected by %s: %s", hash, worker, poolWorker, pool, reason)
+}
+
+// isSubscribeAnswer reports whether resp answers the miner's subscribe.
+func (s *session) isSubscribeAnswer(resp *stratumResponse) bool {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+	return s.subscribeID != "" && idKey(resp.ID) == s.subscribeID
+}
+
+// job returns a recent job of the pool by id and the extranonce1 of the
+// connection, or nil when the job is not known.
+func (u *upstream) job(id string) (*stratumJob, string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := len(u.jobs) - 1; i >= 0; i-- {
+		if u.jobs[i].id == id {
+			return u.jobs[i].job, u.extranonce1
+		}
+	}
+	return nil, ""
+}
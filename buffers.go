@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Buffers reused across connections and messages, so thousands of miners
+// do not keep the garbage collector busy: a reader per client connection,
+// scratch space to write each line with its newline in one call and the
+// decoding and encoding space of rewritten messages.
+var (
+	readerPool  = sync.Pool{New: func() interface{} { return bufio.NewReader(nil) }}
+	linePool    = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	rewritePool = sync.Pool{New: func() interface{} { return newRewriteScratch() }}
+)
+
+// Line buffers that grew past this are left to the garbage collector
+// rather than kept around for ordinary lines.
+const maxPooledLine = 64 << 10
+
+// getReader returns a pooled reader reading from r.
+func getReader(r io.Reader) *bufio.Reader {
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(r)
+	return reader
+}
+
+// putReader returns a reader to the pool once nothing reads from it.
+func putReader(reader *bufio.Reader) {
+	reader.Reset(nil)
+	readerPool.Put(reader)
+}
+
+// writeLine writes line and a newline to w in one Write.
+func writeLine(w io.Writer, line string) (int, error) {
+	buf := linePool.Get().(*bytes.Buffer)
+	buf.Reset()
+	buf.WriteString(line)
+	buf.WriteByte('\n')
+	n, err := w.Write(buf.Bytes())
+	if buf.Cap() <= maxPooledLine {
+		linePool.Put(buf)
+	}
+	return n, err
+}
+
+// rewriteScratch is what rewriting a message decodes into and encodes
+// with: the line as bytes, its fields and the output buffer.
+type rewriteScratch struct {
+	line    []byte
+	message map[string]interface{}
+	out     bytes.Buffer
+	encoder *json.Encoder
+}
+
+func newRewriteScratch() *rewriteScratch {
+	scratch := &rewriteScratch{message: make(map[string]interface{})}
+	scratch.encoder = json.NewEncoder(&scratch.out)
+	return scratch
+}
+
+// getRewriteScratch returns pooled scratch space for a rewrite.
+func getRewriteScratch() *rewriteScratch {
+	return rewritePool.Get().(*rewriteScratch)
+}
+
+// putRewriteScratch returns scratch to the pool once the rewritten line
+// was copied out of it.
+func putRewriteScratch(scratch *rewriteScratch) {
+	clear(scratch.message)
+	if scratch.out.Cap() > maxPooledLine || cap(scratch.line) > maxPooledLine {
+		return
+	}
+	rewritePool.Put(scratch)
+}
+
+// input returns data as bytes to decode, in the scratch line buffer.
+func (scratch *rewriteScratch) input(data string) []byte {
+	scratch.line = append(scratch.line[:0], data...)
+	return scratch.line
+}
+
+// encode encodes v like json.Marshal into the scratch output buffer. The
+// result is only valid until the next use of scratch.
+func (scratch *rewriteScratch) encode(v interface{}) ([]byte, error) {
+	scratch.out.Reset()
+	if err := scratch.encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(scratch.out.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+const (
+	benchAuthorize = `{"id":2,"method":"mining.authorize","params":["miner.worker1","x"]}`
+	benchSubmit    = `{"id":4,"method":"mining.submit","params":["miner.worker1","%s","aabbccdd","5f5e1000","00000001"]}`
+	benchNotify    = `{"id":null,"method":"mining.notify","params":["j1","prev","cb1","cb2",[],"20000000","1d00ffff","5f5e1000",true]}`
+)
+
+func benchConfig() *Config {
+	return &Config{Miner: MinerConfig{Auth: "wallet.", Ipenable: true}.compile()}
+}
+
+// benchLines is a connection's worth of submit lines.
+func benchLines(n int) string {
+	var lines strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&lines, benchSubmit+"\n", "1")
+	}
+	return lines.String()
+}
+
+func BenchmarkClientReader(b *testing.B) {
+	input := benchLines(100)
+	read := func(reader *bufio.Reader) {
+		for {
+			if _, err := readLine(reader, defaultMaxClientMessage); err != nil {
+				return
+			}
+		}
+	}
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader := getReader(strings.NewReader(input))
+			read(reader)
+			putReader(reader)
+		}
+	})
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			read(bufio.NewReader(strings.NewReader(input)))
+		}
+	})
+}
+
+func BenchmarkWriteLine(b *testing.B) {
+	line := fmt.Sprintf(benchSubmit, "1")
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writeLine(io.Discard, line)
+		}
+	})
+	b.Run("concatenated", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.WriteString(io.Discard, line+"\n")
+		}
+	})
+}
+
+func BenchmarkModifyJSON(b *testing.B) {
+	config := benchConfig()
+	id := workerIdentity{ip: "10x0x0x1"}
+	for _, bench := range []struct{ name, line string }{
+		{"authorize", benchAuthorize},
+		{"submit", fmt.Sprintf(benchSubmit, "j1")},
+	} {
+		b.Run(bench.name+"/pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ModifyJSON(bench.line, config, id)
+			}
+		})
+		// Fresh scratch space for every message, as before it was pooled.
+		b.Run(bench.name+"/fresh", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var msg stratumMessage
+				if err := json.Unmarshal([]byte(bench.line), &msg); err != nil {
+					b.Fatal(err)
+				}
+				newRewriteScratch().modifyMessage(bench.line, &msg, config, id)
+			}
+		})
+	}
+}
+
+// BenchmarkSubmitPath is the work the proxy does for each share on its way
+// to the pool: parsing, job translation, the stale check and the rewrite.
+func BenchmarkSubmitPath(b *testing.B) {
+	config := benchConfig()
+	client, miner := net.Pipe()
+	remote, pool := net.Pipe()
+	defer client.Close()
+	defer miner.Close()
+	defer remote.Close()
+	defer pool.Close()
+	target := Target{Address: "pool.example:3333"}
+	s := newSession(config, client, bufio.NewReader(client), remote, target, []Target{target})
+	up := s.up.Load()
+	up.mu.Lock()
+	up.record(benchNotify)
+	up.mu.Unlock()
+	line := fmt.Sprintf(benchSubmit, s.jobs.issue(up, "j1"))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var msg stratumMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			b.Fatal(err)
+		}
+		data, from := s.translateSubmit(line, &msg)
+		if stale, _ := s.staleSubmit(&msg, from); stale {
+			b.Fatal("share for the current job taken as stale")
+		}
+		writeLine(io.Discard, modifyMessage(data, &msg, config, s.identity))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traffic captures hold the raw lines of the sessions of an IP, one file per
+// session in the capture_dir of the admin API, for debugging miners without
+// tcpdump. Each line of a capture is
+//
+//	<RFC 3339 time> <direction> [<pool address>] <line>
+//
+// where direction is "miner>" or ">miner" for what the miner sent or was
+// sent, and "pool>" or ">pool" for the pool side, which names the pool.
+// Lines with control characters, such as a carriage return, are quoted as
+// Go strings. Lines starting with "#" are comments. The replay command
+// plays the miner side of a capture back.
+
+// captureRegistry holds the IPs whose sessions are being captured.
+type captureRegistry struct {
+	mu  sync.Mutex
+	ips map[string]bool
+}
+
+var captures = &captureRegistry{ips: make(map[string]bool)}
+
+func (r *captureRegistry) enabled(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ips[ip]
+}
+
+// list returns the IPs being captured, sorted.
+func (r *captureRegistry) list() []string {
+	r.mu.Lock()
+	list := make([]string, 0, len(r.ips))
+	for ip := range r.ips {
+		list = append(list, ip)
+	}
+	r.mu.Unlock()
+	sort.Strings(list)
+	return list
+}
+
+// start captures the running and future sessions of ip to dir and returns
+// how many sessions were running.
+func (r *captureRegistry) start(ip, dir string) int {
+	r.mu.Lock()
+	r.ips[ip] = true
+	r.mu.Unlock()
+	log.Printf("Capturing the traffic of %s to %s", ip, dir)
+	running := sessions.fromIP(ip)
+	for _, s := range running {
+		s.startCapture(dir)
+	}
+	return len(running)
+}
+
+// stop ends the captures of ip and reports whether it was being captured.
+func (r *captureRegistry) stop(ip string) bool {
+	r.mu.Lock()
+	enabled := r.ips[ip]
+	delete(r.ips, ip)
+	r.mu.Unlock()
+	for _, s := range sessions.fromIP(ip) {
+		s.stopCapture()
+	}
+	if enabled {
+		log.Printf("Stopped capturing the traffic of %s", ip)
+	}
+	return enabled
+}
+
+// trafficCapture is the capture file of one session.
+type trafficCapture struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openCapture creates the capture file of a session in dir, named after
+// the miner's address and the time the capture started.
+func openCapture(dir string, s *session) (*trafficCapture, error) {
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.log", s.clientConn.RemoteAddr(), now.UTC().Format("20060102T150405.000"))
+	// Colons of IPv6 addresses and ports are not allowed in Windows file names.
+	name = strings.NewReplacer(":", "_", "[", "", "]", "").Replace(name)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(file, "# %s to %s, connected %s, capture started %s\n", s.clientConn.RemoteAddr(),
+		s.clientConn.LocalAddr(), s.connected.UTC().Format(time.RFC3339Nano), now.UTC().Format(time.RFC3339Nano))
+	return &trafficCapture{file: file}, nil
+}
+
+// write appends a line that went in direction; pool is the pool address of
+// the pool side and "" for the miner side.
+func (c *trafficCapture) write(direction, pool, line string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		io.WriteString(c.file, captureLine(time.Now(), direction, pool, line))
+	}
+}
+
+// captureLine formats a line of a capture.
+func captureLine(at time.Time, direction, pool, line string) string {
+	line = strings.TrimSuffix(line, "\n")
+	if strings.HasPrefix(line, `"`) || strings.IndexFunc(line, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		line = strconv.Quote(line)
+	}
+	if pool != "" {
+		line = pool + " " + line
+	}
+	return at.UTC().Format(time.RFC3339Nano) + " " + direction + " " + line + "\n"
+}
+
+func (c *trafficCapture) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// startCapture starts capturing the session to dir unless it already is.
+func (s *session) startCapture(dir string) {
+	if s.capture.Load() != nil {
+		return
+	}
+	c, err := openCapture(dir, s)
+	if err != nil {
+		log.Printf("Cannot capture the traffic of %s: %v", s.clientIP, err)
+		return
+	}
+	if !s.capture.CompareAndSwap(nil, c) {
+		name := c.file.Name()
+		c.close()
+		os.Remove(name)
+	}
+}
+
+func (s *session) stopCapture() {
+	s.capture.Swap(nil).close()
+}
+
+// captured records a line of the miner side of the session.
+func (s *session) captured(direction, line string) {
+	s.capture.Load().write(direction, "", line)
+}
+
+// captured records a line of the pool side of the session.
+func (u *upstream) captured(direction, line string) {
+	if u.capture != nil {
+		u.capture.Load().write(direction, u.target.Address, line)
+	}
+}
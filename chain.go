@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proxies can be chained: site proxies gather the miners of a site and
+// forward them to a central proxy, which picks the pools and rewrites
+// worker names once for all sites. A site marks the targets of the central
+// proxy "chained". It then passes usernames on as the miners sent them and
+// starts every pool connection with a PROXY protocol v1 header naming the
+// miner's address. The central proxy lists the sites in downstream_proxies
+// and takes the miner's address from the header, so worker names, clients,
+// routes, bans and statistics see the miners rather than the site.
+
+// How long a downstream proxy gets to send its header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// Longest PROXY protocol v1 header, CRLF included.
+const maxProxyHeader = 107
+
+func validateChain(config *Config) error {
+	for _, entry := range config.DownstreamProxies {
+		if net.ParseIP(entry) == nil {
+			if _, err := netip.ParsePrefix(entry); err != nil {
+				return fmt.Errorf("%q is neither an IP address nor a network", entry)
+			}
+		}
+	}
+	for _, coin := range config.Coins {
+		chained := 0
+		for _, t := range coin.Targets {
+			if t.Chained {
+				chained++
+			}
+		}
+		// Usernames are rewritten for all targets of a coin or none, as
+		// failover replays them.
+		if chained > 0 && chained < len(coin.Targets) {
+			return fmt.Errorf("coin %s mixes chained and other targets", coin.Name)
+		}
+	}
+	return nil
+}
+
+// allChained reports whether every target is another proxy, which leaves
+// worker names to it.
+func (c *Config) allChained() bool {
+	targets := allTargets(c)
+	for _, t := range targets {
+		if !t.Chained {
+			return false
+		}
+	}
+	return len(targets) > 0
+}
+
+// downstreamProxy reports whether ip is a proxy trusted to name the miners
+// it forwards.
+func (c *Config) downstreamProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, entry := range c.DownstreamProxies {
+		if other, err := netip.ParseAddr(entry); err == nil && other.Unmap() == addr {
+			return true
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolWorker returns the name worker goes to the active pool under; a
+// chained proxy gets it unchanged to name it itself.
+func (s *session) poolWorker(worker string) string {
+	up := s.up.Load()
+	if up.target.Chained {
+		return worker
+	}
+	return up.target.sanitizeWorker(s.minerConfig.Load().Miner.poolWorker(s.identity, worker))
+}
+
+// proxyHeader returns the PROXY protocol v1 header announcing the miner at
+// clientIP on a connection to a chained target.
+func proxyHeader(clientIP string, client net.Addr, conn net.Conn) string {
+	src, err := netip.ParseAddr(clientIP)
+	dst, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if err != nil || !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+	family := "TCP4"
+	if src.Unmap().Is6() {
+		family = "TCP6"
+	}
+	var srcPort int
+	if addr, ok := client.(*net.TCPAddr); ok {
+		srcPort = addr.Port
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.Unmap(), dst.IP, srcPort, dst.Port)
+}
+
+// chainedConn is a miner's connection forwarded by a downstream proxy,
+// which reports the miner's address as its remote address.
+type chainedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c chainedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// CloseWrite keeps half-closes working through the wrapper.
+func (c chainedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader reads the PROXY protocol v1 header a downstream proxy
+// starts a connection with, and returns the connection as coming from the
+// miner it names. Connections without a header are returned as they are.
+func readProxyHeader(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	head, err := reader.Peek(6)
+	if err != nil || !bytes.Equal(head, []byte("PROXY ")) {
+		return conn, nil
+	}
+	line, err := readLine(reader, maxProxyHeader)
+	if err != nil {
+		return nil, fmt.Errorf("reading the PROXY header: %v", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return conn, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY header %q", strings.TrimSpace(line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY header %q", strings.TrimSpace(line))
+	}
+	return chainedConn{Conn: conn, remote: &net.TCPAddr{IP: ip, Port: port}}, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// DifficultyClamp bounds the share difficulty miners see, whatever the pool
+// sets. Above Max the miner works at Max and the proxy hashes its shares,
+// forwarding only those that meet the pool's difficulty and accepting the
+// rest itself, so weak devices still submit regularly. Below Min the miner
+// works at Min, which spares very strong devices a flood of shares but
+// credits them only for the pool's difficulty per share. 0 leaves a bound
+// off.
+type DifficultyClamp struct {
+	Min float64 `json:"min,omitempty"`
+	Max float64 `json:"max,omitempty"`
+}
+
+func validateDifficultyClamp(clamp *DifficultyClamp) error {
+	if clamp == nil {
+		return nil
+	}
+	if clamp.Min < 0 || clamp.Max < 0 {
+		return fmt.Errorf("negative difficulty bound")
+	}
+	if clamp.Max > 0 && clamp.Min > clamp.Max {
+		return fmt.Errorf("min difficulty %g above max %g", clamp.Min, clamp.Max)
+	}
+	return nil
+}
+
+func validateDifficultyClamps(config *Config) error {
+	if err := validateDifficultyClamp(&config.Difficulty); err != nil {
+		return err
+	}
+	for _, client := range config.Clients {
+		if err := validateDifficultyClamp(client.Difficulty); err != nil {
+			return fmt.Errorf("client %s: %v", client.IP, err)
+		}
+	}
+	for _, route := range config.Routes {
+		if err := validateDifficultyClamp(route.Difficulty); err != nil {
+			return fmt.Errorf("route %q: %v", route.name(), err)
+		}
+	}
+	return nil
+}
+
+// apply returns the difficulty the miner works at for the pool's.
+func (clamp *DifficultyClamp) apply(difficulty float64) float64 {
+	if clamp == nil || difficulty <= 0 {
+		return difficulty
+	}
+	if clamp.Max > 0 && difficulty > clamp.Max {
+		return clamp.Max
+	}
+	if clamp.Min > 0 && difficulty < clamp.Min {
+		return clamp.Min
+	}
+	return difficulty
+}
+
+// clampDifficulty rewrites a mining.set_difficulty of the pool to the
+// difficulty the miner works at.
+func (s *session) clampDifficulty(line string) string {
+	clamp := s.clamp.Load()
+	if clamp == nil || (clamp.Min == 0 && clamp.Max == 0) {
+		return line
+	}
+	var msg stratumResponse
+	var difficulty float64
+	if json.Unmarshal([]byte(line), &msg) != nil || len(msg.Params) == 0 || json.Unmarshal(msg.Params[0], &difficulty) != nil {
+		return line
+	}
+	clamped := clamp.apply(difficulty)
+	if clamped == difficulty {
+		return line
+	}
+	return fmt.Sprintf(`{"id":null,"method":"mining.set_difficulty","params":[%s]}`, jsonID(clamped))
+}
+
+// belowPoolDifficulty reports whether a mining.submit for a job of up,
+// sent at a difficulty clamped below the pool's, misses the pool's target.
+// Shares that cannot be hashed are taken to meet it.
+func (s *session) belowPoolDifficulty(up *upstream, msg *stratumMessage) bool {
+	clamp := s.clamp.Load()
+	if clamp == nil || clamp.Max == 0 || len(msg.Params) < 5 {
+		return false
+	}
+	difficulty := up.currentDifficulty()
+	if difficulty <= clamp.Max {
+		return false
+	}
+	var id string
+	if json.Unmarshal(msg.Params[1], &id) != nil {
+		return false
+	}
+	job, extranonce1 := up.job(id)
+	if job == nil || extranonce1 == "" {
+		return false
+	}
+	header, err := submitHeader(job, extranonce1, msg.Params)
+	if err != nil {
+		return false
+	}
+	coin := s.config.coinOf(up.target.Address)
+	pow := doubleSHA256(header)
+	if coin != nil && coin.Algorithm == "scrypt" {
+		pow = scryptHash(header)
+	}
+	value := new(big.Int).SetBytes(reversed(pow))
+	return value.Cmp(difficultyTarget(coin.diff1Target(), difficulty)) > 0 &&
+		value.Cmp(networkTarget(binary.LittleEndian.Uint32(header[72:76]))) > 0
+}
+
+// logFiltered records a share the proxy accepted itself for missing the
+// pool's difficulty.
+func (s *session) logFiltered(info submitInfo) {
+	s.noteShare(shareRecord{time: time.Now(), clientIP: s.clientIP, pool: s.up.Load().target.Address,
+		info: info, result: "filtered", reason: "below the pool difficulty"})
+}
+
+func acceptedReply(id interface{}) string {
+	return fmt.Sprintf(`{"id":%s,"result":true,"error":null}`, jsonID(id))
+}
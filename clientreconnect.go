@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+)
+
+// ClientReconnectConfig decides what happens to a client.reconnect from a
+// pool, which tells the miner to connect somewhere else. A compromised pool
+// or a man in the middle can use it to take the miners away from the proxy.
+type ClientReconnectConfig struct {
+	// Policy is "forward" (default) to pass it on to the miner, "log" to
+	// pass it on and log it, or "block" to drop and log it.
+	Policy string `json:"policy"`
+	// AllowedHosts are the hosts, or patterns as in path.Match such as
+	// "*.pool.example", a reconnect is still passed on for under "block".
+	// Under "forward" and "log" a reconnect to any other host is blocked
+	// once the list is set.
+	AllowedHosts []string `json:"allowed_hosts"`
+}
+
+func validateClientReconnect(config *Config) error {
+	switch config.ClientReconnect.Policy {
+	case "", "forward", "log", "block":
+	default:
+		return fmt.Errorf("unknown policy %q", config.ClientReconnect.Policy)
+	}
+	for _, pattern := range config.ClientReconnect.AllowedHosts {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid host pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// allows reports whether a reconnect to host may reach the miner. A
+// reconnect without a host sends the miner back to the proxy and is
+// always allowed.
+func (c *ClientReconnectConfig) allows(host string) bool {
+	if host == "" {
+		return true
+	}
+	if len(c.AllowedHosts) == 0 {
+		return c.Policy != "block"
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range c.AllowedHosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnectTarget returns the host:port a client.reconnect points to, with
+// the host "" when it names none.
+func reconnectTarget(msg *stratumResponse) (string, string) {
+	var host string
+	var port interface{}
+	if len(msg.Params) > 0 {
+		json.Unmarshal(msg.Params[0], &host)
+	}
+	if len(msg.Params) > 1 {
+		json.Unmarshal(msg.Params[1], &port)
+	}
+	if p, ok := port.(float64); ok {
+		return host, fmt.Sprint(int(p))
+	}
+	if p, ok := port.(string); ok {
+		return host, p
+	}
+	return host, ""
+}
+
+// passReconnect applies the client.reconnect policy to a reconnect from
+// up and reports whether it goes on to the miner.
+func (s *session) passReconnect(up *upstream, msg *stratumResponse) bool {
+	policy := &s.config.ClientReconnect
+	host, port := reconnectTarget(msg)
+	to := "the proxy"
+	if host != "" {
+		to = net.JoinHostPort(host, port)
+	}
+	if !policy.allows(host) {
+		log.Printf("Blocked client.reconnect from %s sending %s to %s", up.target.Address, s.clientIP, to)
+		return false
+	}
+	if policy.Policy == "log" || policy.Policy == "block" {
+		log.Printf("Passing on client.reconnect from %s sending %s to %s", up.target.Address, s.clientIP, to)
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// ClientConfig overrides the pool credentials and targets for one client IP
+// or a network of them.
+type ClientConfig struct {
+	// IP is an address or a network such as "10.0.3.0/24". An entry for
+	// the address wins over networks, and smaller networks over larger.
+	IP string `json:"ip"`
+	// Auth replaces miner.auth and Pass miner.pass; Worker replaces
+	// miner.worker.
+	Auth     string   `json:"auth,omitempty"`
+	Pass     string   `json:"pass,omitempty"`
+	Worker   string   `json:"worker,omitempty"`
+	Targets  []Target `json:"targets,omitempty"`
+	Customer string   `json:"customer,omitempty"`
+	Model    string   `json:"model,omitempty"`
+	// Difficulty replaces the difficulty bounds of the config.
+	Difficulty *DifficultyClamp `json:"difficulty,omitempty"`
+}
+
+// clientNetwork is a client entry for a network, looked up by prefix.
+type clientNetwork struct {
+	prefix netip.Prefix
+	client *ClientConfig
+}
+
+func (c *Config) indexClients() {
+	c.clients = make(map[string]*ClientConfig, len(c.Clients))
+	c.clientNetworks = nil
+	for i := range c.Clients {
+		if prefix, err := netip.ParsePrefix(c.Clients[i].IP); err == nil {
+			c.clientNetworks = append(c.clientNetworks, clientNetwork{prefix.Masked(), &c.Clients[i]})
+			continue
+		}
+		// Key by the canonical form so IPv6 entries match however they are written.
+		key := c.Clients[i].IP
+		if ip := net.ParseIP(key); ip != nil {
+			key = ip.String()
+		}
+		c.clients[key] = &c.Clients[i]
+	}
+	// Most specific first, so the first match is the one to use.
+	sort.SliceStable(c.clientNetworks, func(i, j int) bool {
+		return c.clientNetworks[i].prefix.Bits() > c.clientNetworks[j].prefix.Bits()
+	})
+}
+
+func validateClients(config *Config) error {
+	for _, client := range config.Clients {
+		if net.ParseIP(client.IP) == nil {
+			if _, err := netip.ParsePrefix(client.IP); err != nil {
+				return fmt.Errorf("%q is neither an IP address nor a network", client.IP)
+			}
+		}
+	}
+	return nil
+}
+
+// clientFor returns the client entry for an IP, or nil when none matches.
+func (c *Config) clientFor(ip string) *ClientConfig {
+	if client, ok := c.clients[ip]; ok {
+		return client
+	}
+	if len(c.clientNetworks) == 0 {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	for _, network := range c.clientNetworks {
+		if network.prefix.Contains(addr) {
+			return network.client
+		}
+	}
+	return nil
+}
+
+// forClient returns the effective config for a client, with any per-client
+// overrides applied to a copy.
+func (c *Config) forClient(ip string) *Config {
+	client := c.clientFor(ip)
+	if client == nil {
+		return c
+	}
+
+	effective := *c
+	if len(client.Targets) > 0 {
+		effective = *c.withAllTargets(client.Targets)
+	}
+	if client.Auth != "" {
+		effective.Miner.Auth = client.Auth
+	}
+	if client.Pass != "" {
+		effective.Miner.Pass = client.Pass
+	}
+	if client.Worker != "" {
+		effective.Miner.Worker = client.Worker
+	}
+	effective.Miner = effective.Miner.compile()
+	if client.Difficulty != nil {
+		effective.Difficulty = *client.Difficulty
+	}
+	return &effective
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClockCheckConfig sets how the host clock is checked. Pool job times are
+// always compared; an NTP server adds a precise check at startup and every
+// interval.
+type ClockCheckConfig struct {
+	NTPServer       string  `json:"ntp_server"` // e.g. "pool.ntp.org"
+	IntervalSeconds int     `json:"interval_seconds"`
+	MaxSkewSeconds  float64 `json:"max_skew_seconds"`
+}
+
+const (
+	defaultClockIntervalSeconds = 600
+	defaultMaxSkewSeconds       = 2
+	// Pools stamp jobs when they build them and resend them for a while,
+	// so their ntime only shows gross errors.
+	poolTimeSlack = 2 * time.Minute
+)
+
+// clockChecker keeps the last measured skew of the host clock, positive
+// when the host is ahead.
+type clockChecker struct {
+	mu      sync.Mutex
+	maxSkew time.Duration
+	skew    map[string]time.Duration // by source, "ntp" or "pool"
+	skewed  map[string]bool
+}
+
+var clock = &clockChecker{
+	maxSkew: defaultMaxSkewSeconds * time.Second,
+	skew:    make(map[string]time.Duration),
+	skewed:  make(map[string]bool),
+}
+
+// run queries the NTP server every interval until stop is closed.
+func (c *clockChecker) run(cfg ClockCheckConfig, stop <-chan struct{}) {
+	if cfg.MaxSkewSeconds > 0 {
+		c.mu.Lock()
+		c.maxSkew = time.Duration(cfg.MaxSkewSeconds * float64(time.Second))
+		c.mu.Unlock()
+	}
+	if cfg.NTPServer == "" {
+		return
+	}
+	interval := cfg.IntervalSeconds
+	if interval <= 0 {
+		interval = defaultClockIntervalSeconds
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if offset, err := queryNTP(cfg.NTPServer); err != nil {
+			log.Printf("Clock check against %s failed: %v", cfg.NTPServer, err)
+		} else {
+			c.record("ntp", -offset, 0)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Seconds between the NTP epoch (1900) and the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// queryNTP returns how far the server's clock is ahead of the host's, from
+// one SNTP request.
+func queryNTP(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := make([]byte, 48)
+	request[0] = 0x1b // version 3, client mode
+	sent := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 48)
+	n, err := conn.Read(response)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	if n < 48 || response[0]&0x07 != 4 {
+		return 0, fmt.Errorf("invalid NTP response")
+	}
+
+	ntpTime := func(b []byte) time.Time {
+		seconds := binary.BigEndian.Uint32(b[0:4])
+		fraction := binary.BigEndian.Uint32(b[4:8])
+		return time.Unix(int64(seconds)-ntpEpochOffset, int64(fraction)*1e9>>32)
+	}
+	serverReceived := ntpTime(response[32:40])
+	serverSent := ntpTime(response[40:48])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// notePoolTime compares the ntime of a pool's mining.notify with the host
+// clock.
+func (c *clockChecker) notePoolTime(msg *stratumResponse) {
+	var ntime string
+	if len(msg.Params) < 8 || json.Unmarshal(msg.Params[7], &ntime) != nil {
+		return
+	}
+	seconds, err := strconv.ParseUint(ntime, 16, 32)
+	if err != nil {
+		return
+	}
+	c.record("pool", time.Since(time.Unix(int64(seconds), 0)), poolTimeSlack)
+}
+
+func (c *clockChecker) record(source string, skew time.Duration, slack time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limit := c.maxSkew
+	if slack > limit {
+		limit = slack
+	}
+	skewed := skew > limit || skew < -limit
+	c.skew[source] = skew
+	if skewed != c.skewed[source] {
+		if skewed {
+			log.Printf("Host clock is off by %s according to %s time; share timestamps and logs will be wrong", skew.Round(time.Millisecond), source)
+		} else {
+			log.Printf("Host clock agrees with %s time again (off by %s)", source, skew.Round(time.Millisecond))
+		}
+	}
+	c.skewed[source] = skewed
+}
+
+// ok reports whether no source found the clock skewed.
+func (c *clockChecker) ok() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, skewed := range c.skewed {
+		if skewed {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *clockChecker) skews() map[string]time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	skews := make(map[string]time.Duration, len(c.skew))
+	for source, skew := range c.skew {
+		skews[source] = skew
+	}
+	return skews
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterConfig lets several proxies share their sessions and statistics,
+// and the shares they sent, through a Redis server.
+type ClusterConfig struct {
+	// Redis is the "host:port" of the server; "" disables cluster mode.
+	Redis    string `json:"redis"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// Node names this proxy in the cluster, its hostname by default.
+	Node string `json:"node"`
+	// Prefix is put before every key, "stratum-proxy:" by default.
+	Prefix string `json:"prefix"`
+	// DuplicateShares rejects shares that a proxy of the cluster already
+	// sent to the same pool for the same worker.
+	DuplicateShares bool `json:"duplicate_shares"`
+}
+
+const (
+	defaultClusterPrefix = "stratum-proxy:"
+	clusterPublishEvery  = 10 * time.Second
+	// Nodes that stopped publishing drop out after this long.
+	clusterNodeTTL = 3 * clusterPublishEvery
+	// How long a share is remembered for duplicate detection.
+	clusterShareTTL = 10 * time.Minute
+	// Most shares checked for duplicates in one round trip to Redis.
+	clusterMaxShareBatch = 256
+)
+
+// clusterNode publishes this proxy's state and checks shares against the
+// cluster. A nil *clusterNode is a proxy outside any cluster.
+type clusterNode struct {
+	cfg   ClusterConfig
+	redis *redisClient
+	// failing is set while Redis is unreachable, to log that only once.
+	failingMu sync.Mutex
+	failing   bool
+	// checks takes shares to check for duplicates to checkShares.
+	checks chan shareCheck
+	stop   chan struct{}
+}
+
+// shareCheck is a share waiting to hear whether the cluster sent it before.
+type shareCheck struct {
+	key       string
+	duplicate chan bool
+}
+
+// clusterNodeState is what each node publishes.
+type clusterNodeState struct {
+	Node     string        `json:"node"`
+	Updated  time.Time     `json:"updated"`
+	Sessions []sessionInfo `json:"sessions"`
+	Workers  []statsRow    `json:"workers"` // all-time totals
+	Pools    []statsRow    `json:"pools"`
+}
+
+var cluster *clusterNode
+
+func newClusterNode(cfg ClusterConfig) (*clusterNode, error) {
+	if cfg.Redis == "" {
+		return nil, nil
+	}
+	if cfg.Node == "" {
+		cfg.Node, _ = os.Hostname()
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultClusterPrefix
+	}
+	n := &clusterNode{cfg: cfg, redis: newRedisClient(cfg.Redis, cfg.Password, cfg.DB),
+		checks: make(chan shareCheck), stop: make(chan struct{})}
+	// Fail at startup on a bad address or password; later failures are
+	// retried.
+	if _, err := n.redis.do("PING"); err != nil {
+		return nil, fmt.Errorf("cluster: %s: %v", cfg.Redis, err)
+	}
+	log.Printf("Joined cluster at %s as %s", cfg.Redis, cfg.Node)
+	if cfg.DuplicateShares {
+		go n.checkShares()
+	}
+	return n, nil
+}
+
+// check logs the first error of a series and the recovery after it.
+func (n *clusterNode) check(err error) error {
+	n.failingMu.Lock()
+	defer n.failingMu.Unlock()
+	switch {
+	case err != nil && !n.failing:
+		log.Printf("Error talking to the cluster: %v", err)
+	case err == nil && n.failing:
+		log.Printf("Cluster reachable again")
+	}
+	n.failing = err != nil
+	return err
+}
+
+func (n *clusterNode) nodeKey(node string) string {
+	return n.cfg.Prefix + "node:" + node
+}
+
+func (n *clusterNode) publish() error {
+	workers, pools := stats.totals()
+	data, err := json.Marshal(clusterNodeState{
+		Node:     n.cfg.Node,
+		Updated:  time.Now(),
+		Sessions: sessions.snapshot(),
+		Workers:  workers,
+		Pools:    pools,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = n.redis.do("SET", n.nodeKey(n.cfg.Node), string(data), "PX", fmt.Sprint(clusterNodeTTL.Milliseconds()))
+	return n.check(err)
+}
+
+// run publishes the node's state until stop is closed.
+func (n *clusterNode) run(stop <-chan struct{}) {
+	n.publish()
+	ticker := time.NewTicker(clusterPublishEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n.publish()
+		}
+	}
+}
+
+// close withdraws the node from the cluster.
+func (n *clusterNode) close() {
+	if n == nil {
+		return
+	}
+	close(n.stop)
+	n.redis.do("DEL", n.nodeKey(n.cfg.Node))
+	n.redis.close()
+}
+
+// nodes returns the state of every node of the cluster, by name.
+func (n *clusterNode) nodes() ([]clusterNodeState, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := n.redis.do("SCAN", cursor, "MATCH", n.nodeKey("*"), "COUNT", "100")
+		if err != nil {
+			return nil, n.check(err)
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply")
+		}
+		cursor, _ = parts[0].(string)
+		batch, _ := parts[1].([]interface{})
+		for _, key := range batch {
+			if key, ok := key.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	reply, err := n.redis.do(append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, n.check(err)
+	}
+	values, _ := reply.([]interface{})
+	var states []clusterNodeState
+	for _, value := range values {
+		// Keys may have expired between SCAN and MGET.
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var state clusterNodeState
+		if json.Unmarshal([]byte(data), &state) == nil {
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Node < states[j].Node })
+	return states, n.check(nil)
+}
+
+// duplicateShare reports whether a proxy of the cluster already sent this
+// share to the pool of up, on a connection with the same extranonce1.
+// Shares are let through when Redis cannot tell.
+func (n *clusterNode) duplicateShare(up *upstream, poolWorker string, msg *stratumMessage) bool {
+	if n == nil || !n.cfg.DuplicateShares || len(msg.Params) < 5 {
+		return false
+	}
+	up.mu.Lock()
+	extranonce1 := up.extranonce1
+	up.mu.Unlock()
+	// Job, extranonce2, ntime and nonce, with the version bits if rolled.
+	fields := []string{up.target.Address, extranonce1, poolWorker}
+	for _, param := range msg.Params[1:] {
+		fields = append(fields, string(param))
+	}
+	check := shareCheck{key: n.cfg.Prefix + "share:" + strings.Join(fields, "|"), duplicate: make(chan bool, 1)}
+	select {
+	case n.checks <- check:
+	case <-n.stop:
+		return false
+	}
+	return <-check.duplicate
+}
+
+// checkShares checks the shares of all sessions until the node closes.
+// Those that arrive during a round trip to Redis go together in the next.
+func (n *clusterNode) checkShares() {
+	ttl := fmt.Sprint(clusterShareTTL.Milliseconds())
+	for {
+		var batch []shareCheck
+		select {
+		case <-n.stop:
+			return
+		case check := <-n.checks:
+			batch = append(batch, check)
+		}
+	waiting:
+		for len(batch) < clusterMaxShareBatch {
+			select {
+			case check := <-n.checks:
+				batch = append(batch, check)
+			default:
+				break waiting
+			}
+		}
+
+		commands := make([][]string, len(batch))
+		for i, check := range batch {
+			commands[i] = []string{"SET", check.key, n.cfg.Node, "NX", "PX", ttl}
+		}
+		replies, err := n.redis.pipeline(commands)
+		n.check(err)
+		for i, check := range batch {
+			check.duplicate <- err == nil && replies[i] == nil
+		}
+	}
+}
+
+func duplicateReply(id interface{}) string {
+	return fmt.Sprintf(`{"id":%s,"result":null,"error":[22,"Duplicate share",null]}`, jsonID(id))
+}
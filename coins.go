@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// CoinConfig is a coin the proxy mines: the targets its miners go to, how
+// they are recognized and the rewrite rules they get.
+type CoinConfig struct {
+	Name    string   `json:"name"`
+	Targets []Target `json:"targets"`
+	// Algorithm is "sha256" (default) or "scrypt"; it sets the hashrate a
+	// share stands for and the share target of getwork.
+	Algorithm string `json:"algorithm"`
+	// Ports are local ports whose miners all mine this coin.
+	Ports []int `json:"ports"`
+	// DetectPorts recognize a miner by a TCP port open on it, e.g. 4028
+	// of the cgminer API. Coins are tried in order.
+	DetectPorts []int `json:"detect_ports"`
+	// Miner, when set, replaces the non-empty fields of miner for this
+	// coin; client and route overrides still apply on top.
+	Miner *MinerConfig `json:"miner,omitempty"`
+}
+
+// legacyTargets are the coin settings from before coin profiles, turned
+// into the "ltc" and "btc" coins when no coins are configured.
+type legacyTargets struct {
+	BTCTargets []Target `json:"btc_targets"`
+	LTCTargets []Target `json:"ltc_targets"`
+}
+
+// Share targets at difficulty 1.
+var (
+	sha256Diff1Target = new(big.Int).Lsh(big.NewInt(0xffff), 208)
+	scryptDiff1Target = new(big.Int).Lsh(big.NewInt(0xffff), 224)
+)
+
+// legacyCoins reads btc_targets and ltc_targets from the config file data.
+// Miners were taken for litecoin unless their cgminer API port answered.
+func legacyCoins(data []byte) ([]CoinConfig, error) {
+	var legacy legacyTargets
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	if legacy.BTCTargets == nil && legacy.LTCTargets == nil {
+		return nil, nil
+	}
+	// A coin without targets would become the default coin of a config
+	// that only lists btc_targets, leaving its miners nowhere to go.
+	var coins []CoinConfig
+	if len(legacy.LTCTargets) > 0 {
+		coins = append(coins, CoinConfig{Name: "ltc", Targets: legacy.LTCTargets, Algorithm: "scrypt", DetectPorts: []int{8359}})
+	}
+	if len(legacy.BTCTargets) > 0 {
+		coins = append(coins, CoinConfig{Name: "btc", Targets: legacy.BTCTargets, Algorithm: "sha256", DetectPorts: []int{4028}})
+	}
+	return coins, nil
+}
+
+func validateCoins(config *Config) error {
+	seen := make(map[string]bool)
+	for _, coin := range config.Coins {
+		if coin.Name == "" {
+			return fmt.Errorf("coin without a name")
+		}
+		if seen[coin.Name] {
+			return fmt.Errorf("coin %s listed twice", coin.Name)
+		}
+		seen[coin.Name] = true
+		switch coin.Algorithm {
+		case "", "sha256", "scrypt":
+		default:
+			return fmt.Errorf("coin %s: unknown algorithm %q", coin.Name, coin.Algorithm)
+		}
+		for _, port := range append(coin.Ports, coin.DetectPorts...) {
+			if port <= 0 || port > 65535 {
+				return fmt.Errorf("coin %s: invalid port %d", coin.Name, port)
+			}
+		}
+	}
+	if config.DefaultCoin != "" && !seen[config.DefaultCoin] {
+		return fmt.Errorf("default coin %s is not configured", config.DefaultCoin)
+	}
+	return nil
+}
+
+// coin returns the coin called name, or nil.
+func (c *Config) coin(name string) *CoinConfig {
+	for i := range c.Coins {
+		if c.Coins[i].Name == name {
+			return &c.Coins[i]
+		}
+	}
+	return nil
+}
+
+// coinTargets returns the targets of the coin called name.
+func (c *Config) coinTargets(name string) []Target {
+	if coin := c.coin(name); coin != nil {
+		return coin.Targets
+	}
+	return nil
+}
+
+// coinOf returns the coin a pool address is a target of, or nil.
+func (c *Config) coinOf(address string) *CoinConfig {
+	for i := range c.Coins {
+		if containsTarget(c.Coins[i].Targets, address) {
+			return &c.Coins[i]
+		}
+	}
+	for i := range c.VirtualPools {
+		if containsTarget(c.VirtualPools[i].Targets, address) {
+			return c.coin(c.VirtualPools[i].coin(c))
+		}
+	}
+	return nil
+}
+
+// withAllTargets returns a copy of c whose coins all go to targets.
+func (c *Config) withAllTargets(targets []Target) *Config {
+	effective := *c
+	effective.Coins = make([]CoinConfig, len(c.Coins))
+	for i, coin := range c.Coins {
+		coin.Targets = targets
+		effective.Coins[i] = coin
+	}
+	return &effective
+}
+
+// forCoin returns the effective config for the miners of a coin, with its
+// rewrite rules applied to a copy.
+func (c *Config) forCoin(name string) *Config {
+	coin := c.coin(name)
+	if coin == nil || coin.Miner == nil {
+		return c
+	}
+	effective := *c
+	effective.Miner = c.Miner.with(coin.Miner)
+	return &effective
+}
+
+// detectCoin returns the name of the coin a miner mines: the coin of the
+// port it connected to, else the first whose detect port is open on it,
+// else the default coin.
+func (c *Config) detectCoin(conn net.Conn) string {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		for _, coin := range c.Coins {
+			for _, port := range coin.Ports {
+				if port == addr.Port {
+					return coin.Name
+				}
+			}
+		}
+	}
+	ip := remoteIP(conn)
+	for _, coin := range c.Coins {
+		for _, port := range coin.DetectPorts {
+			if checkPort(ip, port) {
+				return coin.Name
+			}
+		}
+	}
+	return c.defaultCoin()
+}
+
+// defaultCoin is the coin of miners that were not recognized: default_coin,
+// or the first coin.
+func (c *Config) defaultCoin() string {
+	if c.DefaultCoin != "" || len(c.Coins) == 0 {
+		return c.DefaultCoin
+	}
+	return c.Coins[0].Name
+}
+
+// diff1Hashes is how many hashes a difficulty 1 share of a coin stands for.
+func (coin *CoinConfig) diff1Hashes() float64 {
+	if coin != nil && coin.Algorithm == "scrypt" {
+		return scryptDiff1Hashes
+	}
+	return sha256Diff1Hashes
+}
+
+// diff1Target is the share target at difficulty 1 of a coin.
+func (coin *CoinConfig) diff1Target() *big.Int {
+	if coin != nil && coin.Algorithm == "scrypt" {
+		return scryptDiff1Target
+	}
+	return sha256Diff1Target
+}
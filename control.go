@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The control socket takes one command per connection and answers with
+// text; answers to failed commands start with "error: ".
+const controlUsage = `commands:
+  status                 connections, workers and hashrate
+  sessions               the miners connected and their pools
+  discovered             the miners found on the network, connected or not
+  deviations             the workers running below their expected hashrate
+  reload                 read the configuration file again
+  drain                  stop accepting miners and exit once the last one left
+  kick <worker>          disconnect a worker so it reconnects
+  curtail [minutes]      pause mining for minutes, resume for 0, or show the state
+  set-loglevel <level>   log info, warning or error and above`
+
+const controlTimeout = 10 * time.Second
+
+// startControl listens on the control socket until the server stops.
+func (p *proxyServer) startControl() error {
+	path := p.config.Load().ControlSocket
+	if path == "" {
+		return nil
+	}
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		return err
+	}
+	// Anyone who can connect controls the proxy.
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	p.control = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handleControl(conn)
+		}
+	}()
+	log.Printf("Control socket on %s", path)
+	return nil
+}
+
+func (p *proxyServer) handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	answer, err := p.controlCommand(strings.Fields(line))
+	if err != nil {
+		answer = "error: " + err.Error()
+	}
+	fmt.Fprintln(conn, answer)
+}
+
+// controlCommand runs one command of the control socket.
+func (p *proxyServer) controlCommand(args []string) (string, error) {
+	if len(args) == 0 {
+		return controlUsage, nil
+	}
+	switch command := args[0]; {
+	case command == "status" && len(args) == 1:
+		return p.statusText(), nil
+	case command == "sessions" && len(args) == 1:
+		return sessionsText(sessions.snapshot()), nil
+	case command == "discovered" && len(args) == 1:
+		return discoveryText(discovery.snapshot()), nil
+	case command == "deviations" && len(args) == 1:
+		return deviationsText(stats.belowSpec(time.Now(), p.config.Load().ExpectedHashrate)), nil
+	case command == "reload" && len(args) == 1:
+		config, err := loadConfig(p.configPath)
+		if err != nil {
+			return "", err
+		}
+		if err := validateConfig(config); err != nil {
+			return "", err
+		}
+		p.reload(config)
+		log.Printf("Reloaded %s on request", p.configPath)
+		return "reloaded " + p.configPath, nil
+	case command == "drain" && len(args) == 1:
+		p.drain()
+		return fmt.Sprintf("draining, %d connections left", p.active.Load()), nil
+	case command == "curtail" && len(args) == 1:
+		return curtailText(curtailment.state()), nil
+	case command == "curtail" && len(args) == 2:
+		minutes, err := strconv.Atoi(args[1])
+		if err != nil || minutes < 0 {
+			return "", fmt.Errorf("invalid minutes %q", args[1])
+		}
+		curtailment.curtail(p.config.Load().Curtailment, minutes)
+		return curtailText(curtailment.state()), nil
+	case command == "kick" && len(args) == 2:
+		n := sessions.kick(args[1])
+		if n == 0 {
+			return "", fmt.Errorf("worker %s is not connected", args[1])
+		}
+		return fmt.Sprintf("disconnected %d sessions of %s", n, args[1]), nil
+	case command == "set-loglevel" && len(args) == 2:
+		if err := setLogLevel(args[1]); err != nil {
+			return "", err
+		}
+		return "log level " + args[1], nil
+	case command == "help":
+		return controlUsage, nil
+	}
+	return "", fmt.Errorf("invalid command %q\n%s", strings.Join(args, " "), controlUsage)
+}
+
+// ctl sends a command to the control socket of a running proxy.
+func ctl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("s", "", "Control socket (default: control_socket of the configuration)")
+	configPath := fs.String("c", "config.json", "Configuration naming the control socket")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ctl [-s socket | -c config] command [args]\n%s\n", controlUsage)
+	}
+	fs.Parse(args)
+
+	if *socket == "" {
+		config, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		if config.ControlSocket == "" {
+			return fmt.Errorf("%s has no control_socket", *configPath)
+		}
+		*socket = config.ControlSocket
+	}
+	conn, err := net.DialTimeout("unix", *socket, controlTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	if _, err := fmt.Fprintln(conn, strings.Join(fs.Args(), " ")); err != nil {
+		return err
+	}
+	answer, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	text := strings.TrimSuffix(string(answer), "\n")
+	if message, failed := strings.CutPrefix(text, "error: "); failed {
+		return fmt.Errorf("%s", message)
+	}
+	fmt.Println(text)
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Every request a miner sends with an id is tracked until the pool answers
+// it, so a response can be matched to the method it answers and how long it
+// took. A request the pool leaves unanswered for the request timeout is
+// answered by the proxy with an error, and the pool's late answer dropped,
+// so miners do not wait on a pool that lost it.
+
+const (
+	defaultRequestTimeout = time.Minute
+	requestSweepInterval  = 5 * time.Second
+)
+
+// pendingRequest is a miner request the pool has not answered yet.
+type pendingRequest struct {
+	id     interface{}
+	method string
+	// sent is when the request went to the pool.
+	sent time.Time
+	// submit describes the share of a submit.
+	submit   submitInfo
+	isSubmit bool
+	// expired is set once the proxy answered the request itself; the entry
+	// stays to drop the pool's late answer.
+	expired bool
+}
+
+// requestTracker holds the requests of a session by id.
+type requestTracker struct {
+	mu      sync.Mutex
+	pending map[string]pendingRequest
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{pending: make(map[string]pendingRequest)}
+}
+
+// add tracks a request other than a share.
+func (t *requestTracker) add(id interface{}, method string) {
+	t.mu.Lock()
+	t.pending[idKey(id)] = pendingRequest{id: id, method: method, sent: time.Now()}
+	t.mu.Unlock()
+}
+
+// addSubmit tracks a share.
+func (t *requestTracker) addSubmit(id interface{}, method string, info submitInfo) {
+	t.mu.Lock()
+	t.pending[idKey(id)] = pendingRequest{id: id, method: method, sent: time.Now(), submit: info, isSubmit: true}
+	t.mu.Unlock()
+}
+
+// resolve returns the request a pool response answers, and false when it
+// answers none that is tracked.
+func (t *requestTracker) resolve(resp *stratumResponse) (pendingRequest, bool) {
+	if !resp.isResponse() {
+		return pendingRequest{}, false
+	}
+	key := idKey(resp.ID)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	req, ok := t.pending[key]
+	delete(t.pending, key)
+	return req, ok
+}
+
+// forget stops tracking a request the proxy answered itself.
+func (t *requestTracker) forget(id interface{}) {
+	t.mu.Lock()
+	delete(t.pending, idKey(id))
+	t.mu.Unlock()
+}
+
+// clear forgets all requests in flight, as when their pool went away, and
+// returns the shares among them by id key.
+func (t *requestTracker) clear() map[string]submitInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	submits := make(map[string]submitInfo)
+	for key, req := range t.pending {
+		if req.isSubmit && !req.expired {
+			submits[key] = req.submit
+		}
+	}
+	t.pending = make(map[string]pendingRequest)
+	return submits
+}
+
+// expire marks the requests sent before timeout ago as expired and returns
+// them. Expired requests are forgotten after another timeout.
+func (t *requestTracker) expire(timeout time.Duration) []pendingRequest {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var expired []pendingRequest
+	for key, req := range t.pending {
+		age := now.Sub(req.sent)
+		switch {
+		case req.expired && age > 2*timeout:
+			delete(t.pending, key)
+		case !req.expired && age > timeout:
+			req.expired = true
+			t.pending[key] = req
+			expired = append(expired, req)
+		}
+	}
+	return expired
+}
+
+func (l LimitsConfig) requestTimeout() time.Duration {
+	if l.RequestTimeoutSeconds > 0 {
+		return time.Duration(l.RequestTimeoutSeconds) * time.Second
+	}
+	return defaultRequestTimeout
+}
+
+// expireRequests answers the requests the pool leaves unanswered until the
+// session ends.
+func (s *session) expireRequests() {
+	ticker := time.NewTicker(requestSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		// Requests held during a failover are settled by it.
+		if s.failingOver.Load() {
+			continue
+		}
+		// The miner's model, known once it subscribed, may set its own.
+		timeout := s.requestTimeout()
+		if timeout == 0 {
+			continue
+		}
+		expired := s.requests.expire(timeout)
+		if len(expired) == 0 {
+			continue
+		}
+		pool := s.up.Load().target.Address
+		log.Printf("Pool %s left %d requests of %s unanswered for %s", pool, len(expired), s.clientIP, timeout)
+		for _, req := range expired {
+			// A switch of pools may have written them off already.
+			if s.outstanding.Add(-1) < 0 {
+				s.outstanding.Add(1)
+			}
+			if req.isSubmit {
+				s.noteShare(shareRecord{time: time.Now(), clientIP: s.clientIP, pool: pool, info: req.submit,
+					result: "dropped", reason: "no answer from the pool"})
+			}
+			s.trace.response(req.id, "no answer from the pool")
+			s.writeClient(fmt.Sprintf(`{"id":%s,"result":null,"error":[20,"No answer from the pool",null]}`, jsonID(req.id)))
+		}
+	}
+}
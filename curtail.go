@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CurtailmentConfig pauses mining while power is expensive, such as during
+// peak pricing or a demand response event.
+type CurtailmentConfig struct {
+	// Mode is "disconnect" (default) to close the connections of the miners
+	// and turn new ones away, or "hold" to keep them connected but withhold
+	// new jobs, which most firmware idles on without failing over to its
+	// backup pools.
+	Mode string `json:"mode"`
+	// Windows curtail on a schedule, written as the schedule of a route.
+	Windows []RouteSchedule `json:"windows"`
+}
+
+// curtailPeriod is a past curtailment, for reporting.
+type curtailPeriod struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+}
+
+const (
+	curtailCheckInterval = 10 * time.Second
+	// How many past curtailments are kept.
+	curtailHistoryLength = 100
+)
+
+type curtailer struct {
+	// Read on every connection and job while curtailed, per mode.
+	disconnecting atomic.Bool
+	holding       atomic.Bool
+	// getwork is the getwork bridge, whose pool connections are closed
+	// with the sessions.
+	getwork atomic.Pointer[getworkBridge]
+
+	mu     sync.Mutex
+	active bool
+	since  time.Time
+	reason string
+	// until ends a curtailment started on request; skip resumes during the
+	// window that is on, until it ends.
+	until   time.Time
+	skip    bool
+	history []curtailPeriod
+	total   time.Duration
+}
+
+var curtailment = &curtailer{}
+
+func validateCurtailment(config *Config) error {
+	switch config.Curtailment.Mode {
+	case "", "disconnect", "hold":
+	default:
+		return fmt.Errorf("unknown mode %q", config.Curtailment.Mode)
+	}
+	for i := range config.Curtailment.Windows {
+		if err := config.Curtailment.Windows[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// windowOn reports whether a curtailment window is on at now.
+func (c CurtailmentConfig) windowOn(now time.Time) bool {
+	for i := range c.Windows {
+		if c.Windows[i].on(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// run starts and ends curtailments as the windows of the current config
+// and requests say, until stop is closed.
+func (c *curtailer) run(config func() CurtailmentConfig, stop <-chan struct{}) {
+	ticker := time.NewTicker(curtailCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.check(config(), time.Now())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// curtail curtails for minutes on request, or resumes for 0.
+func (c *curtailer) curtail(cfg CurtailmentConfig, minutes int) {
+	now := time.Now()
+	c.mu.Lock()
+	if minutes > 0 {
+		c.until = now.Add(time.Duration(minutes) * time.Minute)
+		c.skip = false
+	} else {
+		c.until = time.Time{}
+		c.skip = cfg.windowOn(now)
+	}
+	c.mu.Unlock()
+	c.check(cfg, now)
+}
+
+// check starts or ends a curtailment as due at now.
+func (c *curtailer) check(cfg CurtailmentConfig, now time.Time) {
+	window := cfg.windowOn(now)
+	c.mu.Lock()
+	if !window {
+		c.skip = false
+	}
+	requested := now.Before(c.until)
+	want := requested || window && !c.skip
+	if want == c.active {
+		c.mu.Unlock()
+		return
+	}
+	c.active = want
+	var period curtailPeriod
+	if want {
+		c.since = now
+		c.reason = "scheduled window"
+		if requested {
+			c.reason = "requested until " + c.until.Format("15:04")
+		}
+	} else {
+		period = curtailPeriod{Start: c.since, End: now, Reason: c.reason}
+		c.history = append(c.history, period)
+		if len(c.history) > curtailHistoryLength {
+			c.history = c.history[len(c.history)-curtailHistoryLength:]
+		}
+		c.total += now.Sub(c.since)
+	}
+	reason := c.reason
+	c.mu.Unlock()
+
+	if want {
+		c.start(cfg, reason)
+	} else {
+		c.end(period)
+	}
+}
+
+func (c *curtailer) start(cfg CurtailmentConfig, reason string) {
+	alert(eventCurtailStart, "", "Mining curtailed: %s", reason)
+	if cfg.Mode == "hold" {
+		log.Printf("Curtailment starts (%s): holding jobs from %d miners", reason, sessions.count())
+		c.holding.Store(true)
+		return
+	}
+	log.Printf("Curtailment starts (%s): disconnecting %d miners", reason, sessions.count())
+	c.disconnecting.Store(true)
+	for _, s := range sessions.all() {
+		s.ending("curtailed")
+		s.clientConn.Close()
+		s.up.Load().close()
+	}
+	if b := c.getwork.Load(); b != nil {
+		b.closeAll()
+	}
+}
+
+// curtailed reports whether miners are to be refused work now.
+func (c *curtailer) curtailed() bool {
+	return c.disconnecting.Load() || c.holding.Load()
+}
+
+func (c *curtailer) end(period curtailPeriod) {
+	c.disconnecting.Store(false)
+	if c.holding.Swap(false) {
+		for _, s := range sessions.all() {
+			s.resumeWork()
+		}
+	}
+	duration := period.End.Sub(period.Start).Round(time.Second)
+	log.Printf("Curtailment ends after %s (%s)", duration, period.Reason)
+	alert(eventCurtailEnd, "", "Mining resumed after %s of curtailment", duration)
+}
+
+// resumeWork sends the miner the latest job of its pool, withheld while
+// curtailed.
+func (s *session) resumeWork() {
+	up := s.up.Load()
+	up.mu.Lock()
+	line := up.notify
+	up.mu.Unlock()
+	if line != "" {
+		s.writeClient(s.translateNotify(up, cleanJobsNotify(line)))
+	}
+}
+
+// curtailState is the curtailment state as the admin API reports it.
+type curtailState struct {
+	Active  bool            `json:"active"`
+	Since   *time.Time      `json:"since,omitempty"`
+	Reason  string          `json:"reason,omitempty"`
+	Until   *time.Time      `json:"until,omitempty"`
+	History []curtailPeriod `json:"history"`
+}
+
+func (c *curtailer) state() curtailState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := curtailState{Active: c.active, History: append([]curtailPeriod{}, c.history...)}
+	if c.active {
+		since := c.since
+		state.Since, state.Reason = &since, c.reason
+		if time.Now().Before(c.until) {
+			until := c.until
+			state.Until = &until
+		}
+	}
+	return state
+}
+
+// curtailText describes the curtailment state for the control socket.
+func curtailText(state curtailState) string {
+	var text strings.Builder
+	if state.Active {
+		fmt.Fprintf(&text, "curtailed since %s: %s", state.Since.Format(time.DateTime), state.Reason)
+	} else {
+		text.WriteString("not curtailed")
+	}
+	for _, p := range state.History {
+		fmt.Fprintf(&text, "\n%s\t%s\t%s", p.Start.Format(time.DateTime), p.End.Sub(p.Start).Round(time.Second), p.Reason)
+	}
+	return text.String()
+}
+
+// writeMetrics writes whether mining is curtailed and for how long it was
+// in the Prometheus text format.
+func (c *curtailer) writeMetrics(w io.Writer) {
+	c.mu.Lock()
+	active, total := c.active, c.total
+	if active {
+		total += time.Since(c.since)
+	}
+	c.mu.Unlock()
+	curtailed := 0
+	if active {
+		curtailed = 1
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_curtailed gauge\n")
+	fmt.Fprintf(w, "stratum_proxy_curtailed %d\n", curtailed)
+	fmt.Fprintf(w, "# TYPE stratum_proxy_curtailed_seconds_total counter\n")
+	fmt.Fprintf(w, "stratum_proxy_curtailed_seconds_total %g\n", total.Seconds())
+}
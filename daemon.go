@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// daemonEnv marks the background copy of a proxy started with -d.
+const daemonEnv = "STRATUM_PROXY_DAEMON"
+
+// writePidFile records the process id at path, refusing to replace the file
+// of a proxy that is still running.
+func writePidFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("%s: process %d is still running", path, pid)
+		}
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonize starts the proxy again, with the same arguments, in a new
+// session detached from the terminal, and prints its process id.
+func daemonize(logPath string) error {
+	if logPath == "" {
+		fmt.Fprintln(os.Stderr, "Warning: no -l given, the log of the daemon is discarded")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	// Relative paths keep working from the same directory; stdio is left
+	// unconnected.
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Println(cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// daemonize is not supported on Windows; the proxy runs in the background
+// as a service there.
+func daemonize(logPath string) error {
+	return fmt.Errorf("-d is not supported on Windows, install a service instead")
+}
+
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// DebugConfig enables net/http/pprof on a listener of its own, kept apart
+// from the admin API as profiles expose internals and cost CPU.
+type DebugConfig struct {
+	// Listen is a TCP address or "unix:/path", e.g. "127.0.0.1:6060".
+	Listen string `json:"listen"`
+}
+
+// startDebug serves the profiling endpoints under /debug/pprof/ until the
+// server stops.
+func (p *proxyServer) startDebug() error {
+	address := p.config.Load().Debug.Listen
+	if address == "" {
+		return nil
+	}
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	p.debug = &http.Server{Handler: mux}
+	go func() {
+		if err := p.debug.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Debug listener stopped: %v", err)
+		}
+	}()
+	log.Printf("Debug endpoints on %s/debug/pprof/", address)
+	return nil
+}
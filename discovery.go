@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscoveryConfig scans the local networks for miners, to find the ones
+// that do not mine through the proxy.
+type DiscoveryConfig struct {
+	// Networks are the subnets to scan, such as "10.0.0.0/24".
+	Networks        []string `json:"networks"`
+	IntervalMinutes int      `json:"interval_minutes"` // 0 disables scanning
+	// Ports recognize a miner by being open; the detect ports of the coins,
+	// else 4028, by default.
+	Ports     []int `json:"ports,omitempty"`
+	TimeoutMs int   `json:"timeout_ms,omitempty"`
+}
+
+const (
+	defaultDiscoveryTimeout = 500 * time.Millisecond
+	// How many addresses are probed at once.
+	discoveryParallelism = 64
+	// Largest network scanned, in addresses.
+	maxDiscoveryAddresses = 4096
+)
+
+// discoveredMiner is a machine found by the last scan.
+type discoveredMiner struct {
+	IP    string `json:"ip"`
+	Port  int    `json:"port"`
+	Model string `json:"model,omitempty"`
+	// Connected is set when the miner has a session with the proxy, under
+	// Worker.
+	Connected bool      `json:"connected"`
+	Worker    string    `json:"worker,omitempty"`
+	Seen      time.Time `json:"seen"`
+}
+
+type discoveryScanner struct {
+	mu     sync.RWMutex
+	miners []discoveredMiner
+}
+
+var discovery = &discoveryScanner{}
+
+func validateDiscovery(config *Config) error {
+	d := config.Discovery
+	if d.IntervalMinutes < 0 || d.TimeoutMs < 0 {
+		return fmt.Errorf("negative interval or timeout")
+	}
+	if d.IntervalMinutes > 0 && len(d.Networks) == 0 {
+		return fmt.Errorf("no networks to scan")
+	}
+	for _, network := range d.Networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", network)
+		}
+		if size := prefix.Addr().BitLen() - prefix.Bits(); size > 12 {
+			return fmt.Errorf("network %s has more than %d addresses", network, maxDiscoveryAddresses)
+		}
+	}
+	for _, port := range d.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	return nil
+}
+
+// ports returns the ports that recognize a miner.
+func (d DiscoveryConfig) ports(config *Config) []int {
+	if len(d.Ports) > 0 {
+		return d.Ports
+	}
+	var ports []int
+	for _, coin := range config.Coins {
+		for _, port := range coin.DetectPorts {
+			if !containsInt(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	if len(ports) == 0 {
+		ports = []int{defaultMinerAPIPort}
+	}
+	return ports
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// run scans every interval until stop is closed. The first scan waits an
+// interval too, for the miners to reconnect after a restart.
+func (d *discoveryScanner) run(config *Config, stop <-chan struct{}) {
+	cfg := config.Discovery
+	ticker := time.NewTicker(time.Duration(cfg.IntervalMinutes) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		d.scan(cfg, cfg.ports(config))
+	}
+}
+
+// scan probes the networks and reports the miners not connected.
+func (d *discoveryScanner) scan(cfg DiscoveryConfig, ports []int) {
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultDiscoveryTimeout
+	}
+	addresses := make(chan string)
+	go func() {
+		defer close(addresses)
+		for _, network := range cfg.Networks {
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				continue
+			}
+			prefix = prefix.Masked()
+			for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+				addresses <- addr.String()
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var found []discoveredMiner
+	var wg sync.WaitGroup
+	for i := 0; i < discoveryParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range addresses {
+				if miner, ok := probeMiner(ip, ports, timeout); ok {
+					mu.Lock()
+					found = append(found, miner)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	workers := make(map[string]string)
+	for _, info := range sessions.snapshot() {
+		if worker, ok := workers[info.ClientIP]; !ok || worker == "" {
+			workers[info.ClientIP] = info.Worker
+		}
+	}
+	var missing []string
+	for i := range found {
+		found[i].Worker, found[i].Connected = workers[found[i].IP]
+		if !found[i].Connected {
+			missing = append(missing, found[i].IP)
+			alert(eventMinerNotConnected, found[i].IP, "Miner %s (%s) is on the network but not connected to the proxy", found[i].IP, orDash(found[i].Model))
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return ipLess(found[i].IP, found[j].IP) })
+	sort.Slice(missing, func(i, j int) bool { return ipLess(missing[i], missing[j]) })
+	d.mu.Lock()
+	d.miners = found
+	d.mu.Unlock()
+	log.Printf("Discovery found %d miners, %d not connected to the proxy", len(found), len(missing))
+	for _, ip := range missing {
+		log.Printf("Miner %s is not connected to the proxy", ip)
+	}
+}
+
+func ipLess(a, b string) bool {
+	x, errX := netip.ParseAddr(a)
+	y, errY := netip.ParseAddr(b)
+	if errX != nil || errY != nil {
+		return a < b
+	}
+	return x.Less(y)
+}
+
+// probeMiner reports whether a miner listens on one of ports at ip, and its
+// model when its cgminer API says.
+func probeMiner(ip string, ports []int, timeout time.Duration) (discoveredMiner, bool) {
+	for _, port := range ports {
+		address := net.JoinHostPort(ip, strconv.Itoa(port))
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		miner := discoveredMiner{IP: ip, Port: port, Seen: time.Now()}
+		if reply, err := minerAPICommand(address, "version", timeout); err == nil {
+			miner.Model = versionModel(reply)
+		}
+		return miner, true
+	}
+	return discoveredMiner{}, false
+}
+
+// versionModel returns the model a cgminer API version reply names:
+// Antminers and Whatsminers say it in Type, others name their firmware.
+func versionModel(reply map[string][]map[string]interface{}) string {
+	for _, entry := range reply["VERSION"] {
+		for _, key := range []string{"Type", "Model"} {
+			if s, ok := entry[key].(string); ok && s != "" {
+				return minerModel(s)
+			}
+		}
+		for _, key := range []string{"BMMiner", "CGMiner", "BFGMiner", "LUXminer", "BOSminer", "Miner"} {
+			if s, ok := entry[key].(string); ok && s != "" {
+				return minerModel(strings.ToLower(key) + "/" + s)
+			}
+		}
+	}
+	return ""
+}
+
+// snapshot returns the miners found by the last scan.
+func (d *discoveryScanner) snapshot() []discoveredMiner {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append(make([]discoveredMiner, 0, len(d.miners)), d.miners...)
+}
+
+// discoveryText lists discovered miners for the control socket.
+func discoveryText(list []discoveredMiner) string {
+	if len(list) == 0 {
+		return "no miners discovered"
+	}
+	var text strings.Builder
+	for _, m := range list {
+		state := "not connected"
+		if m.Connected {
+			state = "connected as " + orDash(m.Worker)
+		}
+		fmt.Fprintf(&text, "%s:%d\t%s\t%s\n", m.IP, m.Port, orDash(m.Model), state)
+	}
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+// writeMetrics writes the counts of discovered miners in the Prometheus
+// text format.
+func (d *discoveryScanner) writeMetrics(w io.Writer) {
+	list := d.snapshot()
+	if len(list) == 0 {
+		return
+	}
+	connected := 0
+	for _, m := range list {
+		if m.Connected {
+			connected++
+		}
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_discovered_miners gauge\n")
+	fmt.Fprintf(w, "stratum_proxy_discovered_miners{connected=\"true\"} %d\n", connected)
+	fmt.Fprintf(w, "stratum_proxy_discovered_miners{connected=\"false\"} %d\n", len(list)-connected)
+}
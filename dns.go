@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDNSCacheSeconds = 60
+
+// dnsCache resolves target host names and keeps the result for ttl. The Go
+// resolver does not expose record TTLs, so the lifetime is configured; it
+// should be no longer than the pools' own TTLs.
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+var resolver = newDNSCache(defaultDNSCacheSeconds)
+
+func newDNSCache(seconds int) *dnsCache {
+	if seconds <= 0 {
+		seconds = defaultDNSCacheSeconds
+	}
+	return &dnsCache{ttl: time.Duration(seconds) * time.Second, entries: make(map[string]*dnsEntry)}
+}
+
+// resolve returns the "ip:port" addresses for a "host:port" target.
+func (c *dnsCache) resolve(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{address}, nil
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(ips)
+		if ok && strings.Join(ips, ",") != strings.Join(entry.addrs, ",") {
+			log.Printf("Target %s now resolves to %s", host, strings.Join(ips, ", "))
+		}
+		entry = &dnsEntry{addrs: ips, expires: time.Now().Add(c.ttl)}
+		c.mu.Lock()
+		c.entries[host] = entry
+		c.mu.Unlock()
+	}
+
+	addrs := make([]string, len(entry.addrs))
+	for i, ip := range entry.addrs {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+func (c *dnsCache) invalidate(address string) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+// dialTarget connects to a target, retrying as configured for it.
+func dialTarget(target Target) (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt <= target.DialRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(jitter(target.backoff(attempt)))
+		}
+		var conn net.Conn
+		if conn, err = dialAddresses(target); err == nil {
+			dialBackoff.succeeded(target.Address)
+			return conn, nil
+		}
+	}
+	dialBackoff.failed(target)
+	return nil, err
+}
+
+// dialAddresses connects to the first reachable address of a target. When
+// none of the cached addresses answer, the name is resolved again before
+// giving up.
+func dialAddresses(target Target) (net.Conn, error) {
+	if target.Solo != nil {
+		return soloNodes.dial(target)
+	}
+	if target.Aggregate != nil {
+		return aggregates.dial(target)
+	}
+	timeout := defaultDialTimeout
+	if target.DialTimeoutMs > 0 {
+		timeout = time.Duration(target.DialTimeoutMs) * time.Millisecond
+	}
+	if target.SSH != nil {
+		// The jump host resolves the address.
+		conn, err := sshTunnels.dial(target, timeout)
+		if err != nil || target.TLS == nil {
+			return conn, err
+		}
+		return target.TLS.wrap(conn, target.Address, timeout)
+	}
+	if proxy := target.httpProxy(); proxy != nil {
+		conn, err := proxy.dial(target.Address, timeout, target.Socket)
+		if err != nil || target.TLS == nil {
+			return conn, err
+		}
+		return target.TLS.wrap(conn, target.Address, timeout)
+	}
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		addrs, err := resolver.resolve(target.Address)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err == nil {
+				target.Socket.apply(conn)
+				if target.TLS != nil {
+					return target.TLS.wrap(conn, target.Address, timeout)
+				}
+				return conn, nil
+			}
+			lastErr = err
+		}
+		resolver.invalidate(target.Address)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Ethash miners speak one of two dialects besides plain stratum:
+//
+//   - ethproxy (eth_submitLogin, eth_getWork, eth_submitWork), where the
+//     wallet logs in and the worker name may come in a "worker" field of
+//     the request.
+//   - EthereumStratum/1.0.0, which uses the mining.* methods with
+//     ethash parameters and is rewritten like any other stratum.
+//
+// Logins and submits of either are rewritten the way mining.authorize and
+// mining.submit are.
+
+// loginMethods carry the miner's username in params[0].
+var loginMethods = map[string]bool{
+	"mining.authorize": true,
+	"eth_submitLogin":  true,
+	"eth_login":        true,
+}
+
+// submitMethods send a share.
+var submitMethods = map[string]bool{
+	"mining.submit":  true,
+	"eth_submitWork": true,
+}
+
+// isEthproxy reports whether method belongs to the ethproxy dialect.
+func isEthproxy(method string) bool {
+	return strings.HasPrefix(method, "eth_")
+}
+
+// modifyEthLogin rewrites an ethproxy login in jsonData like an authorize.
+// A "worker" field, when the miner sends one, names the worker instead of
+// the login and is rewritten to match the pool worker; see ethWorker.
+func modifyEthLogin(jsonData map[string]interface{}, config *Config, id workerIdentity) {
+	params, ok := jsonData["params"].([]interface{})
+	if !ok || len(params) == 0 {
+		return
+	}
+	worker, _ := params[0].(string)
+	if named, ok := jsonData["worker"].(string); ok && named != "" {
+		worker = named
+	}
+	params = config.Miner.applyRules(config.Miner.ruleSet().defaults, "mining.authorize", params, id, worker)
+	if _, ok := jsonData["worker"]; ok {
+		if poolWorker, _ := params[0].(string); poolWorker != "" {
+			jsonData["worker"] = ethWorker(poolWorker)
+		}
+	}
+	jsonData["params"] = params
+}
+
+// ethWorker returns the "worker" field that goes with a pool worker: the
+// part after its first dot, or all of it when it has none, so the pool
+// never sees the miner's own name beside the rewritten one.
+func ethWorker(poolWorker string) string {
+	if _, name, found := strings.Cut(poolWorker, "."); found {
+		return name
+	}
+	return poolWorker
+}
+
+// modifyEthSubmit rewrites the "worker" field of an ethproxy share, whose
+// params hold only the solution.
+func modifyEthSubmit(jsonData map[string]interface{}, config *Config, id workerIdentity) {
+	worker, ok := jsonData["worker"].(string)
+	if !ok {
+		return
+	}
+	if poolWorker := config.Miner.poolWorker(id, worker); poolWorker != "" {
+		jsonData["worker"] = ethWorker(poolWorker)
+	}
+}
+
+// loginWorker returns the worker a login names: the "worker" field of an
+// ethproxy login when it has one, otherwise params[0].
+func loginWorker(line string, msg *stratumMessage) string {
+	var worker string
+	if isEthproxy(msg.Method) {
+		var fields struct {
+			Worker string `json:"worker"`
+		}
+		if json.Unmarshal([]byte(line), &fields) == nil && fields.Worker != "" {
+			return fields.Worker
+		}
+	}
+	if len(msg.Params) > 0 {
+		json.Unmarshal(msg.Params[0], &worker)
+	}
+	return worker
+}
+
+// cleanJobsIndex is where a mining.notify with params carries clean_jobs:
+// last of four for EthereumStratum, ninth for bitcoin-style stratum.
+func cleanJobsIndex(params []json.RawMessage) int {
+	if len(params) == 4 {
+		return 3
+	}
+	return 8
+}
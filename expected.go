@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExpectedHashrateConfig declares the hashrate workers are specified for,
+// to report the ones running well below it, such as underclocked or
+// throttling units.
+type ExpectedHashrateConfig struct {
+	// TolerancePercent is how far below its spec a worker may run before
+	// it is reported; 10 by default.
+	TolerancePercent float64 `json:"tolerance_percent"`
+	// Alert also alerts on workers below spec, besides listing them.
+	Alert bool `json:"alert"`
+	// Specs apply in order: the first matching a worker sets its hashrate.
+	Specs []HashrateSpec `json:"specs"`
+}
+
+// HashrateSpec is the expected hashrate of the workers matching Worker, a
+// pattern as in path.Match such as "rack1.*", or of the miners of Model, as
+// in miner_models.
+type HashrateSpec struct {
+	Worker string `json:"worker,omitempty"`
+	Model  string `json:"model,omitempty"`
+	// Hashrate in hashes per second, such as 110e12 for 110 TH/s.
+	Hashrate float64 `json:"hashrate"`
+}
+
+const defaultHashrateTolerancePercent = 10
+
+// hashrateDeviation is a worker running below its expected hashrate.
+type hashrateDeviation struct {
+	Worker   string  `json:"worker"`
+	Model    string  `json:"model,omitempty"`
+	Expected float64 `json:"expected"`
+	Actual   float64 `json:"actual"` // over the last hour
+	// Below is how far below its spec the worker runs, in percent.
+	Below float64 `json:"below_percent"`
+}
+
+func validateExpectedHashrate(config *Config) error {
+	e := config.ExpectedHashrate
+	if e.TolerancePercent < 0 || e.TolerancePercent >= 100 {
+		return fmt.Errorf("tolerance_percent %g is not between 0 and 100", e.TolerancePercent)
+	}
+	for _, spec := range e.Specs {
+		if (spec.Worker == "") == (spec.Model == "") {
+			return fmt.Errorf("a spec needs either a worker or a model")
+		}
+		if _, err := path.Match(spec.Worker, ""); err != nil {
+			return fmt.Errorf("invalid worker pattern %q", spec.Worker)
+		}
+		if spec.Hashrate <= 0 {
+			return fmt.Errorf("%s%s: hashrate must be above 0", spec.Worker, spec.Model)
+		}
+	}
+	return nil
+}
+
+// expected returns the hashrate a worker with a miner of model is specified
+// for, or 0.
+func (e ExpectedHashrateConfig) expected(worker, model string) float64 {
+	for _, spec := range e.Specs {
+		if spec.Worker != "" {
+			if ok, _ := path.Match(spec.Worker, worker); ok {
+				return spec.Hashrate
+			}
+		} else if model != "" && strings.Contains(strings.ToLower(model), strings.ToLower(spec.Model)) {
+			return spec.Hashrate
+		}
+	}
+	return 0
+}
+
+func (e ExpectedHashrateConfig) tolerance() float64 {
+	if e.TolerancePercent > 0 {
+		return e.TolerancePercent
+	}
+	return defaultHashrateTolerancePercent
+}
+
+// belowSpec returns the connected workers whose hashrate over the last hour
+// is below their spec by more than the tolerance. Workers online for less
+// than the hour are left out, as their hour is not complete.
+func (c *statsCollector) belowSpec(now time.Time, e ExpectedHashrateConfig) []hashrateDeviation {
+	if len(e.Specs) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	minutes := len(c.recent.minutes)
+	var list []hashrateDeviation
+	for name, w := range c.workers {
+		if w.connections == 0 || now.Sub(w.onlineSince) < time.Hour {
+			continue
+		}
+		expected := e.expected(name, w.model)
+		if expected == 0 {
+			continue
+		}
+		actual := w.recent.rate(now, 0, minutes)
+		below := 100 * (expected - actual) / expected
+		if below > e.tolerance() {
+			list = append(list, hashrateDeviation{Worker: name, Model: w.model, Expected: expected, Actual: actual, Below: below})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Worker < list[j].Worker })
+	return list
+}
+
+// deviationsText lists workers below spec for the control socket.
+func deviationsText(list []hashrateDeviation) string {
+	if len(list) == 0 {
+		return "no workers below spec"
+	}
+	var text strings.Builder
+	for _, d := range list {
+		fmt.Fprintf(&text, "%s\t%s\t%s of %s\t%.0f%% below\n", d.Worker, orDash(d.Model),
+			formatHashrate(d.Actual), formatHashrate(d.Expected), d.Below)
+	}
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+// writeExpectedMetrics writes the expected hashrate of the connected workers
+// with a spec in the Prometheus text format.
+func writeExpectedMetrics(w io.Writer, e ExpectedHashrateConfig) {
+	if len(e.Specs) == 0 {
+		return
+	}
+	workers, _ := stats.totals()
+	fmt.Fprintf(w, "# TYPE stratum_proxy_worker_expected_hashrate gauge\n")
+	for _, row := range workers {
+		if expected := e.expected(row.Name, row.Model); expected > 0 && row.Connections > 0 {
+			fmt.Fprintf(w, "stratum_proxy_worker_expected_hashrate{worker=%q} %g\n", row.Name, expected)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How long after a switch submits for old work still count against it.
+const failoverSettle = 30 * time.Second
+
+// failoverEvent accounts for the shares one pool loss cost a miner: submits
+// in flight to the lost pool (dropped), submits held during the switch and
+// forwarded to the new pool (buffered), and submits for work from before the
+// switch answered locally (stale). Work lost is the time the miner hashed on
+// dead work until it received a job from the new pool. Planned events are
+// moves between live pools, by a schedule or to rebalance a split, accounted
+// the same way but kept out of the failover totals.
+type failoverEvent struct {
+	client   string
+	from, to string
+	planned  bool
+	detected time.Time
+	workLost time.Duration
+	dropped  int
+	buffered int
+	stale    int
+}
+
+// failoverBudget totals the share loss of all failovers since start.
+type failoverBudget struct {
+	mu       sync.Mutex
+	events   int
+	failed   int
+	dropped  int
+	buffered int
+	stale    int
+	workLost time.Duration
+}
+
+var failovers failoverBudget
+
+func (b *failoverBudget) add(e *failoverEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events++
+	if e.to == "" {
+		b.failed++
+	}
+	b.dropped += e.dropped
+	b.buffered += e.buffered
+	b.stale += e.stale
+	b.workLost += e.workLost
+}
+
+func (b *failoverBudget) summary() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return fmt.Sprintf("%d failovers, %d failed, %s", b.events, b.failed, formatLoss(b.workLost, b.dropped, b.buffered, b.stale))
+}
+
+func formatLoss(workLost time.Duration, dropped, buffered, stale int) string {
+	return fmt.Sprintf("%s of work lost, shares %d dropped/%d buffered/%d stale", workLost.Round(time.Microsecond), dropped, buffered, stale)
+}
+
+// report logs the event and adds it to the totals.
+func (e *failoverEvent) report() {
+	loss := formatLoss(e.workLost, e.dropped, e.buffered, e.stale)
+	if e.planned {
+		log.Printf("Planned move of %s from %s to %s: %s", e.client, e.from, e.to, loss)
+		return
+	}
+	failovers.add(e)
+	if e.to == "" {
+		log.Printf("Failover of %s from %s failed: %s (totals: %s)", e.client, e.from, loss, failovers.summary())
+		return
+	}
+	log.Printf("Failover of %s from %s to %s: %s (totals: %s)", e.client, e.from, e.to, loss, failovers.summary())
+}
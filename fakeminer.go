@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// fakeMiner speaks just enough stratum v1 to subscribe, authorize and submit
+// shares for the last job it was sent.
+type fakeMiner struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	nextID  int
+	job     string
+	// extranonce makes the handshake subscribe to extranonce changes, which
+	// the proxy needs to move a miner between pools.
+	extranonce bool
+}
+
+func dialFakeMiner(network, address string, timeout time.Duration) (*fakeMiner, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeMiner{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+func (m *fakeMiner) Close() error {
+	return m.conn.Close()
+}
+
+// call sends a request and waits for its response, remembering any job
+// notifications that arrive in the meantime.
+func (m *fakeMiner) call(method string, params ...interface{}) (*stratumResponse, error) {
+	m.nextID++
+	id := m.nextID
+	data, _ := json.Marshal(map[string]interface{}{"id": id, "method": method, "params": params})
+	m.conn.SetDeadline(time.Now().Add(m.timeout))
+	if _, err := m.conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	for {
+		line, err := m.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		var resp stratumResponse
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			return nil, fmt.Errorf("bad message from proxy: %q", line)
+		}
+		if resp.Method == "mining.notify" && len(resp.Params) > 0 {
+			json.Unmarshal(resp.Params[0], &m.job)
+			continue
+		}
+		if resp.Method == "" && idKey(resp.ID) == idKey(id) {
+			return &resp, nil
+		}
+	}
+}
+
+// waitFor reads until the proxy sends a notification of method.
+func (m *fakeMiner) waitFor(method string) (*stratumResponse, error) {
+	m.conn.SetDeadline(time.Now().Add(m.timeout))
+	for {
+		line, err := m.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		var resp stratumResponse
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			return nil, fmt.Errorf("bad message from proxy: %q", line)
+		}
+		if resp.Method == "mining.notify" && len(resp.Params) > 0 {
+			json.Unmarshal(resp.Params[0], &m.job)
+		}
+		if resp.Method == method {
+			return &resp, nil
+		}
+	}
+}
+
+// handshake subscribes and authorizes as user.
+func (m *fakeMiner) handshake(agent, user string) error {
+	if _, err := m.call("mining.subscribe", agent); err != nil {
+		return fmt.Errorf("subscribe: %v", err)
+	}
+	if m.extranonce {
+		if _, err := m.call("mining.extranonce.subscribe"); err != nil {
+			return fmt.Errorf("extranonce.subscribe: %v", err)
+		}
+	}
+	resp, err := m.call("mining.authorize", user, "x")
+	if err != nil {
+		return fmt.Errorf("authorize: %v", err)
+	}
+	if !resp.ok() {
+		return fmt.Errorf("authorize rejected: %s", resp.Error)
+	}
+	return nil
+}
+
+// submit sends a share for the current job and reports whether it was accepted.
+func (m *fakeMiner) submit(user string, nonce uint32) (bool, error) {
+	resp, err := m.call("mining.submit", user, m.job, "00000000", fmt.Sprintf("%08x", time.Now().Unix()), fmt.Sprintf("%08x", nonce))
+	if err != nil {
+		return false, err
+	}
+	return resp.ok(), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fakePool is a minimal in-process stratum pool: it answers subscribe,
+// authorize and submit, and pushes a new job every notifyEvery.
+type fakePool struct {
+	listener    net.Listener
+	notifyEvery time.Duration
+	// difficulty is sent after each subscribe; 0 sends 1.
+	difficulty float64
+	// rejectRate is the share of submits answered with a low difficulty
+	// error, from 0 to 1.
+	rejectRate float64
+	// verbose logs logins and shares.
+	verbose bool
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+
+	nextExtranonce atomic.Uint32
+	jobs           atomic.Uint64
+	authorized     atomic.Int64
+	submits        atomic.Int64
+	rejected       atomic.Int64
+	// rejectAll answers every submit with a low difficulty error.
+	rejectAll atomic.Bool
+	// lastUser is the worker name seen in the most recent authorize or submit.
+	lastUser atomic.Value
+}
+
+func startFakePool(address string, notifyEvery time.Duration) (*fakePool, error) {
+	p, err := listenFakePool(address, notifyEvery)
+	if err != nil {
+		return nil, err
+	}
+	go p.acceptLoop()
+	return p, nil
+}
+
+// listenFakePool returns a pool that serves nothing until acceptLoop runs,
+// so its settings can be changed first.
+func listenFakePool(address string, notifyEvery time.Duration) (*fakePool, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &fakePool{listener: listener, notifyEvery: notifyEvery, conns: make(map[net.Conn]bool)}, nil
+}
+
+func (p *fakePool) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Close stops the pool and drops every connection, like a pool outage.
+func (p *fakePool) Close() {
+	p.listener.Close()
+	p.mu.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+}
+
+func (p *fakePool) connCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func (p *fakePool) acceptLoop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.conns[conn] = true
+		p.mu.Unlock()
+		go p.serveConn(conn)
+	}
+}
+
+func (p *fakePool) serveConn(conn net.Conn) {
+	var writeMu sync.Mutex
+	send := func(v interface{}) error {
+		data, _ := json.Marshal(v)
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := conn.Write(append(data, '\n'))
+		return err
+	}
+	notify := func(clean bool) error {
+		job := p.jobs.Add(1)
+		return send(map[string]interface{}{
+			"id":     nil,
+			"method": "mining.notify",
+			"params": []interface{}{fmt.Sprintf("%x", job), "00", "01", "02", []string{}, "20000000", "1d00ffff", fmt.Sprintf("%08x", time.Now().Unix()), clean},
+		})
+	}
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.Close()
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var msg stratumMessage
+		if json.Unmarshal([]byte(line), &msg) != nil {
+			continue
+		}
+
+		switch msg.Method {
+		case "mining.subscribe":
+			extranonce := fmt.Sprintf("%08x", p.nextExtranonce.Add(1))
+			send(map[string]interface{}{"id": msg.ID, "result": []interface{}{
+				[][]string{{"mining.set_difficulty", extranonce}, {"mining.notify", extranonce}}, extranonce, 4,
+			}, "error": nil})
+			difficulty := p.difficulty
+			if difficulty == 0 {
+				difficulty = 1
+			}
+			send(map[string]interface{}{"id": nil, "method": "mining.set_difficulty", "params": []float64{difficulty}})
+			notify(true)
+			if p.notifyEvery > 0 {
+				go func() {
+					ticker := time.NewTicker(p.notifyEvery)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-done:
+							return
+						case <-ticker.C:
+							if notify(false) != nil {
+								return
+							}
+						}
+					}
+				}()
+			}
+		case "mining.authorize":
+			p.setUser(msg.Params)
+			p.authorized.Add(1)
+			if p.verbose {
+				log.Printf("%s: %s authorized from %s", p.Addr(), p.user(), conn.RemoteAddr())
+			}
+			send(map[string]interface{}{"id": msg.ID, "result": true, "error": nil})
+		case "mining.submit":
+			p.setUser(msg.Params)
+			p.submits.Add(1)
+			reject := p.rejectAll.Load() || (p.rejectRate > 0 && rand.Float64() < p.rejectRate)
+			if p.verbose {
+				log.Printf("%s: share from %s, accepted %v", p.Addr(), p.user(), !reject)
+			}
+			if reject {
+				p.rejected.Add(1)
+				send(map[string]interface{}{"id": msg.ID, "result": nil, "error": []interface{}{23, "Low difficulty share", nil}})
+			} else {
+				send(map[string]interface{}{"id": msg.ID, "result": true, "error": nil})
+			}
+		default:
+			if msg.ID != nil {
+				send(map[string]interface{}{"id": msg.ID, "result": true, "error": nil})
+			}
+		}
+	}
+}
+
+func (p *fakePool) setUser(params []json.RawMessage) {
+	var user string
+	if len(params) > 0 && json.Unmarshal(params[0], &user) == nil {
+		p.lastUser.Store(user)
+	}
+}
+
+func (p *fakePool) user() string {
+	user, _ := p.lastUser.Load().(string)
+	return user
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeoIPConfig points at a MaxMind GeoLite2/GeoIP2 Country or City database
+// in its CSV form: one or more blocks files and the matching locations file.
+type GeoIPConfig struct {
+	Blocks    []string `json:"blocks"`
+	Locations string   `json:"locations"`
+}
+
+// GeoRouteConfig sends clients located in a continent, country or region to
+// their own targets. Every field that is set has to match.
+type GeoRouteConfig struct {
+	Continent string   `json:"continent,omitempty"` // e.g. "EU"
+	Country   string   `json:"country,omitempty"`   // ISO code, e.g. "DE"
+	Region    string   `json:"region,omitempty"`    // subdivision code, e.g. "CA"
+	Targets   []Target `json:"targets"`
+}
+
+type geoLocation struct {
+	Continent, Country, Region string
+}
+
+type geoRange struct {
+	start, end [16]byte
+	location   *geoLocation
+}
+
+// geoDatabase maps address ranges to locations, sorted by start address.
+type geoDatabase struct {
+	ranges []geoRange
+}
+
+// geoDB is loaded when the server starts; nil when no database is configured.
+var geoDB *geoDatabase
+
+func loadGeoDB(cfg GeoIPConfig) (*geoDatabase, error) {
+	if len(cfg.Blocks) == 0 {
+		return nil, nil
+	}
+	locations, err := readGeoLocations(cfg.Locations)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &geoDatabase{}
+	for _, path := range cfg.Blocks {
+		if err := db.readBlocks(path, locations); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start[:], db.ranges[j].start[:]) < 0
+	})
+	log.Printf("Loaded %d GeoIP networks", len(db.ranges))
+	return db, nil
+}
+
+// readGeoCSV reads a CSV file with a header row and calls fn with each
+// record as a map of column name to value.
+func readGeoCSV(path string, fn func(row map[string]string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(record) {
+				row[name] = record[i]
+			}
+		}
+		if err := fn(row); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+}
+
+func readGeoLocations(path string) (map[string]*geoLocation, error) {
+	locations := make(map[string]*geoLocation)
+	err := readGeoCSV(path, func(row map[string]string) error {
+		locations[row["geoname_id"]] = &geoLocation{
+			Continent: row["continent_code"],
+			Country:   row["country_iso_code"],
+			Region:    row["subdivision_1_iso_code"],
+		}
+		return nil
+	})
+	return locations, err
+}
+
+func (db *geoDatabase) readBlocks(path string, locations map[string]*geoLocation) error {
+	return readGeoCSV(path, func(row map[string]string) error {
+		prefix, err := netip.ParsePrefix(row["network"])
+		if err != nil {
+			return err
+		}
+		id := row["geoname_id"]
+		if id == "" {
+			id = row["registered_country_geoname_id"]
+		}
+		location, ok := locations[id]
+		if !ok {
+			return nil
+		}
+
+		bits := prefix.Bits()
+		if prefix.Addr().Is4() {
+			bits += 96
+		}
+		r := geoRange{start: prefix.Masked().Addr().As16(), location: location}
+		r.end = r.start
+		for i := bits; i < 128; i++ {
+			r.end[i/8] |= 1 << (7 - i%8)
+		}
+		db.ranges = append(db.ranges, r)
+		return nil
+	})
+}
+
+func (db *geoDatabase) lookup(ip string) *geoLocation {
+	if db == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	key := addr.Unmap().As16()
+	// The last range starting at or before the address, if it covers it.
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start[:], key[:]) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(db.ranges[i].end[:], key[:]) < 0 {
+		return nil
+	}
+	return db.ranges[i].location
+}
+
+func (r *GeoRouteConfig) matches(location *geoLocation) bool {
+	return (r.Continent == "" || strings.EqualFold(r.Continent, location.Continent)) &&
+		(r.Country == "" || strings.EqualFold(r.Country, location.Country)) &&
+		(r.Region == "" || strings.EqualFold(r.Region, location.Region))
+}
+
+func validateGeoRoutes(config *Config) error {
+	if len(config.GeoRoutes) > 0 && len(config.GeoIP.Blocks) == 0 {
+		return fmt.Errorf("geo_routes need a geoip database")
+	}
+	for _, r := range config.GeoRoutes {
+		if r.Continent == "" && r.Country == "" && r.Region == "" {
+			return fmt.Errorf("geo route without continent, country or region")
+		}
+		if len(r.Targets) == 0 {
+			return fmt.Errorf("geo route %s/%s/%s without targets", r.Continent, r.Country, r.Region)
+		}
+	}
+	return nil
+}
+
+// forLocation returns the effective config for a client's location, with
+// the first matching geo route applied to a copy.
+func (c *Config) forLocation(ip string) *Config {
+	if len(c.GeoRoutes) == 0 {
+		return c
+	}
+	location := geoDB.lookup(ip)
+	if location == nil {
+		return c
+	}
+	for i := range c.GeoRoutes {
+		if c.GeoRoutes[i].matches(location) {
+			return c.withAllTargets(c.GeoRoutes[i].Targets)
+		}
+	}
+	return c
+}
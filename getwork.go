@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GetworkConfig serves the legacy HTTP getwork protocol for miners without
+// stratum support. Each username, from HTTP basic authentication and
+// checked against miner_auth, gets its own stratum connection to the pool,
+// and work is built from its jobs.
+type GetworkConfig struct {
+	Listen string `json:"listen"` // "" disables getwork
+	// Group names the coin mined, the default coin when "".
+	Group string `json:"group"`
+	// MaxUsers caps the usernames, and so the pool connections, served at
+	// once; 100 when 0. Idle ones are closed after five minutes.
+	MaxUsers int `json:"max_users"`
+}
+
+const (
+	getworkTimeout = 10 * time.Second
+	// Pool connections of getwork miners that stopped asking are closed.
+	getworkIdleTimeout     = 5 * time.Minute
+	defaultGetworkMaxUsers = 100
+	// Work handed out per job is remembered for submits up to this many.
+	getworkMaxWork = 4096
+	getworkHash1   = "00000000000000000000000000000000000000000000000000000000000000000000008000000000000000000000000000000000000000000000000000010000"
+)
+
+func validateGetwork(config *Config) error {
+	if config.Getwork.MaxUsers < 0 {
+		return fmt.Errorf("negative max_users")
+	}
+	if group := config.Getwork.Group; group != "" && config.coin(group) == nil {
+		return fmt.Errorf("unknown group %q", group)
+	}
+	return nil
+}
+
+// getworkBridge is the HTTP getwork endpoint.
+type getworkBridge struct {
+	p      *proxyServer
+	server *http.Server
+
+	mu      sync.Mutex
+	workers map[string]*getworkUpstream // by username
+	dialing map[string]*getworkDial     // by username
+}
+
+// getworkDial is a pool connection being opened for a username, which
+// other requests of the username wait for.
+type getworkDial struct {
+	done chan struct{}
+	up   *getworkUpstream
+	err  error
+}
+
+// startGetwork serves getwork until the server stops.
+func (p *proxyServer) startGetwork() error {
+	address := p.config.Load().Getwork.Listen
+	if address == "" {
+		return nil
+	}
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+	b := &getworkBridge{p: p, workers: make(map[string]*getworkUpstream), dialing: make(map[string]*getworkDial)}
+	b.server = &http.Server{Handler: b, ReadHeaderTimeout: getworkTimeout}
+	p.getwork = b.server
+	curtailment.getwork.Store(b)
+	go func() {
+		if err := b.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Getwork stopped: %v", err)
+		}
+		b.closeAll()
+	}()
+	go b.closeIdle(p.stopChan)
+	log.Printf("Getwork on %s", address)
+	return nil
+}
+
+func (b *getworkBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if bans.banned(host) {
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	}
+	username, password, _ := r.BasicAuth()
+	if !b.authorized(username, password, host) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="getwork"`)
+		http.Error(w, "unknown username or wrong password", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		ID     interface{} `json:"id"`
+		Method string      `json:"method"`
+		Params []string    `json:"params"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	answer := func(result interface{}, err error) {
+		resp := map[string]interface{}{"id": req.ID, "result": result, "error": nil}
+		if err != nil {
+			resp["result"] = nil
+			resp["error"] = map[string]interface{}{"code": -1, "message": err.Error()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+	if req.Method != "getwork" {
+		answer(nil, fmt.Errorf("method %q not supported", req.Method))
+		return
+	}
+
+	// Miners get neither work nor their shares through while curtailed,
+	// and poll again after the curtailment is next checked.
+	if curtailment.curtailed() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(curtailCheckInterval/time.Second)))
+		http.Error(w, "mining curtailed", http.StatusServiceUnavailable)
+		return
+	}
+	if username == "" {
+		username = "getwork"
+	}
+	up, err := b.upstream(username, host)
+	if err != nil {
+		answer(nil, err)
+		return
+	}
+	if len(req.Params) == 0 {
+		answer(up.work())
+		return
+	}
+	answer(up.submit(req.Params[0]), nil)
+}
+
+// authorized applies miner_auth to the basic authentication credentials of
+// a request, striking the client's IP on failure as a refused stratum login
+// does.
+func (b *getworkBridge) authorized(username, password, clientIP string) bool {
+	config := b.p.config.Load()
+	if config.MinerAuth.File == "" || minerCredentials.check(username, password, config.MinerAuth.By == "username") {
+		return true
+	}
+	log.Printf("Refused getwork login of %q from %s: unknown username or wrong password", username, clientIP)
+	bans.invalid(clientIP)
+	return false
+}
+
+// upstream returns the pool connection of username, dialing it when there
+// is none or it was lost. Dialing happens outside the lock, so a slow pool
+// holds up only the username waiting for it.
+func (b *getworkBridge) upstream(username, clientIP string) (*getworkUpstream, error) {
+	base := b.p.config.Load()
+	b.mu.Lock()
+	if up, ok := b.workers[username]; ok {
+		if !up.closed() {
+			b.mu.Unlock()
+			return up, nil
+		}
+		delete(b.workers, username)
+	}
+	if d, ok := b.dialing[username]; ok {
+		b.mu.Unlock()
+		<-d.done
+		return d.up, d.err
+	}
+	limit := base.Getwork.MaxUsers
+	if limit == 0 {
+		limit = defaultGetworkMaxUsers
+	}
+	if len(b.workers)+len(b.dialing) >= limit {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("getwork serves at most %d users at once", limit)
+	}
+	d := &getworkDial{done: make(chan struct{})}
+	b.dialing[username] = d
+	b.mu.Unlock()
+
+	group := base.Getwork.Group
+	if group == "" {
+		group = base.defaultCoin()
+	}
+	config := base.forCoin(group).forLocation(clientIP).forClient(clientIP).forUser(username)
+	d.up, d.err = dialGetworkUpstream(config, group, username, clientIP)
+	b.mu.Lock()
+	delete(b.dialing, username)
+	if d.err == nil {
+		b.workers[username] = d.up
+	}
+	b.mu.Unlock()
+	close(d.done)
+	return d.up, d.err
+}
+
+func (b *getworkBridge) closeIdle(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		b.mu.Lock()
+		for username, up := range b.workers {
+			if up.idleFor() > getworkIdleTimeout || up.closed() {
+				up.conn.Close()
+				delete(b.workers, username)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *getworkBridge) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for username, up := range b.workers {
+		up.conn.Close()
+		delete(b.workers, username)
+	}
+}
+
+// stratumJob is a mining.notify from the pool, for bitcoin-style coins.
+type stratumJob struct {
+	id                       string
+	prevHash, coinb1, coinb2 string
+	branches                 []string
+	version, nbits, ntime    string
+}
+
+// getworkWork is work handed to the miner, found again by its merkle root.
+type getworkWork struct {
+	job         *stratumJob
+	extranonce2 string
+}
+
+// getworkUpstream is the stratum connection of one getwork username.
+type getworkUpstream struct {
+	config   *Config
+	target   Target
+	worker   string
+	clientIP string
+	identity workerIdentity
+	diff1    *big.Int
+	blocks   bool // whether shares are checked for blocks
+	conn     net.Conn
+
+	mu              sync.Mutex
+	extranonce1     string
+	extranonce2Size int
+	difficulty      float64
+	job             *stratumJob
+	works           map[string]*getworkWork // by merkle root
+	nextExtranonce2 uint64
+	nextID          int
+	pending         map[int]chan *stratumResponse
+	lastUsed        time.Time
+	err             error // set once the connection is lost
+	ready           chan struct{}
+	readyOnce       sync.Once
+}
+
+func dialGetworkUpstream(config *Config, group, worker, clientIP string) (*getworkUpstream, error) {
+	targets, diff1 := config.coinTargets(group), config.coin(group).diff1Target()
+	var conn net.Conn
+	var target Target
+	err := errors.New("no targets")
+	for _, candidate := range dialOrder(config, orderTargets(config, targets, clientIP)) {
+		if conn, err = dialTarget(candidate); err == nil {
+			target = candidate
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no pool reachable: %v", err)
+	}
+
+	up := &getworkUpstream{
+		config:     config,
+		target:     target,
+		worker:     worker,
+		clientIP:   clientIP,
+		identity:   clientIdentity(clientIP),
+		diff1:      diff1,
+		blocks:     config.coin(group).checksBlocks(),
+		conn:       conn,
+		difficulty: 1,
+		works:      make(map[string]*getworkWork),
+		pending:    make(map[int]chan *stratumResponse),
+		lastUsed:   time.Now(),
+		ready:      make(chan struct{}),
+	}
+	go up.readLoop()
+	subscribed, err := up.call("mining.subscribe", "getwork-bridge")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var result []json.RawMessage
+	if json.Unmarshal(subscribed.Result, &result) != nil || len(result) < 3 {
+		conn.Close()
+		return nil, fmt.Errorf("pool %s: unexpected subscribe result", target.Address)
+	}
+	up.mu.Lock()
+	json.Unmarshal(result[1], &up.extranonce1)
+	json.Unmarshal(result[2], &up.extranonce2Size)
+	up.mu.Unlock()
+	authorized, err := up.call("mining.authorize", worker, "x")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if string(authorized.Result) != "true" {
+		conn.Close()
+		return nil, fmt.Errorf("pool %s refused worker %s: %s", target.Address, worker, authorized.Error)
+	}
+	log.Printf("Getwork miner %s at %s mining on %s", worker, clientIP, target.Address)
+	return up, nil
+}
+
+// call sends a request, rewritten like a miner's, and waits for the answer.
+func (up *getworkUpstream) call(method string, params ...interface{}) (*stratumResponse, error) {
+	up.mu.Lock()
+	if up.err != nil {
+		up.mu.Unlock()
+		return nil, up.err
+	}
+	up.nextID++
+	id := up.nextID
+	answer := make(chan *stratumResponse, 1)
+	up.pending[id] = answer
+	up.mu.Unlock()
+
+	data, _ := json.Marshal(map[string]interface{}{"id": id, "method": method, "params": params})
+	line := up.target.sanitizeLine(ModifyJSON(string(data), up.config, up.identity))
+	up.conn.SetWriteDeadline(time.Now().Add(getworkTimeout))
+	if _, err := up.conn.Write([]byte(line + "\n")); err != nil {
+		up.fail(err)
+		return nil, err
+	}
+	select {
+	case resp := <-answer:
+		if resp == nil {
+			up.mu.Lock()
+			defer up.mu.Unlock()
+			return nil, up.err
+		}
+		return resp, nil
+	case <-time.After(getworkTimeout):
+		up.mu.Lock()
+		delete(up.pending, id)
+		up.mu.Unlock()
+		return nil, fmt.Errorf("pool %s did not answer %s", up.target.Address, method)
+	}
+}
+
+func (up *getworkUpstream) readLoop() {
+	reader := bufio.NewReader(up.conn)
+	for {
+		line, err := readLine(reader, up.config.Limits.maxPoolMessage())
+		if err != nil {
+			up.fail(fmt.Errorf("connection to pool %s lost", up.target.Address))
+			return
+		}
+		var msg stratumResponse
+		if json.Unmarshal([]byte(line), &msg) != nil {
+			continue
+		}
+		switch msg.Method {
+		case "mining.set_difficulty":
+			if len(msg.Params) > 0 {
+				up.mu.Lock()
+				json.Unmarshal(msg.Params[0], &up.difficulty)
+				up.mu.Unlock()
+			}
+		case "mining.notify":
+			up.notify(msg.Params)
+		case "":
+			id, err := strconv.Atoi(idKey(msg.ID))
+			if err != nil {
+				continue
+			}
+			up.mu.Lock()
+			answer, ok := up.pending[id]
+			delete(up.pending, id)
+			up.mu.Unlock()
+			if ok {
+				answer <- &msg
+			}
+		}
+	}
+}
+
+func (up *getworkUpstream) notify(params []json.RawMessage) {
+	job := parseJob(params)
+	if job == nil {
+		return
+	}
+	clean := len(params) > 8 && string(params[8]) == "true"
+
+	up.mu.Lock()
+	up.job = job
+	if clean || len(up.works) > getworkMaxWork {
+		up.works = make(map[string]*getworkWork)
+	}
+	up.mu.Unlock()
+	up.readyOnce.Do(func() { close(up.ready) })
+}
+
+// parseJob reads the params of a mining.notify, or returns nil when they
+// are not those of a bitcoin-style job.
+func parseJob(params []json.RawMessage) *stratumJob {
+	if len(params) < 8 {
+		return nil
+	}
+	job := &stratumJob{}
+	for i, field := range []*string{&job.id, &job.prevHash, &job.coinb1, &job.coinb2} {
+		json.Unmarshal(params[i], field)
+	}
+	json.Unmarshal(params[4], &job.branches)
+	json.Unmarshal(params[5], &job.version)
+	json.Unmarshal(params[6], &job.nbits)
+	json.Unmarshal(params[7], &job.ntime)
+	return job
+}
+
+// fail ends the connection and the requests waiting on it.
+func (up *getworkUpstream) fail(err error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.err != nil {
+		return
+	}
+	up.err = err
+	up.conn.Close()
+	for id, answer := range up.pending {
+		close(answer)
+		delete(up.pending, id)
+	}
+}
+
+func (up *getworkUpstream) closed() bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.err != nil
+}
+
+func (up *getworkUpstream) idleFor() time.Duration {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return time.Since(up.lastUsed)
+}
+
+// work builds the next piece of work from the current job with a fresh
+// extranonce2.
+func (up *getworkUpstream) work() (map[string]string, error) {
+	select {
+	case <-up.ready:
+	case <-time.After(getworkTimeout):
+		return nil, fmt.Errorf("pool %s sent no job", up.target.Address)
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.err != nil {
+		return nil, up.err
+	}
+	up.lastUsed = time.Now()
+	extranonce2 := make([]byte, 8)
+	binary.BigEndian.PutUint64(extranonce2, up.nextExtranonce2)
+	up.nextExtranonce2++
+	if up.extranonce2Size < len(extranonce2) {
+		extranonce2 = extranonce2[len(extranonce2)-up.extranonce2Size:]
+	} else {
+		extranonce2 = append(make([]byte, up.extranonce2Size-len(extranonce2)), extranonce2...)
+	}
+	work := &getworkWork{job: up.job, extranonce2: hex.EncodeToString(extranonce2)}
+
+	header, err := up.job.header(up.extranonce1, work.extranonce2)
+	if err != nil {
+		return nil, err
+	}
+	up.works[hex.EncodeToString(header[36:68])] = work
+
+	// The first 64 bytes hash the same for every nonce.
+	sha := sha256.New()
+	sha.Write(header[:64])
+	state, _ := sha.(interface{ MarshalBinary() ([]byte, error) }).MarshalBinary()
+	midstate := make([]byte, 32)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(midstate[i*4:], binary.BigEndian.Uint32(state[4+i*4:]))
+	}
+
+	// SHA-256 padding for an 80 byte message, then every word swapped.
+	data := make([]byte, 128)
+	copy(data, header)
+	data[80] = 0x80
+	binary.BigEndian.PutUint64(data[120:], 80*8)
+	swapWords(data)
+
+	return map[string]string{
+		"data":     hex.EncodeToString(data),
+		"target":   hex.EncodeToString(shareTarget(up.diff1, up.difficulty)),
+		"midstate": hex.EncodeToString(midstate),
+		"hash1":    getworkHash1,
+	}, nil
+}
+
+// submit sends the share found in data to the pool and returns its answer.
+func (up *getworkUpstream) submit(dataHex string) bool {
+	data, err := hex.DecodeString(dataHex)
+	if err != nil || len(data) < 80 {
+		return false
+	}
+	header := append([]byte(nil), data[:80]...)
+	swapWords(header)
+
+	up.mu.Lock()
+	up.lastUsed = time.Now()
+	work, ok := up.works[hex.EncodeToString(header[36:68])]
+	difficulty := up.difficulty
+	up.mu.Unlock()
+	info := submitInfo{age: -1, worker: up.worker, poolWorker: up.config.Miner.poolWorker(up.identity, up.worker), difficulty: difficulty, sent: time.Now()}
+	if !ok {
+		up.record(info, "stale", "work not known, or replaced by a clean job")
+		return false
+	}
+	info.job = work.job.id
+	if up.blocks {
+		if solved, hash := solvesBlock(header); solved {
+			info.block = hash
+			log.Printf("Getwork share from %s at %s solves block %s", up.worker, up.clientIP, hash)
+		}
+	}
+
+	ntime := fmt.Sprintf("%08x", binary.LittleEndian.Uint32(header[68:72]))
+	nonce := fmt.Sprintf("%08x", binary.LittleEndian.Uint32(header[76:80]))
+	resp, err := up.call("mining.submit", up.worker, work.job.id, work.extranonce2, ntime, nonce)
+	if err != nil {
+		up.record(info, "dropped", err.Error())
+		return false
+	}
+	if string(resp.Result) != "true" {
+		up.record(info, "rejected", responseFailure(resp))
+		return false
+	}
+	up.record(info, "accepted", "")
+	return true
+}
+
+func (up *getworkUpstream) record(info submitInfo, result, reason string) {
+	info.poolWorker = up.target.sanitizeWorker(info.poolWorker)
+	r := shareRecord{time: time.Now(), clientIP: up.clientIP, pool: up.target.Address, info: info,
+		result: result, reason: reason}
+	if result == "accepted" || result == "rejected" {
+		r.latency, r.hasLatency = time.Since(info.sent), true
+	}
+	if info.block != "" {
+		reportBlock(info.block, info.worker, info.poolWorker, up.target.Address, result == "accepted", reason)
+	}
+	shareLog.record(r)
+	stats.share(up.config, r)
+	splits.share(up.config, r)
+}
+
+// header returns the 80 byte block header of the job with the given
+// extranonces and a zero nonce.
+func (job *stratumJob) header(extranonce1, extranonce2 string) ([]byte, error) {
+	coinbase, err := hex.DecodeString(job.coinb1 + extranonce1 + extranonce2 + job.coinb2)
+	if err != nil {
+		return nil, fmt.Errorf("job %s: bad coinbase: %v", job.id, err)
+	}
+	root := doubleSHA256(coinbase)
+	for _, branch := range job.branches {
+		b, err := hex.DecodeString(branch)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: bad merkle branch: %v", job.id, err)
+		}
+		root = doubleSHA256(append(root, b...))
+	}
+
+	// Stratum sends the previous hash with its words swapped, and the
+	// other fields as big-endian hex.
+	prevHash, err1 := hex.DecodeString(job.prevHash)
+	version, err2 := strconv.ParseUint(job.version, 16, 32)
+	nbits, err3 := strconv.ParseUint(job.nbits, 16, 32)
+	ntime, err4 := strconv.ParseUint(job.ntime, 16, 32)
+	if err := errors.Join(err1, err2, err3, err4); err != nil || len(prevHash) != 32 {
+		return nil, fmt.Errorf("job %s: bad header fields", job.id)
+	}
+	swapWords(prevHash)
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, uint32(version))
+	header.Write(prevHash)
+	header.Write(root)
+	binary.Write(&header, binary.LittleEndian, uint32(ntime))
+	binary.Write(&header, binary.LittleEndian, uint32(nbits))
+	binary.Write(&header, binary.LittleEndian, uint32(0))
+	return header.Bytes(), nil
+}
+
+func doubleSHA256(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// swapWords reverses the bytes of each 32-bit word of b in place.
+func swapWords(b []byte) {
+	for i := 0; i+4 <= len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+}
+
+// shareTarget is the target of a share at difficulty as 32 little-endian
+// bytes, the way getwork miners compare hashes.
+func shareTarget(diff1 *big.Int, difficulty float64) []byte {
+	out := make([]byte, 32)
+	difficultyTarget(diff1, difficulty).FillBytes(out)
+	return reversed(out)
+}
+
+// difficultyTarget is the target of a share at difficulty.
+func difficultyTarget(diff1 *big.Int, difficulty float64) *big.Int {
+	if difficulty <= 0 {
+		difficulty = 1
+	}
+	target, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1), big.NewFloat(difficulty)).Int(nil)
+	return target
+}
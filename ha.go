@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAConfig pairs two proxies as active and standby. Only the active one
+// listens for miners; the standby takes over when it stops hearing the
+// active one. Heartbeats are UDP datagrams between Listen and Peer.
+type HAConfig struct {
+	Listen string `json:"listen"` // e.g. "10.0.0.1:7400"
+	Peer   string `json:"peer"`   // "" disables HA
+	// Priority decides which proxy becomes active when both are on
+	// standby, and on equal priorities the one with the higher Listen
+	// address. An active proxy is not replaced by a returning one of
+	// higher priority, so miners are not moved twice.
+	Priority int `json:"priority"`
+	// Key authenticates heartbeats; both proxies need the same one.
+	Key         string `json:"key"`
+	IntervalMs  int    `json:"interval_ms"`
+	DeadAfterMs int    `json:"dead_after_ms"`
+	// OnActive and OnStandby are commands, as program and arguments, run
+	// on each change, e.g. to move a virtual IP. The listeners are opened
+	// after OnActive succeeded.
+	OnActive  []string `json:"on_active"`
+	OnStandby []string `json:"on_standby"`
+}
+
+const (
+	defaultHAIntervalMs  = 1000
+	defaultHADeadAfterMs = 5000
+	haCommandTimeout     = 30 * time.Second
+	haMagic              = "stratum-proxy-ha"
+)
+
+// haPair runs this proxy's side of the pair.
+type haPair struct {
+	cfg      HAConfig
+	conn     *net.UDPConn
+	peerAddr *net.UDPAddr
+	started  time.Time
+
+	mu           sync.Mutex
+	active       bool
+	lastHeard    time.Time
+	peerActive   bool
+	peerPriority int
+	peerNode     string // the Listen address of the peer
+	// peerSeq is the sequence number of the last heartbeat taken; older
+	// ones are replays.
+	peerSeq int64
+}
+
+// ha is nil when the proxy is not part of a pair.
+var ha *haPair
+
+func validateHA(config *Config) error {
+	cfg := config.HA
+	if cfg.Peer == "" {
+		return nil
+	}
+	if cfg.Listen == "" {
+		return fmt.Errorf("peer set without listen")
+	}
+	if _, err := net.ResolveUDPAddr("udp", cfg.Peer); err != nil {
+		return err
+	}
+	if cfg.Key == "" {
+		return fmt.Errorf("key missing")
+	}
+	return nil
+}
+
+func newHAPair(cfg HAConfig) (*haPair, error) {
+	if cfg.Peer == "" {
+		return nil, nil
+	}
+	if cfg.IntervalMs <= 0 {
+		cfg.IntervalMs = defaultHAIntervalMs
+	}
+	if cfg.DeadAfterMs <= 0 {
+		cfg.DeadAfterMs = defaultHADeadAfterMs
+	}
+	peer, err := net.ResolveUDPAddr("udp", cfg.Peer)
+	if err != nil {
+		return nil, err
+	}
+	local, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("HA: standby, heartbeats on %s with peer %s", cfg.Listen, cfg.Peer)
+	return &haPair{cfg: cfg, conn: conn, peerAddr: peer, started: time.Now()}, nil
+}
+
+func (h *haPair) sign(text string) string {
+	mac := hmac.New(sha256.New, []byte(h.cfg.Key))
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// heartbeat is "stratum-proxy-ha <active|standby> <priority> <node>
+// <sequence> <hmac>". The node is the Listen address, which breaks ties of
+// priority. The sequence is the time of sending in nanoseconds: it only has
+// to grow, across restarts too, so the clocks of the pair need not agree.
+func (h *haPair) heartbeat() []byte {
+	h.mu.Lock()
+	state := "standby"
+	if h.active {
+		state = "active"
+	}
+	h.mu.Unlock()
+	text := fmt.Sprintf("%s %s %d %s %d", haMagic, state, h.cfg.Priority, h.cfg.Listen, time.Now().UnixNano())
+	return []byte(text + " " + h.sign(text))
+}
+
+// receive reads the peer's heartbeats until the connection is closed.
+func (h *haPair) receive() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := h.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(buf[:n]))
+		if len(fields) != 6 || fields[0] != haMagic || !from.IP.Equal(h.peerAddr.IP) {
+			continue
+		}
+		text := strings.Join(fields[:5], " ")
+		if !hmac.Equal([]byte(fields[5]), []byte(h.sign(text))) {
+			continue
+		}
+		priority, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		seq, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			continue
+		}
+		h.mu.Lock()
+		if seq > h.peerSeq {
+			h.peerSeq = seq
+			h.lastHeard = time.Now()
+			h.peerActive = fields[1] == "active"
+			h.peerPriority = priority
+			h.peerNode = fields[3]
+		}
+		h.mu.Unlock()
+	}
+}
+
+// decide returns whether this proxy should be active now.
+func (h *haPair) decide(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	deadAfter := time.Duration(h.cfg.DeadAfterMs) * time.Millisecond
+	peerAlive := now.Sub(h.lastHeard) < deadAfter
+	switch {
+	case h.lastHeard.IsZero() && now.Sub(h.started) < deadAfter:
+		// A peer not heard from yet may be starting too; it gets as long
+		// as a silent one before it is taken for dead, or both would go
+		// active.
+		return false
+	case !peerAlive:
+		return true
+	case h.active && h.peerActive:
+		// Both took over, e.g. after a network split: the preferred one
+		// stays.
+		return h.preferred()
+	case h.active:
+		return true
+	}
+	return !h.peerActive && h.preferred()
+}
+
+// preferred reports whether this proxy ranks above the peer: by priority,
+// then by node, so that both sides agree. Callers hold h.mu.
+func (h *haPair) preferred() bool {
+	if h.cfg.Priority != h.peerPriority {
+		return h.cfg.Priority > h.peerPriority
+	}
+	return h.cfg.Listen > h.peerNode
+}
+
+// run sends heartbeats and switches p between active and standby until
+// stop is closed.
+func (h *haPair) run(p *proxyServer, stop <-chan struct{}) {
+	go h.receive()
+	ticker := time.NewTicker(time.Duration(h.cfg.IntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		h.conn.WriteToUDP(h.heartbeat(), h.peerAddr)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		h.mu.Lock()
+		active := h.active
+		h.mu.Unlock()
+		switch want := h.decide(time.Now()); {
+		case want && !active && !p.draining.Load():
+			if err := runHACommand(h.cfg.OnActive); err != nil {
+				log.Printf("HA: not taking over, on_active failed: %v", err)
+				continue
+			}
+			if err := p.startAccepting(); err != nil {
+				log.Printf("HA: not taking over: %v", err)
+				continue
+			}
+			h.setActive(true)
+			log.Printf("HA: active, accepting miners")
+			alert(eventHAActive, "", "Proxy became active, the peer %s is down or on standby", h.cfg.Peer)
+		case !want && active:
+			p.closeListeners()
+			h.setActive(false)
+			log.Printf("HA: standby, the peer %s is active", h.cfg.Peer)
+			if err := runHACommand(h.cfg.OnStandby); err != nil {
+				log.Printf("HA: on_standby failed: %v", err)
+			}
+		}
+	}
+}
+
+// close leaves the pair, running on_standby when this proxy was active so
+// the peer can take over at once.
+func (h *haPair) close() {
+	if h == nil {
+		return
+	}
+	h.conn.Close()
+	if h.state() == "active" {
+		if err := runHACommand(h.cfg.OnStandby); err != nil {
+			log.Printf("HA: on_standby failed: %v", err)
+		}
+	}
+}
+
+func (h *haPair) setActive(active bool) {
+	h.mu.Lock()
+	h.active = active
+	h.mu.Unlock()
+}
+
+// state is "active" or "standby", or "" outside a pair.
+func (h *haPair) state() string {
+	if h == nil {
+		return ""
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.active {
+		return "active"
+	}
+	return "standby"
+}
+
+func runHACommand(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), haCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
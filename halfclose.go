@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// How long a half-closed session waits for the other side before closing.
+const halfCloseTimeout = 10 * time.Second
+
+// closeWrite shuts down the write side of conn if it supports half-close and
+// reports whether it did.
+func closeWrite(conn net.Conn) bool {
+	if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite() == nil
+	}
+	return false
+}
+
+// isClosedErr reports errors caused by our own teardown of a session rather
+// than by the peer: a closed connection or an expired drain deadline.
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded)
+}
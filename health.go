@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig enables a background check that subscribes to every
+// target, so new connections skip pools that are down.
+type HealthCheckConfig struct {
+	IntervalSeconds int `json:"interval_seconds"` // 0 disables checking
+	TimeoutSeconds  int `json:"timeout_seconds"`
+	// FailuresDown is how many checks in a row have to fail before a
+	// target is marked down.
+	FailuresDown int `json:"failures_down"`
+}
+
+const (
+	defaultHealthTimeoutSeconds = 5
+	defaultHealthFailuresDown   = 2
+)
+
+// targetHealth is the outcome of the checks of one target.
+type targetHealth struct {
+	Address   string        `json:"address"`
+	Up        bool          `json:"up"`
+	Failures  int           `json:"failures"`
+	LastCheck time.Time     `json:"last_check"`
+	LastError string        `json:"last_error,omitempty"`
+	Latency   time.Duration `json:"latency_ns"`
+	// UpSince is when a target that was down passed a check again.
+	UpSince time.Time `json:"up_since,omitempty"`
+}
+
+type healthChecker struct {
+	mu     sync.RWMutex
+	status map[string]*targetHealth
+}
+
+var health = &healthChecker{status: make(map[string]*targetHealth)}
+
+// run checks the targets returned by current every interval until stop is closed.
+func (h *healthChecker) run(cfg HealthCheckConfig, current func() []Target, stop <-chan struct{}) {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHealthTimeoutSeconds * time.Second
+	}
+	failuresDown := cfg.FailuresDown
+	if failuresDown <= 0 {
+		failuresDown = defaultHealthFailuresDown
+	}
+
+	ticker := time.NewTicker(time.Duration(cfg.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		targets := current()
+		for _, target := range targets {
+			wg.Add(1)
+			go func(target Target) {
+				defer wg.Done()
+				start := time.Now()
+				err := checkTarget(target, timeout)
+				h.record(target.Address, time.Since(start), err, failuresDown)
+			}(target)
+		}
+		wg.Wait()
+		if h.allDown(targets) {
+			alert(eventAllTargetsDown, "", "All %d targets are down", len(targets))
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkTarget subscribes to a target and waits for a successful answer.
+func checkTarget(target Target, timeout time.Duration) error {
+	conn, err := dialTarget(target)
+	if err != nil {
+		return err
+	}
+	up := newUpstream(target, conn, LimitsConfig{})
+	defer up.close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := up.write(`{"id":1,"method":"mining.subscribe","params":["stratum-proxy/health"]}`); err != nil {
+		return err
+	}
+	for {
+		line, err := up.readLine()
+		if err != nil {
+			return err
+		}
+		var resp stratumResponse
+		if json.Unmarshal([]byte(line), &resp) != nil || !resp.isResponse() || idKey(resp.ID) != "1" {
+			continue
+		}
+		if len(resp.Error) > 0 && string(resp.Error) != "null" {
+			return fmt.Errorf("subscribe failed: %s", resp.Error)
+		}
+		if len(resp.Result) == 0 || string(resp.Result) == "null" {
+			return fmt.Errorf("subscribe failed: no result")
+		}
+		return nil
+	}
+}
+
+func (h *healthChecker) record(address string, latency time.Duration, err error, failuresDown int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, ok := h.status[address]
+	if !ok {
+		status = &targetHealth{Address: address, Up: true}
+		h.status[address] = status
+	}
+	status.LastCheck = time.Now()
+	if err == nil {
+		if !status.Up {
+			log.Printf("Target %s is up again", address)
+			status.UpSince = status.LastCheck
+		}
+		status.Up = true
+		status.Failures = 0
+		status.LastError = ""
+		status.Latency = latency
+		return
+	}
+
+	status.Failures++
+	status.LastError = err.Error()
+	if status.Up && status.Failures >= failuresDown {
+		status.Up = false
+		// alert takes no locks of the checker.
+		alert(eventPoolDown, address, "Target %s is down after %d failed checks: %v", address, status.Failures, err)
+	}
+}
+
+// down reports whether a target failed its checks, or recovered less than
+// settle ago.
+func (h *healthChecker) down(address string, settle time.Duration) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status, ok := h.status[address]
+	return ok && (!status.Up || time.Since(status.UpSince) < settle)
+}
+
+// allDown reports whether every one of targets failed its checks.
+func (h *healthChecker) allDown(targets []Target) bool {
+	for _, target := range targets {
+		if !h.down(target.Address, 0) {
+			return false
+		}
+	}
+	return len(targets) > 0
+}
+
+// snapshot returns the status of every checked target, sorted by address.
+func (h *healthChecker) snapshot() []targetHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := make([]targetHealth, 0, len(h.status))
+	for _, status := range h.status {
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPProxyConfig sends the connections to targets through an HTTP proxy,
+// such as a corporate one, with CONNECT. The proxy resolves the targets.
+type HTTPProxyConfig struct {
+	// Address is the host:port of the proxy. On a target, "" connects
+	// directly even when the config sets a proxy for all targets.
+	Address string `json:"address"`
+	// Username and Password, when set, log in to the proxy with basic
+	// auth.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// The HTTP proxy of the config, for targets without their own.
+var defaultHTTPProxy atomic.Pointer[HTTPProxyConfig]
+
+func validateHTTPProxy(config *Config) error {
+	check := func(p *HTTPProxyConfig) error {
+		if p == nil || p.Address == "" {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			return fmt.Errorf("invalid address %q", p.Address)
+		}
+		return nil
+	}
+	if err := check(config.HTTPProxy); err != nil {
+		return err
+	}
+	for _, t := range allTargets(config) {
+		if err := check(t.HTTPProxy); err != nil {
+			return fmt.Errorf("%s: %v", t.Address, err)
+		}
+		if t.HTTPProxy != nil && t.HTTPProxy.Address != "" && t.SSH != nil {
+			return fmt.Errorf("%s: ssh and http_proxy cannot be combined", t.Address)
+		}
+	}
+	return nil
+}
+
+// httpProxy returns the HTTP proxy to reach the target through, or nil.
+// Targets reached through SSH use none.
+func (t Target) httpProxy() *HTTPProxyConfig {
+	p := t.HTTPProxy
+	if p == nil {
+		p = defaultHTTPProxy.Load()
+	}
+	if p == nil || p.Address == "" || t.SSH != nil {
+		return nil
+	}
+	return p
+}
+
+// dial connects to address through the proxy, with the socket options on
+// the connection to the proxy.
+func (p *HTTPProxyConfig) dial(address string, timeout time.Duration, options *SocketOptions) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	options.apply(conn)
+	conn.SetDeadline(time.Now().Add(timeout))
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if p.Username != "" || p.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	// The body of a successful CONNECT is the tunnel: it is not read here.
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %v", p.Address, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s refused %s: %s", p.Address, address, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		// The target spoke first and the reader has its first bytes.
+		return bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads a connection through a reader holding its first
+// bytes.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The kernel's ARP table on Linux. Elsewhere clients have no MAC
+	// address.
+	arpTablePath = "/proc/net/arp"
+	// The IPv6 neighbour table is not in /proc; iproute2 reads it.
+	neighbourTimeout = time.Second
+)
+
+// neighbourFailure logs once that IPv6 MAC addresses cannot be looked up.
+var neighbourFailure sync.Once
+
+// workerIdentity is how a client appears in the worker names sent to pools.
+type workerIdentity struct {
+	// ip is the client's IP in a form pools accept, or its name from the
+	// worker names file.
+	ip string
+	// mac is the client's MAC address when it is on the proxy's LAN.
+	mac string
+}
+
+// clientIdentity looks up the identity of a client once per session, so a
+// changed names file or ARP table does not rename a connected worker.
+func clientIdentity(clientIP string) workerIdentity {
+	id := workerIdentity{ip: workerIP(clientIP), mac: lookupMAC(clientIP)}
+	if name := workerNames.lookup(clientIP); name != "" {
+		id.ip = name
+	} else if name := workerNames.lookup(id.mac); name != "" && id.mac != "" {
+		id.ip = name
+	}
+	return id
+}
+
+// macWorker returns the MAC address in a form pools accept, or the IP when
+// the MAC is not known, so names never come out empty.
+func (id workerIdentity) macWorker() string {
+	if id.mac == "" {
+		return id.ip
+	}
+	return strings.ReplaceAll(id.mac, ":", "")
+}
+
+// lookupMAC returns the MAC address the ARP table, or for IPv6 the
+// neighbour table, has for ip, or "".
+func lookupMAC(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return lookupARP(v4.String())
+	}
+	return lookupNeighbour(parsed.String())
+}
+
+func lookupARP(ip string) string {
+	file, err := os.Open(arpTablePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	// IP address, HW type, Flags, HW address, Mask, Device
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != ip {
+			continue
+		}
+		// Flags 0x0 are incomplete entries without an address.
+		if fields[2] == "0x0" {
+			return ""
+		}
+		if mac, err := net.ParseMAC(fields[3]); err == nil {
+			return mac.String()
+		}
+	}
+	return ""
+}
+
+// lookupNeighbour asks "ip -6 neigh" for the MAC address of an IPv6 client,
+// whose lines read "fe80::1 dev eth0 lladdr 00:11:22:33:44:55 REACHABLE".
+func lookupNeighbour(ip string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), neighbourTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "ip", "-6", "neigh", "show", ip).Output()
+	if err != nil {
+		neighbourFailure.Do(func() {
+			log.Printf("Cannot read the IPv6 neighbour table, {mac} stays empty for IPv6 miners: %v", err)
+		})
+		return ""
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "lladdr" {
+				continue
+			}
+			if mac, err := net.ParseMAC(fields[i+1]); err == nil {
+				return mac.String()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// InventoryEntry is one machine of a miners inventory.
+type InventoryEntry struct {
+	IP       string `json:"ip"`
+	Model    string `json:"model"`
+	Customer string `json:"customer"`
+	Wallet   string `json:"wallet"`
+	Worker   string `json:"worker"`
+	// Targets is optional; in CSV it is a ';' separated list.
+	Targets []string `json:"targets"`
+}
+
+// genConfig writes a config whose clients section is generated from an
+// inventory file. Everything else is taken from the base config unchanged.
+func genConfig(args []string) error {
+	fs := flag.NewFlagSet("gen-config", flag.ExitOnError)
+	basePath := fs.String("c", "config.json", "Base configuration file")
+	inventoryPath := fs.String("i", "inventory.csv", "Inventory file (.csv or .json)")
+	output := fs.String("o", "", "Where to write the generated config (default stdout)")
+	fs.Parse(args)
+
+	entries, err := readInventory(*inventoryPath)
+	if err != nil {
+		return err
+	}
+	clients, err := inventoryClients(entries)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(*basePath)
+	if err != nil {
+		return err
+	}
+	var base map[string]json.RawMessage
+	if err := json.Unmarshal(data, &base); err != nil {
+		return fmt.Errorf("%s: %v", *basePath, err)
+	}
+	if base["clients"], err = json.Marshal(clients); err != nil {
+		return err
+	}
+
+	// Map keys are marshalled in sorted order, so the same inventory always
+	// produces byte-identical output.
+	generated, err := json.Marshal(base)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	json.Indent(&out, generated, "", "  ")
+	out.WriteByte('\n')
+
+	if *output == "" {
+		_, err = os.Stdout.Write(out.Bytes())
+		return err
+	}
+	return os.WriteFile(*output, out.Bytes(), 0644)
+}
+
+func readInventory(path string) ([]InventoryEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []InventoryEntry
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return entries, nil
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading header: %v", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"ip", "wallet"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("%s: missing %q column", path, required)
+		}
+	}
+
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		entry := InventoryEntry{
+			IP:       field("ip"),
+			Model:    field("model"),
+			Customer: field("customer"),
+			Wallet:   field("wallet"),
+			Worker:   field("worker"),
+		}
+		for _, t := range strings.Split(field("targets"), ";") {
+			if t = strings.TrimSpace(t); t != "" {
+				entry.Targets = append(entry.Targets, t)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// inventoryClients validates the inventory and converts it to client
+// overrides sorted by IP address.
+func inventoryClients(entries []InventoryEntry) ([]ClientConfig, error) {
+	var problems []string
+	seen := make(map[string]bool)
+	clients := make([]ClientConfig, 0, len(entries))
+
+	for i, e := range entries {
+		ip := net.ParseIP(e.IP)
+		switch {
+		case ip == nil:
+			problems = append(problems, fmt.Sprintf("entry %d: invalid ip %q", i+1, e.IP))
+			continue
+		case seen[ip.String()]:
+			problems = append(problems, fmt.Sprintf("entry %d: duplicate ip %s", i+1, e.IP))
+			continue
+		case e.Wallet == "":
+			problems = append(problems, fmt.Sprintf("entry %d: %s has no wallet", i+1, e.IP))
+			continue
+		}
+		seen[ip.String()] = true
+
+		client := ClientConfig{
+			IP:       ip.String(),
+			Auth:     e.Wallet + ".",
+			Worker:   e.Worker,
+			Customer: e.Customer,
+			Model:    e.Model,
+		}
+		for _, t := range e.Targets {
+			client.Targets = append(client.Targets, Target{Address: t})
+		}
+		clients = append(clients, client)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid inventory:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		a, b := net.ParseIP(clients[i].IP), net.ParseIP(clients[j].IP)
+		return bytes.Compare(a.To16(), b.To16()) < 0
+	})
+	return clients, nil
+}
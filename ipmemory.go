@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a client IP is remembered after it was last seen.
+	ipMemoryTTL = 24 * time.Hour
+	// How often a persisted memory is saved when it changed.
+	ipMemorySaveInterval = time.Minute
+)
+
+// ipMemory remembers a string per client IP for its next connection, such
+// as the user agent the last miner there subscribed with. IPs not seen for
+// ipMemoryTTL are forgotten, so those of miners that moved on, or of
+// scanners, do not pile up.
+type ipMemory struct {
+	mu      sync.Mutex
+	m       map[string]ipMemoryEntry
+	calls   int
+	changed bool // since last saved
+}
+
+type ipMemoryEntry struct {
+	value string
+	seen  time.Time
+}
+
+func newIPMemory() *ipMemory {
+	return &ipMemory{m: make(map[string]ipMemoryEntry)}
+}
+
+// get returns what was remembered for ip, if it is still.
+func (r *ipMemory) get(ip string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.m[ip]
+	if !ok || time.Since(e.seen) > ipMemoryTTL {
+		return "", false
+	}
+	return e.value, true
+}
+
+func (r *ipMemory) set(ip, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.calls++
+	if r.calls%1024 == 0 {
+		for ip, e := range r.m {
+			if now.Sub(e.seen) > ipMemoryTTL {
+				delete(r.m, ip)
+			}
+		}
+	}
+	r.m[ip] = ipMemoryEntry{value: value, seen: now}
+	r.changed = true
+}
+
+func (r *ipMemory) forget(ip string) {
+	r.mu.Lock()
+	delete(r.m, ip)
+	r.changed = true
+	r.mu.Unlock()
+}
+
+// savedIPMemory is an entry of ipMemory in the state file.
+type savedIPMemory struct {
+	Value string    `json:"value"`
+	Seen  time.Time `json:"seen"`
+}
+
+// restore adds the entries saved to path that are still remembered.
+func (r *ipMemory) restore(path string) {
+	var saved map[string]savedIPMemory
+	if err := readStateFile(path, &saved); err != nil {
+		log.Printf("Error loading %s: %v", path, err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ip, e := range saved {
+		if time.Since(e.Seen) <= ipMemoryTTL {
+			r.m[ip] = ipMemoryEntry{value: e.Value, seen: e.Seen}
+		}
+	}
+}
+
+// save writes the entries to path when they changed since last saved.
+func (r *ipMemory) save(path string) {
+	r.mu.Lock()
+	if !r.changed {
+		r.mu.Unlock()
+		return
+	}
+	saved := make(map[string]savedIPMemory, len(r.m))
+	for ip, e := range r.m {
+		if time.Since(e.seen) <= ipMemoryTTL {
+			saved[ip] = savedIPMemory{Value: e.value, Seen: e.seen}
+		}
+	}
+	r.changed = false
+	r.mu.Unlock()
+	if err := writeStateFile(path, saved); err != nil {
+		log.Printf("Error saving %s: %v", path, err)
+	}
+}
+
+// persist saves the entries to path every ipMemorySaveInterval until stop
+// is closed.
+func (r *ipMemory) persist(path string, stop <-chan struct{}) {
+	ticker := time.NewTicker(ipMemorySaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.save(path)
+		}
+	}
+}
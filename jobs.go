@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// Number of job ids a session keeps translating, those of its pool
+// connections across a failover; older ones are expired and submits for
+// them answered as stale.
+const jobTableSize = 2 * upstreamMaxJobs
+
+// jobTable translates the job ids of the pools a session uses into ids of
+// the proxy's own. Pools number their jobs independently, so after a
+// failover or reconnect the miner could otherwise hold two jobs under one
+// id, and a share for the old one would go to the new pool as if it were
+// for the new job. A pool repeating a job id keeps its proxy id.
+type jobTable struct {
+	mu    sync.Mutex
+	next  uint64
+	down  map[string]poolJob // by proxy id
+	up    map[poolJob]string // proxy id by pool job
+	order []string           // proxy ids, oldest first
+}
+
+// poolJob is a job id as one pool connection sent it.
+type poolJob struct {
+	up *upstream
+	id string
+}
+
+func newJobTable() *jobTable {
+	return &jobTable{down: make(map[string]poolJob), up: make(map[poolJob]string)}
+}
+
+// issue returns the proxy id of a job up sent.
+func (t *jobTable) issue(up *upstream, id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job := poolJob{up: up, id: id}
+	if down, ok := t.up[job]; ok {
+		return down
+	}
+	t.next++
+	down := strconv.FormatUint(t.next, 16)
+	t.down[down] = job
+	t.up[job] = down
+	t.order = append(t.order, down)
+	if len(t.order) > jobTableSize {
+		delete(t.up, t.down[t.order[0]])
+		delete(t.down, t.order[0])
+		t.order = t.order[1:]
+	}
+	return down
+}
+
+// lookup returns the pool job behind a proxy id.
+func (t *jobTable) lookup(down string) (poolJob, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job, ok := t.down[down]
+	return job, ok
+}
+
+// translateNotify gives the job of a mining.notify from up its proxy id.
+func (s *session) translateNotify(up *upstream, line string) string {
+	var msg map[string]interface{}
+	if json.Unmarshal([]byte(line), &msg) != nil {
+		return line
+	}
+	params, ok := msg["params"].([]interface{})
+	if !ok || len(params) == 0 {
+		return line
+	}
+	id, ok := params[0].(string)
+	if !ok {
+		return line
+	}
+	params[0] = s.jobs.issue(up, id)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return line
+	}
+	return string(data)
+}
+
+// translateSubmit puts the pool's job id back into a mining.submit and
+// returns the line to forward and the pool connection the job came from.
+// Jobs the proxy never issued, or expired, are left alone and come from
+// no connection.
+func (s *session) translateSubmit(line string, msg *stratumMessage) (string, *upstream) {
+	var down string
+	if len(msg.Params) < 2 || json.Unmarshal(msg.Params[1], &down) != nil {
+		return line, nil
+	}
+	job, ok := s.jobs.lookup(down)
+	if !ok {
+		return line, nil
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal([]byte(line), &fields) != nil {
+		return line, nil
+	}
+	params, ok := fields["params"].([]interface{})
+	if !ok || len(params) < 2 {
+		return line, nil
+	}
+	params[1] = job.id
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return line, nil
+	}
+	msg.Params[1], _ = json.Marshal(job.id)
+	return string(data), job.up
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultLatencyProbeSeconds = 30
+
+type probeResult struct {
+	rtt     time.Duration
+	healthy bool
+}
+
+// latencyProber periodically measures the TCP handshake time of every
+// target, to the first hop of its connections: the SSH jump host or HTTP
+// proxy it goes through, or the pool itself. Only a plain TCP connection is
+// opened, so no tunnel, proxy request or TLS handshake is made for it.
+type latencyProber struct {
+	mu      sync.RWMutex
+	results map[string]probeResult
+}
+
+var latencies = &latencyProber{results: make(map[string]probeResult)}
+
+// run probes the targets returned by current every interval until stop is closed.
+func (p *latencyProber) run(interval time.Duration, current func() []Target, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, target := range current() {
+			p.probe(target)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *latencyProber) probe(target Target) {
+	hop, ok := firstHop(target)
+	if !ok {
+		return
+	}
+	result := probeResult{}
+	if addrs, err := resolver.resolve(hop); err == nil && len(addrs) > 0 {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addrs[0], 3*time.Second)
+		if err == nil {
+			result = probeResult{rtt: time.Since(start), healthy: true}
+			conn.Close()
+		}
+	}
+
+	p.mu.Lock()
+	previous, seen := p.results[target.Address]
+	p.results[target.Address] = result
+	p.mu.Unlock()
+	if seen && previous.healthy != result.healthy {
+		log.Printf("Target %s latency probe: healthy=%v", target.Address, result.healthy)
+	}
+}
+
+// firstHop returns the address connections to a target are dialed to
+// first. Solo and aggregate targets are served within the proxy and are
+// not measured.
+func firstHop(target Target) (string, bool) {
+	switch {
+	case target.Solo != nil, target.Aggregate != nil:
+		return "", false
+	case target.SSH != nil:
+		if _, _, err := net.SplitHostPort(target.SSH.Host); err != nil {
+			return net.JoinHostPort(target.SSH.Host, "22"), true
+		}
+		return target.SSH.Host, true
+	}
+	if proxy := target.httpProxy(); proxy != nil {
+		return proxy.Address, true
+	}
+	return target.Address, true
+}
+
+// sortByLatency orders targets fastest first. Targets that failed their last
+// probe go last; targets not probed yet, or not measured at all, keep their
+// configured position among themselves after the measured healthy ones.
+func (p *latencyProber) sortByLatency(targets []Target) []Target {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	rank := func(t Target) (int, time.Duration) {
+		r, ok := p.results[t.Address]
+		switch {
+		case !ok:
+			return 1, 0
+		case !r.healthy:
+			return 2, 0
+		default:
+			return 0, r.rtt
+		}
+	}
+	sorted := append([]Target(nil), targets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ci, ri := rank(sorted[i])
+		cj, rj := rank(sorted[j])
+		if ci != cj {
+			return ci < cj
+		}
+		return ri < rj
+	})
+	return sorted
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type LimitsConfig struct {
+	MaxConnections      int `json:"max_connections"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	// AcceptRate caps new connections per second, with bursts of AcceptBurst.
+	AcceptRate  int `json:"accept_rate"`
+	AcceptBurst int `json:"accept_burst"`
+	// ReconnectBackoffMs is the initial per-IP reconnect delay, doubled on
+	// every premature reconnect up to ReconnectBackoffMaxMs.
+	ReconnectBackoffMs    int `json:"reconnect_backoff_ms"`
+	ReconnectBackoffMaxMs int `json:"reconnect_backoff_max_ms"`
+	// MaxClientMessageBytes and MaxPoolMessageBytes bound a line from a
+	// miner or a pool; a connection sending a longer one is closed. 0
+	// means 64 KiB from miners and 1 MiB from pools.
+	MaxClientMessageBytes int `json:"max_client_message_bytes"`
+	MaxPoolMessageBytes   int `json:"max_pool_message_bytes"`
+	// RequestTimeoutSeconds is how long a pool gets to answer a request of
+	// a miner before the proxy answers it with an error. 0 means 60
+	// seconds, a negative value waits for ever.
+	RequestTimeoutSeconds int `json:"request_timeout_seconds"`
+	// MaxSubmitsPerMinute caps the shares of each worker; the proxy
+	// rejects those above it and raises a submit_flood alert. 0 disables.
+	MaxSubmitsPerMinute int `json:"max_submits_per_minute"`
+}
+
+const (
+	defaultMaxClientMessage = 64 << 10
+	defaultMaxPoolMessage   = 1 << 20
+)
+
+var errMessageTooLong = errors.New("message too long")
+
+func (l LimitsConfig) maxClientMessage() int {
+	if l.MaxClientMessageBytes > 0 {
+		return l.MaxClientMessageBytes
+	}
+	return defaultMaxClientMessage
+}
+
+func (l LimitsConfig) maxPoolMessage() int {
+	if l.MaxPoolMessageBytes > 0 {
+		return l.MaxPoolMessageBytes
+	}
+	return defaultMaxPoolMessage
+}
+
+// readLine reads a line like ReadString('\n') but fails with
+// errMessageTooLong once it gets longer than max bytes, without buffering
+// the rest.
+func readLine(reader *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > max {
+			return "", fmt.Errorf("%w: over %d bytes", errMessageTooLong, max)
+		}
+		if err != bufio.ErrBufferFull {
+			if line == nil {
+				// Most lines fit the reader's buffer: a single copy.
+				return string(chunk), err
+			}
+			return string(append(line, chunk...)), err
+		}
+		line = append(line, chunk...)
+	}
+}
+
+// connLimiter counts open client connections globally and per source IP.
+// A zero limit means unlimited.
+type connLimiter struct {
+	mu       sync.Mutex
+	maxTotal int
+	maxPerIP int
+	total    int
+	perIP    map[string]int
+}
+
+func newConnLimiter(cfg LimitsConfig) *connLimiter {
+	return &connLimiter{
+		maxTotal: cfg.MaxConnections,
+		maxPerIP: cfg.MaxConnectionsPerIP,
+		perIP:    make(map[string]int),
+	}
+}
+
+// acquire reserves a connection slot for ip and reports whether it was
+// granted. Without perIP only the total limit applies.
+func (l *connLimiter) acquire(ip string, perIP bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+	if perIP && l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
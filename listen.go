@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ListenList is the set of addresses the proxy accepts miners on. It may be
+// written as a single string or a list. Entries prefixed with "unix:" are
+// Unix domain socket paths, "ws://host:port/path" or "wss://..." take
+// stratum over WebSocket and "tls://host:port" stratum over TLS. A wildcard host such as ":3333" or "[::]:3333"
+// accepts both IPv4 and IPv6 clients.
+type ListenList []string
+
+func (l *ListenList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = ListenList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// listenReusePort listens on a TCP address with SO_REUSEPORT set.
+func listenReusePort(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePort}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+func listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		// Remove a socket left behind by an unclean shutdown, but never
+		// anything else that happens to live at the path.
+		if info, err := os.Lstat(path); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and is not a socket", path)
+			}
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+// remoteIP returns the client's IP address. Unix socket peers are on this
+// host and are treated as 127.0.0.1.
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return "127.0.0.1"
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels by the highest severity logged; lines are classified as in
+// logSeverity.
+var logLevels = map[string]int32{
+	"info":    severityInfo,
+	"warning": severityWarning,
+	"error":   severityError,
+}
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(severityInfo)
+}
+
+func setLogLevel(name string) error {
+	level, ok := logLevels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level %q, use info, warning or error", name)
+	}
+	logLevel.Store(level)
+	return nil
+}
+
+// levelWriter drops the lines below the log level.
+type levelWriter struct {
+	w io.Writer
+}
+
+func (l levelWriter) Write(p []byte) (int, error) {
+	if int32(logSeverity(stripLogTime(strings.TrimSuffix(string(p), "\n")))) > logLevel.Load() {
+		return len(p), nil
+	}
+	return l.w.Write(p)
+}
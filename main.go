@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -10,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -17,68 +17,290 @@ import (
 )
 
 type MinerConfig struct {
-	Auth     string `json:"auth"`
-	Pass     string `json:"pass"`
-	Ipenable bool   `json:"ipenable"`
+	Auth string `json:"auth"`
+	// Pass, when set, replaces the password miners authorize with.
+	Pass string `json:"pass"`
+	// PassOptions are options for the pool merged into the password, such
+	// as "d=64" or "m=solo"; each replaces an option of the same name the
+	// password has, and the rest are appended after a ",".
+	PassOptions []string `json:"pass_options,omitempty"`
+	Ipenable    bool     `json:"ipenable"`
+	// Worker, when set, is appended to auth instead of the client's IP;
+	// "{ip}" in it stands for the IP, "{mac}" for the MAC address of
+	// clients on the LAN and "{worker}" for the miner's own worker name.
+	Worker string `json:"worker"`
+	// KeepSuffix keeps the worker name a miner puts after the first "." of
+	// its username, such as "rack1-07" of "wallet.rack1-07", and appends it
+	// to auth in place of worker or the IP; miners without one get those.
+	KeepSuffix bool `json:"keep_suffix"`
+	// Rules rewrite the messages further, after the default rules auth,
+	// pass and worker stand for.
+	Rules []RewriteRule `json:"rules,omitempty"`
+
+	// compiled are the default and configured rules ready to apply, set by
+	// compile; see rewrite.go.
+	compiled *ruleSet
+}
+
+// poolWorker returns the worker name sent to the pool for the client id
+// that calls itself worker, by the default rules.
+func (m MinerConfig) poolWorker(id workerIdentity, worker string) string {
+	params := m.applyRules(m.ruleSet().defaults, "mining.authorize", []interface{}{worker}, id, worker)
+	poolWorker, _ := params[0].(string)
+	return poolWorker
 }
 
 type Config struct {
-	Listen     string      `json:"listen"`
-	BTCTargets []string    `json:"btc_targets"`
-	LTCTargets []string    `json:"ltc_targets"`
-	Miner      MinerConfig `json:"miner"`
+	Listen ListenList `json:"listen"`
+	// ListenSockets tune the TCP connections accepted on listen addresses,
+	// under TLS and WebSocket too, keyed by the address as written in
+	// listen. Unix socket addresses take none.
+	ListenSockets map[string]SocketOptions `json:"listen_sockets"`
+	// ReusePort binds TCP listen addresses with SO_REUSEPORT so that
+	// Acceptors listeners per address (1 when 0), and other processes
+	// started the same way, share the port; the kernel spreads new
+	// connections over them.
+	ReusePort bool `json:"reuse_port"`
+	Acceptors int  `json:"acceptors"`
+	// Coins are the coins mined, each with its targets; btc_targets and
+	// ltc_targets of older configs become the "ltc" and "btc" coins.
+	Coins []CoinConfig `json:"coins"`
+	// DefaultCoin is mined by miners no coin recognizes, the first coin
+	// when "".
+	DefaultCoin string `json:"default_coin"`
+	// VirtualPools are further listen addresses, each with its own coin,
+	// targets and credentials.
+	VirtualPools []VirtualPoolConfig `json:"virtual_pools"`
+	Miner        MinerConfig         `json:"miner"`
+	Limits       LimitsConfig        `json:"limits"`
+	Shims        []ShimConfig        `json:"shims"`
+	Ban          BanConfig           `json:"ban"`
+	// StateDir keeps bans, statistics and the routes of known miners
+	// across restarts. A relative path is taken from the directory of the
+	// config file.
+	StateDir string `json:"state_dir"`
+	// TargetSelection is "ordered" (default, try targets in config order),
+	// "latency" (try the fastest target first), "weighted" (split new
+	// connections by target weight), "split" (split the accepted share
+	// difficulty by target weight, e.g. 95 and 5) or "hash" (keep each
+	// client IP on the same target across reconnects).
+	TargetSelection     string `json:"target_selection"`
+	LatencyProbeSeconds int    `json:"latency_probe_seconds"`
+	// WarmStandby keeps every miner subscribed and authorized on the next
+	// target as well, so a pool failure moves it over without reconnecting.
+	WarmStandby bool `json:"warm_standby"`
+	// FailbackSeconds is how long a preferred target has to stay up again
+	// before new connections use it and, with a warm standby, miners that
+	// failed over are moved back to it; 0 disables.
+	FailbackSeconds int `json:"failback_seconds"`
+	// ReconnectSeconds is how long a miner without a standby is held
+	// while the proxy connects to its targets again after losing the
+	// pool; the miner then gets the new job at once instead of being
+	// disconnected. 0 means 10 seconds, a negative value disconnects it.
+	ReconnectSeconds int `json:"reconnect_seconds"`
+	// DNSCacheSeconds is how long resolved target addresses are reused.
+	DNSCacheSeconds int            `json:"dns_cache_seconds"`
+	Clients         []ClientConfig `json:"clients"`
+	// Routes pick targets and credentials by the username a miner
+	// authorizes with, first match wins.
+	Routes []RouteConfig `json:"routes"`
+	// GeoRoutes pick targets by where the client address is located
+	// according to the GeoIP database.
+	GeoIP     GeoIPConfig      `json:"geoip"`
+	GeoRoutes []GeoRouteConfig `json:"geo_routes"`
+	// Difficulty bounds the share difficulty miners see; clients and
+	// routes can set their own bounds.
+	Difficulty DifficultyClamp `json:"difficulty"`
+	// ClientReconnect decides which client.reconnect messages of pools
+	// reach the miners.
+	ClientReconnect ClientReconnectConfig `json:"client_reconnect"`
+	// PoolMethods set what becomes of other methods pools send to miners.
+	PoolMethods []PoolMethodPolicy `json:"pool_methods"`
+	// DownstreamProxies are the addresses or networks of proxies chained
+	// to this one, whose connections name the miners they forward.
+	DownstreamProxies []string `json:"downstream_proxies"`
+	// MinerAuth checks the logins of miners against local credentials.
+	MinerAuth MinerAuthConfig `json:"miner_auth"`
+	// MinerModels override settings for the miners of a model, detected
+	// from their mining.subscribe user agent.
+	MinerModels []MinerModelConfig `json:"miner_models"`
+	// MinerAPI polls the cgminer API of connected miners.
+	MinerAPI MinerAPIConfig `json:"miner_api"`
+	// Discovery scans the local networks for miners not using the proxy.
+	Discovery DiscoveryConfig `json:"discovery"`
+	// ExpectedHashrate declares the hashrate of workers and models, to
+	// report those running below it.
+	ExpectedHashrate ExpectedHashrateConfig `json:"expected_hashrate"`
+	// ProfitSwitch sends miners to the most profitable of several coins.
+	ProfitSwitch ProfitSwitchConfig `json:"profit_switch"`
+	// Curtailment pauses mining during windows of expensive power or on
+	// request.
+	Curtailment CurtailmentConfig `json:"curtailment"`
+	// StalePolicies set per worker class how old a job may be and still
+	// have its shares forwarded.
+	StalePolicies []StalePolicyConfig `json:"stale_policies"`
+	HealthCheck   HealthCheckConfig   `json:"health_check"`
+	Admin         AdminConfig         `json:"admin"`
+	Debug         DebugConfig         `json:"debug"`
+	ClockCheck    ClockCheckConfig    `json:"clock_check"`
+	Scanners      ScannerConfig       `json:"scanners"`
+	RejectSwitch  RejectSwitchConfig  `json:"reject_switch"`
+	ShareLog      ShareLogConfig      `json:"share_log"`
+	AccessLog     AccessLogConfig     `json:"access_log"`
+	StatsExport   StatsExportConfig   `json:"stats_export"`
+	Alerts        AlertsConfig        `json:"alerts"`
+	Tracing       TracingConfig       `json:"tracing"`
+	Syslog        SyslogConfig        `json:"syslog"`
+	// LogLevel is "info" (default), "warning" or "error".
+	LogLevel string `json:"log_level"`
+	// ControlSocket is the path of a Unix socket taking commands from the
+	// ctl subcommand.
+	ControlSocket string `json:"control_socket"`
+	// WorkerNames is a file of "ip name" or "mac name" lines; a client
+	// with a name has it in its worker name instead of its IP. Changes are
+	// picked up while running.
+	WorkerNames string          `json:"worker_names"`
+	Cluster     ClusterConfig   `json:"cluster"`
+	HA          HAConfig        `json:"ha"`
+	WebSocket   WebSocketConfig `json:"websocket"`
+	TLS         TLSConfig       `json:"tls"`
+	Getwork     GetworkConfig   `json:"getwork"`
+	// HTTPProxy connects to all targets through an HTTP proxy.
+	HTTPProxy *HTTPProxyConfig `json:"http_proxy"`
+
+	clients        map[string]*ClientConfig
+	clientNetworks []clientNetwork
 }
 
-func getClientIP(conn net.Conn) string {
-	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+// workerIP writes a client IP the way it goes into worker names.
+func workerIP(clientIP string) string {
+	if strings.Contains(clientIP, ":") {
+		// IPv6 addresses: pools do not accept colons in worker names either
+		return strings.ReplaceAll(clientIP, ":", "x")
+	}
 	formattedIP := strings.ReplaceAll(clientIP, ".", "x")
 	return formattedIP
 }
 
-func ModifyJSON(data string, config *Config, ip string) string {
-	var jsonData map[string]interface{}
-	err := json.Unmarshal([]byte(data), &jsonData)
+// rewrittenMethods are the methods ModifyJSON changes messages of.
+var rewrittenMethods = map[string]bool{
+	"mining.authorize": true, "mining.submit": true,
+	"eth_submitLogin": true, "eth_login": true, "eth_submitWork": true,
+}
+
+// ModifyJSON rewrites a message from a miner, or each message of a batch,
+// for the pool.
+func ModifyJSON(data string, config *Config, id workerIdentity) string {
+	if isBatch(data) {
+		return modifyBatch(data, config, id)
+	}
+	scratch := getRewriteScratch()
+	defer putRewriteScratch(scratch)
+	var msg stratumMessage
+	if json.Unmarshal(scratch.input(data), &msg) != nil {
+		return data
+	}
+	return scratch.modifyMessage(data, &msg, config, id)
+}
+
+// modifyMessage rewrites data, parsed as msg, in pooled scratch space.
+func modifyMessage(data string, msg *stratumMessage, config *Config, id workerIdentity) string {
+	scratch := getRewriteScratch()
+	defer putRewriteScratch(scratch)
+	return scratch.modifyMessage(data, msg, config, id)
+}
+
+// modifyMessage rewrites data, parsed as msg. Messages of other methods are
+// forwarded byte for byte, without a JSON round trip; the method is taken
+// as parsed, so that escapes in it cannot hide it.
+func (scratch *rewriteScratch) modifyMessage(data string, msg *stratumMessage, config *Config, id workerIdentity) string {
+	if !rewrittenMethods[msg.Method] && !config.Miner.ruleSet().methods[msg.Method] {
+		return data
+	}
+	jsonData := scratch.message
+	err := json.Unmarshal(scratch.input(data), &jsonData)
 	if err != nil {
 		log.Printf("Error unmarshalling JSON: %v", err)
 		return data
 	}
-
-	if method, ok := jsonData["method"]; ok {
-		switch method {
-		case "mining.authorize":
-			if params1, ok := jsonData["params"].([]interface{}); ok {
-				if false == config.Miner.Ipenable {
-					params1[0] = config.Miner.Auth
-				} else {
-					params1[0] = config.Miner.Auth + ip
-				}
-				jsonData["params"] = params1
+	// Keys match case-insensitively when parsed, so "METHOD" is the method
+	// too; only the lower-case keys are rewritten and sent.
+	for key, value := range jsonData {
+		if lower := strings.ToLower(key); (lower == "method" || lower == "params") && key != lower {
+			delete(jsonData, key)
+			if _, ok := jsonData[lower]; !ok {
+				jsonData[lower] = value
 			}
-		case "mining.submit":
-			if params2, ok := jsonData["params"].([]interface{}); ok {
-				if false == config.Miner.Ipenable {
-					params2[0] = config.Miner.Auth
-				} else {
-					params2[0] = config.Miner.Auth + ip
-				}
-				jsonData["params"] = params2
-			}
-		default:
 		}
+	}
+	jsonData["method"] = msg.Method
 
-		modifiedData, err := json.Marshal(jsonData)
-		if err != nil {
-			log.Printf("Error marshalling JSON: %v", err)
-			return data
+	var worker string
+	params, _ := jsonData["params"].([]interface{})
+	if len(params) > 0 {
+		worker, _ = params[0].(string)
+	}
+	switch msg.Method {
+	case "eth_submitLogin", "eth_login":
+		modifyEthLogin(jsonData, config, id)
+	case "eth_submitWork":
+		modifyEthSubmit(jsonData, config, id)
+	}
+	// The default rules rewrite stratum logins and shares; the ethproxy
+	// ones, rewritten above, only get the configured rules.
+	if params, _ = jsonData["params"].([]interface{}); params != nil {
+		jsonData["params"] = config.Miner.applyRules(config.Miner.ruleSet().all, msg.Method, params, id, worker)
+	}
+
+	modifiedData, err := scratch.encode(jsonData)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %v", err)
+		return data
+	}
+	return string(modifiedData)
+}
+
+// isBatch reports whether data is a JSON-RPC batch, an array of messages
+// on one line.
+func isBatch(data string) bool {
+	return strings.HasPrefix(strings.TrimSpace(data), "[")
+}
+
+// validBatch reports whether every message of a batch is one a miner may
+// send.
+func validBatch(data string) bool {
+	var batch []stratumMessage
+	if json.Unmarshal([]byte(data), &batch) != nil || len(batch) == 0 {
+		return false
+	}
+	for _, msg := range batch {
+		if !clientMethods[msg.Method] {
+			return false
 		}
-		return string(modifiedData)
 	}
+	return true
+}
 
-	return data
+// modifyBatch rewrites every message of a batch.
+func modifyBatch(data string, config *Config, id workerIdentity) string {
+	var batch []json.RawMessage
+	if err := json.Unmarshal([]byte(data), &batch); err != nil {
+		log.Printf("Error unmarshalling JSON batch: %v", err)
+		return data
+	}
+	for i, element := range batch {
+		batch[i] = json.RawMessage(ModifyJSON(string(element), config, id))
+	}
+	modifiedData, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("Error marshalling JSON batch: %v", err)
+		return data
+	}
+	return string(modifiedData)
 }
 
 func checkPort(ip string, port int) bool {
-	address := fmt.Sprintf("%s:%d", ip, port)
+	address := net.JoinHostPort(ip, strconv.Itoa(port))
 	timeout := time.Second * 2
 	conn, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
@@ -88,127 +310,159 @@ func checkPort(ip string, port int) bool {
 	return true
 }
 
-func HandleClient(clientConn net.Conn, config *Config, wg *sync.WaitGroup) {
+// HandleClient serves a miner that connected to the virtual pool called
+// pool, or to a listen address when pool is "".
+func HandleClient(clientConn net.Conn, pool string, base *Config, wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer clientConn.Close()
 
-	var targets []string
-	if true == checkPort(clientConn.RemoteAddr().(*net.TCPAddr).IP.String(), 8359) {
-		targets = config.LTCTargets
-	} else if true == checkPort(clientConn.RemoteAddr().(*net.TCPAddr).IP.String(), 4028) {
-		targets = config.BTCTargets
+	// Miners are turned away while curtailed; they retry until it ends.
+	if curtailment.disconnecting.Load() {
+		return
+	}
+	clientReader := getReader(clientConn)
+	defer putReader(clientReader)
+	if base.downstreamProxy(remoteIP(clientConn)) {
+		conn, err := readProxyHeader(clientConn, clientReader)
+		if err != nil {
+			log.Printf("Downstream proxy %s: %v", clientConn.RemoteAddr(), err)
+			return
+		}
+		if clientConn = conn; bans.banned(remoteIP(clientConn)) {
+			return
+		}
+	}
+
+	config := base.forLocation(remoteIP(clientConn)).forClient(remoteIP(clientConn))
+	if kind := detectProbe(clientConn, clientReader); kind != "" {
+		answerProbe(clientConn, config, kind)
+		return
+	}
+	v2, plaintext, err := detectV2(clientConn, clientReader)
+	if err != nil {
+		return
+	}
+	if v2 {
+		log.Printf("Stratum v2 attempt from %s, signalling fallback to v1", clientConn.RemoteAddr())
+		rejectV2(clientConn, plaintext)
+		return
+	}
+
+	var coin string
+	if virtual := base.virtualPool(pool); virtual != nil {
+		// The operator said what the port is for; nothing to detect.
+		coin = virtual.coin(base)
+		config = base.forVirtualPool(virtual).forLocation(remoteIP(clientConn)).forClient(remoteIP(clientConn))
 	} else {
-		targets = config.LTCTargets
+		coin = profit.coinFor(base, config.detectCoin(clientConn))
+		config = base.forCoin(coin).forLocation(remoteIP(clientConn)).forClient(remoteIP(clientConn))
 	}
 
+	// Until the miner authorizes, dial the route its username took last time.
+	routed := config.forKnownUser(remoteIP(clientConn))
+	targets := orderTargets(config, routed.coinTargets(coin), remoteIP(clientConn))
+
 	var remoteConn net.Conn
-	var err error
-	for index := 0; index < len(targets); index++ {
-		remoteConn, err = net.Dial("tcp", targets[index])
+	var target Target
+	candidates := dialOrder(config, targets)
+	for index := 0; index < len(candidates); index++ {
+		remoteConn, err = dialTarget(candidates[index])
 		if err != nil {
 			continue
 		} else {
+			target = candidates[index]
 			break
 		}
 	}
-	defer remoteConn.Close()
-	if err != nil {
+	if err != nil || len(candidates) == 0 {
 		log.Printf("Failed to connect to all remote server")
+		alert(eventAllTargetsDown, "", "Could not connect to any of %d targets for %s", len(candidates), remoteIP(clientConn))
 		return
 	}
+	defer remoteConn.Close()
 
-	clientReader := bufio.NewReader(clientConn)
-	remoteReader := bufio.NewReader(remoteConn)
-
-	var clientWg sync.WaitGroup
-	clientWg.Add(2)
-
-	go func() {
-		defer clientWg.Done()
-		for {
-			clientData, err := clientReader.ReadString('\n')
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading from client: %v", err)
-				}
-				break
-			}
+	s := newSession(config, clientConn, clientReader, remoteConn, target, targets)
+	s.coin = coin
+	s.profitSwitched = base.ProfitSwitch.switched(coin) && base.virtualPool(pool) == nil
+	s.run()
+}
 
-			modifiedData := ModifyJSON(strings.TrimSpace(clientData), config, getClientIP(clientConn))
-			_, err = remoteConn.Write([]byte(modifiedData + "\n"))
-			if err != nil {
-				log.Printf("Error writing to remote server: %v", err)
-				break
-			}
+// startup opens the log file and loads the configuration, logging to the
+// file, or stderr without one, syslog and extra. The returned function
+// closes the log file.
+func startup(configPath, logPath string, extra ...io.Writer) (*Config, func()) {
+	var logFile io.Writer = os.Stderr
+	closeLog := func() {}
+	if logPath != "" {
+		file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
 		}
-	}()
-
-	go func() {
-		defer clientWg.Done()
-		for {
-			remoteData, err := remoteReader.ReadString('\n')
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading from remote server: %v", err)
-				}
-				break
-			}
-			_, err = clientConn.Write([]byte(remoteData))
+		logFile = file
+		closeLog = func() {
+			err := file.Close()
 			if err != nil {
-				log.Printf("Error writing to client: %v", err)
-				break
+				log.Printf("Error closing log file: %v", err)
 			}
 		}
-	}()
+	}
 
-	clientWg.Wait()
-}
+	outputs := append([]io.Writer{logFile}, extra...)
+	log.SetOutput(levelWriter{io.MultiWriter(outputs...)})
 
-func StartProxy(config *Config) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", config.Listen)
+	config, err := loadConfig(configPath)
 	if err != nil {
-		log.Fatalf("Failed to resolve TCP address: %v", err)
+		log.Fatalf("Error loading config: %v", err)
 	}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		log.Fatalf("Failed to start proxy server: %v", err)
+	if err := validateConfig(config); err != nil {
+		log.Fatal(err)
 	}
-	defer listener.Close()
-
-	log.Printf("Listening on %s", config.Listen)
+	if config.Syslog.Address != "" {
+		syslog, err := newSyslogWriter(config.Syslog)
+		if err != nil {
+			log.Fatalf("Error connecting to syslog: %v", err)
+		}
+		log.SetOutput(levelWriter{io.MultiWriter(append(outputs, syslog)...)})
+	}
+	if config.LogLevel != "" {
+		setLogLevel(config.LogLevel)
+	}
+	return config, closeLog
+}
 
-	var wg sync.WaitGroup
+func StartProxy(config *Config, configPath string) {
 	// Channel to receive OS signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	// Channel to notify the main goroutine to stop accepting new connections
-	stopChan := make(chan struct{})
 
+	stop := make(chan struct{})
 	go func() {
-		for {
-			select {
-			case <-stopChan: // Stop accepting new connections
-				return
-			default:
-				// Set a timeout on Accept to check the stopChan periodically
-				//listener.SetDeadline(time.Now().Add(1 * time.Second))
-				clientConn, err := listener.Accept()
-				if err != nil {
-					continue
-				}
-
-				//log.Printf("Accepted connection from %s", clientConn.RemoteAddr().String())
-				wg.Add(1)
-				go HandleClient(clientConn, config, &wg)
-			}
-		}
+		<-sigChan
+		close(stop)
 	}()
+	runProxy(config, configPath, stop)
+}
 
-	<-sigChan
-	close(stopChan)
-	listener.Close()
-	//wg.Wait()
+// runProxy serves until stop is closed or the server is drained. The
+// configuration is reloaded from configPath on request.
+func runProxy(config *Config, configPath string, stop <-chan struct{}) {
+	server, err := newProxyServer(config)
+	if err != nil {
+		log.Fatalf("Failed to start proxy server: %v", err)
+	}
+	server.configPath = configPath
+	server.serve()
+	sdNotify("READY=1")
+	go server.watchdog()
+
+	select {
+	case <-stop:
+	case <-server.drained:
+		log.Printf("All connections drained")
+	}
+	sdNotify("STOPPING=1")
+	server.stop()
 	log.Println("Proxy server stopped")
 }
 
@@ -223,37 +477,175 @@ func loadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	legacy, err := legacyCoins(file)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		if len(config.Coins) > 0 {
+			return nil, fmt.Errorf("btc_targets and ltc_targets cannot be combined with coins")
+		}
+		config.Coins = legacy
+	}
+	config.indexClients()
+	config.Miner = config.Miner.compile()
+	config.StateDir = configRelative(path, config.StateDir)
 
 	return &config, nil
 }
 
+// validateConfig checks a loaded config before a proxy is started with it.
+func validateConfig(config *Config) error {
+	if len(config.listenAddresses()) == 0 {
+		return fmt.Errorf("No listen address specified in config")
+	}
+	if len(allTargets(config)) == 0 || (len(config.Miner.Auth) == 0 && !config.allChained()) {
+		return fmt.Errorf("No target addresses specified in config or auth is null")
+	}
+	if config.Acceptors < 0 || (config.Acceptors > 1 && !config.ReusePort) {
+		return fmt.Errorf("Invalid acceptors: more than one needs reuse_port")
+	}
+	if config.ReusePort && !reusePortSupported {
+		return fmt.Errorf("Invalid reuse_port: SO_REUSEPORT is not supported on this system")
+	}
+	if err := validateSocketOptions(config); err != nil {
+		return fmt.Errorf("Invalid socket options: %v", err)
+	}
+	if err := validateCoins(config); err != nil {
+		return fmt.Errorf("Invalid coin: %v", err)
+	}
+	if err := validateTargets(config); err != nil {
+		return fmt.Errorf("Invalid target: %v", err)
+	}
+	if err := validateVirtualPools(config); err != nil {
+		return fmt.Errorf("Invalid virtual pool: %v", err)
+	}
+	if err := validateClients(config); err != nil {
+		return fmt.Errorf("Invalid client: %v", err)
+	}
+	if err := validateRoutes(config); err != nil {
+		return fmt.Errorf("Invalid route: %v", err)
+	}
+	if err := validateGeoRoutes(config); err != nil {
+		return fmt.Errorf("Invalid route: %v", err)
+	}
+	if err := validateDifficultyClamps(config); err != nil {
+		return fmt.Errorf("Invalid difficulty: %v", err)
+	}
+	if err := validateClientReconnect(config); err != nil {
+		return fmt.Errorf("Invalid client_reconnect: %v", err)
+	}
+	if err := validatePoolMethods(config); err != nil {
+		return fmt.Errorf("Invalid pool method policy: %v", err)
+	}
+	if err := validateChain(config); err != nil {
+		return fmt.Errorf("Invalid chain: %v", err)
+	}
+	if err := validateMinerAuth(config); err != nil {
+		return fmt.Errorf("Invalid miner_auth: %v", err)
+	}
+	if err := validateMinerModels(config); err != nil {
+		return fmt.Errorf("Invalid miner model: %v", err)
+	}
+	if err := validateMinerAPI(config); err != nil {
+		return fmt.Errorf("Invalid miner_api: %v", err)
+	}
+	if err := validateDiscovery(config); err != nil {
+		return fmt.Errorf("Invalid discovery: %v", err)
+	}
+	if err := validateExpectedHashrate(config); err != nil {
+		return fmt.Errorf("Invalid expected_hashrate: %v", err)
+	}
+	if err := validateProfitSwitch(config); err != nil {
+		return fmt.Errorf("Invalid profit_switch: %v", err)
+	}
+	if err := validateMinerRules(config); err != nil {
+		return fmt.Errorf("Invalid rewrite rule: %v", err)
+	}
+	if err := validateCurtailment(config); err != nil {
+		return fmt.Errorf("Invalid curtailment: %v", err)
+	}
+	if err := validateStalePolicies(config); err != nil {
+		return fmt.Errorf("Invalid stale policy: %v", err)
+	}
+	if err := validateStatsExport(config); err != nil {
+		return fmt.Errorf("Invalid stats export: %v", err)
+	}
+	if err := validateAlerts(config); err != nil {
+		return fmt.Errorf("Invalid alerts: %v", err)
+	}
+	if err := validateWebSocket(config); err != nil {
+		return fmt.Errorf("Invalid websocket listener: %v", err)
+	}
+	if err := validateTLS(config); err != nil {
+		return fmt.Errorf("Invalid TLS: %v", err)
+	}
+	if err := validateSSH(config); err != nil {
+		return fmt.Errorf("Invalid SSH: %v", err)
+	}
+	if err := validateHTTPProxy(config); err != nil {
+		return fmt.Errorf("Invalid http_proxy: %v", err)
+	}
+	if err := validateGetwork(config); err != nil {
+		return fmt.Errorf("Invalid getwork: %v", err)
+	}
+	if err := validateHA(config); err != nil {
+		return fmt.Errorf("Invalid ha: %v", err)
+	}
+	if _, ok := logLevels[config.LogLevel]; !ok && config.LogLevel != "" {
+		return fmt.Errorf("Invalid log level %q", config.LogLevel)
+	}
+	return nil
+}
+
+// Subcommands run instead of the proxy when named as the first argument.
+var commands = map[string]func(args []string) error{
+	"export-state":  exportState,
+	"import-state":  importState,
+	"gen-config":    genConfig,
+	"soak":          soak,
+	"bench":         bench,
+	"simulate-pool": simulatePool,
+	"replay":        replay,
+	"verify":        verify,
+	"service":       service,
+	"ctl":           ctl,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	configPath := flag.String("c", "config.json", "Path to JSON configuration file")
-	logPath := flag.String("l", "", "Path to log configuration file")
+	logPath := flag.String("l", "", "Path to log file (default: stderr)")
+	daemon := flag.Bool("d", false, "Run in the background")
+	pidPath := flag.String("pidfile", "", "Write the process id to this file while running")
 	flag.Parse()
 
-	logFile, err := os.OpenFile(*logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
-	}
-	defer func(logFile *os.File) {
-		err := logFile.Close()
-		if err != nil {
-			log.Printf("Error closing log file: %v", err)
+	if *daemon && os.Getenv(daemonEnv) == "" {
+		if err := daemonize(*logPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start daemon: %v\n", err)
+			os.Exit(1)
 		}
-	}(logFile)
-
-	log.SetOutput(logFile)
-
-	config, err := loadConfig(*configPath)
-	if err != nil {
-		log.Fatalf("Error loading config: %v", err)
+		return
 	}
 
-	if (len(config.BTCTargets) == 0 && len(config.LTCTargets) == 0) || len(config.Miner.Auth) == 0 {
-		log.Fatal("No target addresses specified in config or auth is null")
+	config, closeLog := startup(*configPath, *logPath)
+	defer closeLog()
+	if *pidPath != "" {
+		if err := writePidFile(*pidPath); err != nil {
+			log.Fatalf("Error writing pid file: %v", err)
+		}
+		defer os.Remove(*pidPath)
 	}
 
 	log.Printf("Proxy server start")
-	StartProxy(config)
+	StartProxy(config, *configPath)
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinerAPIConfig polls the cgminer API of connected miners for their
+// temperatures, fans and board hashrates.
+type MinerAPIConfig struct {
+	IntervalSeconds int `json:"interval_seconds"` // 0 disables polling
+	// Port is the API port of the miners; 4028 by default.
+	Port           int `json:"port"`
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+const (
+	defaultMinerAPIPort           = 4028
+	defaultMinerAPITimeoutSeconds = 3
+)
+
+// Largest API response read.
+const maxMinerAPIResponse = 1 << 20
+
+// minerStatus is what the API of a miner reported at the last poll.
+type minerStatus struct {
+	IP     string    `json:"ip"`
+	Worker string    `json:"worker,omitempty"`
+	Polled time.Time `json:"polled"`
+	// Temperatures in °C, fan speeds in RPM and board hashrates in hashes
+	// per second, in the order the miner lists them.
+	Temperatures []float64 `json:"temperatures,omitempty"`
+	Fans         []float64 `json:"fans,omitempty"`
+	Boards       []float64 `json:"boards,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Keys of cgminer, bmminer and btminer replies holding temperatures, fan
+// speeds and board hashrates.
+var (
+	minerTempKey  = regexp.MustCompile(`^(temperature|temp\d+|temp2_\d+|chip temp avg)$`)
+	minerFanKey   = regexp.MustCompile(`^(fan\d+|fan speed in|fan speed out)$`)
+	minerChainKey = regexp.MustCompile(`^chain_rate\d+$`)
+)
+
+type minerAPIPoller struct {
+	mu     sync.RWMutex
+	status map[string]*minerStatus // by IP
+}
+
+var minerAPI = &minerAPIPoller{status: make(map[string]*minerStatus)}
+
+func validateMinerAPI(config *Config) error {
+	c := config.MinerAPI
+	if c.IntervalSeconds < 0 || c.TimeoutSeconds < 0 {
+		return fmt.Errorf("negative interval or timeout")
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	return nil
+}
+
+// run polls the miners of the sessions every interval until stop is closed.
+func (m *minerAPIPoller) run(cfg MinerAPIConfig, stop <-chan struct{}) {
+	port := cfg.Port
+	if port == 0 {
+		port = defaultMinerAPIPort
+	}
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultMinerAPITimeoutSeconds * time.Second
+	}
+
+	ticker := time.NewTicker(time.Duration(cfg.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		workers := make(map[string]string)
+		for _, info := range sessions.snapshot() {
+			if workers[info.ClientIP] == "" {
+				workers[info.ClientIP] = info.Worker
+			}
+		}
+		var wg sync.WaitGroup
+		var resultMu sync.Mutex
+		polled := make(map[string]*minerStatus, len(workers))
+		for ip, worker := range workers {
+			wg.Add(1)
+			go func(ip, worker string) {
+				defer wg.Done()
+				status := pollMiner(ip, port, timeout)
+				status.Worker = worker
+				resultMu.Lock()
+				polled[ip] = status
+				resultMu.Unlock()
+			}(ip, worker)
+		}
+		wg.Wait()
+		// Miners that left are forgotten.
+		m.mu.Lock()
+		m.status = polled
+		m.mu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshot returns the last poll of every connected miner, by IP.
+func (m *minerAPIPoller) snapshot() []minerStatus {
+	m.mu.RLock()
+	list := make([]minerStatus, 0, len(m.status))
+	for _, status := range m.status {
+		list = append(list, *status)
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// pollMiner asks the miner at ip for its devices, stats and summary, which
+// firmwares fill differently: Antminers list their boards only in stats,
+// Whatsminers their fans only in the summary.
+func pollMiner(ip string, port int, timeout time.Duration) *minerStatus {
+	status := &minerStatus{IP: ip, Polled: time.Now()}
+	address := net.JoinHostPort(ip, strconv.Itoa(port))
+	var chains []float64
+	var errs []string
+	for _, command := range []string{"devs", "stats", "summary"} {
+		reply, err := minerAPICommand(address, command, timeout)
+		if err != nil {
+			errs = append(errs, command+": "+err.Error())
+			continue
+		}
+		for _, section := range []string{"DEVS", "STATS", "SUMMARY"} {
+			for _, entry := range reply[section] {
+				keys := make([]string, 0, len(entry))
+				for key := range entry {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					n, ok := apiNumber(entry[key])
+					if !ok || n <= 0 {
+						continue
+					}
+					key = strings.ToLower(key)
+					switch {
+					case minerTempKey.MatchString(key):
+						status.Temperatures = append(status.Temperatures, n)
+					case minerFanKey.MatchString(key):
+						status.Fans = append(status.Fans, n)
+					case minerChainKey.MatchString(key):
+						chains = append(chains, n*1e9)
+					case section == "DEVS" && key == "mhs 5s":
+						status.Boards = append(status.Boards, n*1e6)
+					case section == "DEVS" && key == "ghs 5s":
+						status.Boards = append(status.Boards, n*1e9)
+					}
+				}
+			}
+		}
+	}
+	if len(status.Boards) == 0 {
+		status.Boards = chains
+	}
+	if len(errs) == 3 {
+		status.Error = strings.Join(errs, "; ")
+	}
+	return status
+}
+
+// minerAPICommand sends one command to a cgminer API and returns the
+// sections of its reply.
+func minerAPICommand(address, command string, timeout time.Duration) (map[string][]map[string]interface{}, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := fmt.Fprintf(conn, `{"command":%q}`, command); err != nil {
+		return nil, err
+	}
+	// The miner closes the connection after its reply, which cgminer ends
+	// with a NUL byte.
+	data, err := io.ReadAll(io.LimitReader(conn, maxMinerAPIResponse))
+	if err != nil && len(data) == 0 {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\x00\r\n ")
+	var reply map[string]json.RawMessage
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("invalid reply: %v", err)
+	}
+	sections := make(map[string][]map[string]interface{})
+	for name, raw := range reply {
+		var entries []map[string]interface{}
+		if json.Unmarshal(raw, &entries) == nil {
+			sections[strings.ToUpper(name)] = entries
+		}
+	}
+	return sections, nil
+}
+
+// apiNumber reads a value that firmwares send as a number or a string.
+func apiNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// writeMetrics writes the last poll of the miners in the Prometheus text
+// format, labelled with their workers.
+func (m *minerAPIPoller) writeMetrics(w io.Writer) {
+	list := m.snapshot()
+	if len(list) == 0 {
+		return
+	}
+	series := []struct {
+		name   string
+		label  string
+		values func(minerStatus) []float64
+	}{
+		{"stratum_proxy_miner_temperature_celsius", "sensor", func(s minerStatus) []float64 { return s.Temperatures }},
+		{"stratum_proxy_miner_fan_rpm", "fan", func(s minerStatus) []float64 { return s.Fans }},
+		{"stratum_proxy_miner_board_hashrate", "board", func(s minerStatus) []float64 { return s.Boards }},
+	}
+	for _, metric := range series {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", metric.name)
+		for _, status := range list {
+			for i, v := range metric.values(status) {
+				fmt.Fprintf(w, "%s{worker=%q,ip=%q,%s=\"%d\"} %g\n", metric.name, status.Worker, status.IP, metric.label, i, v)
+			}
+		}
+	}
+}
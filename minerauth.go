@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinerAuthConfig checks the credentials miners log in with against a
+// local table before their shares go to the pool, so devices that merely
+// find the port cannot mine on the operator's account.
+type MinerAuthConfig struct {
+	// File holds "username password" lines; blank lines and lines
+	// starting with # are skipped. A username may be a pattern as in
+	// path.Match, such as "farm1.*". Changes are picked up while running.
+	// "" disables the check.
+	File string `json:"file"`
+	// By is "password" (default) to require the password of a listed
+	// username, or "username" to only require a listed username, for
+	// firmware that cannot set a password.
+	By string `json:"by"`
+}
+
+// How often the credentials file is checked for changes.
+const credentialsCheckInterval = 5 * time.Second
+
+// credential is one line of the credentials file.
+type credential struct {
+	username string // a path.Match pattern
+	password string
+}
+
+// credentialTable holds the credentials file named by miner_auth.
+type credentialTable struct {
+	mu          sync.RWMutex
+	path        string
+	modTime     time.Time
+	credentials []credential
+}
+
+var minerCredentials = &credentialTable{}
+
+func validateMinerAuth(config *Config) error {
+	switch config.MinerAuth.By {
+	case "", "password", "username":
+	default:
+		return fmt.Errorf("unknown by %q", config.MinerAuth.By)
+	}
+	return nil
+}
+
+// readCredentials reads a credentials file. Under "username" the password
+// may be left out.
+func readCredentials(file string) ([]credential, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var credentials []credential
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: want a username and a password", file, n)
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid username pattern %q", file, n, fields[0])
+		}
+		c := credential{username: fields[0]}
+		if len(fields) == 2 {
+			c.password = fields[1]
+		}
+		credentials = append(credentials, c)
+	}
+	return credentials, scanner.Err()
+}
+
+// load reads file if it is not the file loaded already or has changed
+// since. On error the credentials loaded before are kept.
+func (t *credentialTable) load(file string) error {
+	if file == "" {
+		t.mu.Lock()
+		t.path, t.modTime, t.credentials = "", time.Time{}, nil
+		t.mu.Unlock()
+		return nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	t.mu.RLock()
+	unchanged := file == t.path && info.ModTime().Equal(t.modTime)
+	t.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	credentials, err := readCredentials(file)
+	t.mu.Lock()
+	// A broken file is reported once, not on every check.
+	t.path, t.modTime = file, info.ModTime()
+	if err == nil {
+		t.credentials = credentials
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d miner credentials from %s", len(credentials), file)
+	return nil
+}
+
+// watch reloads the file named by the current configuration when it
+// changes, until stop is closed.
+func (t *credentialTable) watch(file func() string, stop <-chan struct{}) {
+	ticker := time.NewTicker(credentialsCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := t.load(file()); err != nil {
+				log.Printf("Error reloading miner credentials: %v", err)
+			}
+		}
+	}
+}
+
+// check reports whether username may log in with password. The first line
+// whose pattern matches the username decides.
+func (t *credentialTable) check(username, password string, byUsername bool) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, c := range t.credentials {
+		if ok, _ := path.Match(c.username, username); !ok {
+			continue
+		}
+		return byUsername || subtle.ConstantTimeCompare([]byte(c.password), []byte(password)) == 1
+	}
+	return false
+}
+
+func unauthorizedReply(id interface{}) string {
+	return fmt.Sprintf(`{"id":%s,"result":null,"error":[24,"Unauthorized worker",null]}`, jsonID(id))
+}
+
+// checkLogin applies miner_auth to a message of the miner. Logins with
+// credentials not in the table, and shares sent before a login passed,
+// are answered by the proxy. It reports whether msg may go on to the pool
+// and whether the session should continue.
+func (s *session) checkLogin(msg *stratumMessage) (pass bool, ok bool) {
+	if s.config.MinerAuth.File == "" || s.loggedIn {
+		return true, true
+	}
+	if submitMethods[msg.Method] {
+		if msg.ID == nil {
+			return false, true
+		}
+		return false, s.writeClient(unauthorizedReply(msg.ID)) == nil
+	}
+	if !loginMethods[msg.Method] {
+		return true, true
+	}
+	var username, password string
+	if len(msg.Params) > 0 {
+		json.Unmarshal(msg.Params[0], &username)
+	}
+	if len(msg.Params) > 1 {
+		json.Unmarshal(msg.Params[1], &password)
+	}
+	if minerCredentials.check(username, password, s.config.MinerAuth.By == "username") {
+		s.loggedIn = true
+		return true, true
+	}
+	log.Printf("Refused login of %q from %s: unknown username or wrong password", username, s.clientIP)
+	if bans.invalid(s.clientIP) {
+		s.ending("banned for failed logins")
+		s.up.Load().close()
+		return false, false
+	}
+	if msg.ID == nil {
+		return false, true
+	}
+	return false, s.writeClient(unauthorizedReply(msg.ID)) == nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinerModelConfig overrides settings for the miners of a model, as
+// detected from the user agent they subscribe with.
+type MinerModelConfig struct {
+	// Model matches the detected model, such as "Antminer S19" or
+	// "cgminer/4.x", or the user agent (case-insensitive substring).
+	Model string `json:"model"`
+	// RequestTimeoutSeconds replaces limits.request_timeout_seconds.
+	RequestTimeoutSeconds int `json:"request_timeout_seconds,omitempty"`
+	// SuggestDifficulty is suggested to the pool with
+	// mining.suggest_difficulty after the miner subscribes.
+	SuggestDifficulty float64 `json:"suggest_difficulty,omitempty"`
+	// Difficulty replaces the difficulty bounds of the config; those of a
+	// route still apply to its users.
+	Difficulty *DifficultyClamp `json:"difficulty,omitempty"`
+}
+
+// minerFamilies maps the names firmwares give themselves in user agents to
+// the model family they are reported under.
+var minerFamilies = []struct{ token, family string }{
+	{"antminer", "Antminer"},
+	{"bmminer", "Antminer"},
+	{"whatsminer", "Whatsminer"},
+	{"btminer", "Whatsminer"},
+	{"avalon", "Avalon"},
+	{"bosminer", "Braiins OS"},
+	{"braiins", "Braiins OS"},
+	{"luxminer", "LuxOS"},
+	{"vnish", "Vnish"},
+	{"bitaxe", "Bitaxe"},
+	{"nerdminer", "NerdMiner"},
+	{"bfgminer", "bfgminer"},
+	{"sgminer", "sgminer"},
+	{"cgminer", "cgminer"},
+	{"nicehash", "NiceHash"},
+	{"xmrig", "XMRig"},
+}
+
+// minerModel returns the model a user agent such as "cgminer/4.11.1" or
+// "Antminer S19 Pro/Thu Jul 1" names: "cgminer/4.x", "Antminer S19 Pro".
+// Unknown firmwares are reported by the name before the version.
+func minerModel(agent string) string {
+	agent = strings.TrimSpace(agent)
+	if agent == "" {
+		return ""
+	}
+	name, version, _ := strings.Cut(agent, "/")
+	name = strings.TrimSpace(name)
+	lower := strings.ToLower(name)
+	family := name
+	for _, f := range minerFamilies {
+		if strings.Contains(lower, f.token) {
+			family = f.family
+			break
+		}
+	}
+	// A name with a model designation, such as "Antminer S19j Pro", says
+	// more than any version.
+	if _, designation, ok := strings.Cut(name, " "); ok && strings.EqualFold(family, strings.Fields(name)[0]) {
+		return family + " " + strings.TrimSpace(designation)
+	}
+	major, _, _ := strings.Cut(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "v"), ".")
+	if _, err := strconv.Atoi(major); err == nil {
+		return family + "/" + major + ".x"
+	}
+	return family
+}
+
+func validateMinerModels(config *Config) error {
+	for _, m := range config.MinerModels {
+		if m.Model == "" {
+			return fmt.Errorf("entry without a model")
+		}
+		if m.SuggestDifficulty < 0 {
+			return fmt.Errorf("%s: suggest_difficulty below 0", m.Model)
+		}
+		if err := validateDifficultyClamp(m.Difficulty); err != nil {
+			return fmt.Errorf("%s: %v", m.Model, err)
+		}
+	}
+	return nil
+}
+
+// matchesAgent reports whether pattern, as in miner_models and shims, matches
+// a miner with the user agent or its model.
+func matchesAgent(pattern, agent string) bool {
+	if agent == "" || pattern == "" {
+		return false
+	}
+	pattern = strings.ToLower(pattern)
+	return strings.Contains(strings.ToLower(agent), pattern) || strings.Contains(strings.ToLower(minerModel(agent)), pattern)
+}
+
+// minerModelConfig returns the overrides for a user agent, or nil.
+func (c *Config) minerModelConfig(agent string) *MinerModelConfig {
+	for i := range c.MinerModels {
+		if matchesAgent(c.MinerModels[i].Model, agent) {
+			return &c.MinerModels[i]
+		}
+	}
+	return nil
+}
+
+// noteAgent records the user agent the miner subscribed with and applies
+// the overrides for its model. Another miner may have connected from the
+// same IP before, so only the session's own subscribe is trusted. Called
+// from the client goroutine.
+func (s *session) noteAgent(agent string) {
+	if agent == "" {
+		return
+	}
+	s.agent.Store(agent)
+	model := minerModel(agent)
+	s.model.Store(model)
+	if s.worker != "" {
+		stats.setModel(s.worker, model)
+	}
+	s.modelConfig.Store(s.config.minerModelConfig(agent))
+	// The bounds of a route, once applied, win over those of the model.
+	if s.minerConfig.Load() == s.config {
+		s.clamp.Store(s.baseClamp())
+	}
+}
+
+// baseClamp returns the difficulty bounds of the miner without a route:
+// those of its model, else of the config.
+func (s *session) baseClamp() *DifficultyClamp {
+	if m := s.modelConfig.Load(); m != nil && m.Difficulty != nil {
+		return m.Difficulty
+	}
+	return &s.config.Difficulty
+}
+
+// userAgent returns the user agent the miner subscribed with, or "".
+func (s *session) userAgent() string {
+	agent, _ := s.agent.Load().(string)
+	return agent
+}
+
+// minerModelName returns the detected model of the miner, or "".
+func (s *session) minerModelName() string {
+	model, _ := s.model.Load().(string)
+	return model
+}
+
+// requestTimeout is how long the pool gets to answer a request of the
+// miner, or 0 to wait for ever.
+func (s *session) requestTimeout() time.Duration {
+	limits := s.config.Limits
+	if m := s.modelConfig.Load(); m != nil && m.RequestTimeoutSeconds != 0 {
+		limits.RequestTimeoutSeconds = m.RequestTimeoutSeconds
+	}
+	if limits.RequestTimeoutSeconds < 0 {
+		return 0
+	}
+	return limits.requestTimeout()
+}
+
+// suggestDifficultyLine returns the mining.suggest_difficulty to send the
+// pool for the miner's model, or "".
+func (s *session) suggestDifficultyLine() string {
+	m := s.modelConfig.Load()
+	if m == nil || m.SuggestDifficulty <= 0 {
+		return ""
+	}
+	params, _ := json.Marshal([]float64{m.SuggestDifficulty})
+	return fmt.Sprintf(`{"id":null,"method":"mining.suggest_difficulty","params":%s}`, params)
+}
+
+// suggestDifficulty sends the pool the difficulty for the miner's model.
+func (s *session) suggestDifficulty() {
+	if line := s.suggestDifficultyLine(); line != "" {
+		if err := s.writeUpstream(line); err != nil {
+			log.Printf("Error suggesting a difficulty for %s: %v", s.clientIP, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Chained instances of the proxy, such as a site proxy forwarding to one in
+// a datacenter, can talk stratum over mutual TLS: the upstream one listens
+// on a "tls://host:port" address and the downstream one dials it through a
+// target with tls options. Either side may pin the certificates of the
+// other by their SHA-256 fingerprint, as printed by
+// "openssl x509 -noout -fingerprint -sha256".
+
+// TLSConfig applies to "tls://" listen addresses, which take stratum over
+// TLS.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM certificate and key of the
+	// listeners.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile, when set, requires a client certificate signed by one
+	// of its PEM CAs. The common name of the certificate takes the place
+	// of the IP in worker names.
+	ClientCAFile string `json:"client_ca_file"`
+	// ClientPins, when set, requires a client certificate with one of
+	// these fingerprints, signed by ClientCAFile if that is set too.
+	ClientPins []string `json:"client_pins"`
+}
+
+// TargetTLS makes the proxy connect to a target over TLS.
+type TargetTLS struct {
+	// CertFile and KeyFile are the PEM client certificate and key shown to
+	// the target, for targets that require one.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// CAFile holds the PEM CAs the target's certificate is verified
+	// against; the system's when "". Without CAFile but with Pins only
+	// the pins are checked, for self-signed certificates.
+	CAFile string `json:"ca_file,omitempty"`
+	// ServerName is the name verified in the target's certificate, the
+	// host of the address when "".
+	ServerName string `json:"server_name,omitempty"`
+	// Pins are the fingerprints of the certificates the target may show.
+	Pins []string `json:"pins,omitempty"`
+}
+
+func isTLSAddress(address string) bool {
+	return strings.HasPrefix(address, "tls://")
+}
+
+func validateTLS(config *Config) error {
+	for _, address := range config.listenAddresses() {
+		if !isTLSAddress(address) {
+			continue
+		}
+		if config.TLS.CertFile == "" || config.TLS.KeyFile == "" {
+			return fmt.Errorf("%s needs cert_file and key_file", address)
+		}
+	}
+	if err := validatePins(config.TLS.ClientPins); err != nil {
+		return err
+	}
+	for _, t := range allTargets(config) {
+		if t.TLS == nil {
+			continue
+		}
+		if (t.TLS.CertFile == "") != (t.TLS.KeyFile == "") {
+			return fmt.Errorf("%s: cert_file and key_file go together", t.Address)
+		}
+		if err := validatePins(t.TLS.Pins); err != nil {
+			return fmt.Errorf("%s: %v", t.Address, err)
+		}
+	}
+	return nil
+}
+
+func validatePins(pins []string) error {
+	for _, pin := range pins {
+		if len(normalizePin(pin)) != 2*sha256.Size {
+			return fmt.Errorf("invalid pin %q", pin)
+		}
+	}
+	return nil
+}
+
+// normalizePin returns a fingerprint as lower case hex without colons, or
+// "" when it is not hex.
+func normalizePin(pin string) string {
+	pin = strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+	if _, err := hex.DecodeString(pin); err != nil {
+		return ""
+	}
+	return pin
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPins returns a tls.Config.VerifyConnection accepting only peers
+// whose certificate has one of pins.
+func checkPins(pins []string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("no certificate to check the pins against")
+		}
+		fingerprint := certFingerprint(state.PeerCertificates[0])
+		for _, pin := range pins {
+			if normalizePin(pin) == fingerprint {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate %s is not pinned", fingerprint)
+	}
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig is the TLS configuration of a listener, requiring client
+// certificates when clientCAFile or clientPins are set.
+func serverTLSConfig(certFile, keyFile, clientCAFile string, clientPins []string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if len(clientPins) > 0 {
+		config.ClientAuth = tls.RequireAnyClientCert
+	}
+	if len(clientPins) > 0 {
+		config.VerifyConnection = checkPins(clientPins)
+	}
+	return config, nil
+}
+
+// listenTLS listens on a tls:// address.
+func listenTLS(address string, cfg TLSConfig, options *SocketOptions) (net.Listener, error) {
+	tlsConfig, err := serverTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile, cfg.ClientPins)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := listen(strings.TrimPrefix(address, "tls://"))
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(options.listener(raw), tlsConfig), nil
+}
+
+// clientConfig is the TLS configuration to dial the target at address
+// with.
+func (t *TargetTLS) clientConfig(address string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.ServerName}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if t.CAFile != "" {
+		pool, err := loadCertPool(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	} else if len(t.Pins) > 0 {
+		// The pins stand in for the chain.
+		config.InsecureSkipVerify = true
+	}
+	if len(t.Pins) > 0 {
+		config.VerifyConnection = checkPins(t.Pins)
+	}
+	return config, nil
+}
+
+// wrap runs the TLS handshake with the target on conn, closing it when that
+// fails.
+func (t *TargetTLS) wrap(conn net.Conn, address string, timeout time.Duration) (net.Conn, error) {
+	config, err := t.clientConfig(address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
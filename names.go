@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the worker names file is checked for changes.
+const workerNamesCheckInterval = 5 * time.Second
+
+// workerNameMap maps client IPs and MAC addresses to the names used for
+// them in worker names, read from the file named by worker_names and reread
+// when it changes.
+type workerNameMap struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	names   map[string]string
+}
+
+var workerNames = &workerNameMap{}
+
+// readWorkerNames reads a file of "ip name" and "mac name" lines; blank
+// lines and lines starting with # are skipped.
+func readWorkerNames(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want an address and a name", path, n)
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			names[ip.String()] = fields[1]
+		} else if mac, err := net.ParseMAC(fields[0]); err == nil {
+			names[mac.String()] = fields[1]
+		} else {
+			return nil, fmt.Errorf("%s:%d: %q is neither an IP nor a MAC address", path, n, fields[0])
+		}
+	}
+	return names, scanner.Err()
+}
+
+// load reads path if it is not the file loaded already or has changed
+// since. On error the names loaded before are kept.
+func (m *workerNameMap) load(path string) error {
+	if path == "" {
+		m.mu.Lock()
+		m.path, m.modTime, m.names = "", time.Time{}, nil
+		m.mu.Unlock()
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	m.mu.RLock()
+	unchanged := path == m.path && info.ModTime().Equal(m.modTime)
+	m.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	names, err := readWorkerNames(path)
+	m.mu.Lock()
+	// A broken file is reported once, not on every check.
+	m.path, m.modTime = path, info.ModTime()
+	if err == nil {
+		m.names = names
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d worker names from %s", len(names), path)
+	return nil
+}
+
+// watch reloads the file named by the current configuration when it
+// changes, until stop is closed.
+func (m *workerNameMap) watch(path func() string, stop <-chan struct{}) {
+	ticker := time.NewTicker(workerNamesCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := m.load(path()); err != nil {
+				log.Printf("Error reloading worker names: %v", err)
+			}
+		}
+	}
+}
+
+// lookup returns the name of a client IP or MAC address, or "" when it has
+// none.
+func (m *workerNameMap) lookup(ip string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.names[ip]
+}
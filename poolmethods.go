@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// PoolMethodPolicy decides what happens to one method pools send to miners,
+// such as client.reconnect, client.show_message or client.get_version, so
+// operators control what the firmware is exposed to.
+type PoolMethodPolicy struct {
+	Method string `json:"method"`
+	// Action is "forward" (default), "drop" or "rewrite". A dropped request
+	// is answered to the pool with an error. A rewritten message reaches the
+	// miner with Params instead of its own; a rewritten request is answered
+	// to the pool with Result by the proxy when that is set.
+	Action string          `json:"action"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	// Log logs every message the policy applies to.
+	Log bool `json:"log,omitempty"`
+}
+
+// trackedPoolMethods are kept by the proxy for failover and cannot be
+// changed by a policy.
+var trackedPoolMethods = map[string]bool{
+	"mining.notify":         true,
+	"mining.set_difficulty": true,
+	"mining.set_extranonce": true,
+}
+
+func validatePoolMethods(config *Config) error {
+	seen := make(map[string]bool)
+	for _, p := range config.PoolMethods {
+		if p.Method == "" {
+			return fmt.Errorf("policy without a method")
+		}
+		if trackedPoolMethods[p.Method] {
+			return fmt.Errorf("%s cannot be filtered", p.Method)
+		}
+		if seen[p.Method] {
+			return fmt.Errorf("%s listed twice", p.Method)
+		}
+		seen[p.Method] = true
+		switch p.Action {
+		case "", "forward", "drop":
+		case "rewrite":
+			var params []json.RawMessage
+			if len(p.Params) > 0 && json.Unmarshal(p.Params, &params) != nil {
+				return fmt.Errorf("%s: params must be a list", p.Method)
+			}
+			if len(p.Params) == 0 && len(p.Result) == 0 {
+				return fmt.Errorf("%s: rewrite needs params or result", p.Method)
+			}
+		default:
+			return fmt.Errorf("%s: unknown action %q", p.Method, p.Action)
+		}
+	}
+	return nil
+}
+
+func (c *Config) poolMethodPolicy(method string) *PoolMethodPolicy {
+	for i := range c.PoolMethods {
+		if c.PoolMethods[i].Method == method {
+			return &c.PoolMethods[i]
+		}
+	}
+	return nil
+}
+
+// applyPoolMethod applies the policy for its method to a message from up.
+// It returns the line to pass on to the miner and false when there is
+// none.
+func (s *session) applyPoolMethod(up *upstream, line string, msg *stratumResponse) (string, bool) {
+	policy := s.config.poolMethodPolicy(msg.Method)
+	if policy == nil {
+		return line, true
+	}
+	request := msg.ID != nil
+	switch policy.Action {
+	case "drop":
+		if policy.Log {
+			log.Printf("Dropped %s from %s to %s", msg.Method, up.target.Address, s.clientIP)
+		}
+		if request {
+			up.write(fmt.Sprintf(`{"id":%s,"result":null,"error":[20,"Method not supported",null]}`, jsonID(msg.ID)))
+		}
+		return "", false
+	case "rewrite":
+		if request && len(policy.Result) > 0 {
+			if policy.Log {
+				log.Printf("Answered %s from %s for %s", msg.Method, up.target.Address, s.clientIP)
+			}
+			answer, _ := json.Marshal(map[string]interface{}{"id": msg.ID, "result": policy.Result, "error": nil})
+			up.write(string(answer))
+			return "", false
+		}
+		if len(policy.Params) > 0 {
+			if policy.Log {
+				log.Printf("Rewrote %s from %s to %s", msg.Method, up.target.Address, s.clientIP)
+			}
+			rewritten, _ := json.Marshal(map[string]interface{}{"id": msg.ID, "method": msg.Method, "params": policy.Params})
+			return string(rewritten), true
+		}
+	}
+	if policy.Log {
+		log.Printf("Passing on %s from %s to %s: %s", msg.Method, up.target.Address, s.clientIP, line)
+	}
+	return line, true
+}
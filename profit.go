@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProfitSwitchConfig sends the miners of several coins to whichever of them
+// a profitability API rates best, such as WhatToMine.
+type ProfitSwitchConfig struct {
+	// URL answers with the profitability of the coins: a WhatToMine style
+	// {"coins": {"Litecoin": {"tag": "LTC", "profitability": 120}}}, or an
+	// object of numbers such as {"LTC": 1.2, "DOGE": 1.1}.
+	URL             string `json:"url"`
+	IntervalMinutes int    `json:"interval_minutes"` // 0 disables switching
+	// ThresholdPercent is how much more profitable another coin must be
+	// than the active one to switch to it; 5 by default.
+	ThresholdPercent float64 `json:"threshold_percent"`
+	// Coins are switched between; they must share an algorithm.
+	Coins []ProfitCoin `json:"coins"`
+}
+
+// ProfitCoin is a coin profile, as in coins, and the name or tag the API
+// rates it under; the coin name by default.
+type ProfitCoin struct {
+	Coin string `json:"coin"`
+	Key  string `json:"key,omitempty"`
+}
+
+const (
+	defaultProfitThresholdPercent = 5
+	profitRequestTimeout          = 30 * time.Second
+)
+
+type profitSwitcher struct {
+	mu     sync.Mutex
+	active string
+	scores map[string]float64 // by coin
+	client *http.Client
+}
+
+var profit = &profitSwitcher{client: &http.Client{Timeout: profitRequestTimeout}}
+
+func validateProfitSwitch(config *Config) error {
+	p := config.ProfitSwitch
+	if p.IntervalMinutes < 0 || p.ThresholdPercent < 0 {
+		return fmt.Errorf("negative interval or threshold")
+	}
+	if p.IntervalMinutes == 0 {
+		return nil
+	}
+	if p.URL == "" {
+		return fmt.Errorf("no url to poll")
+	}
+	if len(p.Coins) < 2 {
+		return fmt.Errorf("needs at least two coins to switch between")
+	}
+	var algorithm string
+	for i, c := range p.Coins {
+		coin := config.coin(c.Coin)
+		if coin == nil {
+			return fmt.Errorf("coin %s is not configured", c.Coin)
+		}
+		if i == 0 {
+			algorithm = coin.Algorithm
+		} else if coin.Algorithm != algorithm {
+			return fmt.Errorf("coin %s does not use the algorithm of %s", c.Coin, p.Coins[0].Coin)
+		}
+	}
+	return nil
+}
+
+// switched reports whether miners of coin follow the profit switch.
+func (p ProfitSwitchConfig) switched(coin string) bool {
+	if p.IntervalMinutes == 0 {
+		return false
+	}
+	for _, c := range p.Coins {
+		if c.Coin == coin {
+			return true
+		}
+	}
+	return false
+}
+
+// coinFor returns the coin a miner detected as mining coin is sent to: the
+// most profitable one when it follows the switch, else coin.
+func (p *profitSwitcher) coinFor(config *Config, coin string) string {
+	if !config.ProfitSwitch.switched(coin) {
+		return coin
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active == "" {
+		return coin
+	}
+	return p.active
+}
+
+// run polls the API at once and then every interval, until stop is closed.
+func (p *profitSwitcher) run(config *Config, stop <-chan struct{}) {
+	cfg := config.ProfitSwitch
+	ticker := time.NewTicker(time.Duration(cfg.IntervalMinutes) * time.Minute)
+	defer ticker.Stop()
+	for {
+		scores, err := p.fetch(cfg)
+		if err != nil {
+			log.Printf("Profitability from %s: %v", cfg.URL, err)
+		} else {
+			p.update(cfg, scores)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch returns the profitability of the configured coins the API rates.
+func (p *profitSwitcher) fetch(cfg ProfitSwitchConfig) (map[string]float64, error) {
+	resp, err := p.client.Get(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var reply map[string]json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&reply); err != nil {
+		return nil, err
+	}
+	rates := make(map[string]float64)
+	var coins map[string]struct {
+		Tag           string      `json:"tag"`
+		Profitability json.Number `json:"profitability"`
+	}
+	if raw, ok := reply["coins"]; ok && json.Unmarshal(raw, &coins) == nil {
+		for name, coin := range coins {
+			if rate, err := coin.Profitability.Float64(); err == nil {
+				rates[strings.ToLower(name)] = rate
+				if coin.Tag != "" {
+					rates[strings.ToLower(coin.Tag)] = rate
+				}
+			}
+		}
+	} else {
+		for key, raw := range reply {
+			// Numbers may come quoted, as WhatToMine does for revenues.
+			text := strings.Trim(string(raw), `"`)
+			if rate, err := strconv.ParseFloat(text, 64); err == nil {
+				rates[strings.ToLower(key)] = rate
+			}
+		}
+	}
+
+	scores := make(map[string]float64)
+	for _, c := range cfg.Coins {
+		key := c.Key
+		if key == "" {
+			key = c.Coin
+		}
+		if rate, ok := rates[strings.ToLower(key)]; ok {
+			scores[c.Coin] = rate
+		}
+	}
+	if len(scores) == 0 {
+		return nil, fmt.Errorf("none of the coins is rated")
+	}
+	return scores, nil
+}
+
+// update records scores and switches to the best coin when it beats the
+// active one by more than the threshold. Miners on other coins are
+// disconnected, to reconnect to the new one.
+func (p *profitSwitcher) update(cfg ProfitSwitchConfig, scores map[string]float64) {
+	threshold := cfg.ThresholdPercent
+	if threshold == 0 {
+		threshold = defaultProfitThresholdPercent
+	}
+	var best string
+	for _, c := range cfg.Coins {
+		if score, ok := scores[c.Coin]; ok && (best == "" || score > scores[best]) {
+			best = c.Coin
+		}
+	}
+
+	p.mu.Lock()
+	p.scores = scores
+	previous := p.active
+	current, rated := scores[previous]
+	switch {
+	case previous == "":
+		p.active = best
+	case best == previous:
+	case !rated || scores[best] > current*(1+threshold/100):
+		p.active = best
+	}
+	active := p.active
+	p.mu.Unlock()
+
+	switch {
+	case active == previous:
+		return
+	case previous == "":
+		log.Printf("Profit switching starts on %s", active)
+	default:
+		log.Printf("Profit switching from %s (%g) to %s (%g)", previous, current, active, scores[active])
+	}
+	for _, s := range sessions.all() {
+		if s.profitSwitched && s.coin != active {
+			s.ending("profit switch")
+			s.clientConn.Close()
+			s.up.Load().close()
+		}
+	}
+}
+
+// writeMetrics writes the profitability of the coins and the active one in
+// the Prometheus text format.
+func (p *profitSwitcher) writeMetrics(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.scores) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_coin_profitability gauge\n")
+	for coin, score := range p.scores {
+		fmt.Fprintf(w, "stratum_proxy_coin_profitability{coin=%q} %g\n", coin, score)
+	}
+	fmt.Fprintf(w, "# TYPE stratum_proxy_profit_active_coin gauge\n")
+	fmt.Fprintf(w, "stratum_proxy_profit_active_coin{coin=%q} 1\n", p.active)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptThrottle is a token bucket that paces the accept loops. Connections
+// above the rate wait in the kernel backlog instead of being dropped.
+type acceptThrottle struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newAcceptThrottle(rate, burst int) *acceptThrottle {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = rate
+	}
+	return &acceptThrottle{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (t *acceptThrottle) wait() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+	if t.tokens < 1 {
+		time.Sleep(time.Duration((1 - t.tokens) / t.rate * float64(time.Second)))
+		t.tokens = 1
+		t.last = time.Now()
+	}
+	t.tokens--
+}
+
+type backoffState struct {
+	last  time.Time
+	next  time.Time
+	delay time.Duration
+}
+
+// reconnectBackoff refuses clients that reconnect faster than their current
+// backoff allows. Each quick reconnect it lets through doubles the delay up
+// to max; refused ones leave it as it is, so a client retrying on a fixed
+// interval still gets through. An IP that stays away for twice the max
+// delay starts over.
+type reconnectBackoff struct {
+	mu      sync.Mutex
+	initial time.Duration
+	max     time.Duration
+	peers   map[string]*backoffState
+	calls   int
+}
+
+func newReconnectBackoff(initialMs, maxMs int) *reconnectBackoff {
+	if initialMs <= 0 {
+		return nil
+	}
+	if maxMs < initialMs {
+		maxMs = initialMs
+	}
+	return &reconnectBackoff{
+		initial: time.Duration(initialMs) * time.Millisecond,
+		max:     time.Duration(maxMs) * time.Millisecond,
+		peers:   make(map[string]*backoffState),
+	}
+}
+
+func (b *reconnectBackoff) allow(ip string) bool {
+	if b == nil {
+		return true
+	}
+	return b.allowAt(ip, time.Now())
+}
+
+func (b *reconnectBackoff) allowAt(ip string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls++
+	if b.calls%1024 == 0 {
+		b.prune(now)
+	}
+
+	st, ok := b.peers[ip]
+	if !ok {
+		b.peers[ip] = &backoffState{last: now, next: now}
+		return true
+	}
+	if now.Before(st.next) {
+		return false
+	}
+	if now.Sub(st.last) > 2*b.max {
+		st.delay = 0
+	} else {
+		st.delay = b.grow(st.delay)
+	}
+	st.last = now
+	st.next = now.Add(st.delay)
+	return true
+}
+
+func (b *reconnectBackoff) grow(d time.Duration) time.Duration {
+	if d == 0 {
+		return b.initial
+	}
+	d *= 2
+	if d > b.max {
+		d = b.max
+	}
+	return d
+}
+
+func (b *reconnectBackoff) prune(now time.Time) {
+	for ip, st := range b.peers {
+		if now.Sub(st.last) > 2*b.max && now.After(st.next) {
+			delete(b.peers, ip)
+		}
+	}
+}
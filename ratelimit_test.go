@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A miner retrying every 5s while the backoff grows to 60s must still get
+// through, at least once per max delay and retry interval.
+func TestReconnectBackoffFixedInterval(t *testing.T) {
+	b := newReconnectBackoff(1000, 60000)
+	start := time.Now()
+	lastAllowed := start
+	for now := start; now.Before(start.Add(10 * time.Minute)); now = now.Add(5 * time.Second) {
+		if b.allowAt("192.0.2.1", now) {
+			lastAllowed = now
+			continue
+		}
+		if now.Sub(lastAllowed) > b.max+5*time.Second {
+			t.Fatalf("refused for %v since the last connection", now.Sub(lastAllowed))
+		}
+	}
+}
+
+// Refused attempts must not push the next allowed one further out.
+func TestReconnectBackoffRefusalKeepsDelay(t *testing.T) {
+	b := newReconnectBackoff(1000, 60000)
+	now := time.Now()
+	b.allowAt("192.0.2.1", now)
+	if !b.allowAt("192.0.2.1", now.Add(100*time.Millisecond)) {
+		t.Fatal("second connection refused before any backoff")
+	}
+	// The delay is now 1s.
+	for i := 0; i < 5; i++ {
+		if b.allowAt("192.0.2.1", now.Add(200*time.Millisecond)) {
+			t.Fatal("connection inside the backoff allowed")
+		}
+	}
+	if !b.allowAt("192.0.2.1", now.Add(1100*time.Millisecond)) {
+		t.Fatal("connection after the backoff refused")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const redisTimeout = 2 * time.Second
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisClient speaks just enough RESP for cluster mode over a single
+// connection, redialed after errors.
+type redisClient struct {
+	address  string
+	password string
+	db       int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisClient(address, password string, db int) *redisClient {
+	return &redisClient{address: address, password: password, db: db}
+}
+
+func (c *redisClient) dial() error {
+	conn, err := net.DialTimeout("tcp", c.address, redisTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(args); err != nil {
+			c.closeConn()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) closeConn() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.reader = nil, nil
+	}
+}
+
+// do runs a command and returns its reply: a string, an int64, nil, or a
+// []interface{} of those. Error replies are returned as redisError.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.closeConn()
+	}
+	return reply, err
+}
+
+// pipeline runs commands in one write and returns their replies in order.
+// Error replies are kept as redisError elements, as inside arrays.
+func (c *redisClient) pipeline(commands [][]string) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var buf []byte
+	for _, args := range commands {
+		buf = appendCommand(buf, args)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		c.closeConn()
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		reply, err := c.readReply()
+		if e, ok := err.(redisError); ok {
+			replies[i] = e
+			continue
+		}
+		if err != nil {
+			c.closeConn()
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := c.conn.Write(appendCommand(nil, args)); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func appendCommand(buf []byte, args []string) []byte {
+	buf = fmt.Appendf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return buf
+}
+
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	kind, text := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return text, nil
+	case '-':
+		return nil, redisError(text)
+	case ':':
+		return strconv.ParseInt(text, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			// Errors inside arrays are kept as elements.
+			if list[i], err = c.readReply(); err != nil {
+				if e, ok := err.(redisError); ok {
+					list[i] = e
+					continue
+				}
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("invalid reply %q", line)
+}
+
+func (c *redisClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeConn()
+}
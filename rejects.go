@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RejectSwitchConfig moves traffic off a pool whose share reject ratio over
+// the last WindowShares shares of all miners climbs above Threshold.
+type RejectSwitchConfig struct {
+	Threshold    float64 `json:"threshold"` // e.g. 0.2; 0 disables
+	WindowShares int     `json:"window_shares"`
+	// CooldownSeconds is how long the pool is avoided before it gets
+	// traffic again.
+	CooldownSeconds int `json:"cooldown_seconds"`
+}
+
+const (
+	defaultRejectWindowShares    = 100
+	defaultRejectCooldownSeconds = 300
+	// Fewer shares than this say nothing about the pool.
+	minRejectSamples = 20
+)
+
+// rejectWindow is a ring of the latest share results of one pool.
+type rejectWindow struct {
+	results  []bool // true for rejected
+	next     int
+	filled   int
+	rejected int
+	avoided  time.Time // until when
+}
+
+// rejectMonitor tracks the reject ratio of every pool.
+type rejectMonitor struct {
+	cfg     RejectSwitchConfig
+	mu      sync.Mutex
+	windows map[string]*rejectWindow
+}
+
+var rejects = newRejectMonitor(RejectSwitchConfig{})
+
+func newRejectMonitor(cfg RejectSwitchConfig) *rejectMonitor {
+	if cfg.WindowShares <= 0 {
+		cfg.WindowShares = defaultRejectWindowShares
+	}
+	if cfg.CooldownSeconds <= 0 {
+		cfg.CooldownSeconds = defaultRejectCooldownSeconds
+	}
+	return &rejectMonitor{cfg: cfg, windows: make(map[string]*rejectWindow)}
+}
+
+// record adds the pool's answer to a share.
+func (m *rejectMonitor) record(address string, accepted bool) {
+	if m.cfg.Threshold <= 0 {
+		return
+	}
+	m.mu.Lock()
+	w, ok := m.windows[address]
+	if !ok {
+		w = &rejectWindow{results: make([]bool, m.cfg.WindowShares)}
+		m.windows[address] = w
+	}
+	if time.Now().Before(w.avoided) {
+		m.mu.Unlock()
+		return
+	}
+
+	if w.filled == len(w.results) {
+		if w.results[w.next] {
+			w.rejected--
+		}
+	} else {
+		w.filled++
+	}
+	w.results[w.next] = !accepted
+	if !accepted {
+		w.rejected++
+	}
+	w.next = (w.next + 1) % len(w.results)
+
+	ratio, samples := float64(w.rejected)/float64(w.filled), w.filled
+	tripped := samples >= minRejectSamples && ratio > m.cfg.Threshold
+	cooldown := time.Duration(m.cfg.CooldownSeconds) * time.Second
+	if tripped {
+		w.avoided = time.Now().Add(cooldown)
+		clear(w.results)
+		w.next, w.filled, w.rejected = 0, 0, 0
+	}
+	m.mu.Unlock()
+
+	if tripped {
+		alert(eventRejectRate, address, "Pool %s rejected %.0f%% of the last %d shares, moving traffic to other targets for %s", address, ratio*100, samples, cooldown)
+	}
+}
+
+// avoided reports whether a pool is cooling down after too many rejects.
+func (m *rejectMonitor) avoided(address string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.windows[address]
+	return ok && time.Now().Before(w.avoided)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayLine is a line a miner sent in a traffic capture and when.
+type replayLine struct {
+	at   time.Time
+	line string
+}
+
+// replay plays the miner side of a traffic capture against a proxy or a
+// pool with the original timing, and prints the exchange in the capture
+// format so it can be compared with the original.
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	address := fs.String("a", "127.0.0.1:3333", "Proxy or pool to play the miner against")
+	speed := fs.Float64("speed", 1, "Playback speed; 2 plays twice as fast, 0 sends without pauses")
+	wait := fs.Duration("wait", 2*time.Second, "How long to wait for answers after the last line")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: replay [-a address] [-speed factor] [-wait duration] capture\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *speed < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	lines, err := readCapture(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("%s has no lines from the miner", fs.Arg(0))
+	}
+	conn, err := net.DialTimeout("tcp", *address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var out sync.Mutex
+	show := func(direction, line string) {
+		out.Lock()
+		defer out.Unlock()
+		fmt.Print(captureLine(time.Now(), direction, "", line))
+	}
+	fmt.Printf("# replay of %s to %s\n", fs.Arg(0), *address)
+
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				show(">miner", line)
+				n++
+			}
+			if err != nil {
+				received <- n
+				return
+			}
+		}
+	}()
+
+	start, first := time.Now(), lines[0].at
+	for _, l := range lines {
+		if *speed > 0 {
+			due := start.Add(time.Duration(float64(l.at.Sub(first)) / *speed))
+			time.Sleep(time.Until(due))
+		}
+		show("miner>", l.line)
+		if _, err := writeLine(conn, l.line); err != nil {
+			return err
+		}
+	}
+	time.Sleep(*wait)
+	conn.Close()
+	n := <-received
+	fmt.Printf("# sent %d lines in %s, received %d\n", len(lines), time.Since(start).Round(time.Millisecond), n)
+	return nil
+}
+
+// readCapture returns the lines the miner sent in a traffic capture.
+func readCapture(path string) ([]replayLine, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []replayLine
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, defaultMaxPoolMessage+1024)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: not a capture line", path, n)
+		}
+		if fields[1] != "miner>" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		line := fields[2]
+		if strings.HasPrefix(line, `"`) {
+			if line, err = strconv.Unquote(line); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+		}
+		lines = append(lines, replayLine{at: at, line: line})
+	}
+	return lines, scanner.Err()
+}
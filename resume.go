@@ -0,0 +1,99 @@
+package main
+
+import "encoding/json"
+
+// Pools that implement session resumption take the subscription id of an
+// earlier connection as the second parameter of mining.subscribe and, when
+// they still know the session, answer with its extranonce again. The proxy
+// does that for targets with resume_session set when it reconnects a lost
+// pool, so the miner keeps its extranonce and its shares for the jobs of
+// the lost connection still count.
+
+// noteSubscribe keeps the subscription id and extranonce of a subscribe
+// answer. Callers hold u.mu.
+func (u *upstream) noteSubscribe(resp *stratumResponse) {
+	var result []json.RawMessage
+	if json.Unmarshal(resp.Result, &result) == nil && len(result) >= 3 {
+		u.sessionID = subscriptionID(result[0])
+		json.Unmarshal(result[1], &u.extranonce1)
+		json.Unmarshal(result[2], &u.extranonce2Size)
+	}
+}
+
+// subscriptionID returns the id of the mining.notify subscription in the
+// first element of a subscribe answer. Pools send it as a list of
+// [method, id] pairs, a single pair or a bare id.
+func subscriptionID(raw json.RawMessage) string {
+	var id string
+	if json.Unmarshal(raw, &id) == nil {
+		return id
+	}
+	var pairs [][]string
+	if json.Unmarshal(raw, &pairs) != nil {
+		var pair []string
+		if json.Unmarshal(raw, &pair) != nil {
+			return ""
+		}
+		pairs = [][]string{pair}
+	}
+	for _, pair := range pairs {
+		if len(pair) == 2 && pair[0] == "mining.notify" {
+			return pair[1]
+		}
+	}
+	return ""
+}
+
+// resumeParams returns the miner's subscribe parameters with the session id
+// to resume in place of any it sent itself.
+func resumeParams(subscribe json.RawMessage, sessionID string) json.RawMessage {
+	var params []json.RawMessage
+	json.Unmarshal(subscribe, &params)
+	if len(params) == 0 {
+		params = append(params, json.RawMessage(`""`))
+	}
+	id, _ := json.Marshal(sessionID)
+	// Parameters after the session id, such as the host, stay as they are.
+	if len(params) < 2 {
+		params = append(params, id)
+	} else {
+		params[1] = id
+	}
+	data, _ := json.Marshal(params)
+	return data
+}
+
+// resume takes over the jobs of the lost connection whose session the pool
+// resumed. Its jobs count as one clean_jobs notify older than the first
+// the pool sends on the new connection.
+func (u *upstream) resume(lost *upstream) {
+	lost.mu.Lock()
+	jobs := make([]upstreamJob, len(lost.jobs))
+	for i, job := range lost.jobs {
+		job.generation -= lost.generation
+		jobs[i] = job
+	}
+	lost.mu.Unlock()
+
+	u.mu.Lock()
+	u.resumed = true
+	u.jobs = append(jobs, u.jobs...)
+	u.trimJobs()
+	u.mu.Unlock()
+}
+
+// rebind moves the jobs issued for one pool connection to another, for a
+// resumed session.
+func (t *jobTable) rebind(from, to *upstream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for down, job := range t.down {
+		if job.up != from {
+			continue
+		}
+		delete(t.up, job)
+		job.up = to
+		t.down[down] = job
+		t.up[job] = down
+	}
+}
@@ -0,0 +1,6 @@
+//go:build linux && (386 || amd64 || arm)
+
+package main
+
+// The syscall package lacks SO_REUSEPORT on these architectures.
+const soReusePort = 0xf
@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+const reusePortSupported = true
+
+// reusePort sets SO_REUSEPORT on a socket before it is bound.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
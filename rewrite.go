@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// RewriteRule rewrites a string parameter of the messages miners send, for
+// pools that want the login in another shape: only the wallet, a different
+// worker separator, or options in the password. Auth, pass and worker are
+// default rules the configured ones follow.
+type RewriteRule struct {
+	Method string `json:"method"` // such as "mining.authorize"
+	Param  int    `json:"param"`  // index into params
+	// Worker, when set, is a regular expression {worker} must match for
+	// the rule to apply.
+	Worker string `json:"worker,omitempty"`
+	// Match is a regular expression the parameter must match, and only the
+	// matching part is replaced; the whole parameter when empty. A rule
+	// without one for the parameter after the last adds it.
+	Match string `json:"match,omitempty"`
+	// Replace is the new text: $1 or ${name} stand for groups of Match, and
+	// {ip}, {mac}, {auth} and {pass} for the IP and MAC address of the miner,
+	// miner.auth and miner.pass; {worker} is the first parameter as the
+	// miner sent it, its own username in logins and submits, and {suffix}
+	// the part of it after the first ".".
+	Replace string `json:"replace"`
+	// Options are merged into the new text as into the password with
+	// pass_options.
+	Options []string `json:"options,omitempty"`
+}
+
+// with returns m with the non-empty fields of override replacing its own,
+// for the coins, routes and virtual pools that replace miner. Rules replace
+// the rules of m as a whole.
+func (m MinerConfig) with(override *MinerConfig) MinerConfig {
+	if override == nil {
+		return m
+	}
+	if override.Auth != "" {
+		m.Auth = override.Auth
+	}
+	if override.Pass != "" {
+		m.Pass = override.Pass
+	}
+	if len(override.PassOptions) > 0 {
+		m.PassOptions = override.PassOptions
+	}
+	if override.Worker != "" {
+		m.Worker = override.Worker
+	}
+	if override.Ipenable {
+		m.Ipenable = true
+	}
+	if override.KeepSuffix {
+		m.KeepSuffix = true
+	}
+	if len(override.Rules) > 0 {
+		m.Rules = override.Rules
+	}
+	return m.compile()
+}
+
+// Compiled patterns of the rules, by expression.
+var rewritePatterns sync.Map
+
+func validateRewriteRules(rules []RewriteRule) error {
+	for _, r := range rules {
+		if r.Method == "" {
+			return fmt.Errorf("rule without a method")
+		}
+		if r.Param < 0 {
+			return fmt.Errorf("%s: negative param index", r.Method)
+		}
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("%s: invalid match %q: %v", r.Method, r.Match, err)
+		}
+		if _, err := regexp.Compile(r.Worker); err != nil {
+			return fmt.Errorf("%s: invalid worker %q: %v", r.Method, r.Worker, err)
+		}
+	}
+	return nil
+}
+
+// validateMinerRules checks the rewrite rules of miner and of the coins,
+// routes and virtual pools that replace them.
+func validateMinerRules(config *Config) error {
+	if err := validateRewriteRules(config.Miner.Rules); err != nil {
+		return err
+	}
+	for _, coin := range config.Coins {
+		if coin.Miner != nil {
+			if err := validateRewriteRules(coin.Miner.Rules); err != nil {
+				return fmt.Errorf("coin %s: %v", coin.Name, err)
+			}
+		}
+	}
+	for _, route := range config.Routes {
+		if route.Miner != nil {
+			if err := validateRewriteRules(route.Miner.Rules); err != nil {
+				return fmt.Errorf("route %q: %v", route.name(), err)
+			}
+		}
+	}
+	for _, pool := range config.VirtualPools {
+		if pool.Miner != nil {
+			if err := validateRewriteRules(pool.Miner.Rules); err != nil {
+				return fmt.Errorf("virtual pool %s: %v", pool.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func compileRewrite(expr string) *regexp.Regexp {
+	if re, ok := rewritePatterns.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		// Rules are validated on load; an invalid one matches nothing.
+		re = regexp.MustCompile(`[^\s\S]`)
+	}
+	rewritePatterns.Store(expr, re)
+	return re
+}
+
+// defaultRules are auth, pass and worker as rules. The login and the
+// worker of shares become auth followed by the miner's own worker name
+// with keep_suffix, else by worker or the IP; the password becomes pass
+// with the pass options merged in.
+func (m MinerConfig) defaultRules() []RewriteRule {
+	login := RewriteRule{Replace: "{auth}"}
+	switch {
+	case m.Worker != "":
+		login.Replace += escapeDollars(m.Worker)
+	case m.Ipenable:
+		login.Replace += "{ip}"
+	}
+	logins := []RewriteRule{login}
+	if m.KeepSuffix {
+		login.Worker = `^[^.]*\.?$`
+		logins = []RewriteRule{{Worker: `^[^.]*\.[\s\S]`, Replace: "{auth}{suffix}"}, login}
+	}
+	var rules []RewriteRule
+	for _, method := range []string{"mining.authorize", "mining.submit"} {
+		for _, r := range logins {
+			r.Method = method
+			rules = append(rules, r)
+		}
+	}
+	// Logins without a password get one when there is something to send.
+	if m.Pass != "" || len(m.PassOptions) > 0 {
+		pass := RewriteRule{Method: "mining.authorize", Param: 1, Replace: "$0", Options: m.PassOptions}
+		if m.Pass != "" {
+			pass.Replace = "{pass}"
+		}
+		rules = append(rules, pass)
+	}
+	return rules
+}
+
+// ruleSet is the rules of a MinerConfig compiled once, when the config is
+// loaded or derived, rather than for every message.
+type ruleSet struct {
+	// defaults are the default rules, all those followed by the
+	// configured ones.
+	defaults, all []compiledRule
+	// methods are those a rule applies to.
+	methods map[string]bool
+}
+
+// compiledRule is a rule with its patterns compiled; worker and match are
+// nil when the rule has none.
+type compiledRule struct {
+	RewriteRule
+	worker, match *regexp.Regexp
+	// placeholders is whether Replace has any to fill in.
+	placeholders bool
+}
+
+// wholeParam stands in for Match when a rule without one has a replacement
+// with group references, such as $0 for the parameter as it was.
+var wholeParam = regexp.MustCompile(`(?s)^.*$`)
+
+// compile returns m with its rules compiled, for configs whose rewriting
+// fields were changed.
+func (m MinerConfig) compile() MinerConfig {
+	defaults := compileRules(m.defaultRules())
+	set := &ruleSet{
+		defaults: defaults,
+		all:      append(defaults[:len(defaults):len(defaults)], compileRules(m.Rules)...),
+		methods:  make(map[string]bool),
+	}
+	for _, r := range set.all {
+		set.methods[r.Method] = true
+	}
+	m.compiled = set
+	return m
+}
+
+// ruleSet returns the compiled rules of m, compiling them when m was built
+// without compile, as by tools and tests.
+func (m MinerConfig) ruleSet() *ruleSet {
+	if m.compiled == nil {
+		return m.compile().compiled
+	}
+	return m.compiled
+}
+
+func compileRules(rules []RewriteRule) []compiledRule {
+	compiled := make([]compiledRule, len(rules))
+	for i, r := range rules {
+		compiled[i] = compiledRule{RewriteRule: r, placeholders: strings.Contains(r.Replace, "{")}
+		if r.Worker != "" {
+			compiled[i].worker = compileRewrite(r.Worker)
+		}
+		if r.Match != "" {
+			compiled[i].match = compileRewrite(r.Match)
+		}
+	}
+	return compiled
+}
+
+// applyRules applies those of rules for method to params and returns them,
+// with a parameter a rule added. worker is the first parameter as the miner
+// sent it, before any rewriting.
+func (m MinerConfig) applyRules(rules []compiledRule, method string, params []interface{}, id workerIdentity, worker string) []interface{} {
+	for i := range rules {
+		r := &rules[i]
+		if r.Method != method || r.Param > len(params) || r.Param == len(params) && r.match != nil {
+			continue
+		}
+		if r.worker != nil && !r.worker.MatchString(worker) {
+			continue
+		}
+		if r.Param == len(params) {
+			params = append(params, "")
+		}
+		value, ok := params[r.Param].(string)
+		if !ok {
+			continue
+		}
+		template := r.Replace
+		if r.placeholders {
+			template = m.fillPlaceholders(template, id, worker)
+		}
+		switch {
+		case r.match != nil:
+			value = r.match.ReplaceAllString(value, template)
+		case strings.Contains(template, "$"):
+			value = wholeParam.ReplaceAllString(value, template)
+		default:
+			// A template without group references replaces the whole
+			// parameter as it is.
+			value = template
+		}
+		if len(r.Options) > 0 {
+			value = mergeOptions(value, r.Options)
+		}
+		params[r.Param] = value
+	}
+	return params
+}
+
+// fillPlaceholders replaces the placeholders of template with their values
+// for the miner, which are literal text rather than group references.
+// Unknown ones are left as they are.
+func (m MinerConfig) fillPlaceholders(template string, id workerIdentity, worker string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		end := strings.IndexByte(template[start+1:], '}')
+		if start < 0 || end < 0 {
+			break
+		}
+		end += start + 1
+		var value string
+		switch template[start+1 : end] {
+		case "ip":
+			value = id.ip
+		case "mac":
+			value = id.macWorker()
+		case "worker":
+			value = worker
+		case "suffix":
+			_, value, _ = strings.Cut(worker, ".")
+		case "auth":
+			value = m.Auth
+		case "pass":
+			value = m.Pass
+		default:
+			b.WriteString(template[:start+1])
+			template = template[start+1:]
+			continue
+		}
+		b.WriteString(template[:start])
+		b.WriteString(escapeDollars(value))
+		template = template[end+1:]
+	}
+	if b.Len() == 0 {
+		return template
+	}
+	b.WriteString(template)
+	return b.String()
+}
+
+// mergeOptions merges options into a comma-separated list of them: each
+// replaces an option of the same name the list has, and the rest are
+// appended.
+func mergeOptions(list string, options []string) string {
+	var merged []string
+	if list != "" {
+		merged = strings.Split(list, ",")
+	}
+	for _, option := range options {
+		name, _, _ := strings.Cut(option, "=")
+		replaced := false
+		for i, o := range merged {
+			if n, _, _ := strings.Cut(o, "="); strings.TrimSpace(n) == name {
+				merged[i], replaced = option, true
+			}
+		}
+		if !replaced {
+			merged = append(merged, option)
+		}
+	}
+	return strings.Join(merged, ",")
+}
+
+func escapeDollars(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
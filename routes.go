@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// RouteConfig sends miners that authorize with a matching username to their
+// own targets, so one listener can serve several tenants.
+type RouteConfig struct {
+	// Username is matched as in path.Match, e.g. "ltc_*" or an exact wallet.
+	Username string `json:"username,omitempty"`
+	// Wallet is matched the same way against the wallet or account miners
+	// log in with, the username before the first ".", so each customer's
+	// devices reach that customer's pool account whatever their worker
+	// names. A route with both must match both.
+	Wallet string `json:"wallet,omitempty"`
+	// Group picks the targets of the coin it names; Targets lists them
+	// directly.
+	Group   string   `json:"group,omitempty"`
+	Targets []Target `json:"targets,omitempty"`
+	// Auth replaces miner.auth for matching miners, and Miner the non-empty
+	// fields of miner, such as pass, worker or rules, like a coin's miner.
+	Auth  string       `json:"auth,omitempty"`
+	Miner *MinerConfig `json:"miner,omitempty"`
+	// Difficulty replaces the difficulty bounds for matching miners, so
+	// each worker can have its own.
+	Difficulty *DifficultyClamp `json:"difficulty,omitempty"`
+	// Schedule limits the route to times of the day or week. Connected
+	// miners are moved when the route starts or stops applying to them.
+	Schedule *RouteSchedule `json:"schedule,omitempty"`
+}
+
+// Remember the last username seen per client IP so that reconnecting miners
+// are dialed to their route straight away, across restarts when there is a
+// state directory.
+var knownUsers = newIPMemory()
+
+func validateRoutes(config *Config) error {
+	for _, r := range config.Routes {
+		if r.Username == "" && r.Wallet == "" {
+			return fmt.Errorf("route without a username or wallet")
+		}
+		if _, err := path.Match(r.Username, ""); err != nil {
+			return fmt.Errorf("route %q: invalid username pattern", r.name())
+		}
+		if _, err := path.Match(r.Wallet, ""); err != nil {
+			return fmt.Errorf("route %q: invalid wallet pattern", r.name())
+		}
+		if r.Group != "" && config.coin(r.Group) == nil {
+			return fmt.Errorf("route %q: unknown group %q", r.name(), r.Group)
+		}
+		if r.Group == "" && len(r.Targets) == 0 && r.Auth == "" && r.Miner == nil && r.Difficulty == nil {
+			return fmt.Errorf("route %q: needs a group, targets, auth, miner or difficulty", r.name())
+		}
+		if err := r.Schedule.validate(); err != nil {
+			return fmt.Errorf("route %q: %v", r.name(), err)
+		}
+	}
+	return nil
+}
+
+// name is how messages refer to the route.
+func (r *RouteConfig) name() string {
+	if r.Username != "" {
+		return r.Username
+	}
+	return "wallet " + r.Wallet
+}
+
+// matches reports whether the route is for the miners logging in as
+// username.
+func (r *RouteConfig) matches(username string) bool {
+	if r.Username != "" {
+		if ok, _ := path.Match(r.Username, username); !ok {
+			return false
+		}
+	}
+	if r.Wallet != "" {
+		wallet, _, _ := strings.Cut(username, ".")
+		if ok, _ := path.Match(r.Wallet, wallet); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// routeFor returns the route of username now, or nil.
+func (c *Config) routeFor(username string) *RouteConfig {
+	return c.routeAt(username, time.Now())
+}
+
+// routeAt returns the first route matching username whose schedule, if
+// any, is on at now.
+func (c *Config) routeAt(username string, now time.Time) *RouteConfig {
+	for i := range c.Routes {
+		if c.Routes[i].matches(username) && c.Routes[i].Schedule.on(now) {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// targets returns the targets a route sends miners to, or nil when it keeps
+// the usual ones.
+func (r *RouteConfig) targets(c *Config) []Target {
+	switch {
+	case len(r.Targets) > 0:
+		return r.Targets
+	case r.Group != "":
+		return c.coinTargets(r.Group)
+	}
+	return nil
+}
+
+// forUser returns the effective config for a miner's username, with the
+// matching route applied to a copy.
+func (c *Config) forUser(username string) *Config {
+	return c.forRoute(c.routeFor(username))
+}
+
+// forRoute returns the effective config with route, if any, applied to a
+// copy.
+func (c *Config) forRoute(route *RouteConfig) *Config {
+	if route == nil {
+		return c
+	}
+
+	effective := *c
+	if targets := route.targets(c); targets != nil {
+		effective = *c.withAllTargets(targets)
+	}
+	effective.Miner = effective.Miner.with(route.Miner)
+	if route.Auth != "" {
+		effective.Miner.Auth = route.Auth
+	}
+	if route.Difficulty != nil {
+		effective.Difficulty = *route.Difficulty
+	}
+	return &effective
+}
+
+// forKnownUser applies the route of the username last seen from ip.
+func (c *Config) forKnownUser(ip string) *Config {
+	if len(c.Routes) == 0 {
+		return c
+	}
+	username, ok := knownUsers.get(ip)
+	if !ok {
+		return c
+	}
+	return c.forUser(username)
+}
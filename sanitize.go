@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const defaultWorkerReplace = "_"
+
+// Compiled worker_chars classes, by their text.
+var workerCharsets sync.Map
+
+// workerCharset returns a regexp matching the characters outside chars.
+func workerCharset(chars string) (*regexp.Regexp, error) {
+	if re, ok := workerCharsets.Load(chars); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile("[^" + chars + "]")
+	if err != nil {
+		return nil, err
+	}
+	workerCharsets.Store(chars, re)
+	return re, nil
+}
+
+func validateWorkerRules(t Target) error {
+	if t.WorkerMaxLength < 0 {
+		return fmt.Errorf("target %s: negative worker_max_length", t.Address)
+	}
+	if t.WorkerChars == "" {
+		return nil
+	}
+	re, err := workerCharset(t.WorkerChars)
+	if err != nil {
+		return fmt.Errorf("target %s: invalid worker_chars %q", t.Address, t.WorkerChars)
+	}
+	if t.WorkerReplace != "" && re.MatchString(t.WorkerReplace) {
+		return fmt.Errorf("target %s: worker_replace %q is not in worker_chars", t.Address, t.WorkerReplace)
+	}
+	return nil
+}
+
+// sanitizeWorker makes the worker part of a username, after the first dot,
+// fit the target's rules. The account before it is left alone.
+func (t Target) sanitizeWorker(username string) string {
+	if t.WorkerChars == "" && t.WorkerMaxLength == 0 {
+		return username
+	}
+	account, worker, ok := strings.Cut(username, ".")
+	if !ok {
+		return username
+	}
+	if t.WorkerChars != "" {
+		if re, err := workerCharset(t.WorkerChars); err == nil {
+			replace := t.WorkerReplace
+			if replace == "" {
+				replace = defaultWorkerReplace
+			}
+			worker = re.ReplaceAllLiteralString(worker, replace)
+		}
+	}
+	if t.WorkerMaxLength > 0 && len(worker) > t.WorkerMaxLength {
+		n := t.WorkerMaxLength
+		for n > 0 && !utf8.RuneStart(worker[n]) {
+			n--
+		}
+		worker = worker[:n]
+	}
+	return account + "." + worker
+}
+
+// sanitizeLine applies the target's worker rules to the username of an
+// authorize or submit on its way to the pool.
+func (t Target) sanitizeLine(line string) string {
+	if t.WorkerChars == "" && t.WorkerMaxLength == 0 {
+		return line
+	}
+	if !strings.Contains(line, `"mining.authorize"`) && !strings.Contains(line, `"mining.submit"`) &&
+		!strings.Contains(line, `"eth_submitLogin"`) && !strings.Contains(line, `"eth_login"`) {
+		return line
+	}
+	if isBatch(line) {
+		var batch []json.RawMessage
+		if json.Unmarshal([]byte(line), &batch) != nil {
+			return line
+		}
+		for i, element := range batch {
+			batch[i] = json.RawMessage(t.sanitizeLine(string(element)))
+		}
+		sanitized, err := json.Marshal(batch)
+		if err != nil {
+			return line
+		}
+		return string(sanitized)
+	}
+	var msg map[string]interface{}
+	if json.Unmarshal([]byte(line), &msg) != nil {
+		return line
+	}
+	params, ok := msg["params"].([]interface{})
+	if !ok || len(params) == 0 {
+		return line
+	}
+	username, ok := params[0].(string)
+	if !ok || t.sanitizeWorker(username) == username {
+		return line
+	}
+	params[0] = t.sanitizeWorker(username)
+	sanitized, err := json.Marshal(msg)
+	if err != nil {
+		return line
+	}
+	return string(sanitized)
+}
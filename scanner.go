@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ScannerConfig sets how probes that are not Stratum at all are answered.
+// Internet-facing listeners see plenty of them.
+type ScannerConfig struct {
+	// HTTPStatus and HTTPBody answer HTTP requests; 503 with an empty body
+	// by default.
+	HTTPStatus int    `json:"http_status"`
+	HTTPBody   string `json:"http_body"`
+	// Response is written verbatim to other garbage, if set.
+	Response string `json:"response"`
+}
+
+// How often the probes dropped since the last summary are logged.
+const scannerLogInterval = time.Minute
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("CONNECT "), []byte("PATCH "), []byte("TRACE "), []byte("PRI "),
+}
+
+// TLS alert record: fatal handshake_failure.
+var tlsHandshakeFailure = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}
+
+// Probes dropped per kind: in total, and since the last summary.
+var scannerStats = struct {
+	sync.Mutex
+	total   map[string]int
+	recent  map[string]int
+	since   time.Time
+	lastLog time.Time
+}{total: make(map[string]int), recent: make(map[string]int)}
+
+// detectProbe peeks at the first bytes of a client connection and returns
+// "http" or "tls" for such requests, or "" for anything else.
+func detectProbe(conn net.Conn, reader *bufio.Reader) string {
+	conn.SetReadDeadline(time.Now().Add(sv2FirstMessageTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if _, err := reader.Peek(1); err != nil {
+		return ""
+	}
+	head, _ := reader.Peek(min(reader.Buffered(), 8))
+	if len(head) >= 2 && head[0] == 0x16 && head[1] == 0x03 {
+		return "tls"
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(head, method) {
+			return "http"
+		}
+	}
+	return ""
+}
+
+// answerProbe sends the configured minimal response for a probe of kind
+// and counts it.
+func answerProbe(conn net.Conn, config *Config, kind string) {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	switch kind {
+	case "http":
+		status := config.Scanners.HTTPStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		body := config.Scanners.HTTPBody
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+			status, http.StatusText(status), len(body), body)
+	case "tls":
+		conn.Write(tlsHandshakeFailure)
+	default:
+		if config.Scanners.Response != "" {
+			conn.Write([]byte(config.Scanners.Response))
+		}
+	}
+	noteProbe(remoteIP(conn), kind)
+}
+
+// noteProbe counts a dropped probe and logs a summary at most once per
+// interval instead of a line per probe.
+func noteProbe(ip, kind string) {
+	scannerStats.Lock()
+	defer scannerStats.Unlock()
+	scannerStats.total[kind]++
+	if len(scannerStats.recent) == 0 {
+		scannerStats.since = time.Now()
+	}
+	scannerStats.recent[kind]++
+	if time.Since(scannerStats.lastLog) < scannerLogInterval {
+		return
+	}
+	log.Printf("Dropped scanner probes since %s: http=%d tls=%d other=%d (last from %s)",
+		scannerStats.since.Format(time.TimeOnly), scannerStats.recent["http"], scannerStats.recent["tls"], scannerStats.recent["other"], ip)
+	scannerStats.recent = make(map[string]int)
+	scannerStats.lastLog = time.Now()
+}
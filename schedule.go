@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RouteSchedule is when a route applies, such as the hours power is cheap
+// or a pool pays more.
+type RouteSchedule struct {
+	// From and To are times of the day as "15:04"; a window ending before
+	// it starts runs past midnight, and From equal to To lasts all day.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Days are the days the window starts on, as "mon" to "sun"; every day
+	// when empty.
+	Days []string `json:"days,omitempty"`
+	// Timezone is the zone of the times, as in the tz database, such as
+	// "America/Chicago"; the local zone when empty.
+	Timezone string `json:"timezone,omitempty"`
+
+	location *time.Location // of Timezone, set by validate
+}
+
+// How often connected miners are checked for a route their schedule turned
+// on or off.
+const scheduleCheckInterval = 30 * time.Second
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (r *RouteSchedule) validate() error {
+	if r == nil {
+		return nil
+	}
+	if _, err := time.Parse("15:04", r.From); err != nil {
+		return fmt.Errorf("invalid schedule from %q", r.From)
+	}
+	if _, err := time.Parse("15:04", r.To); err != nil {
+		return fmt.Errorf("invalid schedule to %q", r.To)
+	}
+	for _, day := range r.Days {
+		if _, ok := scheduleDays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("invalid schedule day %q", day)
+		}
+	}
+	location, err := loadScheduleLocation(r.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid schedule timezone %q", r.Timezone)
+	}
+	r.location = location
+	return nil
+}
+
+// loadScheduleLocation returns the zone called name, the local one for "".
+// time.LoadLocation would return UTC for "".
+func loadScheduleLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// on reports whether the schedule is on at now. No schedule is always on.
+func (r *RouteSchedule) on(now time.Time) bool {
+	if r == nil {
+		return true
+	}
+	location := r.location
+	if location == nil {
+		// Not validated; look it up each time.
+		location, _ = loadScheduleLocation(r.Timezone)
+	}
+	if location != nil {
+		now = now.In(location)
+	}
+	from, _ := time.Parse("15:04", r.From)
+	to, _ := time.Parse("15:04", r.To)
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+	minute := now.Hour()*60 + now.Minute()
+
+	day := now.Weekday()
+	switch {
+	case start == end:
+	case start < end:
+		if minute < start || minute >= end {
+			return false
+		}
+	case minute >= end && minute < start:
+		return false
+	case minute < end:
+		// Past midnight the window belongs to the day it started on.
+		day = (day + 6) % 7
+	}
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, d := range r.Days {
+		if scheduleDays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSchedules reports whether a route of the config has a schedule.
+func (c *Config) hasSchedules() bool {
+	for _, r := range c.Routes {
+		if r.Schedule != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// watchSchedules moves the connected miners whose route a schedule turned
+// on or off until stop is closed.
+func watchSchedules(stop <-chan struct{}) {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		// Moves wait on pools: one slow pool must not hold up the others.
+		for _, s := range sessions.all() {
+			go s.followSchedule(now)
+		}
+	}
+}
+
+// followSchedule applies the route the username of the miner has at now, if
+// it changed, and hands the miner over to its pools.
+func (s *session) followSchedule(now time.Time) {
+	s.handshakeMu.Lock()
+	username, current := s.username, s.route
+	s.handshakeMu.Unlock()
+	// Miners that have not logged in yet get their route when they do.
+	if username == "" {
+		return
+	}
+	route := s.config.routeAt(username, now)
+	// A miner failing over, or still being moved, is looked at again on
+	// the next check.
+	if route == current || !s.failingOver.CompareAndSwap(false, true) {
+		return
+	}
+	reason := "route schedule ended"
+	if route != nil {
+		reason = fmt.Sprintf("route %s scheduled", route.name())
+	}
+	targets := s.useRoute(username, route)
+	if targets == nil {
+		s.failingOver.Store(false)
+		return
+	}
+	s.handOver(targets, reason, "moved by schedule")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of sent messages kept for retransmission.
+	seqWindow = 512
+	// How often each side announces its last sequence number, so that a
+	// loss at the end of a burst is noticed without waiting for more traffic.
+	seqTipInterval = 2 * time.Second
+)
+
+// seqLink frames the lines of a proxy-to-proxy link as
+// "#<seq>:<crc32>:<message>" so that lost or corrupted messages on an
+// unreliable transport are noticed and retransmitted. The receiving side
+// answers a gap or bad checksum with "#nack:<seq>"; when the sender no longer
+// has that message it answers "#skip:<seq>" and the loss is counted. Idle
+// senders periodically send "#tip:<seq>" with the last number they used.
+// The connecting side opens the link with seqHello.
+type seqLink struct {
+	peer string
+
+	mu       sync.Mutex
+	opened   bool
+	sendSeq  uint64
+	sent     map[uint64]string
+	recvSeq  uint64
+	nackSeq  uint64
+	nackTime time.Time
+
+	gaps    int
+	corrupt int
+	lost    uint64
+}
+
+func newSeqLink(peer string) *seqLink {
+	return &seqLink{peer: peer, sent: make(map[uint64]string), recvSeq: 1}
+}
+
+// seqHello is the first line of a sequenced link. Clients are only read
+// as framed after sending it, before any message, so that a miner sending
+// a line that happens to start with "#" is not taken for a proxy.
+const seqHello = "#seqlink:1"
+
+func isSeqLine(line string) bool {
+	return strings.HasPrefix(line, "#")
+}
+
+// open returns seqHello the first time it is called, and "" after.
+func (l *seqLink) open() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.opened {
+		return ""
+	}
+	l.opened = true
+	return seqHello
+}
+
+// frame numbers a message for sending. Callers must send frames in the order
+// they were numbered.
+func (l *seqLink) frame(message string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sendSeq++
+	framed := fmt.Sprintf("#%d:%08x:%s", l.sendSeq, crc32.ChecksumIEEE([]byte(message)), message)
+	l.sent[l.sendSeq] = framed
+	delete(l.sent, l.sendSeq-seqWindow)
+	return framed
+}
+
+// receive decodes one line from the peer. It returns the message when it is
+// the next one in sequence, and any control or retransmitted lines that must
+// be written back to the peer.
+func (l *seqLink) receive(line string) (message string, ok bool, replies []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	body := line[1:]
+	if arg, found := strings.CutPrefix(body, "nack:"); found {
+		if seq, err := strconv.ParseUint(arg, 10, 64); err == nil {
+			return "", false, l.resend(seq)
+		}
+		return "", false, nil
+	}
+	if arg, found := strings.CutPrefix(body, "tip:"); found {
+		if seq, err := strconv.ParseUint(arg, 10, 64); err == nil && seq >= l.recvSeq {
+			replies := l.requestResend(fmt.Sprintf("peer is at %d", seq))
+			if replies != nil {
+				l.gaps++
+			}
+			return "", false, replies
+		}
+		return "", false, nil
+	}
+	if arg, found := strings.CutPrefix(body, "skip:"); found {
+		if seq, err := strconv.ParseUint(arg, 10, 64); err == nil && seq > l.recvSeq {
+			l.lost += seq - l.recvSeq
+			log.Printf("Link %s: %d messages lost before %d", l.peer, seq-l.recvSeq, seq)
+			l.recvSeq = seq
+		}
+		return "", false, nil
+	}
+
+	parts := strings.SplitN(body, ":", 3)
+	if len(parts) != 3 {
+		l.corrupt++
+		return "", false, l.requestResend("malformed frame")
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	sum, sumErr := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil || sumErr != nil || crc32.ChecksumIEEE([]byte(parts[2])) != uint32(sum) {
+		l.corrupt++
+		return "", false, l.requestResend("checksum mismatch")
+	}
+	switch {
+	case seq < l.recvSeq:
+		return "", false, nil // duplicate from a retransmission
+	case seq > l.recvSeq:
+		l.gaps++
+		return "", false, l.requestResend(fmt.Sprintf("got %d", seq))
+	}
+	l.recvSeq++
+	return parts[2], true, nil
+}
+
+// requestResend asks the peer to retransmit from the next expected message,
+// at most once every two seconds for the same position.
+func (l *seqLink) requestResend(reason string) []string {
+	if l.nackSeq == l.recvSeq && time.Since(l.nackTime) < 2*time.Second {
+		return nil
+	}
+	l.nackSeq, l.nackTime = l.recvSeq, time.Now()
+	log.Printf("Link %s: expected message %d, %s; requesting resend", l.peer, l.recvSeq, reason)
+	return []string{fmt.Sprintf("#nack:%d", l.recvSeq)}
+}
+
+func (l *seqLink) resend(from uint64) []string {
+	var out []string
+	if oldest := l.sendSeq - uint64(len(l.sent)) + 1; from < oldest {
+		out = append(out, fmt.Sprintf("#skip:%d", oldest))
+		from = oldest
+	}
+	for seq := from; seq <= l.sendSeq; seq++ {
+		out = append(out, l.sent[seq])
+	}
+	return out
+}
+
+// tip returns the announcement of the last sequence number sent, or "" when
+// nothing has been sent yet.
+func (l *seqLink) tip() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sendSeq == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#tip:%d", l.sendSeq)
+}
+
+func (l *seqLink) summary() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return fmt.Sprintf("%d gaps, %d corrupt, %d lost", l.gaps, l.corrupt, l.lost)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyServer owns the listeners and accept loops of a running proxy.
+type proxyServer struct {
+	config atomic.Pointer[Config]
+	// listeners are opened at start, or by HA once this proxy is active.
+	listenMu  sync.Mutex
+	listeners []net.Listener
+	limiter   *connLimiter
+	throttle  *acceptThrottle
+	backoff   *reconnectBackoff
+	active    atomic.Int64
+	admin     *http.Server
+	debug     *http.Server
+	control   net.Listener
+	getwork   *http.Server
+	// configPath is where reload reads the configuration from.
+	configPath string
+	// Set by drain; drained is closed once the last connection ended.
+	draining    atomic.Bool
+	drained     chan struct{}
+	drainedOnce sync.Once
+	wg          sync.WaitGroup
+	// Channel to notify the accept loops to stop accepting new connections
+	stopChan chan struct{}
+}
+
+func newProxyServer(config *Config) (*proxyServer, error) {
+	p := &proxyServer{
+		limiter:  newConnLimiter(config.Limits),
+		throttle: newAcceptThrottle(config.Limits.AcceptRate, config.Limits.AcceptBurst),
+		backoff:  newReconnectBackoff(config.Limits.ReconnectBackoffMs, config.Limits.ReconnectBackoffMaxMs),
+		stopChan: make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+	p.config.Store(config)
+	soloNodes.configure(config)
+	defaultHTTPProxy.Store(config.HTTPProxy)
+
+	if config.HA.Peer == "" {
+		if err := p.openListeners(); err != nil {
+			return nil, err
+		}
+	}
+
+	geo, err := loadGeoDB(config.GeoIP)
+	if err != nil {
+		p.closeListeners()
+		return nil, err
+	}
+	geoDB = geo
+	if err := workerNames.load(config.WorkerNames); err != nil {
+		p.closeListeners()
+		return nil, err
+	}
+	if err := minerCredentials.load(config.MinerAuth.File); err != nil {
+		p.closeListeners()
+		return nil, err
+	}
+	bans = newBanList(config.Ban, statePath(config, "bans.json"))
+	if path := statePath(config, "stats.json"); path != "" {
+		stats.restore(path)
+	}
+	if path := statePath(config, "known_users.json"); path != "" {
+		knownUsers.restore(path)
+	}
+	rejects = newRejectMonitor(config.RejectSwitch)
+	alerts = newAlerter(config.Alerts)
+	resolver = newDNSCache(config.DNSCacheSeconds)
+	if shareLog, err = openShareLog(config.ShareLog); err != nil {
+		p.closeListeners()
+		return nil, err
+	}
+	if accessLog, err = openAccessLog(config.AccessLog); err != nil {
+		p.closeListeners()
+		shareLog.close()
+		return nil, err
+	}
+	if cluster, err = newClusterNode(config.Cluster); err != nil {
+		p.closeListeners()
+		shareLog.close()
+		accessLog.close()
+		return nil, err
+	}
+	for _, start := range []func() error{p.startAdmin, p.startDebug, p.startControl, p.startGetwork} {
+		if err := start(); err != nil {
+			p.closeListeners()
+			p.closeInterfaces()
+			shareLog.close()
+			accessLog.close()
+			cluster.close()
+			return nil, err
+		}
+	}
+	if ha, err = newHAPair(config.HA); err != nil {
+		p.closeListeners()
+		p.closeInterfaces()
+		shareLog.close()
+		accessLog.close()
+		cluster.close()
+		return nil, err
+	}
+	tracer = newTraceExporter(config.Tracing)
+	return p, nil
+}
+
+// openListeners listens on the configured addresses, or on none of them.
+func (p *proxyServer) openListeners() error {
+	p.listenMu.Lock()
+	defer p.listenMu.Unlock()
+	config := p.config.Load()
+	for i, address := range config.listenAddresses() {
+		// The addresses of virtual pools follow those of listen.
+		var pool string
+		if i >= len(config.Listen) {
+			pool = config.VirtualPools[i-len(config.Listen)].Name
+		}
+		acceptors := 1
+		reuse := config.ReusePort && !isWebSocketAddress(address) && !isTLSAddress(address) && !strings.HasPrefix(address, "unix:")
+		if reuse && config.Acceptors > 1 {
+			acceptors = config.Acceptors
+		}
+		for i := 0; i < acceptors; i++ {
+			var listener net.Listener
+			var err error
+			var options *SocketOptions
+			if o, ok := config.ListenSockets[address]; ok {
+				options = &o
+			}
+			switch {
+			case isWebSocketAddress(address):
+				listener, err = listenWebSocket(address, config.WebSocket, options)
+			case isTLSAddress(address):
+				listener, err = listenTLS(address, config.TLS, options)
+			case reuse:
+				listener, err = listenReusePort(address)
+			default:
+				listener, err = listen(address)
+			}
+			if err == nil && !isWebSocketAddress(address) && !isTLSAddress(address) {
+				listener = options.listener(listener)
+			}
+			if err != nil {
+				for _, listener := range p.listeners {
+					listener.Close()
+				}
+				p.listeners = nil
+				return err
+			}
+			if pool != "" {
+				listener = virtualPoolListener{listener, pool}
+			}
+			p.listeners = append(p.listeners, listener)
+		}
+		if pool != "" {
+			log.Printf("Listening on %s for virtual pool %s", address, pool)
+		} else if acceptors > 1 {
+			log.Printf("Listening on %s with %d acceptors", address, acceptors)
+		} else {
+			log.Printf("Listening on %s", address)
+		}
+	}
+	return nil
+}
+
+// startAccepting opens the listeners and accepts miners on them.
+func (p *proxyServer) startAccepting() error {
+	if err := p.openListeners(); err != nil {
+		return err
+	}
+	p.acceptAll()
+	return nil
+}
+
+func (p *proxyServer) acceptAll() {
+	p.listenMu.Lock()
+	defer p.listenMu.Unlock()
+	for _, listener := range p.listeners {
+		go p.acceptLoop(listener)
+	}
+}
+
+// addrs returns the bound listen addresses, which differ from the configured
+// ones when a port of 0 was requested.
+func (p *proxyServer) addrs() []string {
+	p.listenMu.Lock()
+	defer p.listenMu.Unlock()
+	var addrs []string
+	for _, listener := range p.listeners {
+		addrs = append(addrs, listener.Addr().String())
+	}
+	return addrs
+}
+
+func (p *proxyServer) serve() {
+	p.acceptAll()
+	if ha != nil {
+		go ha.run(p, p.stopChan)
+	}
+
+	config := p.config.Load()
+	if config.TargetSelection == "latency" {
+		interval := config.LatencyProbeSeconds
+		if interval <= 0 {
+			interval = defaultLatencyProbeSeconds
+		}
+		go latencies.run(time.Duration(interval)*time.Second, func() []Target {
+			return allTargets(p.config.Load())
+		}, p.stopChan)
+	}
+	if config.TargetSelection == "split" {
+		go splits.run(p.stopChan)
+	}
+	go clock.run(config.ClockCheck, p.stopChan)
+	go workerNames.watch(func() string { return p.config.Load().WorkerNames }, p.stopChan)
+	go minerCredentials.watch(func() string { return p.config.Load().MinerAuth.File }, p.stopChan)
+	if config.Alerts.WorkerOfflineMinutes > 0 || config.Alerts.WorkerSilentMinutes > 0 ||
+		config.Alerts.HashrateDropPercent > 0 || config.Alerts.WorkerHashrateDropPercent > 0 || config.ExpectedHashrate.Alert {
+		go watchStats(config, p.stopChan)
+	}
+	if alerts.telegram != nil && config.Alerts.Telegram.Commands {
+		go alerts.telegram.run(p, p.stopChan)
+	}
+	if config.StatsExport.Dir != "" {
+		go stats.run(config.StatsExport, p.stopChan)
+	}
+	if path := statePath(config, "stats.json"); path != "" {
+		go stats.persist(path, p.stopChan)
+	}
+	if path := statePath(config, "known_users.json"); path != "" {
+		go knownUsers.persist(path, p.stopChan)
+	}
+	if cluster != nil {
+		go cluster.run(p.stopChan)
+	}
+	if config.ProfitSwitch.IntervalMinutes > 0 {
+		go profit.run(config, p.stopChan)
+	}
+	go curtailment.run(func() CurtailmentConfig { return p.config.Load().Curtailment }, p.stopChan)
+	if config.hasSchedules() {
+		go watchSchedules(p.stopChan)
+	}
+	if config.MinerAPI.IntervalSeconds > 0 {
+		go minerAPI.run(config.MinerAPI, p.stopChan)
+	}
+	if config.Discovery.IntervalMinutes > 0 {
+		go discovery.run(config, p.stopChan)
+	}
+	if config.HealthCheck.IntervalSeconds > 0 {
+		go health.run(config.HealthCheck, func() []Target {
+			return allTargets(p.config.Load())
+		}, p.stopChan)
+	}
+}
+
+func (p *proxyServer) acceptLoop(listener net.Listener) {
+	var pool string
+	if vl, ok := listener.(virtualPoolListener); ok {
+		pool = vl.pool
+	}
+	for {
+		select {
+		case <-p.stopChan: // Stop accepting new connections
+			return
+		default:
+			p.throttle.wait()
+			clientConn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				continue
+			}
+
+			ip := remoteIP(clientConn)
+			// The miners behind a downstream proxy share its address.
+			downstream := p.config.Load().downstreamProxy(ip)
+			if bans.banned(ip) || (!downstream && !p.backoff.allow(ip)) {
+				clientConn.Close()
+				continue
+			}
+			if !p.limiter.acquire(ip, !downstream) {
+				log.Printf("Connection limit reached, rejecting %s", ip)
+				clientConn.Close()
+				continue
+			}
+			p.wg.Add(1)
+			p.active.Add(1)
+			go func() {
+				defer p.connectionDone()
+				defer p.limiter.release(ip)
+				HandleClient(clientConn, pool, p.config.Load(), &p.wg)
+			}()
+		}
+	}
+}
+
+// reload makes new connections use config. Listen addresses, limits, the
+// GeoIP database, the share log and the access log keep the values the
+// server was started with.
+func (p *proxyServer) reload(config *Config) {
+	p.config.Store(config)
+	soloNodes.configure(config)
+	defaultHTTPProxy.Store(config.HTTPProxy)
+}
+
+func (p *proxyServer) stop() {
+	close(p.stopChan)
+	p.closeListeners()
+	p.closeInterfaces()
+	shareLog.close()
+	accessLog.close()
+	tracer.close()
+	cluster.close()
+	ha.close()
+	sshTunnels.close()
+	if path := statePath(p.config.Load(), "stats.json"); path != "" {
+		stats.save(path)
+	}
+	if path := statePath(p.config.Load(), "known_users.json"); path != "" {
+		knownUsers.save(path)
+	}
+}
+
+// closeInterfaces closes the admin, debug, control and getwork listeners.
+func (p *proxyServer) closeInterfaces() {
+	if p.admin != nil {
+		p.admin.Close()
+	}
+	if p.debug != nil {
+		p.debug.Close()
+	}
+	if p.control != nil {
+		p.control.Close()
+	}
+	if p.getwork != nil {
+		p.getwork.Close()
+	}
+}
+
+// drain stops accepting connections; the server is drained once the
+// connections it has end.
+func (p *proxyServer) drain() {
+	if p.draining.Swap(true) {
+		return
+	}
+	log.Printf("Draining: no new connections, %d still open", p.active.Load())
+	p.closeListeners()
+	if p.active.Load() == 0 {
+		p.drainedOnce.Do(func() { close(p.drained) })
+	}
+}
+
+func (p *proxyServer) connectionDone() {
+	if p.active.Add(-1) == 0 && p.draining.Load() {
+		p.drainedOnce.Do(func() { close(p.drained) })
+	}
+}
+
+func (p *proxyServer) closeListeners() {
+	p.listenMu.Lock()
+	defer p.listenMu.Unlock()
+	for _, listener := range p.listeners {
+		listener.Close()
+	}
+	p.listeners = nil
+}
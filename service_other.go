@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// service is only available on Windows; use a systemd unit or similar
+// elsewhere.
+func service(args []string) error {
+	return fmt.Errorf("Windows services are only supported on Windows")
+}
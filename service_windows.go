@@ -0,0 +1,341 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Windows service support through the Service Control Manager, with the
+// log also going to the Application event log.
+
+const defaultServiceName = "stratum-proxy"
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManager                = advapi32.NewProc("OpenSCManagerW")
+	procCreateService                = advapi32.NewProc("CreateServiceW")
+	procOpenService                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procStartService                 = advapi32.NewProc("StartServiceW")
+	procControlService               = advapi32.NewProc("ControlService")
+	procQueryServiceStatus           = advapi32.NewProc("QueryServiceStatus")
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSource          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEvent                  = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyEx               = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx                = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKey                 = advapi32.NewProc("RegDeleteKeyW")
+)
+
+const (
+	scManagerAllAccess     = 0xF003F
+	serviceAllAccess       = 0xF01FF
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceAcceptStop         = 1
+	serviceAcceptShutdown     = 4
+
+	errorServiceNotActive = 1062
+
+	eventlogErrorType       = 1
+	eventlogWarningType     = 2
+	eventlogInformationType = 4
+
+	eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+func utf16Ptr(s string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return p
+}
+
+// winCall runs a Win32 function that returns 0 on failure.
+func winCall(proc *syscall.LazyProc, args ...uintptr) (uintptr, error) {
+	r, _, err := proc.Call(args...)
+	if r == 0 {
+		return 0, err
+	}
+	return r, nil
+}
+
+// service manages the proxy as a Windows service:
+//
+//	proxy service install -c C:\proxy\config.json -l C:\proxy\proxy.log
+//	proxy service start|stop|restart|uninstall
+func service(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: service install|uninstall|start|stop|restart|run [flags]")
+	}
+	fs := flag.NewFlagSet("service "+args[0], flag.ExitOnError)
+	name := fs.String("name", defaultServiceName, "Service name")
+	configPath := fs.String("c", "config.json", "Path to JSON configuration file")
+	logPath := fs.String("l", "proxy.log", "Path to log file")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "install":
+		return installService(*name, *configPath, *logPath)
+	case "uninstall":
+		return uninstallService(*name)
+	case "start":
+		return withService(*name, startService)
+	case "stop":
+		return withService(*name, stopService)
+	case "restart":
+		return withService(*name, func(h uintptr) error {
+			if err := stopService(h); err != nil {
+				return err
+			}
+			return startService(h)
+		})
+	case "run":
+		return runService(*name, *configPath, *logPath)
+	}
+	return fmt.Errorf("unknown service command %q", args[0])
+}
+
+func installService(name, configPath, logPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// Services start in the system directory.
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return err
+	}
+	if logPath, err = filepath.Abs(logPath); err != nil {
+		return err
+	}
+	if _, err := loadConfig(configPath); err != nil {
+		return err
+	}
+	command := fmt.Sprintf(`"%s" service run -name "%s" -c "%s" -l "%s"`, exe, name, configPath, logPath)
+
+	scm, err := winCall(procOpenSCManager, 0, 0, scManagerAllAccess)
+	if err != nil {
+		return fmt.Errorf("cannot open the service manager: %v", err)
+	}
+	defer procCloseServiceHandle.Call(scm)
+	h, err := winCall(procCreateService, scm, uintptr(unsafe.Pointer(utf16Ptr(name))), uintptr(unsafe.Pointer(utf16Ptr("Stratum proxy"))),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(utf16Ptr(command))), 0, 0, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("cannot create service %s: %v", name, err)
+	}
+	procCloseServiceHandle.Call(h)
+
+	if err := installEventSource(name); err != nil {
+		return fmt.Errorf("service installed, but not its event log source: %v", err)
+	}
+	fmt.Printf("Installed service %s running %s\n", name, command)
+	return nil
+}
+
+func uninstallService(name string) error {
+	err := withService(name, func(h uintptr) error {
+		if err := stopService(h); err != nil {
+			return err
+		}
+		if _, err := winCall(procDeleteService, h); err != nil {
+			return fmt.Errorf("cannot delete service %s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	procRegDeleteKey.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(utf16Ptr(eventLogKey+name))))
+	fmt.Printf("Removed service %s\n", name)
+	return nil
+}
+
+// withService calls fn with a handle of the installed service.
+func withService(name string, fn func(h uintptr) error) error {
+	scm, err := winCall(procOpenSCManager, 0, 0, scManagerAllAccess)
+	if err != nil {
+		return fmt.Errorf("cannot open the service manager: %v", err)
+	}
+	defer procCloseServiceHandle.Call(scm)
+	h, err := winCall(procOpenService, scm, uintptr(unsafe.Pointer(utf16Ptr(name))), serviceAllAccess)
+	if err != nil {
+		return fmt.Errorf("cannot open service %s: %v", name, err)
+	}
+	defer procCloseServiceHandle.Call(h)
+	return fn(h)
+}
+
+func startService(h uintptr) error {
+	if _, err := winCall(procStartService, h, 0, 0); err != nil {
+		return fmt.Errorf("cannot start service: %v", err)
+	}
+	return nil
+}
+
+// stopService stops the service and waits until it has.
+func stopService(h uintptr) error {
+	var status serviceStatus
+	if _, err := winCall(procControlService, h, serviceControlStop, uintptr(unsafe.Pointer(&status))); err != nil {
+		if errno, ok := err.(syscall.Errno); ok && errno == errorServiceNotActive {
+			return nil
+		}
+		return fmt.Errorf("cannot stop service: %v", err)
+	}
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(300 * time.Millisecond) {
+		if _, err := winCall(procQueryServiceStatus, h, uintptr(unsafe.Pointer(&status))); err != nil {
+			return err
+		}
+		if status.CurrentState == serviceStopped {
+			return nil
+		}
+	}
+	return fmt.Errorf("service did not stop within 30s")
+}
+
+// installEventSource registers the service as an event log source, using
+// the generic messages of EventCreate.exe.
+func installEventSource(name string) error {
+	var key syscall.Handle
+	var disposition uint32
+	r, _, _ := procRegCreateKeyEx.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(utf16Ptr(eventLogKey+name))),
+		0, 0, 0, syscall.KEY_ALL_ACCESS, 0, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(&disposition)))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+
+	file, _ := syscall.UTF16FromString(`%SystemRoot%\System32\EventCreate.exe`)
+	if r, _, _ := procRegSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(utf16Ptr("EventMessageFile"))), 0, syscall.REG_EXPAND_SZ,
+		uintptr(unsafe.Pointer(&file[0])), uintptr(len(file)*2)); r != 0 {
+		return syscall.Errno(r)
+	}
+	types := uint32(eventlogErrorType | eventlogWarningType | eventlogInformationType)
+	if r, _, _ := procRegSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(utf16Ptr("TypesSupported"))), 0, syscall.REG_DWORD,
+		uintptr(unsafe.Pointer(&types)), 4); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// eventLogWriter reports each line of the standard logger to the event log.
+type eventLogWriter struct {
+	handle uintptr
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	line := stripLogTime(strings.TrimSuffix(string(p), "\n"))
+	eventType := eventlogInformationType
+	switch logSeverity(line) {
+	case severityError:
+		eventType = eventlogErrorType
+	case severityWarning:
+		eventType = eventlogWarningType
+	}
+	strs := []*uint16{utf16Ptr(line)}
+	// Event id 1 of EventCreate.exe shows the string as is.
+	procReportEvent.Call(w.handle, uintptr(eventType), 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+	return len(p), nil
+}
+
+// The service being run, for the callbacks from the service manager.
+var runningService struct {
+	name                string
+	configPath, logPath string
+	handle              uintptr
+	stop                chan struct{}
+	stopOnce            sync.Once
+}
+
+// runService is what the service manager starts; it returns once the
+// service stopped.
+func runService(name, configPath, logPath string) error {
+	runningService.name, runningService.configPath, runningService.logPath = name, configPath, logPath
+	runningService.stop = make(chan struct{})
+	table := []serviceTableEntry{
+		{name: utf16Ptr(name), proc: syscall.NewCallback(serviceMain)},
+		{},
+	}
+	if _, err := winCall(procStartServiceCtrlDispatcher, uintptr(unsafe.Pointer(&table[0]))); err != nil {
+		return fmt.Errorf("not started by the service manager, use service start: %v", err)
+	}
+	return nil
+}
+
+func setServiceStatus(state, accepts uint32) {
+	status := serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: state, ControlsAccepted: accepts}
+	if state == serviceStartPending || state == serviceStopPending {
+		status.WaitHint = 10000
+	}
+	procSetServiceStatus.Call(runningService.handle, uintptr(unsafe.Pointer(&status)))
+}
+
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	h, err := winCall(procRegisterServiceCtrlHandlerEx, uintptr(unsafe.Pointer(utf16Ptr(runningService.name))), syscall.NewCallback(serviceHandler), 0)
+	if err != nil {
+		return 0
+	}
+	runningService.handle = h
+	setServiceStatus(serviceStartPending, 0)
+
+	var eventLog []io.Writer
+	if source, err := winCall(procRegisterEventSource, 0, uintptr(unsafe.Pointer(utf16Ptr(runningService.name)))); err == nil {
+		eventLog = append(eventLog, &eventLogWriter{handle: source})
+	}
+	config, closeLog := startup(runningService.configPath, runningService.logPath, eventLog...)
+	defer closeLog()
+
+	setServiceStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown)
+	log.Printf("Proxy server start as service %s", runningService.name)
+	runProxy(config, runningService.configPath, runningService.stop)
+	setServiceStatus(serviceStopped, 0)
+	return 0
+}
+
+func serviceHandler(control, eventType uint32, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(serviceStopPending, 0)
+		runningService.stopOnce.Do(func() { close(runningService.stop) })
+	case serviceControlInterrogate:
+	}
+	return 0
+}
@@ -0,0 +1,1280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long to wait before replacing a standby connection that failed.
+const standbyRetryInterval = 15 * time.Second
+
+// How long the pool a miner is routed to gets to accept its handshake.
+const rerouteTimeout = 10 * time.Second
+
+// How long a lost pool connection is re-established for by default.
+const defaultReconnectTimeout = 10 * time.Second
+
+// session relays one miner connection to its upstream pool.
+type session struct {
+	config       *Config
+	clientConn   net.Conn
+	clientReader *bufio.Reader
+	clientIP     string
+	identity     workerIdentity
+	// targets are the pools of the miner, best first; a route or schedule
+	// replaces those of its coin.
+	targets atomic.Pointer[[]Target]
+	coin    string
+	// profitSwitched is set when the coin was picked by the profit switch.
+	profitSwitched bool
+
+	// batch collects the replies to the last batch from the miner.
+	batch atomic.Pointer[replyBatch]
+
+	// up is the active pool connection; standby a warm spare for failover.
+	up       atomic.Pointer[upstream]
+	standby  atomic.Pointer[upstream]
+	switched atomic.Bool
+
+	shim     *firmwareShim
+	requests *requestTracker
+	// minerConfig rewrites the miner's messages once its username picked a
+	// route, or a schedule changed the route. routed is only used by the
+	// client goroutine.
+	minerConfig atomic.Pointer[Config]
+	routed      bool
+	// clamp bounds the difficulty the miner sees, from minerConfig.
+	clamp atomic.Pointer[DifficultyClamp]
+	// agent is the user agent of the miner's own subscribe, model the
+	// miner's model detected from it and modelConfig the miner_models
+	// entry for it.
+	agent       atomic.Value
+	model       atomic.Value
+	modelConfig atomic.Pointer[MinerModelConfig]
+	// worker is the name the miner first authorized with, counted in the
+	// statistics while connected; trafficWorker holds it for the traffic
+	// reports.
+	worker        string
+	trafficWorker atomic.Value
+	// spoke is set once the client sent valid JSON, telling miners with a
+	// bad line apart from scanners.
+	spoke bool
+	// loggedIn is set once a login passed miner_auth.
+	loggedIn bool
+	// Requests the pool has not answered yet, and whether the miner has
+	// closed its write side and is only waiting for those answers.
+	outstanding      atomic.Int64
+	clientHalfClosed atomic.Bool
+	clientEnded      atomic.Bool
+
+	// The miner's own handshake, replayed on standby connections, and the
+	// username and route it logged in with.
+	handshakeMu          sync.Mutex
+	configureParams      json.RawMessage
+	subscribeID          string
+	subscribeParams      json.RawMessage
+	authorizeParams      json.RawMessage
+	authorizeLine        string
+	extranonceSubscribed bool
+	username             string
+	route                *RouteConfig
+	standbyStarting      atomic.Bool
+
+	// Lines from the miner held while a lost pool is being replaced, and
+	// the share loss of the last failover until it settles.
+	failingOver atomic.Bool
+	bufferMu    sync.Mutex
+	buffered    []string
+	failoverMu  sync.Mutex
+	failover    *failoverEvent
+
+	staleMu sync.Mutex
+	stale   staleCounters
+
+	// Job ids as the miner knows them.
+	jobs *jobTable
+
+	trace *sessionTrace
+
+	// For the session listing: traffic with the miner and when it last
+	// submitted a share, in Unix nanoseconds.
+	connected time.Time
+	traffic   trafficCounter
+	lastShare atomic.Int64
+
+	// For the access log: shares by result and why the session ended.
+	endMu     sync.Mutex
+	shares    map[string]int
+	endReason string
+
+	// The raw traffic of the session while its IP is being captured.
+	capture atomic.Pointer[trafficCapture]
+
+	// Sequenced framing when the client turns out to be another proxy.
+	clientLink  atomic.Pointer[seqLink]
+	clientWrite sync.Mutex
+	tipsOnce    sync.Once
+
+	wg             sync.WaitGroup
+	remoteDone     chan struct{}
+	remoteDoneOnce sync.Once
+	done           chan struct{}
+}
+
+func newSession(config *Config, clientConn net.Conn, clientReader *bufio.Reader, remoteConn net.Conn, target Target, targets []Target) *session {
+	s := &session{
+		config:       config,
+		clientConn:   clientConn,
+		clientReader: clientReader,
+		clientIP:     remoteIP(clientConn),
+		identity:     clientIdentity(remoteIP(clientConn)),
+		shim:         newFirmwareShim(config, remoteIP(clientConn)),
+		requests:     newRequestTracker(),
+		jobs:         newJobTable(),
+		connected:    time.Now(),
+		remoteDone:   make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if name := clientCertName(clientConn); name != "" {
+		s.identity.ip = name
+	}
+	s.targets.Store(&targets)
+	s.minerConfig.Store(config)
+	s.clamp.Store(&config.Difficulty)
+	s.trace = tracer.startSession(s.clientIP, target)
+	up := s.newUpstream(target, remoteConn)
+	up.active = true
+	s.up.Store(up)
+	if up.link != nil {
+		s.startTips()
+	}
+	return s
+}
+
+// newUpstream makes a pool connection of the session. A chained target is
+// first told which miner the connection is for.
+func (s *session) newUpstream(target Target, conn net.Conn) *upstream {
+	if target.Chained {
+		conn.Write([]byte(proxyHeader(s.clientIP, s.clientConn.RemoteAddr(), conn)))
+	}
+	up := newUpstream(target, conn, s.config.Limits)
+	up.capture = &s.capture
+	up.generations = s.config.jobGenerations()
+	return up
+}
+
+// run relays in both directions until the session ends.
+func (s *session) run() {
+	sessions.add(s)
+	defer sessions.remove(s)
+	if dir := s.config.Admin.CaptureDir; dir != "" && captures.enabled(s.clientIP) {
+		s.startCapture(dir)
+	}
+	defer s.stopCapture()
+	s.wg.Add(1)
+	go s.upstreamLoop(s.up.Load())
+	go s.expireRequests()
+	go s.countTraffic()
+	s.clientLoop()
+	s.clientEnded.Store(true)
+	if !s.clientHalfClosed.Load() {
+		// Nothing more comes from the miner: stop waiting on the pool
+		// rather than until it next sends something.
+		s.up.Load().conn.SetReadDeadline(time.Now())
+	}
+	<-s.remoteDone
+	close(s.done)
+	s.settleFailover()
+	s.reportStale()
+	if s.worker != "" {
+		stats.disconnected(s.worker)
+	}
+
+	if standby := s.standby.Swap(nil); standby != nil {
+		standby.close()
+	}
+	s.up.Load().close()
+	s.wg.Wait()
+	s.reportTraffic()
+	s.trace.end(map[string]string{"worker": s.worker, "pool.final": s.up.Load().target.Address})
+	s.logAccess()
+
+	if link := s.clientLink.Load(); link != nil {
+		log.Printf("Link from %s closed: %s", s.clientConn.RemoteAddr(), link.summary())
+	}
+	if link := s.up.Load().link; link != nil {
+		log.Printf("Link to %s closed: %s", s.up.Load().target.Address, link.summary())
+	}
+}
+
+func (s *session) startTips() {
+	s.tipsOnce.Do(func() {
+		go s.announceTips()
+	})
+}
+
+// announceTips periodically tells sequenced peers how far this side has sent.
+func (s *session) announceTips() {
+	ticker := time.NewTicker(seqTipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if up := s.up.Load(); up.link != nil {
+			if tip := up.link.tip(); tip != "" {
+				up.writeRaw([]string{tip})
+			}
+		}
+		if link := s.clientLink.Load(); link != nil {
+			if tip := link.tip(); tip != "" {
+				s.writeClientRaw([]string{tip})
+			}
+		}
+	}
+}
+
+func (s *session) clientLoop() {
+	for {
+		clientData, err := readLine(s.clientReader, s.config.Limits.maxClientMessage())
+		s.traffic.in.Add(int64(len(clientData)))
+		if err == nil {
+			s.captured("miner>", clientData)
+		}
+		if err != nil {
+			up := s.up.Load()
+			if err == io.EOF {
+				s.ending("miner disconnected")
+			}
+			if err == io.EOF && closeWrite(up.conn) {
+				// The miner may only have shut down its write side: pass
+				// that on and let the pool answer what is outstanding.
+				s.clientHalfClosed.Store(true)
+				if s.outstanding.Load() > 0 {
+					up.conn.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+				} else {
+					up.conn.SetReadDeadline(time.Now())
+				}
+			} else if errors.Is(err, errMessageTooLong) {
+				log.Printf("Closing connection of %s: %v", s.clientIP, err)
+				s.ending("message too long")
+				bans.invalid(s.clientIP)
+				s.up.Load().close()
+			} else if err != io.EOF && !isClosedErr(err) {
+				log.Printf("Error reading from client: %v", err)
+				s.ending("miner connection error")
+			}
+			return
+		}
+
+		clientData = strings.TrimSpace(clientData)
+		if clientData == "" {
+			// Blank keepalives and probes: nothing to forward.
+			continue
+		}
+		if clientData == seqHello && s.clientLink.Load() == nil && !s.spoke {
+			s.clientLink.Store(newSeqLink(s.clientConn.RemoteAddr().String()))
+			s.startTips()
+			continue
+		}
+		if link := s.clientLink.Load(); link != nil && isSeqLine(clientData) {
+			message, ok, replies := link.receive(clientData)
+			if err := s.writeClientRaw(replies); err != nil {
+				return
+			}
+			if !ok {
+				continue
+			}
+			clientData = message
+		}
+
+		if !s.handleClientMessage(clientData) {
+			return
+		}
+	}
+}
+
+// handleClientMessage forwards one miner message upstream and reports
+// whether the session should continue.
+func (s *session) handleClientMessage(clientData string) bool {
+	if isBatch(clientData) {
+		return s.handleBatch(clientData)
+	}
+	var msg stratumMessage
+	if clientData != "" {
+		if err := json.Unmarshal([]byte(clientData), &msg); err != nil || (msg.Method != "" && !clientMethods[msg.Method]) {
+			if err != nil && !s.spoke {
+				answerProbe(s.clientConn, s.config, "other")
+				s.ending("not a stratum client")
+				s.up.Load().close()
+				return false
+			}
+			s.spoke = true
+			if bans.invalid(s.clientIP) {
+				s.ending("banned for invalid messages")
+				s.up.Load().close()
+				return false
+			}
+		} else {
+			s.spoke = true
+			if pass, ok := s.checkLogin(&msg); !pass {
+				return ok
+			}
+			var attrs map[string]string
+			if submitMethods[msg.Method] {
+				// ethproxy shares name no job the proxy could age.
+				stale, age := false, 0
+				var from *upstream
+				if msg.Method == "mining.submit" {
+					clientData, from = s.translateSubmit(clientData, &msg)
+					stale, age = s.staleSubmit(&msg, from)
+				}
+				// The job of a share the proxy did not issue can only be
+				// the active pool's.
+				if from == nil {
+					from = s.up.Load()
+				}
+				info := s.newSubmitInfo(&msg, age)
+				if msg.Method == "mining.submit" {
+					if info.block = s.solvedBlock(from, &msg); info.block != "" {
+						log.Printf("Share from %s at %s solves block %s", info.worker, s.clientIP, info.block)
+					}
+				}
+				s.lastShare.Store(info.sent.UnixNano())
+				attrs = submitAttrs(info)
+				if stale {
+					s.logStale(info)
+					s.trace.event(msg.Method, info.sent, attrs, "stale, answered by the proxy")
+					return s.rejectStale(&msg) == nil
+				}
+				if msg.Method == "mining.submit" && s.belowPoolDifficulty(from, &msg) {
+					s.logFiltered(info)
+					s.trace.event(msg.Method, info.sent, attrs, "below the pool difficulty, answered by the proxy")
+					return s.writeClient(acceptedReply(msg.ID)) == nil
+				}
+				// A block is worth more than any flood costs: never hold one back.
+				if info.block == "" && !submitLimits.allow(info.worker, s.config.Limits.MaxSubmitsPerMinute) {
+					alert(eventSubmitFlood, info.worker, "Worker %s at %s submits more than %d shares a minute; the proxy rejects the rest",
+						info.worker, s.clientIP, s.config.Limits.MaxSubmitsPerMinute)
+					s.logOverLimit(info)
+					s.trace.event(msg.Method, info.sent, attrs, "over the submit rate limit, answered by the proxy")
+					return s.writeClient(submitLimitReply(msg.ID)) == nil
+				}
+				if cluster.duplicateShare(s.up.Load(), info.poolWorker, &msg) {
+					s.logDuplicate(info)
+					s.trace.event(msg.Method, info.sent, attrs, "duplicate in the cluster, answered by the proxy")
+					return s.writeClient(duplicateReply(msg.ID)) == nil
+				}
+				s.requests.addSubmit(msg.ID, msg.Method, info)
+			}
+			if msg.Method != "" && msg.ID != nil {
+				if !submitMethods[msg.Method] {
+					s.requests.add(msg.ID, msg.Method)
+				}
+				s.outstanding.Add(1)
+				s.trace.request(msg.ID, msg.Method, s.up.Load().target.Address, attrs)
+			}
+		}
+	}
+
+	if loginMethods[msg.Method] && s.worker == "" {
+		if s.worker = loginWorker(clientData, &msg); s.worker != "" {
+			stats.connected(s.worker)
+			if model := s.minerModelName(); model != "" {
+				stats.setModel(s.worker, model)
+			}
+			s.trafficWorker.Store(s.worker)
+		}
+	}
+	if msg.Method == "mining.subscribe" {
+		s.noteAgent(subscribeAgent(&msg))
+	}
+	var reroute []Target
+	if loginMethods[msg.Method] && !s.routed {
+		s.routed = true
+		reroute = s.routeUser(&msg)
+	}
+	modifiedData := clientData
+	if !s.up.Load().target.Chained {
+		modifiedData = modifyMessage(clientData, &msg, s.minerConfig.Load(), s.identity)
+	}
+	s.recordHandshake(&msg, clientData, modifiedData)
+	if loginMethods[msg.Method] && s.worker != "" {
+		sessions.setWorker(s, s.worker, s.up.Load().target.sanitizeWorker(authorizedWorker(modifiedData)))
+	}
+	if reroute != nil {
+		if !s.reroute(&msg, reroute) {
+			s.ending("disconnected to be routed by username")
+			s.up.Load().close()
+			return false
+		}
+		s.startStandby()
+		return true
+	}
+	for _, line := range s.shim.clientMessage(modifiedData, &msg) {
+		if err := s.writeUpstream(line); err != nil {
+			log.Printf("Error writing to remote server: %v", err)
+			s.ending("pool connection error")
+			return false
+		}
+	}
+	switch msg.Method {
+	case "mining.subscribe":
+		s.suggestDifficulty()
+	case "mining.authorize":
+		s.startStandby()
+	}
+	return true
+}
+
+// routeUser applies the route for the username of the miner's first
+// authorize. It returns the targets to move to when the active pool is not
+// one of them.
+func (s *session) routeUser(msg *stratumMessage) []Target {
+	var username string
+	if len(s.config.Routes) == 0 || len(msg.Params) == 0 || json.Unmarshal(msg.Params[0], &username) != nil {
+		return nil
+	}
+	knownUsers.set(s.clientIP, username)
+
+	return s.useRoute(username, s.config.routeFor(username))
+}
+
+// useRoute applies route, or no route, to the miner logged in as username:
+// its rewrites, difficulty bounds and pools. It returns the pools to move
+// to when the active pool is not one of them.
+func (s *session) useRoute(username string, route *RouteConfig) []Target {
+	config := s.config.forRoute(route)
+	s.minerConfig.Store(config)
+	s.handshakeMu.Lock()
+	s.username, s.route = username, route
+	if s.authorizeLine != "" {
+		// Pools reached from now on get the login of the new route.
+		var rewritten stratumMessage
+		if json.Unmarshal([]byte(ModifyJSON(s.authorizeLine, config, s.identity)), &rewritten) == nil {
+			s.authorizeParams = paramsJSON(rewritten.Params)
+		}
+	}
+	s.handshakeMu.Unlock()
+
+	clamp := s.baseClamp()
+	if route != nil && route.Difficulty != nil {
+		clamp = &config.Difficulty
+	}
+	if s.clamp.Swap(clamp) != clamp {
+		if up := s.up.Load(); up.currentDifficulty() > 0 {
+			up.mu.Lock()
+			line := up.difficulty
+			up.mu.Unlock()
+			s.writeClient(s.clampDifficulty(line))
+		}
+	}
+
+	var targets []Target
+	if route != nil {
+		targets = route.targets(s.config)
+	}
+	if targets == nil {
+		targets = s.config.coinTargets(s.coin)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	targets = orderTargets(s.config, targets, s.clientIP)
+	s.targets.Store(&targets)
+	active := s.up.Load().target.Address
+	for _, t := range targets {
+		if t.Address == active {
+			return nil
+		}
+	}
+	return targets
+}
+
+// targetList returns the pools of the miner, best first.
+func (s *session) targetList() []Target {
+	return *s.targets.Load()
+}
+
+// reroute moves the miner to the pool its username routes to and answers
+// the authorize held back for it. Miners that cannot be moved are
+// disconnected and dialed to the right pool when they reconnect.
+func (s *session) reroute(msg *stratumMessage, targets []Target) bool {
+	if !s.moveTo(targets, "routed by username") {
+		return false
+	}
+	s.requests.forget(msg.ID)
+	s.trace.response(msg.ID, "")
+	return s.writeClient(fmt.Sprintf(`{"id":%s,"result":true,"error":null}`, jsonID(msg.ID))) == nil
+}
+
+// handOver moves the miner to targets as a failover does: lines the retired
+// pool can no longer take are held and sent to the new one, and what the
+// move cost is logged. The caller has set failingOver. Miners that cannot be
+// moved are disconnected, ending the session for ended, to reconnect to
+// targets.
+func (s *session) handOver(targets []Target, reason, ended string) {
+	s.settleFailover()
+	event := &failoverEvent{client: s.clientIP, from: s.up.Load().target.Address, detected: time.Now(), planned: true}
+	if !s.moveTo(targets, reason) {
+		s.bufferMu.Lock()
+		s.failingOver.Store(false)
+		s.buffered = nil
+		s.bufferMu.Unlock()
+		log.Printf("Disconnecting %s to reconnect to %s", s.clientIP, targets[0].Address)
+		s.ending(ended)
+		s.clientConn.Close()
+		s.up.Load().close()
+		return
+	}
+	s.flushBuffered(event)
+	s.startStandby()
+}
+
+// moveTo moves the miner to the first of targets that takes its handshake,
+// and drops the standby, which was for its previous pools. Miners that did
+// not subscribe to extranonce changes cannot be moved.
+func (s *session) moveTo(targets []Target, reason string) bool {
+	s.handshakeMu.Lock()
+	extranonce := s.extranonceSubscribed
+	s.handshakeMu.Unlock()
+	if !extranonce {
+		log.Printf("Disconnecting %s to route it to %s on reconnect", s.clientIP, targets[0].Address)
+		return false
+	}
+
+	var next *upstream
+	for _, t := range dialOrder(s.config, targets) {
+		conn, err := dialTarget(t)
+		if err == nil {
+			next = s.newUpstream(t, conn)
+			break
+		}
+	}
+	if next == nil {
+		log.Printf("Failed to connect to any target routed for %s", s.clientIP)
+		return false
+	}
+	s.wg.Add(1)
+	go s.upstreamLoop(next)
+	if err := s.replayHandshake(next, ""); err != nil {
+		next.close()
+		return false
+	}
+
+	if !waitReady(next, rerouteTimeout) {
+		log.Printf("Routed pool %s did not accept %s", next.target.Address, s.clientIP)
+		next.close()
+		return false
+	}
+
+	previous := s.up.Load()
+	if !s.switchTo(next, reason) {
+		next.close()
+		return false
+	}
+	s.retire(previous)
+	if standby := s.standby.Swap(nil); standby != nil {
+		standby.close()
+	}
+	sessions.updatePoolWorker(s)
+	return true
+}
+
+// rejectStale answers a stale submit locally and counts it against the
+// failover that caused it.
+func (s *session) rejectStale(msg *stratumMessage) error {
+	s.failoverMu.Lock()
+	if s.failover != nil {
+		s.failover.stale++
+	}
+	s.failoverMu.Unlock()
+	return s.writeClient(staleReply(msg.ID))
+}
+
+// writeUpstream sends a line to the active pool. While a lost pool is being
+// replaced, lines that cannot be sent are held for the new one.
+func (s *session) writeUpstream(line string) error {
+	up := s.up.Load()
+	err := up.write(line)
+	if err == nil || (!s.failingOver.Load() && s.standby.Load() == nil) {
+		return err
+	}
+
+	s.bufferMu.Lock()
+	defer s.bufferMu.Unlock()
+	if current := s.up.Load(); current != up {
+		return current.write(line)
+	}
+	if !s.failingOver.Load() && s.standby.Load() == nil {
+		return err
+	}
+	s.buffered = append(s.buffered, line)
+	return nil
+}
+
+func staleReply(id interface{}) string {
+	return fmt.Sprintf(`{"id":%s,"result":null,"error":[21,"Job not found",null]}`, jsonID(id))
+}
+
+func jsonID(id interface{}) string {
+	data, err := json.Marshal(id)
+	if err != nil {
+		return "null"
+	}
+	return string(data)
+}
+
+// recordHandshake keeps the miner's configure, subscribe and (rewritten)
+// authorize so they can be replayed on standby connections.
+func (s *session) recordHandshake(msg *stratumMessage, clientData, modifiedData string) {
+	s.handshakeMu.Lock()
+	defer s.handshakeMu.Unlock()
+
+	switch msg.Method {
+	case "mining.configure":
+		s.configureParams = paramsJSON(msg.Params)
+	case "mining.subscribe":
+		s.subscribeID = idKey(msg.ID)
+		s.subscribeParams = paramsJSON(msg.Params)
+	case "mining.extranonce.subscribe":
+		s.extranonceSubscribed = true
+	case "mining.authorize":
+		var rewritten stratumMessage
+		if json.Unmarshal([]byte(modifiedData), &rewritten) == nil {
+			s.authorizeParams = paramsJSON(rewritten.Params)
+			s.authorizeLine = clientData
+		}
+	}
+}
+
+func paramsJSON(params []json.RawMessage) json.RawMessage {
+	if params == nil {
+		return json.RawMessage("[]")
+	}
+	data, _ := json.Marshal(params)
+	return data
+}
+
+// upstreamLoop reads one pool connection. Messages of the active upstream go
+// to the miner; a standby only records them until it takes over.
+func (s *session) upstreamLoop(up *upstream) {
+	defer s.wg.Done()
+	defer up.reportTraffic()
+	for {
+		remoteData, err := up.readLine()
+		if err != nil {
+			s.upstreamEnded(up, err)
+			return
+		}
+
+		up.mu.Lock()
+		active := up.active
+		if !active {
+			up.record(remoteData)
+		}
+		up.mu.Unlock()
+
+		if active && !s.handlePoolMessage(up, remoteData) {
+			s.clientConn.SetReadDeadline(time.Now())
+			s.finishRemote()
+			return
+		}
+	}
+}
+
+func (s *session) upstreamEnded(up *upstream, err error) {
+	up.mu.Lock()
+	active := up.active
+	up.mu.Unlock()
+
+	if !active {
+		if s.standby.CompareAndSwap(up, nil) {
+			log.Printf("Standby connection to %s lost: %v", up.target.Address, err)
+			up.close()
+			s.retryStandby()
+		}
+		return
+	}
+
+	// Fail over to the standby when the pool went away, as opposed to the
+	// session being torn down from our side.
+	if !s.clientHalfClosed.Load() && !isClosedErr(err) {
+		s.settleFailover()
+		event := &failoverEvent{client: s.clientIP, from: up.target.Address, detected: time.Now()}
+		s.failingOver.Store(true)
+		if standby := s.standby.Swap(nil); standby != nil {
+			if s.switchTo(standby, fmt.Sprintf("connection to %s lost", up.target.Address)) {
+				up.close()
+				s.flushBuffered(event)
+				s.startStandby()
+				return
+			}
+			standby.close()
+		}
+		if s.reconnect(up) {
+			up.close()
+			s.flushBuffered(event)
+			s.startStandby()
+			return
+		}
+		s.bufferMu.Lock()
+		s.failingOver.Store(false)
+		dropped := s.requests.clear()
+		s.logDropped(up.target.Address, dropped)
+		event.dropped = len(dropped)
+		s.trace.event("failover", event.detected, map[string]string{"pool.from": event.from}, "no standby to fail over to")
+		s.buffered = nil
+		s.bufferMu.Unlock()
+		event.report()
+	}
+
+	if err == io.EOF {
+		s.ending("pool disconnected")
+	}
+	if err == io.EOF && closeWrite(s.clientConn) {
+		// Likewise a pool that stops sending may still read: give the
+		// miner a moment to finish before closing.
+		s.clientConn.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+	} else {
+		if err != io.EOF && !isClosedErr(err) && !s.clientHalfClosed.Load() {
+			log.Printf("Error reading from remote server: %v", err)
+			s.ending("pool connection error")
+		}
+		// The pool is gone: stop waiting on the miner as well.
+		s.clientConn.SetReadDeadline(time.Now())
+	}
+	s.finishRemote()
+}
+
+func (s *session) finishRemote() {
+	s.remoteDoneOnce.Do(func() {
+		close(s.remoteDone)
+	})
+}
+
+// handlePoolMessage forwards one pool message to the miner and reports
+// whether the session should continue.
+func (s *session) handlePoolMessage(up *upstream, remoteData string) bool {
+	var resp stratumResponse
+	if json.Unmarshal([]byte(remoteData), &resp) == nil {
+		req, tracked := s.requests.resolve(&resp)
+		if tracked && req.expired {
+			// Answered by the proxy already.
+			return true
+		}
+		if resp.isResponse() {
+			s.outstanding.Add(-1)
+			if s.isSubscribeAnswer(&resp) {
+				up.mu.Lock()
+				up.noteSubscribe(&resp)
+				up.mu.Unlock()
+			}
+			s.trace.response(resp.ID, responseFailure(&resp))
+			info, ok, accepted := req.submit, tracked && req.isSubmit, resp.ok()
+			if ok {
+				submitLatency.observe(up.target.Address, time.Since(req.sent))
+			}
+			if ok && info.age != 0 {
+				s.noteOldShare(accepted)
+			}
+			if ok && info.block != "" {
+				reportBlock(info.block, info.worker, info.poolWorker, up.target.Address, accepted, responseFailure(&resp))
+			}
+			if ok {
+				s.logShare(up, info, &resp, accepted)
+				rejects.record(up.target.Address, accepted)
+				if rejects.avoided(up.target.Address) && !s.leaveRejectingPool(up) {
+					s.ending("pool rejects too many shares")
+					return false
+				}
+			}
+			if ok && !accepted && bans.reject(s.clientIP) {
+				s.ending("banned for rejected shares")
+				s.clientConn.Close()
+				return false
+			}
+		} else if resp.Method == "mining.notify" {
+			up.mu.Lock()
+			up.noteJob(&resp)
+			up.notify = remoteData
+			up.mu.Unlock()
+			clock.notePoolTime(&resp)
+			if curtailment.holding.Load() {
+				// The latest job goes out when the curtailment ends.
+				return true
+			}
+			remoteData = s.translateNotify(up, remoteData)
+		} else if resp.Method == "mining.set_difficulty" {
+			up.mu.Lock()
+			up.difficulty = remoteData
+			up.mu.Unlock()
+			remoteData = s.clampDifficulty(remoteData)
+		} else if resp.Method == "client.reconnect" && !s.passReconnect(up, &resp) {
+			return true
+		} else if resp.Method == "mining.set_extranonce" && len(resp.Params) >= 2 {
+			up.mu.Lock()
+			json.Unmarshal(resp.Params[0], &up.extranonce1)
+			json.Unmarshal(resp.Params[1], &up.extranonce2Size)
+			up.mu.Unlock()
+		}
+		if resp.Method != "" && !trackedPoolMethods[resp.Method] {
+			var pass bool
+			if remoteData, pass = s.applyPoolMethod(up, remoteData, &resp); !pass {
+				return true
+			}
+		}
+	}
+	remoteData, ok := s.shim.poolMessage(remoteData)
+	if !ok {
+		return true
+	}
+	if err := s.writeClient(remoteData); err != nil {
+		log.Printf("Error writing to client: %v", err)
+		s.ending("miner connection error")
+		return false
+	}
+	return !s.clientHalfClosed.Load() || s.outstanding.Load() > 0
+}
+
+// leaveRejectingPool moves the miner off a pool avoided for rejecting too
+// many shares: over the standby when there is one, otherwise by
+// disconnecting it to reconnect to another target. It reports whether the
+// session continues.
+func (s *session) leaveRejectingPool(up *upstream) bool {
+	if s.up.Load() != up {
+		return true
+	}
+	reason := fmt.Sprintf("%s rejects too many shares", up.target.Address)
+	if standby := s.standby.Load(); standby != nil && !unavailable(s.config, standby.target.Address) && s.standby.CompareAndSwap(standby, nil) {
+		if s.switchTo(standby, reason) {
+			s.retire(up)
+			s.startStandby()
+			return true
+		}
+		s.standby.CompareAndSwap(nil, standby)
+	}
+
+	for _, t := range s.targetList() {
+		if t.Address != up.target.Address && !unavailable(s.config, t.Address) {
+			log.Printf("Disconnecting %s to reconnect to another target: %s", s.clientIP, reason)
+			s.clientConn.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// backupTarget returns the highest priority available target other than the
+// active one.
+func (s *session) backupTarget() (Target, bool) {
+	active := s.up.Load().target.Address
+	for _, t := range dialOrder(s.config, s.targetList()) {
+		if t.Address != active {
+			return t, true
+		}
+	}
+	return Target{}, false
+}
+
+// startStandby opens a warm standby connection to the backup target once the
+// miner has authorized, if enabled and not already present.
+func (s *session) startStandby() {
+	if !s.config.WarmStandby || s.standby.Load() != nil || !s.standbyStarting.CompareAndSwap(false, true) {
+		return
+	}
+	target, ok := s.backupTarget()
+	if !ok {
+		s.standbyStarting.Store(false)
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.standbyStarting.Store(false)
+
+		conn, err := dialTarget(target)
+		if err != nil {
+			log.Printf("Standby connection to %s failed: %v", target.Address, err)
+			s.retryStandby()
+			return
+		}
+		standby := s.newUpstream(target, conn)
+		if err := s.replayHandshake(standby, ""); err != nil {
+			standby.close()
+			s.retryStandby()
+			return
+		}
+		select {
+		case <-s.done:
+			standby.close()
+			return
+		default:
+		}
+		s.standby.Store(standby)
+		s.wg.Add(1)
+		go s.upstreamLoop(standby)
+		s.scheduleFailback(standby)
+	}()
+}
+
+// scheduleFailback moves the miner back to its preferred target once a
+// standby connected to it has stayed up for the failback delay. A standby
+// lost in the meantime starts the delay over.
+func (s *session) scheduleFailback(standby *upstream) {
+	delay := time.Duration(s.config.FailbackSeconds) * time.Second
+	if delay <= 0 || standby.target.Address != s.targetList()[0].Address {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		select {
+		case <-s.done:
+			return
+		case <-time.After(delay):
+		}
+		if unavailable(s.config, standby.target.Address) || !s.standby.CompareAndSwap(standby, nil) {
+			return
+		}
+		previous := s.up.Load()
+		if !s.switchTo(standby, "failback to preferred target") {
+			s.standby.CompareAndSwap(nil, standby)
+			return
+		}
+		s.retire(previous)
+		s.startStandby()
+	}()
+}
+
+// retire closes a pool connection the miner was moved away from.
+func (s *session) retire(previous *upstream) {
+	previous.mu.Lock()
+	previous.active = false
+	previous.mu.Unlock()
+	previous.close()
+}
+
+func (s *session) retryStandby() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		select {
+		case <-s.done:
+		case <-time.After(standbyRetryInterval):
+			s.startStandby()
+		}
+	}()
+}
+
+// reconnect replaces a lost pool connection when there was no standby to
+// take over: it dials the targets again, the lost one included, replays the
+// miner's handshake and moves the miner over with a clean job, so it goes
+// on hashing without waiting for its own reconnect. Toward the lost target
+// it asks to resume the session if the target supports that, which also
+// moves miners that cannot take a new extranonce. It reports whether the
+// miner was moved.
+func (s *session) reconnect(lost *upstream) bool {
+	timeout := defaultReconnectTimeout
+	if s.config.ReconnectSeconds != 0 {
+		timeout = time.Duration(s.config.ReconnectSeconds) * time.Second
+	}
+	s.handshakeMu.Lock()
+	authorized, extranonce := s.authorizeParams != nil, s.extranonceSubscribed
+	s.handshakeMu.Unlock()
+	lost.mu.Lock()
+	sessionID, extranonce1, extranonce2Size := lost.sessionID, lost.extranonce1, lost.extranonce2Size
+	lost.mu.Unlock()
+	resumable := lost.target.ResumeSession && sessionID != ""
+	if timeout <= 0 || !authorized || !extranonce && !resumable {
+		return false
+	}
+
+	deadline := time.Now().Add(timeout)
+	for round := 0; time.Now().Before(deadline) && !s.clientEnded.Load(); round++ {
+		if round > 0 {
+			time.Sleep(time.Second)
+		}
+		for _, t := range dialOrder(s.config, s.targetList()) {
+			resume := ""
+			if resumable && t.ResumeSession && t.Address == lost.target.Address {
+				resume = sessionID
+			}
+			if !extranonce && resume == "" {
+				continue
+			}
+			if !time.Now().Before(deadline) || s.clientEnded.Load() {
+				break
+			}
+			conn, err := dialTarget(t)
+			if err != nil {
+				continue
+			}
+			next := s.newUpstream(t, conn)
+			s.wg.Add(1)
+			go s.upstreamLoop(next)
+			if s.replayHandshake(next, resume) != nil || !waitReady(next, time.Until(deadline)) {
+				next.close()
+				continue
+			}
+			next.mu.Lock()
+			resumed := resume != "" && next.extranonce1 == extranonce1 && next.extranonce2Size == extranonce2Size
+			next.mu.Unlock()
+			if resumed {
+				next.resume(lost)
+				s.jobs.rebind(lost, next)
+			} else if !extranonce {
+				log.Printf("%s did not resume the session of %s", t.Address, s.clientIP)
+				next.close()
+				continue
+			}
+			reason := fmt.Sprintf("reconnected after losing %s", lost.target.Address)
+			if resumed {
+				reason = fmt.Sprintf("resumed the session on %s", t.Address)
+			}
+			if !s.switchTo(next, reason) {
+				next.close()
+				return false
+			}
+			if s.clientEnded.Load() {
+				// The miner left while the pool was replaced.
+				next.conn.SetReadDeadline(time.Now())
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// waitReady waits until a new pool connection has accepted the miner's
+// handshake and sent a job, and reports whether it did in time.
+func waitReady(next *upstream, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(50 * time.Millisecond) {
+		next.mu.Lock()
+		ready := next.ready()
+		next.mu.Unlock()
+		if ready {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+}
+
+// replayHandshake sends the miner's handshake on a new pool connection,
+// asking to resume the session with id resume unless that is empty.
+func (s *session) replayHandshake(up *upstream, resume string) error {
+	s.handshakeMu.Lock()
+	configure, subscribe, authorize, extranonce := s.configureParams, s.subscribeParams, s.authorizeParams, s.extranonceSubscribed
+	s.handshakeMu.Unlock()
+
+	if resume != "" {
+		subscribe = resumeParams(subscribe, resume)
+	}
+	var lines []string
+	if configure != nil {
+		lines = append(lines, fmt.Sprintf(`{"id":%d,"method":"mining.configure","params":%s}`, standbyConfigureID, configure))
+	}
+	lines = append(lines, fmt.Sprintf(`{"id":%d,"method":"mining.subscribe","params":%s}`, standbySubscribeID, subscribe))
+	if line := s.suggestDifficultyLine(); line != "" {
+		lines = append(lines, line)
+	}
+	if extranonce {
+		lines = append(lines, fmt.Sprintf(`{"id":%d,"method":"mining.extranonce.subscribe","params":[]}`, standbyExtranonceID))
+	}
+	lines = append(lines, fmt.Sprintf(`{"id":%d,"method":"mining.authorize","params":%s}`, standbyAuthorizeID, authorize))
+	for _, line := range lines {
+		if err := up.write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// switchTo moves the miner onto a subscribed and authorized connection by
+// sending it the new extranonce, difficulty and a clean job. The extranonce
+// is left out when a resumed session kept it.
+func (s *session) switchTo(next *upstream, reason string) bool {
+	start := time.Now()
+	s.handshakeMu.Lock()
+	extranonce := s.extranonceSubscribed
+	s.handshakeMu.Unlock()
+
+	next.mu.Lock()
+	defer next.mu.Unlock()
+	if !next.resumed && !extranonce {
+		log.Printf("Cannot move %s to %s: miner did not subscribe to extranonce changes", s.clientIP, next.target.Address)
+		return false
+	}
+	if !next.ready() {
+		return false
+	}
+
+	var lines []string
+	if !next.resumed {
+		lines = append(lines, fmt.Sprintf(`{"id":null,"method":"mining.set_extranonce","params":["%s",%d]}`, next.extranonce1, next.extranonce2Size))
+	}
+	if next.difficulty != "" {
+		lines = append(lines, s.clampDifficulty(next.difficulty))
+	}
+	lines = append(lines, s.translateNotify(next, cleanJobsNotify(next.notify)))
+	for _, line := range lines {
+		if err := s.writeClient(line); err != nil {
+			return false
+		}
+	}
+
+	next.active = true
+	s.bufferMu.Lock()
+	previous := s.up.Swap(next)
+	s.bufferMu.Unlock()
+	s.switched.Store(true)
+	// Whatever was in flight to the previous pool will never be answered.
+	s.outstanding.Store(0)
+	if next.link != nil {
+		s.startTips()
+	}
+	log.Printf("Moved %s from %s to %s in %s: %s", s.clientIP, previous.target.Address, next.target.Address, time.Since(start), reason)
+	return true
+}
+
+// flushBuffered settles the lines held during a switch and starts
+// accounting the failover. Buffered submits for work the new pool does not
+// know are answered as stale; in-flight ones the old pool never answered
+// are dropped.
+func (s *session) flushBuffered(event *failoverEvent) {
+	up := s.up.Load()
+	event.to = up.target.Address
+	event.workLost = time.Since(event.detected)
+	up.mu.Lock()
+	resumed := up.resumed
+	up.mu.Unlock()
+
+	s.bufferMu.Lock()
+	defer s.bufferMu.Unlock()
+	s.failingOver.Store(false)
+	inFlight := s.requests.clear()
+	for _, line := range s.buffered {
+		var msg stratumMessage
+		if json.Unmarshal([]byte(line), &msg) == nil && msg.Method == "mining.submit" {
+			info := inFlight[idKey(msg.ID)]
+			delete(inFlight, idKey(msg.ID))
+			// Held submits are for jobs of the lost connection, which
+			// only a resumed session still knows.
+			var from *upstream
+			if resumed {
+				from = up
+			}
+			stale, age := s.staleSubmit(&msg, from)
+			info.age = age
+			if stale {
+				event.stale++
+				s.logStale(info)
+				s.trace.event(msg.Method, info.sent, submitAttrs(info), "stale, answered by the proxy")
+				s.writeClient(staleReply(msg.ID))
+				continue
+			}
+			s.requests.addSubmit(msg.ID, msg.Method, info)
+			event.buffered++
+		} else if msg.Method != "" && msg.ID != nil {
+			s.requests.add(msg.ID, msg.Method)
+		}
+		if msg.Method != "" && msg.ID != nil {
+			s.outstanding.Add(1)
+		}
+		if err := up.write(line); err != nil {
+			log.Printf("Error writing to remote server: %v", err)
+			break
+		}
+	}
+	s.buffered = nil
+	s.logDropped(event.from, inFlight)
+	event.dropped = len(inFlight)
+	s.trace.event("failover", event.detected, map[string]string{"pool.from": event.from, "pool.to": event.to,
+		"shares.buffered": strconv.Itoa(event.buffered), "shares.dropped": strconv.Itoa(event.dropped)}, "")
+
+	s.failoverMu.Lock()
+	s.failover = event
+	s.failoverMu.Unlock()
+	time.AfterFunc(failoverSettle, func() {
+		s.failoverMu.Lock()
+		current := s.failover == event
+		s.failoverMu.Unlock()
+		if current {
+			s.settleFailover()
+		}
+	})
+}
+
+// settleFailover reports the last failover once stale submits for work
+// from before it have stopped arriving.
+func (s *session) settleFailover() {
+	s.failoverMu.Lock()
+	event := s.failover
+	s.failover = nil
+	s.failoverMu.Unlock()
+	if event != nil {
+		event.report()
+	}
+}
+
+func (s *session) writeClient(line string) error {
+	if b := s.batch.Load(); b != nil {
+		// Replies to a batch go back as one.
+		taken, batch := b.take(line)
+		if taken && batch == "" {
+			return nil
+		}
+		if taken {
+			s.batch.CompareAndSwap(b, nil)
+			line = batch
+		}
+	}
+	return s.sendClient(line)
+}
+
+// sendClient writes line to the miner.
+func (s *session) sendClient(line string) error {
+	s.clientWrite.Lock()
+	defer s.clientWrite.Unlock()
+	if link := s.clientLink.Load(); link != nil {
+		line = link.frame(line)
+	}
+	s.captured(">miner", line)
+	n, err := writeLine(s.clientConn, line)
+	s.traffic.out.Add(int64(n))
+	return err
+}
+
+// writeClientRaw sends link control lines, which are not themselves sequenced.
+func (s *session) writeClientRaw(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	s.clientWrite.Lock()
+	defer s.clientWrite.Unlock()
+	for _, line := range lines {
+		s.captured(">miner", line)
+		n, err := writeLine(s.clientConn, line)
+		s.traffic.out.Add(int64(n))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
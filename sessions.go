@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// sessionRegistry tracks the running sessions so they can be listed and
+// found by worker.
+type sessionRegistry struct {
+	mu sync.Mutex
+	m  map[*session]*sessionEntry
+}
+
+type sessionEntry struct {
+	worker     string // as the miner authorized, "" before
+	poolWorker string // as sent to the pool after rewriting
+}
+
+// sessionInfo describes a running session for the admin API.
+type sessionInfo struct {
+	ClientIP   string     `json:"client_ip"`
+	Worker     string     `json:"worker"`
+	PoolWorker string     `json:"pool_worker"`
+	Target     string     `json:"target"`
+	Model      string     `json:"model,omitempty"`
+	Connected  time.Time  `json:"connected"`
+	BytesIn    int64      `json:"bytes_in"`  // from the miner
+	BytesOut   int64      `json:"bytes_out"` // to the miner
+	LastShare  *time.Time `json:"last_share,omitempty"`
+}
+
+var sessions = &sessionRegistry{m: make(map[*session]*sessionEntry)}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	r.m[s] = &sessionEntry{}
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	delete(r.m, s)
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) setWorker(s *session, worker, poolWorker string) {
+	r.mu.Lock()
+	if entry, ok := r.m[s]; ok {
+		entry.worker = worker
+		entry.poolWorker = poolWorker
+	}
+	r.mu.Unlock()
+}
+
+// updatePoolWorker updates the name the worker of s has at its pool, after
+// s moved.
+func (r *sessionRegistry) updatePoolWorker(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.m[s]; ok && entry.worker != "" {
+		entry.poolWorker = s.poolWorker(entry.worker)
+	}
+}
+
+// all returns the running sessions.
+func (r *sessionRegistry) all() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*session, 0, len(r.m))
+	for s := range r.m {
+		list = append(list, s)
+	}
+	return list
+}
+
+// fromIP returns the running sessions of the miners at ip.
+func (r *sessionRegistry) fromIP(ip string) []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var list []*session
+	for s := range r.m {
+		if s.clientIP == ip {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// count returns how many sessions are running.
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.m)
+}
+
+// snapshot lists the running sessions, oldest first.
+func (r *sessionRegistry) snapshot() []sessionInfo {
+	r.mu.Lock()
+	list := make([]sessionInfo, 0, len(r.m))
+	for s, entry := range r.m {
+		info := sessionInfo{
+			ClientIP:   s.clientIP,
+			Worker:     entry.worker,
+			PoolWorker: entry.poolWorker,
+			Target:     s.up.Load().target.Address,
+			Model:      s.minerModelName(),
+			Connected:  s.connected,
+			BytesIn:    s.traffic.in.Load(),
+			BytesOut:   s.traffic.out.Load(),
+		}
+		if last := s.lastShare.Load(); last != 0 {
+			t := time.Unix(0, last)
+			info.LastShare = &t
+		}
+		list = append(list, info)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Connected.Before(list[j].Connected) })
+	return list
+}
+
+// kick disconnects the sessions of worker, so the miners reconnect with the
+// current configuration, and returns how many there were.
+func (r *sessionRegistry) kick(worker string) int {
+	r.mu.Lock()
+	var kicked []*session
+	for s, entry := range r.m {
+		if entry.worker == worker {
+			kicked = append(kicked, s)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, s := range kicked {
+		log.Printf("Disconnecting worker %s at %s on request", worker, s.clientIP)
+		s.ending("kicked")
+		s.clientConn.Close()
+		// The session only ends on its own once the pool hangs up.
+		s.up.Load().close()
+	}
+	return len(kicked)
+}
+
+// authorizedWorker returns the username of a login line.
+func authorizedWorker(line string) string {
+	var msg stratumMessage
+	var worker string
+	if json.Unmarshal([]byte(line), &msg) == nil && len(msg.Params) > 0 {
+		json.Unmarshal(msg.Params[0], &worker)
+	}
+	return worker
+}
+
+// sessionsText lists the sessions as a table for the control socket.
+func sessionsText(list []sessionInfo) string {
+	if len(list) == 0 {
+		return "no sessions"
+	}
+	var text strings.Builder
+	tw := tabwriter.NewWriter(&text, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT\tWORKER\tPOOL WORKER\tTARGET\tMODEL\tCONNECTED\tIN\tOUT\tLAST SHARE")
+	now := time.Now()
+	for _, info := range list {
+		lastShare := "-"
+		if info.LastShare != nil {
+			lastShare = now.Sub(*info.LastShare).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", info.ClientIP, orDash(info.Worker), orDash(info.PoolWorker),
+			info.Target, orDash(info.Model), now.Sub(info.Connected).Round(time.Second), info.BytesIn, info.BytesOut, lastShare)
+	}
+	tw.Flush()
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
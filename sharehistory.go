@@ -0,0 +1,60 @@
+package main
+
+import "time"
+
+// How many recent shares are kept per worker, for dashboards to draw the
+// recent activity of workers from.
+const shareHistoryLength = 100
+
+// shareEvent is one share in the history of a worker.
+type shareEvent struct {
+	Time       time.Time `json:"time"`
+	Difficulty float64   `json:"difficulty"`
+	Result     string    `json:"result"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// shareHistory is a ring of the last shares of a worker.
+type shareHistory struct {
+	events []shareEvent
+	next   int // where the next event goes once the ring is full
+}
+
+func (h *shareHistory) add(e shareEvent) {
+	if len(h.events) < shareHistoryLength {
+		h.events = append(h.events, e)
+		return
+	}
+	h.events[h.next] = e
+	h.next = (h.next + 1) % len(h.events)
+}
+
+// list returns the events from the oldest.
+func (h *shareHistory) list() []shareEvent {
+	list := make([]shareEvent, 0, len(h.events))
+	list = append(list, h.events[h.next:]...)
+	return append(list, h.events[:h.next]...)
+}
+
+// shareHistory returns the last shares of worker from the oldest, and
+// whether the worker is known.
+func (c *statsCollector) shareHistory(worker string) ([]shareEvent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.workers[worker]
+	if !ok {
+		return nil, false
+	}
+	return w.history.list(), true
+}
+
+// shareHistories returns the last shares of every worker.
+func (c *statsCollector) shareHistories() map[string][]shareEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	histories := make(map[string][]shareEvent, len(c.workers))
+	for name, w := range c.workers {
+		histories[name] = w.history.list()
+	}
+	return histories
+}
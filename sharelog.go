@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ShareLogConfig keeps a record of every submit for auditing and payout
+// reconciliation, in the shares table of an SQLite database:
+//
+//	sqlite3 shares.db "SELECT worker, result, COUNT(*) FROM shares GROUP BY 1, 2"
+//
+// The shares of each second are inserted as one transaction. The database
+// can be queried while the proxy runs; see sqlite.go for what it can take.
+type ShareLogConfig struct {
+	Path string `json:"path"` // "" disables the log
+}
+
+const shareLogFlushInterval = time.Second
+
+// Shares kept for the database while another program holds it locked;
+// beyond that the oldest are dropped.
+const maxPendingShares = 100000
+
+// Longest text stored per column, so every row fits in a database page.
+const (
+	maxShareText   = 256
+	maxShareReason = 1024
+)
+
+const shareLogSchema = `CREATE TABLE shares (
+  time TEXT NOT NULL,
+  client_ip TEXT NOT NULL,
+  worker TEXT NOT NULL,
+  pool_worker TEXT NOT NULL,
+  pool TEXT NOT NULL,
+  job_id TEXT NOT NULL,
+  difficulty REAL,
+  result TEXT NOT NULL,
+  error TEXT,
+  latency_ms REAL
+)`
+
+// shareRecord is one submit and what became of it.
+type shareRecord struct {
+	time     time.Time
+	clientIP string
+	pool     string
+	info     submitInfo
+	// "accepted" or "rejected" by the pool, "stale" when answered by the
+	// proxy, or "dropped" when the pool went away before answering.
+	result     string
+	reason     string // the pool's error
+	latency    time.Duration
+	hasLatency bool
+}
+
+// shareDB inserts share records into the database in transactions.
+type shareDB struct {
+	table *sqliteTable
+	mu    sync.Mutex
+	batch [][]interface{} // rows of the transaction to come
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// shareLog is nil when no share log is configured.
+var shareLog *shareDB
+
+func openShareLog(cfg ShareLogConfig) (*shareDB, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	table, err := openSQLiteTable(cfg.Path, "shares", shareLogSchema)
+	if err != nil {
+		return nil, err
+	}
+	sw := &shareDB{table: table, stop: make(chan struct{}), done: make(chan struct{})}
+	go sw.run()
+	return sw, nil
+}
+
+func (sw *shareDB) run() {
+	defer close(sw.done)
+	ticker := time.NewTicker(shareLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sw.stop:
+			sw.flush()
+			return
+		case <-ticker.C:
+			sw.flush()
+		}
+	}
+}
+
+// record adds a share to the current batch.
+func (sw *shareDB) record(r shareRecord) {
+	if sw == nil {
+		return
+	}
+	row := []interface{}{
+		r.time.UTC().Format(time.RFC3339Nano), shareText(r.clientIP, maxShareText),
+		shareText(r.info.worker, maxShareText), shareText(r.info.poolWorker, maxShareText),
+		shareText(r.pool, maxShareText), shareText(r.info.job, maxShareText), nil,
+		r.result, nil, nil,
+	}
+	if r.info.difficulty > 0 {
+		row[6] = r.info.difficulty
+	}
+	if r.reason != "" {
+		row[8] = shareText(r.reason, maxShareReason)
+	}
+	if r.hasLatency {
+		row[9] = float64(r.latency.Microseconds()) / 1000
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.batch = append(sw.batch, row)
+	if len(sw.batch) > maxPendingShares {
+		sw.batch = sw.batch[len(sw.batch)-maxPendingShares:]
+	}
+}
+
+// flush inserts the batch as a transaction. When the database cannot take
+// it, the rows stay for the next flush.
+func (sw *shareDB) flush() {
+	sw.mu.Lock()
+	rows := sw.batch
+	sw.batch = nil
+	sw.mu.Unlock()
+	if len(rows) == 0 {
+		return
+	}
+	if err := sw.table.insert(rows); err != nil {
+		log.Printf("Error writing share log: %v", err)
+		sw.mu.Lock()
+		sw.batch = append(rows, sw.batch...)
+		if len(sw.batch) > maxPendingShares {
+			sw.batch = sw.batch[len(sw.batch)-maxPendingShares:]
+		}
+		sw.mu.Unlock()
+	}
+}
+
+// close writes out the last batch.
+func (sw *shareDB) close() {
+	if sw == nil {
+		return
+	}
+	close(sw.stop)
+	<-sw.done
+	sw.table.close()
+}
+
+// shareText cuts s to at most max bytes, on a UTF-8 boundary.
+func shareText(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// newSubmitInfo describes a miner's mining.submit, as it goes to the pool.
+// Called from the client goroutine.
+func (s *session) newSubmitInfo(msg *stratumMessage, age int) submitInfo {
+	info := submitInfo{age: age, sent: time.Now()}
+	if len(msg.Params) >= 2 {
+		json.Unmarshal(msg.Params[0], &info.worker)
+		json.Unmarshal(msg.Params[1], &info.job)
+	}
+	if isEthproxy(msg.Method) {
+		// The params are the solution; the job is its header hash.
+		info.worker = s.worker
+	}
+	info.poolWorker = s.poolWorker(info.worker)
+	info.difficulty = s.up.Load().currentDifficulty()
+	return info
+}
+
+// logShare records the pool's answer to a share.
+func (s *session) logShare(up *upstream, info submitInfo, resp *stratumResponse, accepted bool) {
+	r := shareRecord{time: time.Now(), clientIP: s.clientIP, pool: up.target.Address, info: info,
+		result: "accepted", latency: time.Since(info.sent), hasLatency: true}
+	if !accepted {
+		r.result = "rejected"
+		if len(resp.Error) > 0 && string(resp.Error) != "null" {
+			r.reason = string(resp.Error)
+		} else {
+			r.reason = "false"
+		}
+	}
+	s.noteShare(r)
+}
+
+// logStale records a share the proxy answered as stale itself.
+func (s *session) logStale(info submitInfo) {
+	s.noteShare(shareRecord{time: time.Now(), clientIP: s.clientIP, pool: s.up.Load().target.Address,
+		info: info, result: "stale", reason: "job not known to the pool"})
+}
+
+// logDuplicate records a share the proxy rejected as already sent by the
+// cluster.
+func (s *session) logDuplicate(info submitInfo) {
+	s.noteShare(shareRecord{time: time.Now(), clientIP: s.clientIP, pool: s.up.Load().target.Address,
+		info: info, result: "rejected", reason: "duplicate share in the cluster"})
+}
+
+// logDropped records the shares a lost pool never answered.
+func (s *session) logDropped(pool string, pending map[string]submitInfo) {
+	for _, info := range pending {
+		s.noteShare(shareRecord{time: time.Now(), clientIP: s.clientIP, pool: pool, info: info,
+			result: "dropped", reason: "connection to the pool lost"})
+	}
+}
+
+// noteShare sends a share to the share log and the statistics.
+func (s *session) noteShare(r shareRecord) {
+	s.countShare(r.result)
+	shareLog.record(r)
+	stats.share(s.config, r)
+	splits.share(s.config, r)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// stratumResponse is any message from a pool: a response when Method is
+// empty, otherwise a notification or server request.
+type stratumResponse struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result"`
+	Error  json.RawMessage   `json:"error"`
+}
+
+func (r *stratumResponse) isResponse() bool {
+	return r.Method == "" && r.ID != nil
+}
+
+func (r *stratumResponse) ok() bool {
+	return string(r.Result) == "true" && (len(r.Error) == 0 || string(r.Error) == "null")
+}
+
+// submitInfo is what is known about a share while the pool decides on it.
+type submitInfo struct {
+	age        int // of its job in clean jobs, -1 when unknown
+	worker     string
+	poolWorker string
+	job        string
+	difficulty float64
+	sent       time.Time
+	block      string // hash of the block the share solves, if any
+}
+
+func idKey(id interface{}) string {
+	return fmt.Sprint(id)
+}
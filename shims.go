@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// ShimConfig enables workarounds for a firmware family. The profile applies to
+// sessions whose mining.subscribe user agent or detected model contains
+// UserAgent (case-insensitive).
+type ShimConfig struct {
+	UserAgent string `json:"user_agent"`
+	// SubscribeFirst holds a mining.authorize sent before mining.subscribe and
+	// forwards it right after the subscribe, for pools that reject the reverse order.
+	SubscribeFirst bool `json:"subscribe_first"`
+	// ArrayErrors rewrites pool errors sent as {"code":..,"message":..} objects
+	// into the [code, message, null] form stratum v1 firmwares expect.
+	ArrayErrors bool `json:"array_errors"`
+	// DropMethods lists pool notifications the firmware cannot handle.
+	DropMethods []string `json:"drop_methods"`
+	// EchoPassword answers a successful mining.authorize with the password
+	// the miner sent in place of true, for firmwares that check it.
+	EchoPassword bool `json:"echo_password"`
+}
+
+// Remember the last user agent seen per client IP so that firmwares which
+// authorize before subscribing get their profile on the next connection.
+var knownAgents = newIPMemory()
+
+type stratumMessage struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type firmwareShim struct {
+	config     *Config
+	ip         string
+	subscribed bool
+	held       []string
+
+	// Guard profile, read by the pool goroutine, and the passwords of
+	// authorizes the pool has yet to answer, by request id.
+	mu        sync.Mutex
+	profile   *ShimConfig
+	passwords map[string]string
+}
+
+func newFirmwareShim(config *Config, ip string) *firmwareShim {
+	f := &firmwareShim{config: config, ip: ip}
+	f.profile = matchShim(config, lastAgent(ip))
+	return f
+}
+
+// lastAgent returns the user agent the last miner at ip subscribed with.
+func lastAgent(ip string) string {
+	agent, _ := knownAgents.get(ip)
+	return agent
+}
+
+// subscribeAgent returns the user agent of a mining.subscribe, or "".
+func subscribeAgent(msg *stratumMessage) string {
+	var agent string
+	if len(msg.Params) > 0 {
+		json.Unmarshal(msg.Params[0], &agent)
+	}
+	return agent
+}
+
+func matchShim(config *Config, agent string) *ShimConfig {
+	for i := range config.Shims {
+		if matchesAgent(config.Shims[i].UserAgent, agent) {
+			return &config.Shims[i]
+		}
+	}
+	return nil
+}
+
+// clientMessage returns the lines to forward upstream for one client
+// message, msg as the miner sent it and line as rewritten for the pool.
+func (f *firmwareShim) clientMessage(line string, msg *stratumMessage) []string {
+	switch msg.Method {
+	case "mining.subscribe":
+		f.subscribed = true
+		if agent := subscribeAgent(msg); agent != "" {
+			knownAgents.set(f.ip, agent)
+			f.mu.Lock()
+			f.profile = matchShim(f.config, agent)
+			f.mu.Unlock()
+		}
+		out := append([]string{line}, f.held...)
+		f.held = nil
+		return out
+	case "mining.authorize":
+		f.mu.Lock()
+		profile := f.profile
+		var password string
+		if profile != nil && profile.EchoPassword && len(msg.Params) > 1 && json.Unmarshal(msg.Params[1], &password) == nil {
+			if f.passwords == nil {
+				f.passwords = make(map[string]string)
+			}
+			f.passwords[idKey(msg.ID)] = password
+		}
+		f.mu.Unlock()
+		if !f.subscribed && profile != nil && profile.SubscribeFirst {
+			f.held = append(f.held, line)
+			return nil
+		}
+	}
+	return []string{line}
+}
+
+// poolMessage rewrites one pool message for the client. It returns false when
+// the message must not be delivered.
+func (f *firmwareShim) poolMessage(line string) (string, bool) {
+	f.mu.Lock()
+	profile := f.profile
+	f.mu.Unlock()
+	if profile == nil || (!profile.ArrayErrors && len(profile.DropMethods) == 0 && !profile.EchoPassword) {
+		return line, true
+	}
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return line, true
+	}
+
+	if method, ok := msg["method"].(string); ok {
+		for _, m := range profile.DropMethods {
+			if m == method {
+				return "", false
+			}
+		}
+	}
+
+	changed := false
+	if profile.ArrayErrors {
+		if e, ok := msg["error"].(map[string]interface{}); ok {
+			msg["error"] = []interface{}{e["code"], e["message"], nil}
+			changed = true
+		}
+	}
+	if id, ok := msg["id"]; ok && id != nil && profile.EchoPassword {
+		f.mu.Lock()
+		password, ok := f.passwords[idKey(id)]
+		delete(f.passwords, idKey(id))
+		f.mu.Unlock()
+		if ok && msg["result"] == true {
+			msg["result"] = password
+			changed = true
+		}
+	}
+	if changed {
+		if modified, err := json.Marshal(msg); err == nil {
+			return string(modified), true
+		}
+	}
+	return line, true
+}
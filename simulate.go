@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// simulatePool runs stand-in pools on the given addresses until interrupted,
+// so routing, rewriting and failover can be tried without a real pool: they
+// send difficulty and jobs, accept shares and log what miners send.
+// Stopping one of several pools is a pool outage for the proxy.
+func simulatePool(args []string) error {
+	fs := flag.NewFlagSet("simulate-pool", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:3334", "Comma-separated addresses, one pool each")
+	notifyEvery := fs.Duration("notify", 30*time.Second, "Interval between new jobs")
+	difficulty := fs.Float64("difficulty", 1, "Share difficulty sent to miners")
+	rejectRate := fs.Float64("reject", 0, "Fraction of shares to reject, from 0 to 1")
+	quiet := fs.Bool("q", false, "Log only the periodic totals, not every login and share")
+	reportEvery := fs.Duration("report", time.Minute, "Interval between totals")
+	fs.Parse(args)
+	if *difficulty <= 0 || *rejectRate < 0 || *rejectRate > 1 || *reportEvery <= 0 {
+		return fmt.Errorf("difficulty must be positive, reject between 0 and 1 and report positive")
+	}
+
+	var pools []*fakePool
+	defer func() {
+		for _, pool := range pools {
+			pool.Close()
+		}
+	}()
+	for _, address := range strings.Split(*listen, ",") {
+		pool, err := listenFakePool(strings.TrimSpace(address), *notifyEvery)
+		if err != nil {
+			return err
+		}
+		pool.difficulty = *difficulty
+		pool.rejectRate = *rejectRate
+		pool.verbose = !*quiet
+		go pool.acceptLoop()
+		pools = append(pools, pool)
+		fmt.Printf("simulate-pool: pool on %s, difficulty %g, new job every %s\n", pool.Addr(), *difficulty, *notifyEvery)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*reportEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			for _, pool := range pools {
+				fmt.Printf("simulate-pool: %s: %d connections, %d logins, %d shares, %d rejected, %d jobs\n", pool.Addr(),
+					pool.connCount(), pool.authorized.Load(), pool.submits.Load(), pool.rejected.Load(), pool.jobs.Load())
+			}
+		}
+	}
+}
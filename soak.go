@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// soak runs the proxy in-process against two fake pools while synthetic
+// miners churn connections, the primary pool keeps failing and the config is
+// reloaded. It checks that goroutines, file descriptors and sessions are all
+// released again, and exits non-zero when they are not.
+func soak(args []string) error {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	configPath := fs.String("c", "", "Configuration to take miner and shim settings from")
+	duration := fs.Duration("d", 10*time.Minute, "How long to run")
+	miners := fs.Int("miners", 50, "Concurrent synthetic miners")
+	failoverEvery := fs.Duration("failover", 30*time.Second, "Interval between primary pool outages")
+	reloadEvery := fs.Duration("reload", 20*time.Second, "Interval between config reloads")
+	reportEvery := fs.Duration("report", 10*time.Second, "Interval between invariant checks")
+	logPath := fs.String("l", "", "Proxy log file (default: discard)")
+	fs.Parse(args)
+
+	closeLog, err := openCommandLog(*logPath)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	base := &Config{Miner: MinerConfig{Auth: "soak.", Ipenable: true}.compile()}
+	if *configPath != "" {
+		loaded, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		base = loaded
+	}
+
+	primary, err := startFakePool("127.0.0.1:0", 5*time.Second)
+	if err != nil {
+		return err
+	}
+	backup, err := startFakePool("127.0.0.1:0", 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+	primaryAddr := primary.Addr()
+
+	// Only the rewriting behaviour of the base config is kept; routing,
+	// limits and state are under the soak test's control.
+	config := &Config{
+		Listen:          ListenList{"127.0.0.1:0"},
+		Coins:           []CoinConfig{{Name: "soak", Targets: []Target{{Address: primaryAddr}, {Address: backup.Addr()}}}},
+		Miner:           base.Miner,
+		Shims:           base.Shims,
+		DNSCacheSeconds: base.DNSCacheSeconds,
+		WarmStandby:     base.WarmStandby,
+	}
+	config.indexClients()
+
+	server, err := newProxyServer(config)
+	if err != nil {
+		return err
+	}
+	server.serve()
+	defer server.stop()
+	proxyAddr := server.addrs()[0]
+
+	time.Sleep(100 * time.Millisecond)
+	baseGoroutines, baseFDs := runtime.NumGoroutine(), openFDs()
+	fmt.Printf("soak: proxy %s, pools %s and %s, %d miners for %s\n", proxyAddr, primaryAddr, backup.Addr(), *miners, *duration)
+	fmt.Printf("soak: baseline %d goroutines, %d fds\n", baseGoroutines, baseFDs)
+
+	var (
+		stop      atomic.Bool
+		sessions  atomic.Int64
+		accepted  atomic.Int64
+		failures  atomic.Int64
+		failovers atomic.Int64
+		reloads   atomic.Int64
+		minersWg  sync.WaitGroup
+	)
+
+	for i := 0; i < *miners; i++ {
+		minersWg.Add(1)
+		go func(i int) {
+			defer minersWg.Done()
+			user := fmt.Sprintf("soak%d", i)
+			for !stop.Load() {
+				m, err := dialFakeMiner("tcp", proxyAddr, 10*time.Second)
+				if err != nil {
+					failures.Add(1)
+					time.Sleep(time.Second)
+					continue
+				}
+				if err := m.handshake("soak/1.0", user); err != nil {
+					failures.Add(1)
+					m.Close()
+					continue
+				}
+				shares := 1 + rand.Intn(20)
+				for j := 0; j < shares && !stop.Load(); j++ {
+					time.Sleep(time.Duration(50+rand.Intn(450)) * time.Millisecond)
+					ok, err := m.submit(user, rand.Uint32())
+					if err != nil {
+						failures.Add(1)
+						break
+					}
+					if ok {
+						accepted.Add(1)
+					}
+				}
+				m.Close()
+				sessions.Add(1)
+			}
+		}(i)
+	}
+
+	// Background churn stops as soon as stopChan is closed.
+	stopChan := make(chan struct{})
+	var churnWg sync.WaitGroup
+	pause := func(d time.Duration) bool {
+		select {
+		case <-stopChan:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	// Primary pool outages: sessions on it drop and reconnect to the backup.
+	churnWg.Add(1)
+	go func() {
+		defer churnWg.Done()
+		for pause(*failoverEvery) {
+			primary.Close()
+			failovers.Add(1)
+			pause(*failoverEvery / 3)
+			for {
+				if primary, err = startFakePool(primaryAddr, 5*time.Second); err == nil {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}()
+
+	// Reloads alternate the target order and the worker naming mode.
+	churnWg.Add(1)
+	go func() {
+		defer churnWg.Done()
+		for n := 1; pause(*reloadEvery); n++ {
+			reloaded := *config
+			reloaded.Miner.Ipenable = n%2 == 0
+			reloaded.Miner = reloaded.Miner.compile()
+			if n%2 == 1 {
+				targets := config.Coins[0].Targets
+				reloaded = *reloaded.withAllTargets([]Target{targets[1], targets[0]})
+			}
+			server.reload(&reloaded)
+			reloads.Add(1)
+		}
+	}()
+
+	var violations []string
+	stuckReports := 0
+	start := time.Now()
+	ticker := time.NewTicker(*reportEvery)
+	for time.Since(start) < *duration {
+		<-ticker.C
+		active := server.active.Load()
+		fmt.Printf("soak: %s active=%d goroutines=%d fds=%d sessions=%d accepted=%d failures=%d failovers=%d reloads=%d\n",
+			time.Since(start).Round(time.Second), active, runtime.NumGoroutine(), openFDs(),
+			sessions.Load(), accepted.Load(), failures.Load(), failovers.Load(), reloads.Load())
+
+		// More sessions than miners means some never finished.
+		if active > int64(*miners+*miners/10+5) {
+			stuckReports++
+		} else {
+			stuckReports = 0
+		}
+		if stuckReports == 3 {
+			violations = append(violations, fmt.Sprintf("%d sessions open for %d miners", active, *miners))
+		}
+	}
+	ticker.Stop()
+
+	stop.Store(true)
+	close(stopChan)
+	churnWg.Wait()
+	minersWg.Wait()
+	deadline := time.Now().Add(30 * time.Second)
+	for server.active.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(time.Second)
+	runtime.GC()
+
+	if active := server.active.Load(); active > 0 {
+		violations = append(violations, fmt.Sprintf("%d sessions still open after all miners left", active))
+	}
+	if g := runtime.NumGoroutine(); g > baseGoroutines+5 {
+		violations = append(violations, fmt.Sprintf("goroutines grew from %d to %d", baseGoroutines, g))
+	}
+	if fds := openFDs(); baseFDs >= 0 && fds > baseFDs+5 {
+		violations = append(violations, fmt.Sprintf("file descriptors grew from %d to %d", baseFDs, fds))
+	}
+	primary.Close()
+
+	fmt.Printf("soak: %d sessions, %d accepted shares, %d failures, %d failovers, %d reloads\n",
+		sessions.Load(), accepted.Load(), failures.Load(), failovers.Load(), reloads.Load())
+	if len(violations) > 0 {
+		for _, v := range violations {
+			fmt.Printf("soak: FAIL %s\n", v)
+		}
+		return fmt.Errorf("%d invariant violations", len(violations))
+	}
+	fmt.Println("soak: PASS")
+	return nil
+}
+
+// openCommandLog sends the proxy log of a command to path, or discards it
+// when path is empty. The returned function closes the file.
+func openCommandLog(path string) (func(), error) {
+	if path == "" {
+		log.SetOutput(io.Discard)
+		return func() {}, nil
+	}
+	logFile, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(logFile)
+	return func() { logFile.Close() }, nil
+}
+
+// openFDs counts this process's open file descriptors, or returns -1 where
+// /proc is not available.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
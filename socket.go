@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// SocketOptions tune the TCP connections of a listener or target. Unset
+// fields keep the defaults: TCP_NODELAY on, as Go sets it, and the
+// system's buffer sizes.
+type SocketOptions struct {
+	// NoDelay false lets Nagle's algorithm batch small writes.
+	NoDelay *bool `json:"no_delay,omitempty"`
+	// SendBuffer and ReceiveBuffer set SO_SNDBUF and SO_RCVBUF in bytes.
+	SendBuffer    int `json:"send_buffer,omitempty"`
+	ReceiveBuffer int `json:"receive_buffer,omitempty"`
+}
+
+func validateSocketOptions(config *Config) error {
+	check := func(name string, o *SocketOptions) error {
+		if o != nil && (o.SendBuffer < 0 || o.ReceiveBuffer < 0) {
+			return fmt.Errorf("%s: negative buffer size", name)
+		}
+		return nil
+	}
+	for address, o := range config.ListenSockets {
+		if !containsString(config.listenAddresses(), address) {
+			return fmt.Errorf("%s is not a listen address", address)
+		}
+		if strings.HasPrefix(address, "unix:") {
+			return fmt.Errorf("%s: unix sockets take no TCP options", address)
+		}
+		if err := check(address, &o); err != nil {
+			return err
+		}
+	}
+	for _, t := range allTargets(config) {
+		if err := check(t.Address, t.Socket); err != nil {
+			return err
+		}
+		// The ssh client makes the connection to the jump host, and solo
+		// targets are served within the proxy.
+		if t.Socket != nil && (t.SSH != nil || t.Solo != nil) {
+			return fmt.Errorf("%s: socket options cannot be set on ssh or solo targets", t.Address)
+		}
+	}
+	return nil
+}
+
+// apply sets the options on conn when it is a TCP connection.
+func (o *SocketOptions) apply(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if o == nil || !ok {
+		return
+	}
+	var err error
+	if o.NoDelay != nil {
+		err = tcp.SetNoDelay(*o.NoDelay)
+	}
+	if o.SendBuffer > 0 && err == nil {
+		err = tcp.SetWriteBuffer(o.SendBuffer)
+	}
+	if o.ReceiveBuffer > 0 && err == nil {
+		err = tcp.SetReadBuffer(o.ReceiveBuffer)
+	}
+	if err != nil {
+		log.Printf("Error setting socket options on %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// listener applies the options to the connections l accepts. TLS and
+// WebSocket listeners are built on such a listener, as the options are
+// only set on the TCP connection they wrap.
+func (o *SocketOptions) listener(l net.Listener) net.Listener {
+	if o == nil {
+		return l
+	}
+	return socketListener{l, *o}
+}
+
+// socketListener applies socket options to the connections it accepts.
+type socketListener struct {
+	net.Listener
+	options SocketOptions
+}
+
+func (l socketListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.options.apply(conn)
+	}
+	return conn, err
+}
@@ -0,0 +1,933 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A target with solo settings is a bitcoind or litecoind node rather than a
+// pool. Dialing it opens an in-process stratum pool that builds jobs from
+// the node's getblocktemplate, checks the miners' shares and submits the
+// blocks they find, paying to the payout address. Sessions use it like any
+// other target, failover and statistics included.
+
+// SoloConfig logs in to a node's RPC interface at the target address and
+// says where found blocks pay to.
+type SoloConfig struct {
+	RPCUser     string `json:"rpc_user"`
+	RPCPassword string `json:"rpc_password"`
+	// RPCCookie is the node's .cookie file, read on every call, instead of
+	// a user and password.
+	RPCCookie     string `json:"rpc_cookie"`
+	PayoutAddress string `json:"payout_address"`
+	// CoinbaseTag goes into the coinbase of found blocks,
+	// "/stratum-proxy/" when "".
+	CoinbaseTag string `json:"coinbase_tag"`
+	// Difficulty is the share difficulty miners start at, 1024 when 0. It
+	// is adjusted to about a share every 10 seconds, but not below the
+	// lower of this and 1.
+	Difficulty float64 `json:"difficulty"`
+}
+
+const (
+	defaultSoloDifficulty = 1024
+	defaultCoinbaseTag    = "/stratum-proxy/"
+	// The node is asked for its best block this often, and for a new
+	// template when that changed or the last is older than the refresh
+	// interval.
+	soloPollInterval    = time.Second
+	soloRefreshInterval = 30 * time.Second
+	// Connections are dropped when the node cannot be reached for this
+	// long, so their sessions fail over.
+	soloDownAfter = 30 * time.Second
+	// A node without connections is let go after this long.
+	soloIdleTimeout = time.Minute
+	// Jobs kept for submits; a new block drops them all.
+	soloJobHistory      = 8
+	soloExtranonce2Size = 4
+	// Difficulty is retargeted after this many shares or this long.
+	soloRetargetShares = 20
+	soloRetargetTime   = 30 * time.Second
+	soloShareInterval  = 10 * time.Second
+	soloWriteTimeout   = 10 * time.Second
+	soloRPCTimeout     = 30 * time.Second
+)
+
+func validateSolo(t Target) error {
+	solo := t.Solo
+	if solo == nil {
+		return nil
+	}
+	if solo.PayoutAddress == "" {
+		return fmt.Errorf("target %s: solo needs a payout_address", t.Address)
+	}
+	if solo.RPCCookie == "" && solo.RPCUser == "" {
+		return fmt.Errorf("target %s: solo needs rpc_user or rpc_cookie", t.Address)
+	}
+	if solo.Difficulty < 0 {
+		return fmt.Errorf("target %s: negative solo difficulty", t.Address)
+	}
+	return nil
+}
+
+func (c *SoloConfig) credentials() (string, string, error) {
+	if c.RPCCookie == "" {
+		return c.RPCUser, c.RPCPassword, nil
+	}
+	data, err := os.ReadFile(c.RPCCookie)
+	if err != nil {
+		return "", "", err
+	}
+	user, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok {
+		return "", "", fmt.Errorf("%s is not a cookie file", c.RPCCookie)
+	}
+	return user, password, nil
+}
+
+func (c *SoloConfig) startDifficulty() float64 {
+	if c.Difficulty > 0 {
+		return c.Difficulty
+	}
+	return defaultSoloDifficulty
+}
+
+func (c *SoloConfig) minDifficulty() float64 {
+	return min(c.startDifficulty(), 1)
+}
+
+func (c *SoloConfig) coinbaseTag() string {
+	if c.CoinbaseTag != "" {
+		return c.CoinbaseTag
+	}
+	return defaultCoinbaseTag
+}
+
+// soloRegistry holds the nodes being mined on, one per target address.
+type soloRegistry struct {
+	mu         sync.Mutex
+	nodes      map[string]*soloNode
+	algorithms map[string]string
+}
+
+var soloNodes = &soloRegistry{nodes: make(map[string]*soloNode), algorithms: make(map[string]string)}
+
+// configure notes the coin algorithm of every solo target of config, which
+// the shares on it are hashed with.
+func (r *soloRegistry) configure(config *Config) {
+	algorithms := make(map[string]string)
+	for _, t := range allTargets(config) {
+		if coin := config.coinOf(t.Address); t.Solo != nil && coin != nil {
+			algorithms[t.Address] = coin.Algorithm
+		}
+	}
+	r.mu.Lock()
+	r.algorithms = algorithms
+	r.mu.Unlock()
+}
+
+func (r *soloRegistry) algorithm(address string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.algorithms[address]
+}
+
+// dial returns a connection to the stratum pool of the node at target,
+// starting to mine on the node if nobody does yet.
+func (r *soloRegistry) dial(target Target) (net.Conn, error) {
+	r.mu.Lock()
+	node := r.nodes[target.Address]
+	if node == nil {
+		node = newSoloNode(target)
+		r.nodes[target.Address] = node
+		go node.run()
+	}
+	client, server := net.Pipe()
+	c := node.open(server)
+	r.mu.Unlock()
+
+	if !node.up() {
+		if err := node.refresh(); err != nil {
+			node.release(c)
+			server.Close()
+			client.Close()
+			return nil, err
+		}
+	}
+	go c.serve()
+	return client, nil
+}
+
+// soloNode mines on one node for all connections to it.
+type soloNode struct {
+	target Target
+	client *http.Client
+	// One template is fetched at a time.
+	fetchMu sync.Mutex
+
+	mu             sync.Mutex
+	payout         []byte // script of the payout address
+	jobs           []*soloJob
+	changed        chan struct{} // closed and replaced on a new job
+	nextJob        uint64
+	conns          map[*soloConn]bool
+	extranonces    map[string]bool
+	nextExtranonce uint32
+	idleSince      time.Time
+	refreshed      time.Time
+	failingSince   time.Time
+}
+
+func newSoloNode(target Target) *soloNode {
+	return &soloNode{
+		target:      target,
+		client:      &http.Client{Timeout: soloRPCTimeout},
+		changed:     make(chan struct{}),
+		conns:       make(map[*soloConn]bool),
+		extranonces: make(map[string]bool),
+	}
+}
+
+// blockTemplate is the part of a getblocktemplate result jobs are built of.
+type blockTemplate struct {
+	Version           uint32 `json:"version"`
+	PreviousBlockHash string `json:"previousblockhash"`
+	Transactions      []struct {
+		Data string `json:"data"`
+		TxID string `json:"txid"`
+		Hash string `json:"hash"`
+	} `json:"transactions"`
+	CoinbaseValue            int64  `json:"coinbasevalue"`
+	Bits                     string `json:"bits"`
+	CurTime                  int64  `json:"curtime"`
+	MinTime                  int64  `json:"mintime"`
+	Height                   int64  `json:"height"`
+	DefaultWitnessCommitment string `json:"default_witness_commitment"`
+	// MWEB is the MimbleWimble extension block of litecoin templates.
+	MWEB string `json:"mweb"`
+}
+
+// soloJob is a template as a stratum job.
+type soloJob struct {
+	*stratumJob
+	template *blockTemplate
+	clean    bool
+}
+
+// call makes a JSON-RPC call to the node and decodes its result into
+// result unless that is nil.
+func (n *soloNode) call(method string, params []interface{}, result interface{}) error {
+	user, password, err := n.target.Solo.credentials()
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "1.0", "id": "stratum-proxy", "method": method, "params": params})
+	req, err := http.NewRequest("POST", "http://"+n.target.Address+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(user, password)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%s: RPC login refused", method)
+	}
+	// Errors come with a status of 500 and the reason in the body.
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&reply); err != nil {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("%s: %s (%d)", method, reply.Error.Message, reply.Error.Code)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+// up reports whether the node has a current job.
+func (n *soloNode) up() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.jobs) > 0 && n.failingSince.IsZero()
+}
+
+// refresh fetches a template and makes it the current job.
+func (n *soloNode) refresh() error {
+	n.fetchMu.Lock()
+	defer n.fetchMu.Unlock()
+
+	n.mu.Lock()
+	payout := n.payout
+	n.mu.Unlock()
+	if payout == nil {
+		var address struct {
+			IsValid      bool   `json:"isvalid"`
+			ScriptPubKey string `json:"scriptPubKey"`
+		}
+		if err := n.call("validateaddress", []interface{}{n.target.Solo.PayoutAddress}, &address); err != nil {
+			return n.failed(err)
+		}
+		script, err := hex.DecodeString(address.ScriptPubKey)
+		if !address.IsValid || err != nil || len(script) == 0 {
+			return n.failed(fmt.Errorf("payout address %s is not valid on the node", n.target.Solo.PayoutAddress))
+		}
+		payout = script
+	}
+
+	var template blockTemplate
+	rules := map[string]interface{}{"rules": []string{"segwit", "mweb"}}
+	if err := n.call("getblocktemplate", []interface{}{rules}, &template); err != nil {
+		return n.failed(err)
+	}
+	job, err := newSoloJob(&template, payout, n.target.Solo.coinbaseTag())
+	if err != nil {
+		return n.failed(err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.payout = payout
+	if !n.failingSince.IsZero() {
+		log.Printf("Solo node %s is back after %s", n.target.Address, time.Since(n.failingSince).Round(time.Second))
+		n.failingSince = time.Time{}
+	}
+	job.clean = len(n.jobs) == 0 || n.jobs[len(n.jobs)-1].template.PreviousBlockHash != template.PreviousBlockHash
+	if job.clean {
+		n.jobs = nil
+	}
+	n.nextJob++
+	job.id = strconv.FormatUint(n.nextJob, 16)
+	n.jobs = append(n.jobs, job)
+	if len(n.jobs) > soloJobHistory {
+		n.jobs = n.jobs[len(n.jobs)-soloJobHistory:]
+	}
+	n.refreshed = time.Now()
+	close(n.changed)
+	n.changed = make(chan struct{})
+	return nil
+}
+
+// failed notes that the node could not be reached and returns err.
+func (n *soloNode) failed(err error) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.failingSince.IsZero() {
+		log.Printf("Solo node %s failed: %v", n.target.Address, err)
+		n.failingSince = time.Now()
+	}
+	return err
+}
+
+// run keeps the job current until the node has had no connections for the
+// idle timeout.
+func (n *soloNode) run() {
+	ticker := time.NewTicker(soloPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if soloNodes.remove(n) {
+			return
+		}
+		var best string
+		if err := n.call("getbestblockhash", nil, &best); err != nil {
+			n.failed(err)
+		} else if n.stale(best) {
+			n.refresh()
+		}
+
+		n.mu.Lock()
+		var down []*soloConn
+		if !n.failingSince.IsZero() && time.Since(n.failingSince) > soloDownAfter {
+			for c := range n.conns {
+				down = append(down, c)
+			}
+		}
+		n.mu.Unlock()
+		for _, c := range down {
+			c.conn.Close()
+		}
+	}
+}
+
+// stale reports whether the job is for another block than best or due for
+// new transactions.
+func (n *soloNode) stale(best string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.jobs) == 0 || !n.failingSince.IsZero() || n.jobs[len(n.jobs)-1].template.PreviousBlockHash != best ||
+		time.Since(n.refreshed) >= soloRefreshInterval
+}
+
+// remove lets go of the node once it has been idle for the idle timeout,
+// and reports whether it did.
+func (r *soloRegistry) remove(n *soloNode) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.conns) > 0 || time.Since(n.idleSince) < soloIdleTimeout {
+		return false
+	}
+	delete(r.nodes, n.target.Address)
+	return true
+}
+
+// open registers the server end of a new connection.
+func (n *soloNode) open(conn net.Conn) *soloConn {
+	c := &soloConn{node: n, conn: conn, difficulty: n.target.Solo.startDifficulty(),
+		sent: make(map[string]float64), submitted: make(map[string]bool), retargeted: time.Now()}
+	n.mu.Lock()
+	n.conns[c] = true
+	n.mu.Unlock()
+	return c
+}
+
+func (n *soloNode) release(c *soloConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.conns, c)
+	if c.extranonce1 != "" {
+		delete(n.extranonces, c.extranonce1)
+	}
+	if len(n.conns) == 0 {
+		n.idleSince = time.Now()
+	}
+}
+
+// extranonce returns an extranonce1 for a new subscription: resume, the
+// extranonce1 of a lost connection, when it is free, else a new one.
+func (n *soloNode) extranonce(resume string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if b, err := hex.DecodeString(resume); err == nil && len(b) == 4 && !n.extranonces[resume] {
+		n.extranonces[resume] = true
+		return resume
+	}
+	for {
+		n.nextExtranonce++
+		extranonce := fmt.Sprintf("%08x", n.nextExtranonce)
+		if !n.extranonces[extranonce] {
+			n.extranonces[extranonce] = true
+			return extranonce
+		}
+	}
+}
+
+// current returns the latest job and a channel closed when it is replaced.
+func (n *soloNode) current() (*soloJob, <-chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.jobs) == 0 {
+		return nil, n.changed
+	}
+	return n.jobs[len(n.jobs)-1], n.changed
+}
+
+func (n *soloNode) job(id string) *soloJob {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, job := range n.jobs {
+		if job.id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// newSoloJob builds the stratum job of a template, its coinbase paying to
+// payout.
+func newSoloJob(t *blockTemplate, payout []byte, tag string) (*soloJob, error) {
+	prevHash, err := hex.DecodeString(t.PreviousBlockHash)
+	if err != nil || len(prevHash) != 32 || len(t.Bits) != 8 {
+		return nil, fmt.Errorf("bad template for height %d", t.Height)
+	}
+	prevHash = reversed(prevHash)
+	swapWords(prevHash)
+
+	txids := make([][]byte, len(t.Transactions))
+	for i, tx := range t.Transactions {
+		id := tx.TxID
+		if id == "" {
+			// Nodes from before segwit name it hash.
+			id = tx.Hash
+		}
+		b, err := hex.DecodeString(id)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("bad transaction id %q in template", id)
+		}
+		txids[i] = reversed(b)
+	}
+	var branches []string
+	for _, b := range merkleBranch(txids) {
+		branches = append(branches, hex.EncodeToString(b))
+	}
+
+	coinb1, coinb2, err := coinbaseParts(t, payout, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &soloJob{
+		stratumJob: &stratumJob{
+			prevHash: hex.EncodeToString(prevHash),
+			coinb1:   coinb1,
+			coinb2:   coinb2,
+			branches: branches,
+			version:  fmt.Sprintf("%08x", t.Version),
+			nbits:    t.Bits,
+			ntime:    fmt.Sprintf("%08x", t.CurTime),
+		},
+		template: t,
+	}, nil
+}
+
+// coinbaseParts returns the coinbase transaction of a template in hex, up
+// to and after the extranonces in its input script.
+func coinbaseParts(t *blockTemplate, payout []byte, tag string) (string, string, error) {
+	height := heightPush(t.Height)
+	// An input script is at most 100 bytes.
+	if room := 100 - len(height) - 4 - soloExtranonce2Size; len(tag) > room {
+		tag = tag[:room]
+	}
+
+	var b1 bytes.Buffer
+	binary.Write(&b1, binary.LittleEndian, uint32(1))
+	b1.WriteByte(1)
+	b1.Write(make([]byte, 32))
+	binary.Write(&b1, binary.LittleEndian, uint32(0xffffffff))
+	b1.Write(compactSize(len(height) + 4 + soloExtranonce2Size + len(tag)))
+	b1.Write(height)
+
+	var b2 bytes.Buffer
+	b2.WriteString(tag)
+	binary.Write(&b2, binary.LittleEndian, uint32(0xffffffff))
+	outputs := 1
+	var commitment []byte
+	if t.DefaultWitnessCommitment != "" {
+		var err error
+		if commitment, err = hex.DecodeString(t.DefaultWitnessCommitment); err != nil {
+			return "", "", fmt.Errorf("bad witness commitment in template")
+		}
+		outputs++
+	}
+	b2.Write(compactSize(outputs))
+	binary.Write(&b2, binary.LittleEndian, t.CoinbaseValue)
+	b2.Write(compactSize(len(payout)))
+	b2.Write(payout)
+	if commitment != nil {
+		binary.Write(&b2, binary.LittleEndian, int64(0))
+		b2.Write(compactSize(len(commitment)))
+		b2.Write(commitment)
+	}
+	binary.Write(&b2, binary.LittleEndian, uint32(0))
+	return hex.EncodeToString(b1.Bytes()), hex.EncodeToString(b2.Bytes()), nil
+}
+
+// heightPush is the block height as BIP 34 wants it at the start of the
+// coinbase input script.
+func heightPush(height int64) []byte {
+	switch {
+	case height == 0:
+		return []byte{0}
+	case height <= 16:
+		return []byte{byte(0x50 + height)}
+	}
+	var n []byte
+	for v := height; v > 0; v >>= 8 {
+		n = append(n, byte(v))
+	}
+	if n[len(n)-1]&0x80 != 0 {
+		n = append(n, 0)
+	}
+	return append([]byte{byte(len(n))}, n...)
+}
+
+func compactSize(n int) []byte {
+	switch {
+	case n < 0xfd:
+		return []byte{byte(n)}
+	case n <= 0xffff:
+		return binary.LittleEndian.AppendUint16([]byte{0xfd}, uint16(n))
+	default:
+		return binary.LittleEndian.AppendUint32([]byte{0xfe}, uint32(n))
+	}
+}
+
+// merkleBranch returns the hashes a coinbase is combined with, in order, to
+// get the merkle root of a block with the transactions txids after it.
+func merkleBranch(txids [][]byte) [][]byte {
+	var branch [][]byte
+	level := append([][]byte{nil}, txids...)
+	for len(level) > 1 {
+		branch = append(branch, level[1])
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := [][]byte{nil}
+		for i := 2; i < len(level); i += 2 {
+			next = append(next, doubleSHA256(append(append([]byte(nil), level[i]...), level[i+1]...)))
+		}
+		level = next
+	}
+	return branch
+}
+
+// block returns the hex of the block a share with header solved.
+func (job *soloJob) block(header []byte, extranonce1, extranonce2 string) string {
+	var b strings.Builder
+	b.WriteString(hex.EncodeToString(header))
+	b.WriteString(hex.EncodeToString(compactSize(1 + len(job.template.Transactions))))
+	coinbase := job.coinb1 + extranonce1 + extranonce2 + job.coinb2
+	if job.template.DefaultWitnessCommitment != "" {
+		// With a witness commitment the coinbase carries the witness
+		// reserved value, 32 zero bytes.
+		coinbase = coinbase[:8] + "0001" + coinbase[8:len(coinbase)-8] + "0120" + strings.Repeat("00", 32) + coinbase[len(coinbase)-8:]
+	}
+	b.WriteString(coinbase)
+	for _, tx := range job.template.Transactions {
+		b.WriteString(tx.Data)
+	}
+	if job.template.MWEB != "" {
+		b.WriteString("01" + job.template.MWEB)
+	}
+	return b.String()
+}
+
+func (job *soloJob) notify() string {
+	data, _ := json.Marshal(map[string]interface{}{"id": nil, "method": "mining.notify", "params": []interface{}{
+		job.id, job.prevHash, job.coinb1, job.coinb2, append([]string{}, job.branches...), job.version, job.nbits, job.ntime, job.clean,
+	}})
+	return string(data)
+}
+
+// soloConn is the pool side of one connection to a node.
+type soloConn struct {
+	node    *soloNode
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	extranonce1 string
+	worker      string
+	difficulty  float64
+	announced   float64 // the difficulty the miner was last sent
+	// sent is the difficulty each job was sent at, submitted the shares
+	// seen for the jobs of the node.
+	sent       map[string]float64
+	submitted  map[string]bool
+	shares     int
+	retargeted time.Time
+}
+
+func (c *soloConn) send(v interface{}) error {
+	data, _ := json.Marshal(v)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(soloWriteTimeout))
+	_, err := c.conn.Write(append(data, '\n'))
+	return err
+}
+
+func (c *soloConn) answer(id interface{}, result interface{}, code int, message string) error {
+	if message != "" {
+		return c.send(map[string]interface{}{"id": id, "result": nil, "error": []interface{}{code, message, nil}})
+	}
+	return c.send(map[string]interface{}{"id": id, "result": result, "error": nil})
+}
+
+func (c *soloConn) serve() {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		c.conn.Close()
+		c.node.release(c)
+	}()
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var msg stratumMessage
+		if json.Unmarshal([]byte(line), &msg) != nil {
+			continue
+		}
+
+		switch msg.Method {
+		case "mining.configure":
+			c.answer(msg.ID, configureResult(msg.Params), 0, "")
+		case "mining.subscribe":
+			c.mu.Lock()
+			subscribed := c.extranonce1 != ""
+			c.mu.Unlock()
+			if subscribed {
+				c.answer(msg.ID, nil, 20, "Already subscribed")
+				continue
+			}
+			var resume string
+			if len(msg.Params) > 1 {
+				json.Unmarshal(msg.Params[1], &resume)
+			}
+			extranonce1 := c.node.extranonce(resume)
+			c.mu.Lock()
+			c.extranonce1 = extranonce1
+			c.mu.Unlock()
+			c.answer(msg.ID, []interface{}{
+				[][]string{{"mining.set_difficulty", extranonce1}, {"mining.notify", extranonce1}}, extranonce1, soloExtranonce2Size,
+			}, 0, "")
+			go c.push(done)
+		case "mining.extranonce.subscribe":
+			c.answer(msg.ID, true, 0, "")
+		case "mining.authorize":
+			var worker string
+			if len(msg.Params) > 0 {
+				json.Unmarshal(msg.Params[0], &worker)
+			}
+			c.mu.Lock()
+			c.worker = worker
+			c.mu.Unlock()
+			c.answer(msg.ID, true, 0, "")
+		case "mining.suggest_difficulty":
+			var difficulty float64
+			if len(msg.Params) > 0 && json.Unmarshal(msg.Params[0], &difficulty) == nil && difficulty > 0 {
+				c.mu.Lock()
+				c.difficulty = max(difficulty, c.node.target.Solo.minDifficulty())
+				c.mu.Unlock()
+			}
+			c.answer(msg.ID, true, 0, "")
+		case "mining.submit":
+			result, code, message := c.submit(&msg)
+			c.answer(msg.ID, result, code, message)
+		default:
+			if msg.ID != nil {
+				c.answer(msg.ID, nil, 20, "Unsupported method")
+			}
+		}
+	}
+}
+
+// configureResult answers a mining.configure: version rolling within the
+// BIP 320 bits, no other extension.
+func configureResult(params []json.RawMessage) map[string]interface{} {
+	result := make(map[string]interface{})
+	var extensions []string
+	var options map[string]interface{}
+	if len(params) > 0 {
+		json.Unmarshal(params[0], &extensions)
+	}
+	if len(params) > 1 {
+		json.Unmarshal(params[1], &options)
+	}
+	for _, extension := range extensions {
+		if extension != "version-rolling" {
+			result[extension] = false
+			continue
+		}
+		mask := uint64(versionRollingMask)
+		if requested, ok := options["version-rolling.mask"].(string); ok {
+			if m, err := strconv.ParseUint(requested, 16, 32); err == nil {
+				mask &= m
+			}
+		}
+		result["version-rolling"] = true
+		result["version-rolling.mask"] = fmt.Sprintf("%08x", mask)
+	}
+	return result
+}
+
+// push sends the difficulty and every new job, and lowers the difficulty
+// of a connection that sends no shares, until done is closed.
+func (c *soloConn) push(done <-chan struct{}) {
+	job, changed := c.node.current()
+	c.notify(job, true)
+	ticker := time.NewTicker(soloRetargetTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-changed:
+			job, changed = c.node.current()
+			c.notify(job, false)
+		case <-ticker.C:
+			c.retarget(0)
+		}
+	}
+}
+
+// notify sends job, after the difficulty when that changed. The first job
+// a connection gets is always clean.
+func (c *soloConn) notify(job *soloJob, first bool) {
+	if job == nil {
+		return
+	}
+	c.mu.Lock()
+	difficulty := c.difficulty
+	announce := first || difficulty != c.announced
+	c.announced = difficulty
+	// A job sent again at another difficulty takes shares at the lower of
+	// the two, as the miner may still be working at the old one.
+	if sent, ok := c.sent[job.id]; !ok || difficulty < sent {
+		c.sent[job.id] = difficulty
+	}
+	for id := range c.sent {
+		if c.node.job(id) == nil {
+			delete(c.sent, id)
+		}
+	}
+	for key := range c.submitted {
+		if id, _, _ := strings.Cut(key, "/"); c.sent[id] == 0 {
+			delete(c.submitted, key)
+		}
+	}
+	c.mu.Unlock()
+
+	if announce {
+		c.send(map[string]interface{}{"id": nil, "method": "mining.set_difficulty", "params": []float64{difficulty}})
+	}
+	if first && !job.clean {
+		job = &soloJob{stratumJob: job.stratumJob, template: job.template, clean: true}
+	}
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(soloWriteTimeout))
+	_, err := c.conn.Write([]byte(job.notify() + "\n"))
+	c.writeMu.Unlock()
+	if err != nil {
+		c.conn.Close()
+	}
+}
+
+// retarget counts shares and, every so many shares or so often, sets the
+// difficulty that gets about a share per share interval.
+func (c *soloConn) retarget(shares int) {
+	c.mu.Lock()
+	c.shares += shares
+	elapsed := time.Since(c.retargeted)
+	if c.shares < soloRetargetShares && elapsed < soloRetargetTime {
+		c.mu.Unlock()
+		return
+	}
+	// Without shares the difficulty is quartered, otherwise moved by at
+	// most four times and only when off by more than a quarter.
+	factor := 0.25
+	if c.shares > 0 {
+		factor = min(max(soloShareInterval.Seconds()*float64(c.shares)/elapsed.Seconds(), 0.25), 4)
+	}
+	previous := c.difficulty
+	if factor < 0.8 || factor > 1.25 {
+		c.difficulty = max(c.difficulty*factor, c.node.target.Solo.minDifficulty())
+	}
+	c.shares = 0
+	c.retargeted = time.Now()
+	changed := c.difficulty != previous
+	c.mu.Unlock()
+
+	if changed {
+		job, _ := c.node.current()
+		c.notify(job, false)
+	}
+}
+
+// submit checks a share and submits the block it solves to the node. It
+// returns the result or the error code and message to answer with.
+func (c *soloConn) submit(msg *stratumMessage) (interface{}, int, string) {
+	c.mu.Lock()
+	extranonce1, worker := c.extranonce1, c.worker
+	c.mu.Unlock()
+	if extranonce1 == "" {
+		return nil, 25, "Not subscribed"
+	}
+	if worker == "" {
+		return nil, 24, "Unauthorized worker"
+	}
+
+	var id, extranonce2, ntime string
+	if len(msg.Params) < 5 || json.Unmarshal(msg.Params[1], &id) != nil ||
+		json.Unmarshal(msg.Params[2], &extranonce2) != nil || json.Unmarshal(msg.Params[3], &ntime) != nil {
+		return nil, 20, "Bad submit"
+	}
+	job := c.node.job(id)
+	c.mu.Lock()
+	difficulty, sent := c.sent[id]
+	c.mu.Unlock()
+	if job == nil || !sent {
+		return nil, 21, "Job not found"
+	}
+	if len(extranonce2) != 2*soloExtranonce2Size {
+		return nil, 20, "Incorrect size of extranonce2"
+	}
+	if t, err := strconv.ParseInt(ntime, 16, 64); err != nil || t < job.template.MinTime || t > time.Now().Unix()+7200 {
+		return nil, 20, "ntime out of range"
+	}
+	header, err := submitHeader(job.stratumJob, extranonce1, msg.Params)
+	if err != nil {
+		return nil, 20, err.Error()
+	}
+
+	key := id + "/" + hex.EncodeToString(header)
+	c.mu.Lock()
+	duplicate := c.submitted[key]
+	c.submitted[key] = true
+	c.mu.Unlock()
+	if duplicate {
+		return nil, 22, "Duplicate share"
+	}
+
+	coin := &CoinConfig{Algorithm: soloNodes.algorithm(c.node.target.Address)}
+	pow := doubleSHA256(header)
+	if coin.Algorithm == "scrypt" {
+		pow = scryptHash(header)
+	}
+	value := new(big.Int).SetBytes(reversed(pow))
+	if value.Cmp(difficultyTarget(coin.diff1Target(), difficulty)) > 0 {
+		return nil, 23, "Low difficulty share"
+	}
+	if value.Cmp(networkTarget(binary.LittleEndian.Uint32(header[72:76]))) <= 0 {
+		c.node.submitBlock(job, header, extranonce1, extranonce2, worker)
+	}
+	c.retarget(1)
+	return true, 0, ""
+}
+
+// submitBlock submits the block a share solved and raises its alert.
+func (n *soloNode) submitBlock(job *soloJob, header []byte, extranonce1, extranonce2, worker string) {
+	hash := hex.EncodeToString(reversed(doubleSHA256(header)))
+	// The node answers null for a block it took, else why not.
+	var reason *string
+	err := n.call("submitblock", []interface{}{job.block(header, extranonce1, extranonce2)}, &reason)
+	switch {
+	case err != nil:
+		reportBlock(hash, worker, worker, n.target.Address, false, err.Error())
+	case reason != nil:
+		reportBlock(hash, worker, worker, n.target.Address, false, *reason)
+	default:
+		reportBlock(hash, worker, worker, n.target.Address, true, "")
+		// Move on to the next block without waiting for the poll.
+		go n.refresh()
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Under "split" target selection the weights of targets are their parts of
+// the accepted work, e.g. 95 and 5. New connections are drawn towards the
+// targets below their part, measured by the difficulty of the shares the
+// targets accepted lately, and connected miners are moved between targets
+// that drifted apart, so miners of any size end up splitting the work and
+// not just the connections.
+
+const (
+	// Accepted work counts half as much after this long, so the split
+	// follows the hashrate the miners have now.
+	splitHalfLife = time.Hour
+	// How often the split is rebalanced, moving at most one miner of each
+	// list of targets.
+	splitRebalanceInterval = 5 * time.Minute
+	// How far above its part a target has to be to give up a miner.
+	splitRebalanceMargin = 0.05
+)
+
+// splitLedger sums the difficulty of accepted shares per target, decaying
+// with splitHalfLife.
+type splitLedger struct {
+	mu sync.Mutex
+	// difficulty is as of updated.
+	difficulty map[string]float64
+	updated    time.Time
+}
+
+var splits = &splitLedger{difficulty: make(map[string]float64)}
+
+// share counts a share that was answered under config.
+func (l *splitLedger) share(config *Config, r shareRecord) {
+	if r.result != "accepted" || config.TargetSelection != "split" {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	if !l.updated.IsZero() {
+		decay := math.Exp2(-now.Sub(l.updated).Seconds() / splitHalfLife.Seconds())
+		for address, difficulty := range l.difficulty {
+			l.difficulty[address] = difficulty * decay
+		}
+	}
+	l.updated = now
+	l.difficulty[r.pool] += r.info.difficulty
+	l.mu.Unlock()
+}
+
+// shortfalls returns how far the part of the accepted work of each of
+// targets falls short of its weight, negative for targets above it, or nil
+// before any of them accepted a share. Decay scales all targets alike, so
+// the parts need no decaying here.
+func (l *splitLedger) shortfalls(targets []Target) map[string]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var weights, done float64
+	for _, t := range targets {
+		weights += float64(t.weight())
+		done += l.difficulty[t.Address]
+	}
+	if done == 0 {
+		return nil
+	}
+	shortfall := make(map[string]float64, len(targets))
+	for _, t := range targets {
+		shortfall[t.Address] = float64(t.weight())/weights - l.difficulty[t.Address]/done
+	}
+	return shortfall
+}
+
+// byShortfall returns targets furthest below their part first.
+func byShortfall(targets []Target, shortfall map[string]float64) []Target {
+	sorted := append([]Target(nil), targets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return shortfall[sorted[i].Address] > shortfall[sorted[j].Address]
+	})
+	return sorted
+}
+
+// order draws the first of targets with a probability proportional to how
+// far it falls short of its part, so miners connecting at once spread over
+// the targets below theirs instead of all going to the one furthest below.
+// The rest follow furthest below first. Before any of them accepted a
+// share, or when none is below its part, the connections are split by
+// weight.
+func (l *splitLedger) order(targets []Target) []Target {
+	shortfall := l.shortfalls(targets)
+	if shortfall == nil {
+		return weightedOrder(targets)
+	}
+	sorted := byShortfall(targets, shortfall)
+	var total float64
+	for _, t := range sorted {
+		total += math.Max(shortfall[t.Address], 0)
+	}
+	if total == 0 {
+		return weightedOrder(targets)
+	}
+	pick := rand.Float64() * total
+	for i, t := range sorted {
+		if pick < shortfall[t.Address] || i == len(sorted)-1 {
+			return append(append([]Target{t}, sorted[:i]...), sorted[i+1:]...)
+		}
+		pick -= math.Max(shortfall[t.Address], 0)
+	}
+	return sorted
+}
+
+// run rebalances the split every splitRebalanceInterval until stop is
+// closed.
+func (l *splitLedger) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(splitRebalanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		l.rebalance()
+	}
+}
+
+// rebalance moves one miner of each list of split targets from the target
+// furthest above its part, by more than splitRebalanceMargin, to the ones
+// below it. Only miners subscribed to extranonce changes are moved, as the
+// others would have to be disconnected and may come back to the same
+// target.
+func (l *splitLedger) rebalance() {
+	groups := make(map[string][]*session)
+	lists := make(map[string][]Target)
+	for _, s := range sessions.all() {
+		targets := s.targets.Load()
+		if s.config.TargetSelection != "split" || targets == nil || len(*targets) < 2 {
+			continue
+		}
+		addresses := make([]string, len(*targets))
+		for i, t := range *targets {
+			addresses[i] = t.Address
+		}
+		key := strings.Join(addresses, " ")
+		groups[key] = append(groups[key], s)
+		lists[key] = *targets
+	}
+
+	for key, group := range groups {
+		shortfall := l.shortfalls(lists[key])
+		if shortfall == nil {
+			continue
+		}
+		sorted := byShortfall(lists[key], shortfall)
+		over := sorted[len(sorted)-1].Address
+		if -shortfall[over] <= splitRebalanceMargin || unavailable(group[0].config, sorted[0].Address) {
+			continue
+		}
+		var movable []*session
+		for _, s := range group {
+			s.handshakeMu.Lock()
+			extranonce := s.extranonceSubscribed
+			s.handshakeMu.Unlock()
+			if extranonce && s.up.Load().target.Address == over {
+				movable = append(movable, s)
+			}
+		}
+		if len(movable) == 0 {
+			continue
+		}
+		s := movable[rand.Intn(len(movable))]
+		// A miner failing over is left where it ends up.
+		if !s.failingOver.CompareAndSwap(false, true) {
+			continue
+		}
+		log.Printf("Split: %s is %.1f%% above its part, moving %s to %s", over, -shortfall[over]*100, s.clientIP, sorted[0].Address)
+		// Moves wait on pools: one slow pool must not hold up the others.
+		go s.handOver(sorted, "split rebalanced", "moved by split")
+	}
+}
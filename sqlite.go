@@ -0,0 +1,822 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// sqliteTable appends rows to a table of an SQLite 3 database file, writing
+// just enough of the file format for the share log: the schema on page 1
+// and the table's b-tree, grown along its right edge as rows come with ever
+// larger rowids. Each insert is a transaction with a rollback journal and
+// the locks of SQLite's unix VFS, so sqlite3 and other readers can query the
+// file while the proxy runs, and a crash leaves a journal they roll back.
+//
+// Other programs may read and even change the rows; a change is noticed by
+// the file change counter and the table reloaded. Indexes and triggers on
+// the table are refused, since inserts here would not maintain them.
+type sqliteTable struct {
+	file *os.File
+	path string
+	name string
+	sql  string // the CREATE TABLE statement
+
+	pageSize int
+	usable   int    // bytes of a page not reserved for extensions
+	pages    uint32 // database size in pages
+	counter  uint32 // file change counter as last seen
+	loaded   bool   // whether the fields below match the file
+
+	header    *sqlitePage   // page 1
+	spine     []*sqlitePage // right edge of the table, leaf first, root last
+	nextRowid int64
+	dirty     map[uint32]*sqlitePage
+}
+
+const (
+	sqliteMagic         = "SQLite format 3\x00"
+	sqliteJournalMagic  = "\xd9\xd5\x05\xf9\x20\xa1\x63\xd7"
+	sqliteNewPageSize   = 4096
+	sqliteSectorSize    = 512
+	sqliteLeafTable     = 0x0d
+	sqliteInteriorTable = 0x05
+	// The writer claimed in the header; readers do not act on it.
+	sqliteVersionNumber = 3045000
+	// Rows longer than a page would need overflow pages, which are not
+	// written; callers keep rows below this.
+	sqliteMinPageSize = 4096
+
+	// Byte ranges locked like SQLite's unix VFS does.
+	sqlitePendingByte  = 0x40000000
+	sqliteReservedByte = sqlitePendingByte + 1
+	sqliteSharedFirst  = sqlitePendingByte + 2
+	sqliteSharedSize   = 510
+
+	// How long an insert waits for readers to finish before giving up.
+	sqliteBusyTimeout = time.Second
+)
+
+// Kinds of byte-range locks; see sqlitelock_unix.go.
+type sqliteLockKind int
+
+const (
+	sqliteUnlock sqliteLockKind = iota
+	sqliteLockRead
+	sqliteLockWrite
+)
+
+// errSQLiteBusy is returned when another program holds the database; the
+// insert can be retried.
+var errSQLiteBusy = errors.New("database is locked")
+
+// openSQLiteTable opens the database at path, created with the table when
+// missing, for inserting into the table name created by sql.
+func openSQLiteTable(path, name, sql string) (*sqliteTable, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := &sqliteTable{file: file, path: path, name: name, sql: sql, dirty: make(map[uint32]*sqlitePage)}
+	if err := t.begin(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	defer t.unlock()
+	info, err := file.Stat()
+	if err == nil && info.Size() == 0 {
+		err = t.create()
+	}
+	if err == nil {
+		err = t.load()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+func (t *sqliteTable) close() error {
+	return t.file.Close()
+}
+
+// insert appends rows to the table in one transaction. The values are nil,
+// int64, float64 or string.
+func (t *sqliteTable) insert(rows [][]interface{}) error {
+	if err := t.begin(); err != nil {
+		return err
+	}
+	defer t.unlock()
+	err := t.write(rows)
+	if err != nil {
+		// Whatever was built in memory may not have reached the file.
+		t.loaded = false
+		t.dirty = make(map[uint32]*sqlitePage)
+	}
+	return err
+}
+
+// begin takes the shared and reserved locks, rolls back what a crashed
+// writer left and reloads the table when another program changed the file.
+func (t *sqliteTable) begin() error {
+	if err := sqliteLock(t.file, sqliteLockRead, sqlitePendingByte, 1); err != nil {
+		return errSQLiteBusy
+	}
+	err := sqliteLock(t.file, sqliteLockRead, sqliteSharedFirst, sqliteSharedSize)
+	sqliteLock(t.file, sqliteUnlock, sqlitePendingByte, 1)
+	if err != nil {
+		return errSQLiteBusy
+	}
+	if err := sqliteLock(t.file, sqliteLockWrite, sqliteReservedByte, 1); err != nil {
+		t.unlock()
+		return errSQLiteBusy
+	}
+	// With the reserved lock held, a journal is one no writer is using.
+	if _, err := os.Stat(t.journalPath()); err == nil {
+		if err := t.exclusive(); err != nil {
+			t.unlock()
+			return err
+		}
+		if err := t.rollback(); err != nil {
+			t.unlock()
+			return fmt.Errorf("rolling back %s: %v", t.journalPath(), err)
+		}
+		t.loaded = false
+	}
+	if t.loaded {
+		var counter [4]byte
+		if _, err := t.file.ReadAt(counter[:], 24); err != nil || binary.BigEndian.Uint32(counter[:]) != t.counter {
+			t.loaded = false
+		}
+	}
+	if !t.loaded {
+		info, err := t.file.Stat()
+		if err == nil && info.Size() > 0 {
+			err = t.load()
+		}
+		if err != nil {
+			t.unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// exclusive waits for readers to leave and keeps new ones out.
+func (t *sqliteTable) exclusive() error {
+	if err := sqliteLock(t.file, sqliteLockWrite, sqlitePendingByte, 1); err != nil {
+		return errSQLiteBusy
+	}
+	deadline := time.Now().Add(sqliteBusyTimeout)
+	for sqliteLock(t.file, sqliteLockWrite, sqliteSharedFirst, sqliteSharedSize) != nil {
+		if time.Now().After(deadline) {
+			return errSQLiteBusy
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (t *sqliteTable) unlock() {
+	sqliteLock(t.file, sqliteUnlock, sqlitePendingByte, 2+sqliteSharedSize)
+}
+
+func (t *sqliteTable) journalPath() string {
+	return t.path + "-journal"
+}
+
+// create writes an empty database holding the table, whose root is page 2.
+func (t *sqliteTable) create() error {
+	t.pageSize, t.usable = sqliteNewPageSize, sqliteNewPageSize
+	header := t.newPage(1, sqliteLeafTable)
+	h := header.data
+	copy(h, sqliteMagic)
+	binary.BigEndian.PutUint16(h[16:], sqliteNewPageSize)
+	h[18], h[19] = 1, 1 // rollback journal, not WAL
+	h[21], h[22], h[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(h[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(h[44:], 4) // schema format
+	binary.BigEndian.PutUint32(h[56:], 1) // UTF-8
+	schema := sqliteRecord([]interface{}{"table", t.name, t.name, int64(2), t.sql})
+	if !header.add(sqliteLeafCell(1, schema)) {
+		return fmt.Errorf("schema does not fit on page 1")
+	}
+	root := t.newPage(2, sqliteLeafTable)
+	t.pages = 2
+	t.stamp(header, 1)
+	for _, p := range []*sqlitePage{header, root} {
+		if _, err := t.file.WriteAt(p.data, t.offset(p.no)); err != nil {
+			return err
+		}
+	}
+	return t.file.Sync()
+}
+
+// load reads the header, checks the schema and follows the table's right
+// edge to where the next rows go.
+func (t *sqliteTable) load() error {
+	h := make([]byte, 100)
+	if _, err := t.file.ReadAt(h, 0); err != nil {
+		return fmt.Errorf("not an SQLite database: %v", err)
+	}
+	if string(h[:16]) != sqliteMagic {
+		return fmt.Errorf("not an SQLite database")
+	}
+	pageSize := int(binary.BigEndian.Uint16(h[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	switch {
+	case h[18] != 1 || h[19] != 1:
+		return fmt.Errorf("in WAL mode; set journal_mode=DELETE")
+	case pageSize < sqliteMinPageSize:
+		return fmt.Errorf("page size %d below %d", pageSize, sqliteMinPageSize)
+	case binary.BigEndian.Uint32(h[52:]) != 0:
+		return fmt.Errorf("auto_vacuum is on")
+	case binary.BigEndian.Uint32(h[56:]) != 1:
+		return fmt.Errorf("text encoding is not UTF-8")
+	}
+	t.pageSize, t.usable = pageSize, pageSize-int(h[20])
+	t.counter = binary.BigEndian.Uint32(h[24:])
+	t.pages = binary.BigEndian.Uint32(h[28:])
+	if info, err := t.file.Stat(); err != nil {
+		return err
+	} else if t.pages == 0 || binary.BigEndian.Uint32(h[92:]) != t.counter {
+		t.pages = uint32(info.Size() / int64(pageSize))
+	}
+
+	header, err := t.readPage(1)
+	if err != nil {
+		return err
+	}
+	if header.kind() != sqliteLeafTable {
+		return fmt.Errorf("schema too large")
+	}
+	var root uint32
+	for i := 0; i < header.cells(); i++ {
+		_, payload, err := header.leafCell(i, t.usable)
+		if err != nil {
+			return fmt.Errorf("schema: %v", err)
+		}
+		row, err := sqliteDecodeRecord(payload)
+		if err != nil || len(row) < 5 {
+			return fmt.Errorf("schema: bad row")
+		}
+		kind, _ := row[0].(string)
+		name, _ := row[1].(string)
+		table, _ := row[2].(string)
+		switch {
+		case kind == "table" && name == t.name:
+			if sql, _ := row[4].(string); sql != t.sql {
+				return fmt.Errorf("table %s is not the one written here", t.name)
+			}
+			page, _ := row[3].(int64)
+			root = uint32(page)
+		case table == t.name && (kind == "index" || kind == "trigger"):
+			return fmt.Errorf("%s %s on table %s would not be maintained", kind, name, t.name)
+		}
+	}
+	if root < 2 || root > t.pages {
+		return fmt.Errorf("no table %s", t.name)
+	}
+
+	var spine []*sqlitePage
+	for no := root; ; {
+		p, err := t.readPage(no)
+		if err != nil {
+			return err
+		}
+		spine = append([]*sqlitePage{p}, spine...)
+		if p.kind() == sqliteLeafTable {
+			break
+		}
+		if p.kind() != sqliteInteriorTable || len(spine) > 20 {
+			return fmt.Errorf("table %s: bad page %d", t.name, no)
+		}
+		no = p.right()
+	}
+	var last int64
+	for _, p := range spine {
+		if p.cells() == 0 {
+			continue
+		}
+		if p.kind() == sqliteLeafTable {
+			rowid, _, err := p.leafCell(p.cells()-1, t.usable)
+			if err != nil {
+				return err
+			}
+			last = rowid
+		} else if _, key := p.interiorCell(p.cells() - 1); key > last {
+			last = key
+		}
+		break
+	}
+	t.header, t.spine, t.nextRowid = header, spine, last+1
+	t.dirty = make(map[uint32]*sqlitePage)
+	t.loaded = true
+	return nil
+}
+
+// write adds rows to the pages in memory and commits them: the pages about
+// to change are saved to the journal, synced, then overwritten, synced, and
+// the journal deleted.
+func (t *sqliteTable) write(rows [][]interface{}) error {
+	before := t.pages
+	for _, row := range rows {
+		if err := t.append(t.nextRowid, sqliteRecord(row)); err != nil {
+			return err
+		}
+		t.nextRowid++
+	}
+	t.counter++
+	t.stamp(t.header, t.counter)
+	t.dirty[1] = t.header
+
+	nonce := uint32(time.Now().UnixNano())
+	journal := make([]byte, sqliteSectorSize)
+	copy(journal, sqliteJournalMagic)
+	binary.BigEndian.PutUint32(journal[12:], nonce)
+	binary.BigEndian.PutUint32(journal[16:], before)
+	binary.BigEndian.PutUint32(journal[20:], sqliteSectorSize)
+	binary.BigEndian.PutUint32(journal[24:], uint32(t.pageSize))
+	saved := uint32(0)
+	original := make([]byte, t.pageSize)
+	for no := range t.dirty {
+		if no > before {
+			continue
+		}
+		if _, err := t.file.ReadAt(original, t.offset(no)); err != nil {
+			return err
+		}
+		journal = binary.BigEndian.AppendUint32(journal, no)
+		journal = append(journal, original...)
+		journal = binary.BigEndian.AppendUint32(journal, sqliteChecksum(nonce, original))
+		saved++
+	}
+	binary.BigEndian.PutUint32(journal[8:], saved)
+	if err := writeSynced(t.journalPath(), journal); err != nil {
+		return err
+	}
+
+	if err := t.exclusive(); err != nil {
+		os.Remove(t.journalPath())
+		return err
+	}
+	for no, p := range t.dirty {
+		if _, err := t.file.WriteAt(p.data, t.offset(no)); err != nil {
+			return err
+		}
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Remove(t.journalPath()); err != nil {
+		return err
+	}
+	t.dirty = make(map[uint32]*sqlitePage)
+	return nil
+}
+
+// append adds a row at the right edge of the table. A full page is left
+// as it is and a new one started beside it, which the parent points to with
+// its right pointer; a full root moves to a new page under a new root.
+func (t *sqliteTable) append(rowid int64, record []byte) error {
+	if len(record) > t.usable-35 {
+		return fmt.Errorf("row of %d bytes too long for a page", len(record))
+	}
+	cell := sqliteLeafCell(rowid, record)
+	leaf := t.spine[0]
+	t.dirty[leaf.no] = leaf
+	if leaf.add(cell) {
+		return nil
+	}
+	next := t.newPage(t.allocate(), sqliteLeafTable)
+	next.add(cell)
+	t.dirty[next.no] = next
+	t.grow(0, rowid-1, next)
+	return nil
+}
+
+// grow makes page the right edge at level of the spine, after the page
+// there, whose rows go up to key, filled up.
+func (t *sqliteTable) grow(level int, key int64, page *sqlitePage) {
+	full := t.spine[level]
+	if level == len(t.spine)-1 {
+		// The root keeps its page number: its content moves to a new page,
+		// and it becomes the parent of that and page.
+		moved := &sqlitePage{no: t.allocate(), data: append([]byte(nil), full.data...)}
+		t.dirty[moved.no] = moved
+		root := full
+		for i := range root.data {
+			root.data[i] = 0
+		}
+		root.init(sqliteInteriorTable, t.usable)
+		root.add(sqliteInteriorCell(moved.no, key))
+		root.setRight(page.no)
+		t.dirty[root.no] = root
+		t.spine[level] = page
+		t.spine = append(t.spine, root)
+		return
+	}
+	parent := t.spine[level+1]
+	t.dirty[parent.no] = parent
+	if parent.add(sqliteInteriorCell(full.no, key)) {
+		parent.setRight(page.no)
+		t.spine[level] = page
+		return
+	}
+	// Pages other than the root may not be empty, so the new parent takes
+	// the full page along, and the old one ends at its last child.
+	sibling := t.newPage(t.allocate(), sqliteInteriorTable)
+	sibling.add(sqliteInteriorCell(full.no, key))
+	sibling.setRight(page.no)
+	t.dirty[sibling.no] = sibling
+	child, last := parent.interiorCell(parent.cells() - 1)
+	parent.removeLast(t.usable)
+	parent.setRight(child)
+	t.spine[level] = page
+	t.grow(level+1, last, sibling)
+}
+
+// allocate returns the number of a new page at the end of the file,
+// skipping the one holding the lock bytes.
+func (t *sqliteTable) allocate() uint32 {
+	t.pages++
+	if int64(t.pages-1)*int64(t.pageSize) <= sqlitePendingByte && sqlitePendingByte < int64(t.pages)*int64(t.pageSize) {
+		t.pages++
+	}
+	return t.pages
+}
+
+// stamp records a new file change counter and the database size in the
+// header.
+func (t *sqliteTable) stamp(header *sqlitePage, counter uint32) {
+	h := header.data
+	binary.BigEndian.PutUint32(h[24:], counter)
+	binary.BigEndian.PutUint32(h[28:], t.pages)
+	binary.BigEndian.PutUint32(h[92:], counter)
+	binary.BigEndian.PutUint32(h[96:], sqliteVersionNumber)
+}
+
+// rollback restores the pages saved in the journal and deletes it.
+func (t *sqliteTable) rollback() error {
+	journal, err := os.ReadFile(t.journalPath())
+	if err != nil {
+		return err
+	}
+	if len(journal) < 28 || string(journal[:8]) != sqliteJournalMagic {
+		// Zeroed or never finished: nothing of the database changed.
+		return os.Remove(t.journalPath())
+	}
+	count := binary.BigEndian.Uint32(journal[8:])
+	nonce := binary.BigEndian.Uint32(journal[12:])
+	size := binary.BigEndian.Uint32(journal[16:])
+	sector := int(binary.BigEndian.Uint32(journal[20:]))
+	pageSize := int(binary.BigEndian.Uint32(journal[24:]))
+	if sector < 28 || pageSize < 512 || sector > len(journal) {
+		return os.Remove(t.journalPath())
+	}
+	records := journal[sector:]
+	if count == 0 || count == math.MaxUint32 {
+		count = uint32(len(records) / (pageSize + 8))
+	}
+	for i := uint32(0); i < count && len(records) >= pageSize+8; i++ {
+		no := binary.BigEndian.Uint32(records)
+		data := records[4 : 4+pageSize]
+		if binary.BigEndian.Uint32(records[4+pageSize:]) != sqliteChecksum(nonce, data) {
+			break
+		}
+		if no > 0 && no <= size {
+			if _, err := t.file.WriteAt(data, int64(no-1)*int64(pageSize)); err != nil {
+				return err
+			}
+		}
+		records = records[pageSize+8:]
+	}
+	if err := t.file.Truncate(int64(size) * int64(pageSize)); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(t.journalPath())
+}
+
+func (t *sqliteTable) offset(no uint32) int64 {
+	return int64(no-1) * int64(t.pageSize)
+}
+
+func (t *sqliteTable) readPage(no uint32) (*sqlitePage, error) {
+	if no == 0 || no > t.pages {
+		return nil, fmt.Errorf("page %d out of range", no)
+	}
+	p := &sqlitePage{no: no, data: make([]byte, t.pageSize)}
+	if _, err := t.file.ReadAt(p.data, t.offset(no)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (t *sqliteTable) newPage(no uint32, kind byte) *sqlitePage {
+	p := &sqlitePage{no: no, data: make([]byte, t.pageSize)}
+	p.init(kind, t.usable)
+	return p
+}
+
+// writeSynced writes data to a new file at path and syncs it.
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sqliteChecksum is the checksum of a page in the journal: the nonce plus
+// every 200th byte, from the end.
+func sqliteChecksum(nonce uint32, data []byte) uint32 {
+	sum := nonce
+	for i := len(data) - 200; i > 0; i -= 200 {
+		sum += uint32(data[i])
+	}
+	return sum
+}
+
+// sqlitePage is a b-tree page of a table; page 1 has its b-tree header
+// after the database header.
+type sqlitePage struct {
+	no   uint32
+	data []byte
+}
+
+func (p *sqlitePage) start() int {
+	if p.no == 1 {
+		return 100
+	}
+	return 0
+}
+
+func (p *sqlitePage) kind() byte {
+	return p.data[p.start()]
+}
+
+func (p *sqlitePage) headerSize() int {
+	if p.kind() == sqliteLeafTable {
+		return 8
+	}
+	return 12
+}
+
+func (p *sqlitePage) init(kind byte, usable int) {
+	h := p.data[p.start():]
+	h[0] = kind
+	binary.BigEndian.PutUint16(h[1:], 0)
+	binary.BigEndian.PutUint16(h[3:], 0)
+	binary.BigEndian.PutUint16(h[5:], uint16(usable)) // 65536 wraps to 0, as it should
+	h[7] = 0
+}
+
+func (p *sqlitePage) cells() int {
+	return int(binary.BigEndian.Uint16(p.data[p.start()+3:]))
+}
+
+func (p *sqlitePage) content() int {
+	if c := int(binary.BigEndian.Uint16(p.data[p.start()+5:])); c > 0 {
+		return c
+	}
+	return 65536
+}
+
+func (p *sqlitePage) pointer(i int) int {
+	return p.start() + p.headerSize() + 2*i
+}
+
+// add puts cell after the others, when the page has room for it.
+func (p *sqlitePage) add(cell []byte) bool {
+	n := p.cells()
+	end := p.pointer(n)
+	if p.content()-end < len(cell)+2 {
+		return false
+	}
+	at := p.content() - len(cell)
+	copy(p.data[at:], cell)
+	binary.BigEndian.PutUint16(p.data[end:], uint16(at))
+	binary.BigEndian.PutUint16(p.data[p.start()+3:], uint16(n+1))
+	binary.BigEndian.PutUint16(p.data[p.start()+5:], uint16(at))
+	return true
+}
+
+func (p *sqlitePage) right() uint32 {
+	return binary.BigEndian.Uint32(p.data[p.start()+8:])
+}
+
+func (p *sqlitePage) setRight(no uint32) {
+	binary.BigEndian.PutUint32(p.data[p.start()+8:], no)
+}
+
+func (p *sqlitePage) cell(i int) []byte {
+	return p.data[binary.BigEndian.Uint16(p.data[p.pointer(i):]):]
+}
+
+// interiorCell returns the child and key of cell i of an interior page.
+func (p *sqlitePage) interiorCell(i int) (uint32, int64) {
+	c := p.cell(i)
+	key, _ := sqliteVarint(c[4:])
+	return binary.BigEndian.Uint32(c), int64(key)
+}
+
+// leafCell returns the rowid and record of cell i of a leaf page.
+func (p *sqlitePage) leafCell(i int, usable int) (int64, []byte, error) {
+	c := p.cell(i)
+	size, n := sqliteVarint(c)
+	rowid, m := sqliteVarint(c[n:])
+	if n == 0 || m == 0 || size > uint64(usable-35) || n+m+int(size) > len(c) {
+		return 0, nil, fmt.Errorf("page %d: unsupported cell", p.no)
+	}
+	return int64(rowid), c[n+m : n+m+int(size)], nil
+}
+
+// removeLast drops the last cell of an interior page, laying the others
+// out anew so no free space is left between them.
+func (p *sqlitePage) removeLast(usable int) {
+	n := p.cells() - 1
+	cells := make([][]byte, n)
+	for i := range cells {
+		child, key := p.interiorCell(i)
+		cells[i] = sqliteInteriorCell(child, key)
+	}
+	right := p.right()
+	for i := p.start(); i < len(p.data); i++ {
+		p.data[i] = 0
+	}
+	p.init(sqliteInteriorTable, usable)
+	for _, c := range cells {
+		p.add(c)
+	}
+	p.setRight(right)
+}
+
+func sqliteLeafCell(rowid int64, record []byte) []byte {
+	cell := sqlitePutVarint(nil, uint64(len(record)))
+	cell = sqlitePutVarint(cell, uint64(rowid))
+	return append(cell, record...)
+}
+
+func sqliteInteriorCell(child uint32, key int64) []byte {
+	return sqlitePutVarint(binary.BigEndian.AppendUint32(nil, child), uint64(key))
+}
+
+// sqliteRecord encodes values in the record format: a header of serial
+// types, then the values.
+func sqliteRecord(values []interface{}) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = sqlitePutVarint(types, 0)
+		case int64:
+			serial, size := sqliteIntSerial(v)
+			types = sqlitePutVarint(types, serial)
+			for i := size - 1; i >= 0; i-- {
+				body = append(body, byte(v>>(8*i)))
+			}
+		case float64:
+			types = sqlitePutVarint(types, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case string:
+			types = sqlitePutVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		}
+	}
+	size := len(types) + 1
+	for len(sqlitePutVarint(nil, uint64(size)))+len(types) != size {
+		size++
+	}
+	record := sqlitePutVarint(nil, uint64(size))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// sqliteIntSerial returns the serial type and size of the smallest integer
+// encoding holding v.
+func sqliteIntSerial(v int64) (uint64, int) {
+	switch {
+	case v == 0:
+		return 8, 0
+	case v == 1:
+		return 9, 0
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return 1, 1
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return 2, 2
+	case v >= -1<<23 && v < 1<<23:
+		return 3, 3
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return 4, 4
+	case v >= -1<<47 && v < 1<<47:
+		return 5, 6
+	}
+	return 6, 8
+}
+
+// sqliteDecodeRecord decodes a record of NULLs, integers and text; other
+// values come back as nil.
+func sqliteDecodeRecord(record []byte) ([]interface{}, error) {
+	size, n := sqliteVarint(record)
+	if n == 0 || size > uint64(len(record)) {
+		return nil, fmt.Errorf("bad record")
+	}
+	types, body := record[n:size], record[size:]
+	var values []interface{}
+	for len(types) > 0 {
+		serial, n := sqliteVarint(types)
+		if n == 0 {
+			return nil, fmt.Errorf("bad record")
+		}
+		types = types[n:]
+		var length int
+		switch {
+		case serial >= 12:
+			length = int(serial-12) / 2
+		case serial == 7 || serial == 6:
+			length = 8
+		case serial == 5:
+			length = 6
+		case serial <= 4:
+			length = int(serial)
+		}
+		if length > len(body) {
+			return nil, fmt.Errorf("bad record")
+		}
+		value := body[:length]
+		body = body[length:]
+		switch {
+		case serial >= 13 && serial%2 == 1:
+			values = append(values, string(value))
+		case serial >= 1 && serial <= 6:
+			v := int64(int8(value[0]))
+			for _, b := range value[1:] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+		case serial == 8:
+			values = append(values, int64(0))
+		case serial == 9:
+			values = append(values, int64(1))
+		default:
+			values = append(values, nil)
+		}
+	}
+	return values, nil
+}
+
+// sqlitePutVarint appends v in SQLite's big-endian varint format.
+func sqlitePutVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, buf[i:]...)
+}
+
+// sqliteVarint decodes a varint, returning 0 bytes read when b ends first.
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	if len(b) < 9 {
+		return 0, 0
+	}
+	return v<<8 | uint64(b[8]), 9
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// rowids walks the b-tree under page no and returns the rowids of its rows
+// in order, checking every key against the interior cells above it.
+func rowids(t *testing.T, table *sqliteTable, no uint32, max int64) []int64 {
+	t.Helper()
+	p, err := table.readPage(no)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.cells() == 0 && no != 2 {
+		t.Fatalf("page %d is empty", no)
+	}
+	var ids []int64
+	if p.kind() == sqliteLeafTable {
+		for i := 0; i < p.cells(); i++ {
+			rowid, _, err := p.leafCell(i, table.usable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rowid > max {
+				t.Fatalf("rowid %d on page %d above its key %d", rowid, no, max)
+			}
+			ids = append(ids, rowid)
+		}
+		return ids
+	}
+	for i := 0; i < p.cells(); i++ {
+		child, key := p.interiorCell(i)
+		ids = append(ids, rowids(t, table, child, key)...)
+	}
+	return append(ids, rowids(t, table, p.right(), max)...)
+}
+
+func TestSQLiteTableAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	const sql = "CREATE TABLE t (a TEXT, b REAL, c INTEGER)"
+	table, err := openSQLiteTable(path, "t", sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const batches, perBatch = 200, 50
+	for b := 0; b < batches; b++ {
+		rows := make([][]interface{}, perBatch)
+		for i := range rows {
+			rows[i] = []interface{}{fmt.Sprintf("row %d.%d", b, i), float64(i) / 4, int64(b*perBatch + i)}
+		}
+		if err := table.insert(rows); err != nil {
+			t.Fatal(err)
+		}
+	}
+	table.close()
+
+	table, err = openSQLiteTable(path, "t", sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	if len(table.spine) < 2 {
+		t.Fatalf("tree of %d levels for %d rows", len(table.spine), batches*perBatch)
+	}
+	if table.nextRowid != batches*perBatch+1 {
+		t.Fatalf("next rowid %d after %d rows", table.nextRowid, batches*perBatch)
+	}
+	ids := rowids(t, table, table.spine[len(table.spine)-1].no, 1<<62)
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("rowid %d at position %d", id, i)
+		}
+	}
+	if len(ids) != batches*perBatch {
+		t.Fatalf("%d rows read back of %d", len(ids), batches*perBatch)
+	}
+
+	_, record, err := table.spine[0].leafCell(table.spine[0].cells()-1, table.usable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := sqliteDecodeRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("row %d.%d", batches-1, perBatch-1); row[0] != want || row[2] != int64(batches*perBatch-1) {
+		t.Fatalf("last row %v", row)
+	}
+}
+
+func TestSQLiteTableRefusesOtherTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	table, err := openSQLiteTable(path, "t", "CREATE TABLE t (a TEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.close()
+	if _, err := openSQLiteTable(path, "t", "CREATE TABLE t (b TEXT)"); err == nil {
+		t.Fatal("table with other columns taken")
+	}
+}
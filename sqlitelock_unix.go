@@ -0,0 +1,21 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// sqliteLock takes or releases a POSIX lock on length bytes at start of
+// file without waiting, as SQLite does, so both see each other's locks.
+func sqliteLock(file *os.File, kind sqliteLockKind, start, length int64) error {
+	lock := syscall.Flock_t{Type: syscall.F_UNLCK, Start: start, Len: length}
+	switch kind {
+	case sqliteLockRead:
+		lock.Type = syscall.F_RDLCK
+	case sqliteLockWrite:
+		lock.Type = syscall.F_WRLCK
+	}
+	return syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock)
+}
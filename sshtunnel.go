@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSHConfig dials a target through an SSH jump host, for farms whose only
+// way out is an SSH bastion. The ssh client of the system keeps one tunnel
+// per target open, which all connections to the target go through.
+type SSHConfig struct {
+	// Host is the jump host, as host or host:port; port 22 when left out.
+	Host string `json:"host"`
+	User string `json:"user"`
+	// KeyFile is the private key to log in with.
+	KeyFile string `json:"key_file"`
+	// KnownHostsFile holds the host key of the jump host, which must be
+	// known; the user's known hosts when "".
+	KnownHostsFile string `json:"known_hosts_file,omitempty"`
+}
+
+// How often a starting tunnel is checked for taking connections.
+const sshTunnelPollInterval = 100 * time.Millisecond
+
+func validateSSH(config *Config) error {
+	for _, t := range allTargets(config) {
+		if t.SSH == nil {
+			continue
+		}
+		if t.SSH.Host == "" || t.SSH.User == "" || t.SSH.KeyFile == "" {
+			return fmt.Errorf("%s: host, user and key_file are required", t.Address)
+		}
+		if t.Solo != nil {
+			return fmt.Errorf("%s: solo targets are not dialed", t.Address)
+		}
+	}
+	return nil
+}
+
+// sshTunnel is an ssh process forwarding a local port to a target.
+type sshTunnel struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	local  string
+	exited chan struct{}
+}
+
+type sshTunnelRegistry struct {
+	mu      sync.Mutex
+	tunnels map[string]*sshTunnel // by jump host, user and target
+}
+
+var sshTunnels = &sshTunnelRegistry{tunnels: make(map[string]*sshTunnel)}
+
+// dial connects to target through its tunnel, starting the tunnel when it
+// is not running.
+func (r *sshTunnelRegistry) dial(target Target, timeout time.Duration) (net.Conn, error) {
+	key := target.SSH.User + "@" + target.SSH.Host + "/" + target.Address
+	r.mu.Lock()
+	t := r.tunnels[key]
+	if t == nil {
+		t = &sshTunnel{}
+		r.tunnels[key] = t
+	}
+	r.mu.Unlock()
+
+	local, err := t.open(target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", local, timeout)
+}
+
+// close stops all tunnels.
+func (r *sshTunnelRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, t := range r.tunnels {
+		t.mu.Lock()
+		t.stop()
+		t.mu.Unlock()
+		delete(r.tunnels, key)
+	}
+}
+
+func (t *sshTunnel) running() bool {
+	if t.exited == nil {
+		return false
+	}
+	select {
+	case <-t.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// open returns the local address of the tunnel, starting ssh if it is not
+// running, and waits up to timeout for the tunnel to take connections.
+func (t *sshTunnel) open(target Target, timeout time.Duration) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running() {
+		return t.local, nil
+	}
+
+	// ssh binds the port itself; a port just free is as close as it gets.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	t.local = l.Addr().String()
+	l.Close()
+
+	host, port, err := net.SplitHostPort(target.SSH.Host)
+	if err != nil {
+		host, port = target.SSH.Host, "22"
+	}
+	targetHost, targetPort, err := net.SplitHostPort(target.Address)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(targetHost, ":") {
+		targetHost = "[" + targetHost + "]"
+	}
+	args := []string{"-N",
+		"-o", "BatchMode=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=15",
+		"-o", "ServerAliveCountMax=3",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "IdentitiesOnly=yes",
+		"-i", target.SSH.KeyFile,
+		"-l", target.SSH.User,
+		"-p", port,
+		"-L", t.local + ":" + targetHost + ":" + targetPort,
+	}
+	if target.SSH.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+target.SSH.KnownHostsFile)
+	}
+	args = append(args, host)
+
+	stderr := &bytes.Buffer{}
+	t.cmd = exec.Command("ssh", args...)
+	t.cmd.Stderr = stderr
+	if err := t.cmd.Start(); err != nil {
+		return "", fmt.Errorf("starting ssh: %v", err)
+	}
+	exited := make(chan struct{})
+	t.exited = exited
+	cmd := t.cmd
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-exited:
+			err := fmt.Errorf("ssh to %s exited: %s", target.SSH.Host, lastLine(stderr))
+			log.Printf("SSH tunnel to %s failed: %v", target.Address, err)
+			return "", err
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", t.local, sshTunnelPollInterval); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.stop()
+			return "", fmt.Errorf("ssh tunnel through %s not up after %s", target.SSH.Host, timeout)
+		}
+		time.Sleep(sshTunnelPollInterval)
+	}
+	log.Printf("SSH tunnel to %s through %s on %s", target.Address, target.SSH.Host, t.local)
+	go func() {
+		<-exited
+		log.Printf("SSH tunnel to %s through %s closed: %s", target.Address, target.SSH.Host, lastLine(stderr))
+	}()
+	return t.local, nil
+}
+
+// lastLine returns the last line ssh wrote to stderr, once it exited.
+func lastLine(stderr *bytes.Buffer) string {
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	return "no error output"
+}
+
+// stop kills ssh. Callers hold t.mu.
+func (t *sshTunnel) stop() {
+	if t.running() {
+		t.cmd.Process.Kill()
+		<-t.exited
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// StalePolicyConfig sets how old work a class of workers may still submit.
+// Submits for older jobs are answered as stale without bothering the pool.
+type StalePolicyConfig struct {
+	// Class matches the miner's user agent (case-insensitive substring, as
+	// for shims) or the model of its client entry.
+	Class string `json:"class"`
+	// MaxJobAge is how many clean jobs back a submit is still forwarded: 0
+	// for the current job only, -1 for everything.
+	MaxJobAge int `json:"max_job_age"`
+}
+
+// Name of the built-in policy, which only filters work from before a
+// switchover.
+const defaultStalePolicy = "default"
+
+// staleCounters is the evidence for tuning a stale policy: shares it
+// filtered, which would most likely have been rejected, and shares for older
+// jobs it forwarded, split by what the pool made of them.
+type staleCounters struct {
+	filtered    int
+	oldAccepted int
+	oldRejected int
+}
+
+func (c staleCounters) String() string {
+	return fmt.Sprintf("%d filtered, %d old accepted, %d old rejected", c.filtered, c.oldAccepted, c.oldRejected)
+}
+
+// Totals per stale policy since start.
+var staleStats = struct {
+	sync.Mutex
+	m map[string]*staleCounters
+}{m: make(map[string]*staleCounters)}
+
+func validateStalePolicies(config *Config) error {
+	for _, p := range config.StalePolicies {
+		if p.Class == "" {
+			return fmt.Errorf("stale policy without class")
+		}
+		if p.MaxJobAge < -1 {
+			return fmt.Errorf("stale policy %s: max_job_age below -1", p.Class)
+		}
+	}
+	return nil
+}
+
+// jobGenerations returns how many clean_jobs notifies back the stale
+// policies still forward shares for, -1 for all, which pool connections
+// keep the jobs of.
+func (c *Config) jobGenerations() int {
+	generations := 0
+	for _, p := range c.StalePolicies {
+		if p.MaxJobAge < 0 {
+			return -1
+		}
+		if p.MaxJobAge > generations {
+			generations = p.MaxJobAge
+		}
+	}
+	return generations
+}
+
+// stalePolicy returns the policy for the session's worker class, or nil for
+// the default. The class is taken from the session's own subscribe, not from
+// what an earlier miner of the same IP sent.
+func (s *session) stalePolicy() *StalePolicyConfig {
+	if len(s.config.StalePolicies) == 0 {
+		return nil
+	}
+	agent := strings.ToLower(s.userAgent())
+	var model string
+	if client := s.config.clientFor(s.clientIP); client != nil {
+		model = client.Model
+	}
+
+	for i := range s.config.StalePolicies {
+		p := &s.config.StalePolicies[i]
+		if (agent != "" && strings.Contains(agent, strings.ToLower(p.Class))) || strings.EqualFold(model, p.Class) {
+			return p
+		}
+	}
+	return nil
+}
+
+// staleSubmit reports whether a submit is for work too old under the
+// worker's policy, and the age of its job in clean jobs (-1 when the pool
+// never sent it). from is the pool connection the job came from; jobs of
+// any but the current one are unknown to the pool.
+func (s *session) staleSubmit(msg *stratumMessage, from *upstream) (bool, int) {
+	var job string
+	if len(msg.Params) < 2 || json.Unmarshal(msg.Params[1], &job) != nil {
+		return false, 0
+	}
+	var age int
+	var known, forgot bool
+	if from == s.up.Load() {
+		age, known, forgot = from.jobAge(job)
+	}
+	if !known {
+		age = -1
+	}
+	// A job dropped for room may still be one the pool takes.
+	if forgot {
+		return false, age
+	}
+
+	policy := s.stalePolicy()
+	var stale bool
+	if policy == nil {
+		// A job the current pool never sent is only possible for work
+		// started before a switchover.
+		stale = !known && s.switched.Load()
+	} else {
+		stale = policy.MaxJobAge >= 0 && (!known || age > policy.MaxJobAge)
+	}
+	if stale {
+		s.noteStale(func(c *staleCounters) { c.filtered++ })
+	}
+	return stale, age
+}
+
+// noteOldShare counts the pool's answer to a submit for an older job.
+func (s *session) noteOldShare(accepted bool) {
+	s.noteStale(func(c *staleCounters) {
+		if accepted {
+			c.oldAccepted++
+		} else {
+			c.oldRejected++
+		}
+	})
+}
+
+func (s *session) noteStale(count func(c *staleCounters)) {
+	name := defaultStalePolicy
+	if policy := s.stalePolicy(); policy != nil {
+		name = policy.Class
+	}
+
+	s.staleMu.Lock()
+	count(&s.stale)
+	s.staleMu.Unlock()
+
+	staleStats.Lock()
+	total, ok := staleStats.m[name]
+	if !ok {
+		total = &staleCounters{}
+		staleStats.m[name] = total
+	}
+	count(total)
+	staleStats.Unlock()
+}
+
+// reportStale logs what the stale policy did for a closed session.
+func (s *session) reportStale() {
+	s.staleMu.Lock()
+	counts := s.stale
+	s.staleMu.Unlock()
+	if counts == (staleCounters{}) {
+		return
+	}
+
+	name := defaultStalePolicy
+	if policy := s.stalePolicy(); policy != nil {
+		name = policy.Class
+	}
+	staleStats.Lock()
+	total := *staleStats.m[name]
+	staleStats.Unlock()
+	log.Printf("Stale policy %s for %s: %s (totals: %s)", name, s.clientIP, counts, total)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statePath returns where a named state file lives, or "" when the config
+// has no state directory and state is kept in memory only.
+func statePath(config *Config, name string) string {
+	if config.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(config.StateDir, name)
+}
+
+// configRelative resolves name against the directory of the config file at
+// path when it is relative.
+func configRelative(path, name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+// writeStateFile atomically replaces path with v encoded as JSON.
+func writeStateFile(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readStateFile(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// exportState bundles the config file, the files it refers to, such as
+// worker names, credentials, GeoIP database and certificates, and every file
+// of the state directory into a gzipped tar archive. The referenced files go
+// under files/ and the archived config points there.
+func exportState(args []string) error {
+	fs := flag.NewFlagSet("export-state", flag.ExitOnError)
+	configPath := fs.String("c", "config.json", "Path to JSON configuration file")
+	output := fs.String("o", "proxy-state.tar.gz", "Archive to write")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %v", err)
+	}
+	configData, err := os.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	bundled := make(map[string]string) // archive name by path
+	taken := make(map[string]bool)
+	configData, err = rewriteConfigFiles(configData, func(path string) (string, error) {
+		if name, ok := bundled[path]; ok {
+			return name, nil
+		}
+		name := "files/" + filepath.Base(path)
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("files/%d-%s", i, filepath.Base(path))
+		}
+		if err := addArchiveFile(tw, name, path); err != nil {
+			return "", err
+		}
+		bundled[path], taken[name] = name, true
+		return name, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := addArchiveData(tw, "config.json", configData, 0644); err != nil {
+		return err
+	}
+	count := 0
+	if config.StateDir != "" {
+		entries, err := os.ReadDir(config.StateDir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || strings.HasSuffix(e.Name(), ".tmp") {
+				continue
+			}
+			if err := addArchiveFile(tw, "state/"+e.Name(), filepath.Join(config.StateDir, e.Name())); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Exported config, %d referenced files and %d state files to %s\n", len(bundled), count, *output)
+	return nil
+}
+
+// addArchiveFile adds the file at path, keeping its permissions so keys
+// stay private.
+func addArchiveFile(tw *tar.Writer, name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return addArchiveData(tw, name, data, info.Mode().Perm())
+}
+
+func addArchiveData(tw *tar.Writer, name string, data []byte, mode os.FileMode) error {
+	hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// rewriteConfigFiles replaces the path of every file a config refers to
+// with what fn returns for it, and returns the config indented again.
+func rewriteConfigFiles(data []byte, fn func(path string) (string, error)) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var config interface{}
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	if err := rewriteFilePaths(config, "", fn); err != nil {
+		return nil, err
+	}
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// rewriteFilePaths walks a decoded config, whose objects are found under
+// parent, for the keys naming files it reads.
+func rewriteFilePaths(v interface{}, parent string, fn func(string) (string, error)) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !configFileKey(parent, key) {
+				if err := rewriteFilePaths(v[key], key, fn); err != nil {
+					return err
+				}
+				continue
+			}
+			var err error
+			switch value := v[key].(type) {
+			case string:
+				if value != "" {
+					v[key], err = fn(value)
+				}
+			case []interface{}:
+				for i, item := range value {
+					if path, ok := item.(string); ok && path != "" && err == nil {
+						value[i], err = fn(path)
+					}
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := rewriteFilePaths(item, parent, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// configFileKey reports whether key of an object under parent names files
+// the proxy reads: certificates, keys and known hosts, worker names,
+// credentials and the GeoIP database.
+func configFileKey(parent, key string) bool {
+	switch {
+	case strings.HasSuffix(key, "_file"), key == "worker_names":
+		return true
+	case parent == "miner_auth":
+		return key == "file"
+	case parent == "geoip":
+		return key == "blocks" || key == "locations"
+	}
+	return false
+}
+
+// importState restores an archive written by export-state: the config goes
+// to -c, the files it refers to into files/ next to it, and the state files
+// into the state directory named by that config.
+func importState(args []string) error {
+	fs := flag.NewFlagSet("import-state", flag.ExitOnError)
+	configPath := fs.String("c", "config.json", "Where to write the restored configuration")
+	input := fs.String("i", "proxy-state.tar.gz", "Archive to read")
+	force := fs.Bool("f", false, "Overwrite an existing configuration file")
+	fs.Parse(args)
+
+	in, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string][]byte)
+	modes := make(map[string]os.FileMode)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		files[hdr.Name], modes[hdr.Name] = data, os.FileMode(hdr.Mode).Perm()
+	}
+
+	configData, ok := files["config.json"]
+	if !ok {
+		return fmt.Errorf("%s has no config.json", *input)
+	}
+	var config Config
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return fmt.Errorf("archived config: %v", err)
+	}
+	if _, err := os.Stat(*configPath); err == nil && !*force {
+		return fmt.Errorf("%s exists, use -f to overwrite", *configPath)
+	}
+	dir, err := filepath.Abs(filepath.Dir(*configPath))
+	if err != nil {
+		return err
+	}
+
+	// Referenced files are written next to the config, which then names
+	// them by absolute path.
+	restored := make(map[string]string) // written file by archive name
+	configData, err = rewriteConfigFiles(configData, func(path string) (string, error) {
+		data, ok := files[path]
+		if !ok || !strings.HasPrefix(path, "files/") {
+			return path, nil
+		}
+		if target, ok := restored[path]; ok {
+			return target, nil
+		}
+		target := filepath.Join(dir, "files", filepath.Base(path))
+		if _, err := os.Stat(target); err == nil && !*force {
+			return "", fmt.Errorf("%s exists, use -f to overwrite", target)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(target, data, modes[path]); err != nil {
+			return "", err
+		}
+		restored[path] = target
+		return target, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*configPath, configData, 0644); err != nil {
+		return err
+	}
+
+	stateDir := configRelative(*configPath, config.StateDir)
+	count := 0
+	for name, data := range files {
+		if !strings.HasPrefix(name, "state/") {
+			continue
+		}
+		if stateDir == "" {
+			return fmt.Errorf("archive has state files but the config has no state_dir")
+		}
+		base := filepath.Base(name)
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(stateDir, base), data, 0644); err != nil {
+			return err
+		}
+		count++
+	}
+	fmt.Printf("Restored %s, %d referenced files and %d state files\n", *configPath, len(restored), count)
+	return nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StatsExportConfig periodically appends per-worker and per-pool statistics
+// to workers.csv and pools.csv, or .jsonl, in Dir.
+type StatsExportConfig struct {
+	Dir             string `json:"dir"`    // "" disables the export
+	Format          string `json:"format"` // "csv" (default) or "jsonl"
+	IntervalSeconds int    `json:"interval_seconds"`
+}
+
+const defaultStatsIntervalSeconds = 60
+
+// Workers offline this long are forgotten.
+const workerForgetAfter = 24 * time.Hour
+
+// Hashes a share of difficulty 1 stands for: 2^32 on SHA-256 pools, 2^16 on
+// scrypt ones.
+const (
+	sha256Diff1Hashes = 1 << 32
+	scryptDiff1Hashes = 1 << 16
+)
+
+// shareCounts are the shares of a worker or pool in one interval.
+type shareCounts struct {
+	accepted, rejected, stale, dropped int
+	hashes                             float64 // of the accepted ones
+	// Stratum traffic received from and sent to the worker or pool.
+	bytesIn, bytesOut int64
+}
+
+func (c *shareCounts) add(r shareRecord, diff1Hashes float64) {
+	switch r.result {
+	case "accepted":
+		c.accepted++
+		c.hashes += r.info.difficulty * diff1Hashes
+	case "rejected":
+		c.rejected++
+	case "stale":
+		c.stale++
+	case "dropped":
+		c.dropped++
+	}
+}
+
+type workerStats struct {
+	shareCounts
+	// total counts all shares and online time, never reset by exports.
+	total       shareCounts
+	online      time.Duration // before onlineSince
+	connections int
+	onlineSince time.Time
+	offlineAt   time.Time
+	// offlineAlerted is set once the worker was reported offline.
+	offlineAlerted bool
+	// recent are the hashes of the last hour, and dropAlerted is set once
+	// a drop of the worker's hashrate was reported.
+	recent      minuteHashes
+	dropAlerted bool
+	// lastShare is when the worker last submitted; silentAlerted is set
+	// once it was reported silent since, or since it came online.
+	lastShare     time.Time
+	silentAlerted bool
+	history       shareHistory
+	// model is the last detected model of the worker's miner.
+	model string
+}
+
+type poolStats struct {
+	shareCounts
+	total     shareCounts
+	firstSeen time.Time
+}
+
+// statsCollector counts shares and worker connections between exports.
+type statsCollector struct {
+	mu      sync.Mutex
+	since   time.Time
+	workers map[string]*workerStats
+	pools   map[string]*poolStats
+	// recent are the hashes of all workers, for the current hashrate.
+	recent minuteHashes
+	// restored is set when the interval continues one from before a restart.
+	restored bool
+}
+
+var stats = newStatsCollector()
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{
+		since:   time.Now(),
+		workers: make(map[string]*workerStats),
+		pools:   make(map[string]*poolStats),
+	}
+}
+
+func (c *statsCollector) worker(name string) *workerStats {
+	w, ok := c.workers[name]
+	if !ok {
+		w = &workerStats{}
+		c.workers[name] = w
+	}
+	return w
+}
+
+func (c *statsCollector) pool(address string) *poolStats {
+	p, ok := c.pools[address]
+	if !ok {
+		p = &poolStats{firstSeen: time.Now()}
+		c.pools[address] = p
+	}
+	return p
+}
+
+// connected counts a session of a worker from its authorize until
+// disconnected is called.
+func (c *statsCollector) connected(name string) {
+	c.mu.Lock()
+	w := c.worker(name)
+	if w.connections == 0 {
+		// A worker coming back online is watched for silence afresh.
+		w.onlineSince, w.silentAlerted = time.Now(), false
+	}
+	w.connections++
+	alerted := w.offlineAlerted
+	w.offlineAlerted = false
+	offline := w.onlineSince.Sub(w.offlineAt)
+	c.mu.Unlock()
+
+	if alerted {
+		alert(eventWorkerOnline, name, "Worker %s is back online after %s", name, offline.Round(time.Second))
+	}
+}
+
+// setModel records the model of the miner a worker connected with.
+func (c *statsCollector) setModel(name, model string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.worker(name).model = model
+}
+
+func (c *statsCollector) disconnected(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := c.worker(name)
+	w.connections--
+	if w.connections == 0 {
+		w.offlineAt = time.Now()
+		w.online += w.offlineAt.Sub(w.onlineSince)
+	}
+}
+
+// offlineWorkers returns the workers disconnected for longer than after
+// that were not returned before, and forgets long gone ones.
+func (c *statsCollector) offlineWorkers(after time.Duration) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name, w := range c.workers {
+		if w.connections == 0 && time.Since(w.offlineAt) > workerForgetAfter {
+			delete(c.workers, name)
+			continue
+		}
+		if w.connections == 0 && !w.offlineAt.IsZero() && !w.offlineAlerted && time.Since(w.offlineAt) > after {
+			w.offlineAlerted = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// silentWorkers returns the connected workers that have not submitted a
+// share for longer than after, since their last share or since they came
+// online, and were not returned since.
+func (c *statsCollector) silentWorkers(now time.Time, after time.Duration) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name, w := range c.workers {
+		if w.connections == 0 || w.silentAlerted {
+			continue
+		}
+		last := w.lastShare
+		if w.onlineSince.After(last) {
+			last = w.onlineSince
+		}
+		if now.Sub(last) > after {
+			w.silentAlerted = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// share counts a share against its worker and pool.
+func (c *statsCollector) share(config *Config, r shareRecord) {
+	diff1Hashes := config.coinOf(r.pool).diff1Hashes()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, p := c.worker(r.info.worker), c.pool(r.pool)
+	w.add(r, diff1Hashes)
+	w.total.add(r, diff1Hashes)
+	w.lastShare, w.silentAlerted = r.time, false
+	w.history.add(shareEvent{Time: r.time, Difficulty: r.info.difficulty, Result: r.result, Reason: r.reason})
+	p.add(r, diff1Hashes)
+	p.total.add(r, diff1Hashes)
+	if r.result == "accepted" {
+		c.recent.add(r.time, r.info.difficulty*diff1Hashes)
+		w.recent.add(r.time, r.info.difficulty*diff1Hashes)
+	}
+}
+
+// minuteHashes holds the hashes of accepted shares per minute of the last
+// hour.
+type minuteHashes struct {
+	hashes  [60]float64
+	minutes [60]int64
+}
+
+func (m *minuteHashes) add(t time.Time, hashes float64) {
+	minute := t.Unix() / 60
+	i := minute % int64(len(m.minutes))
+	if m.minutes[i] != minute {
+		m.minutes[i], m.hashes[i] = minute, 0
+	}
+	m.hashes[i] += hashes
+}
+
+// rate returns the hashes per second over the minutes complete minutes that
+// ended ago before now.
+func (m *minuteHashes) rate(now time.Time, ago, minutes int) float64 {
+	var hashes float64
+	last := now.Unix()/60 - 1 - int64(ago)
+	for minute := last - int64(minutes) + 1; minute <= last; minute++ {
+		i := minute % int64(len(m.minutes))
+		if m.minutes[i] == minute {
+			hashes += m.hashes[i]
+		}
+	}
+	return hashes / float64(minutes*60)
+}
+
+// hashrate returns the hashes per second of all workers over the minutes
+// complete minutes that ended ago before now.
+func (c *statsCollector) hashrate(now time.Time, ago, minutes int) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recent.rate(now, ago, minutes)
+}
+
+// hashrateDrop is a worker whose hashrate fell below its baseline.
+type hashrateDrop struct {
+	worker            string
+	current, baseline float64
+}
+
+// hashrateDrops returns the connected workers whose hashrate over the last
+// minutes is percent or more below their own over the rest of the hour, and
+// were not returned since they last recovered. Workers online for less than
+// the hour have no baseline yet.
+func (c *statsCollector) hashrateDrops(now time.Time, percent float64, minutes int) []hashrateDrop {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	baselineMinutes := len(c.recent.minutes) - minutes
+	var drops []hashrateDrop
+	for name, w := range c.workers {
+		if w.connections == 0 || now.Sub(w.onlineSince) < time.Hour {
+			continue
+		}
+		current := w.recent.rate(now, 0, minutes)
+		baseline := w.recent.rate(now, minutes, baselineMinutes)
+		dropped := baseline > 0 && current < baseline*(1-percent/100)
+		if dropped && !w.dropAlerted {
+			drops = append(drops, hashrateDrop{name, current, baseline})
+		}
+		w.dropAlerted = dropped
+	}
+	sort.Slice(drops, func(i, j int) bool { return drops[i].worker < drops[j].worker })
+	return drops
+}
+
+// onlineWorkers returns how many workers are connected.
+func (c *statsCollector) onlineWorkers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, w := range c.workers {
+		if w.connections > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// statsRow is one line of an export.
+type statsRow struct {
+	Time        time.Time `json:"time"`
+	Name        string    `json:"name"` // worker name or pool address
+	Connections int       `json:"connections,omitempty"`
+	Accepted    int       `json:"accepted"`
+	Rejected    int       `json:"rejected"`
+	Stale       int       `json:"stale"`
+	Dropped     int       `json:"dropped"`
+	Hashrate    float64   `json:"hashrate"` // hashes per second
+	Uptime      float64   `json:"uptime_seconds"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Model       string    `json:"model,omitempty"` // of a worker's miner
+}
+
+var statsColumns = []string{"time", "name", "connections", "accepted", "rejected", "stale", "dropped", "hashrate", "uptime_seconds",
+	"bytes_in", "bytes_out", "model"}
+
+func (r statsRow) csv() []string {
+	return []string{
+		r.Time.UTC().Format(time.RFC3339), r.Name, strconv.Itoa(r.Connections),
+		strconv.Itoa(r.Accepted), strconv.Itoa(r.Rejected), strconv.Itoa(r.Stale), strconv.Itoa(r.Dropped),
+		strconv.FormatFloat(r.Hashrate, 'f', 0, 64), strconv.FormatFloat(r.Uptime, 'f', 0, 64),
+		strconv.FormatInt(r.BytesIn, 10), strconv.FormatInt(r.BytesOut, 10), r.Model,
+	}
+}
+
+// take returns the rows of the interval since the last call and starts the
+// next one. Workers that were offline all interval are left out.
+func (c *statsCollector) take() (workers, pools []statsRow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	seconds := now.Sub(c.since).Seconds()
+	c.since = now
+	row := func(name string, counts shareCounts) statsRow {
+		return statsRow{Time: now, Name: name, Accepted: counts.accepted, Rejected: counts.rejected,
+			Stale: counts.stale, Dropped: counts.dropped, Hashrate: counts.hashes / seconds,
+			BytesIn: counts.bytesIn, BytesOut: counts.bytesOut}
+	}
+
+	for name, w := range c.workers {
+		if w.connections == 0 && w.shareCounts == (shareCounts{}) {
+			// Long gone workers are forgotten with their totals.
+			if now.Sub(w.offlineAt) > workerForgetAfter {
+				delete(c.workers, name)
+			}
+			continue
+		}
+		r := row(name, w.shareCounts)
+		r.Connections = w.connections
+		r.Model = w.model
+		if w.connections > 0 {
+			r.Uptime = now.Sub(w.onlineSince).Seconds()
+		}
+		workers = append(workers, r)
+		w.shareCounts = shareCounts{}
+	}
+	for address, p := range c.pools {
+		r := row(address, p.shareCounts)
+		r.Uptime = poolUptime(address, p.firstSeen, now)
+		pools = append(pools, r)
+		p.shareCounts = shareCounts{}
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Name < workers[j].Name })
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return workers, pools
+}
+
+// poolUptime is how long a pool has been up as far as the health checks
+// know, or since it was first used.
+func poolUptime(address string, firstSeen, now time.Time) float64 {
+	for _, status := range health.snapshot() {
+		if status.Address != address {
+			continue
+		}
+		if !status.Up {
+			return 0
+		}
+		if status.UpSince.After(firstSeen) {
+			return now.Sub(status.UpSince).Seconds()
+		}
+	}
+	return now.Sub(firstSeen).Seconds()
+}
+
+// run appends the statistics to the export files every interval until stop
+// is closed.
+func (c *statsCollector) run(cfg StatsExportConfig, stop <-chan struct{}) {
+	interval := cfg.IntervalSeconds
+	if interval <= 0 {
+		interval = defaultStatsIntervalSeconds
+	}
+	c.mu.Lock()
+	if !c.restored {
+		c.since = time.Now()
+	}
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		workers, pools := c.take()
+		for name, rows := range map[string][]statsRow{"workers": workers, "pools": pools} {
+			if err := exportStats(cfg, name, rows); err != nil {
+				log.Printf("Error exporting %s statistics: %v", name, err)
+			}
+		}
+	}
+}
+
+func validateStatsExport(config *Config) error {
+	switch config.StatsExport.Format {
+	case "", "csv", "jsonl":
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", config.StatsExport.Format)
+}
+
+// exportStats appends rows to the file for name, starting a new CSV file
+// with a header.
+func exportStats(cfg StatsExportConfig, name string, rows []statsRow) error {
+	format := cfg.Format
+	if format == "" {
+		format = "csv"
+	}
+	path := filepath.Join(cfg.Dir, name+"."+format)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if format == "jsonl" {
+		encoder := json.NewEncoder(file)
+		for _, row := range rows {
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := csv.NewWriter(file)
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		w.Write(statsColumns)
+	}
+	for _, row := range rows {
+		w.Write(row.csv())
+	}
+	w.Flush()
+	return w.Error()
+}
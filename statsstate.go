@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// How often the statistics are saved to the state directory.
+const statsSaveInterval = time.Minute
+
+// savedShares is shareCounts in the state file.
+type savedShares struct {
+	Accepted int     `json:"accepted"`
+	Rejected int     `json:"rejected"`
+	Stale    int     `json:"stale"`
+	Dropped  int     `json:"dropped"`
+	Hashes   float64 `json:"hashes"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+}
+
+func saveShares(c shareCounts) savedShares {
+	return savedShares{c.accepted, c.rejected, c.stale, c.dropped, c.hashes, c.bytesIn, c.bytesOut}
+}
+
+func (s savedShares) counts() shareCounts {
+	return shareCounts{s.Accepted, s.Rejected, s.Stale, s.Dropped, s.Hashes, s.BytesIn, s.BytesOut}
+}
+
+type savedWorker struct {
+	Interval      savedShares `json:"interval"` // since the last export
+	Total         savedShares `json:"total"`
+	OnlineSeconds float64     `json:"online_seconds"`
+}
+
+type savedPool struct {
+	Interval  savedShares `json:"interval"`
+	Total     savedShares `json:"total"`
+	FirstSeen time.Time   `json:"first_seen"`
+}
+
+// statsState is the state file of the statistics, stats.json.
+type statsState struct {
+	Saved   time.Time              `json:"saved"`
+	Since   time.Time              `json:"since"` // start of the export interval
+	Workers map[string]savedWorker `json:"workers"`
+	Pools   map[string]savedPool   `json:"pools"`
+	// Hashes of accepted shares by Unix minute, for the hashrate.
+	Minutes map[int64]float64 `json:"minutes"`
+}
+
+// onlineTime is how long a worker has been connected in total.
+func (w *workerStats) onlineTime(now time.Time) time.Duration {
+	if w.connections > 0 {
+		return w.online + now.Sub(w.onlineSince)
+	}
+	return w.online
+}
+
+func (c *statsCollector) state() statsState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	state := statsState{
+		Saved:   now,
+		Since:   c.since,
+		Workers: make(map[string]savedWorker, len(c.workers)),
+		Pools:   make(map[string]savedPool, len(c.pools)),
+		Minutes: make(map[int64]float64),
+	}
+	for name, w := range c.workers {
+		state.Workers[name] = savedWorker{saveShares(w.shareCounts), saveShares(w.total), w.onlineTime(now).Seconds()}
+	}
+	for address, p := range c.pools {
+		state.Pools[address] = savedPool{saveShares(p.shareCounts), saveShares(p.total), p.firstSeen}
+	}
+	for i, minute := range c.recent.minutes {
+		if c.recent.hashes[i] > 0 {
+			state.Minutes[minute] = c.recent.hashes[i]
+		}
+	}
+	return state
+}
+
+// restore loads the statistics saved in path. The workers come back
+// offline since the save, so those that do not reconnect are alerted on.
+func (c *statsCollector) restore(path string) {
+	var state statsState
+	if err := readStateFile(path, &state); err != nil {
+		log.Printf("Error loading statistics: %v", err)
+		return
+	}
+	if state.Saved.IsZero() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.since, c.restored = state.Since, true
+	for name, saved := range state.Workers {
+		w := c.worker(name)
+		w.shareCounts = saved.Interval.counts()
+		w.total = saved.Total.counts()
+		w.online = time.Duration(saved.OnlineSeconds * float64(time.Second))
+		w.offlineAt = state.Saved
+	}
+	for address, saved := range state.Pools {
+		p := c.pool(address)
+		p.shareCounts = saved.Interval.counts()
+		p.total = saved.Total.counts()
+		p.firstSeen = saved.FirstSeen
+	}
+	for minute, hashes := range state.Minutes {
+		i := minute % int64(len(c.recent.minutes))
+		if minute > c.recent.minutes[i] {
+			c.recent.minutes[i], c.recent.hashes[i] = minute, hashes
+		}
+	}
+	log.Printf("Restored statistics of %d workers and %d pools saved %s", len(state.Workers), len(state.Pools), state.Saved.Format(time.RFC3339))
+}
+
+func (c *statsCollector) save(path string) {
+	if err := writeStateFile(path, c.state()); err != nil {
+		log.Printf("Error saving statistics: %v", err)
+	}
+}
+
+// persist saves the statistics to path every statsSaveInterval until stop
+// is closed.
+func (c *statsCollector) persist(path string, stop <-chan struct{}) {
+	ticker := time.NewTicker(statsSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.save(path)
+		}
+	}
+}
+
+// totals returns the all-time counts of workers and pools, with the time
+// online of workers as Uptime.
+func (c *statsCollector) totals() (workers, pools []statsRow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	row := func(name string, counts shareCounts) statsRow {
+		return statsRow{Time: now, Name: name, Accepted: counts.accepted, Rejected: counts.rejected,
+			Stale: counts.stale, Dropped: counts.dropped, BytesIn: counts.bytesIn, BytesOut: counts.bytesOut}
+	}
+	for name, w := range c.workers {
+		r := row(name, w.total)
+		r.Connections = w.connections
+		r.Model = w.model
+		r.Uptime = w.onlineTime(now).Seconds()
+		workers = append(workers, r)
+	}
+	for address, p := range c.pools {
+		pools = append(pools, row(address, p.total))
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Name < workers[j].Name })
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return workers, pools
+}
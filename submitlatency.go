@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// submitLatencyBuckets are the upper bounds, in seconds, of the histogram of
+// how long pools take to answer a share after the proxy forwarded it.
+var submitLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// latencyHistogram counts latencies by bucket, the last counting those
+// above every bound.
+type latencyHistogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// submitLatencies are the submit latency histograms of the pools.
+type submitLatencies struct {
+	mu    sync.Mutex
+	pools map[string]*latencyHistogram
+}
+
+var submitLatency = &submitLatencies{pools: make(map[string]*latencyHistogram)}
+
+// observe counts the answer of pool to a share that took d.
+func (l *submitLatencies) observe(pool string, d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(submitLatencyBuckets, seconds)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.pools[pool]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]uint64, len(submitLatencyBuckets)+1)}
+		l.pools[pool] = h
+	}
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// write writes the histograms in the Prometheus text format.
+func (l *submitLatencies) write(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pools := make([]string, 0, len(l.pools))
+	for pool := range l.pools {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	fmt.Fprintf(w, "# TYPE stratum_proxy_submit_latency_seconds histogram\n")
+	for _, pool := range pools {
+		h := l.pools[pool]
+		var cumulative uint64
+		for i, bound := range submitLatencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "stratum_proxy_submit_latency_seconds_bucket{pool=%q,le=\"%g\"} %d\n", pool, bound, cumulative)
+		}
+		fmt.Fprintf(w, "stratum_proxy_submit_latency_seconds_bucket{pool=%q,le=\"+Inf\"} %d\n", pool, h.count)
+		fmt.Fprintf(w, "stratum_proxy_submit_latency_seconds_sum{pool=%q} %g\n", pool, h.sum)
+		fmt.Fprintf(w, "stratum_proxy_submit_latency_seconds_count{pool=%q} %d\n", pool, h.count)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// submitLimiter caps the shares each worker may submit per minute, over all
+// its connections, to protect pool accounts from firmware gone haywire.
+// Shares above the cap are rejected by the proxy instead of forwarded.
+type submitLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*submitWindow
+}
+
+// submitWindow counts the shares of a worker in the minute from start.
+type submitWindow struct {
+	start time.Time
+	count int
+}
+
+var submitLimits = &submitLimiter{windows: make(map[string]*submitWindow)}
+
+// allow counts a share of worker and reports whether it is within max per
+// minute.
+func (l *submitLimiter) allow(worker string, max int) bool {
+	if max <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := l.windows[worker]
+	if w == nil || now.Sub(w.start) >= time.Minute {
+		if w == nil && len(l.windows) > 0 {
+			l.forgetIdle(now)
+		}
+		w = &submitWindow{start: now}
+		l.windows[worker] = w
+	}
+	w.count++
+	return w.count <= max
+}
+
+// forgetIdle drops the windows of workers that sent nothing for a minute.
+// Callers hold l.mu.
+func (l *submitLimiter) forgetIdle(now time.Time) {
+	for worker, w := range l.windows {
+		if now.Sub(w.start) >= 2*time.Minute {
+			delete(l.windows, worker)
+		}
+	}
+}
+
+func submitLimitReply(id interface{}) string {
+	return fmt.Sprintf(`{"id":%s,"result":null,"error":[20,"Too many shares",null]}`, jsonID(id))
+}
+
+// logOverLimit records a share the proxy rejected for the submit rate limit.
+func (s *session) logOverLimit(info submitInfo) {
+	s.noteShare(shareRecord{time: time.Now(), clientIP: s.clientIP, pool: s.up.Load().target.Address,
+		info: info, result: "rejected", reason: "over the submit rate limit"})
+}
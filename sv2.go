@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	sv2HeaderLen           = 6
+	sv2SetupConnection     = 0x00
+	sv2SetupConnectionErr  = 0x02
+	sv2FirstMessageTimeout = 30 * time.Second
+)
+
+// detectV2 peeks at the first bytes of a client connection. Stratum v1 is
+// newline delimited JSON, so anything else is taken as a Stratum v2 attempt:
+// either a plaintext SetupConnection frame or an encrypted Noise handshake.
+func detectV2(conn net.Conn, reader *bufio.Reader) (v2 bool, plaintext bool, err error) {
+	conn.SetReadDeadline(time.Now().Add(sv2FirstMessageTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return false, false, err
+	}
+	switch first[0] {
+	case '{', '[', '#', ' ', '\t', '\r', '\n':
+		return false, false, nil
+	}
+
+	header, err := reader.Peek(sv2HeaderLen)
+	if err != nil {
+		return true, false, nil
+	}
+	extension := binary.LittleEndian.Uint16(header[0:2]) &^ 0x8000
+	return true, extension == 0 && header[2] == sv2SetupConnection, nil
+}
+
+// rejectV2 tells a Stratum v2 client to fall back to v1. A plaintext client
+// gets a SetupConnection.Error; a Noise handshake cannot be answered without
+// the keys, so the connection is simply closed, which firmwares treat as
+// "v2 unavailable".
+func rejectV2(conn net.Conn, plaintext bool) {
+	if !plaintext {
+		return
+	}
+	code := "unsupported-protocol"
+	payload := make([]byte, 4, 4+1+len(code))
+	payload = append(payload, byte(len(code)))
+	payload = append(payload, code...)
+
+	frame := make([]byte, sv2HeaderLen, sv2HeaderLen+len(payload))
+	frame[2] = sv2SetupConnectionErr
+	frame[3] = byte(len(payload))
+	frame[4] = byte(len(payload) >> 8)
+	frame[5] = byte(len(payload) >> 16)
+	frame = append(frame, payload...)
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(frame)
+}
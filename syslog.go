@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogConfig sends the log to a syslog server as RFC 5424 messages, in
+// addition to the log file.
+type SyslogConfig struct {
+	// Network is "udp" (default), "tcp" or "unixgram" for a local socket
+	// such as /dev/log.
+	Network string `json:"network"`
+	Address string `json:"address"` // "" disables syslog
+	// Facility is the syslog facility number, 16 (local0) by default.
+	Facility *int   `json:"facility"`
+	AppName  string `json:"app_name"`
+}
+
+const (
+	defaultSyslogFacility = 16
+	syslogTimeout         = 2 * time.Second
+	syslogRedialInterval  = 10 * time.Second
+)
+
+// Severities of the messages sent.
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+// syslogWriter turns each line of the standard logger into a syslog message.
+type syslogWriter struct {
+	cfg      SyslogConfig
+	facility int
+	hostname string
+	mu       sync.Mutex
+	conn     net.Conn
+	lastDial time.Time
+}
+
+func newSyslogWriter(cfg SyslogConfig) (*syslogWriter, error) {
+	if cfg.Network == "" {
+		cfg.Network = "udp"
+	}
+	switch cfg.Network {
+	case "udp", "tcp", "unixgram":
+	default:
+		return nil, fmt.Errorf("unknown syslog network %q", cfg.Network)
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = "stratum-proxy"
+	}
+	w := &syslogWriter{cfg: cfg, facility: defaultSyslogFacility}
+	if cfg.Facility != nil {
+		if *cfg.Facility < 0 || *cfg.Facility > 23 {
+			return nil, fmt.Errorf("syslog facility %d is not between 0 and 23", *cfg.Facility)
+		}
+		w.facility = *cfg.Facility
+	}
+	w.hostname, _ = os.Hostname()
+	if w.hostname == "" {
+		w.hostname = "-"
+	}
+	// Fail at startup on a bad address; later failures are retried.
+	if err := w.dial(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) dial() error {
+	w.lastDial = time.Now()
+	conn, err := net.DialTimeout(w.cfg.Network, w.cfg.Address, syslogTimeout)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// logSeverity guesses the severity of a log line from how it starts.
+func logSeverity(line string) int {
+	switch {
+	case strings.HasPrefix(line, "ALERT:"):
+		return severityWarning
+	case strings.HasPrefix(line, "Error"), strings.HasPrefix(line, "Failed"):
+		return severityError
+	}
+	return severityInfo
+}
+
+// stripLogTime removes the date and time the standard logger puts before a
+// line, for outputs that stamp messages themselves.
+func stripLogTime(line string) string {
+	if log.Flags() == log.LstdFlags && len(line) >= len("2006/01/02 15:04:05 ") {
+		return line[len("2006/01/02 15:04:05 "):]
+	}
+	return line
+}
+
+// Write sends one line of the standard logger. Errors are not returned, so
+// the log file keeps working while the syslog server is unreachable.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	line := stripLogTime(strings.TrimSuffix(string(p), "\n"))
+
+	message := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", w.facility*8+logSeverity(line),
+		time.Now().Format(time.RFC3339Nano), w.hostname, w.cfg.AppName, os.Getpid(), line)
+	if w.cfg.Network == "tcp" {
+		// Octet counting framing, RFC 6587.
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil && (time.Since(w.lastDial) < syslogRedialInterval || w.dial() != nil) {
+		return len(p), nil
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := w.conn.Write([]byte(message)); err != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	return len(p), nil
+}
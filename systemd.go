@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state such as "READY=1" to systemd when it started the
+// proxy with Type=notify; otherwise it does nothing.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, or 0
+// when WatchdogSec is not set for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings systemd twice per watchdog interval while the proxy is
+// responsive, so systemd restarts it when it hangs.
+func (p *proxyServer) watchdog() {
+	interval := watchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+		}
+		if p.responsive(interval / 4) {
+			sdNotify("WATCHDOG=1")
+		} else {
+			log.Printf("Proxy is not responding, skipping the watchdog ping")
+		}
+	}
+}
+
+// responsive reports whether the state shared by all sessions can be used
+// within timeout, which a deadlock would prevent.
+func (p *proxyServer) responsive(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		stats.onlineWorkers()
+		health.snapshot()
+		rejects.avoided("")
+		bans.banned("")
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
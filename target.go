@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// Target is an upstream pool. In the config it is either a plain "host:port"
+// string or an object carrying per-target options.
+type Target struct {
+	Address string `json:"address"`
+	// Sequenced numbers and checksums every message on the link. Only for
+	// targets that are themselves instances of this proxy.
+	Sequenced bool `json:"sequenced,omitempty"`
+	// ResumeSession passes the subscription id of a lost connection when
+	// subscribing to the target again. Pools that resume the session keep
+	// the extranonce, so the miner's jobs stay valid.
+	ResumeSession bool `json:"resume_session,omitempty"`
+	// Weight is the target's share of new connections under weighted
+	// selection, and of the accepted work under split selection. Unset or
+	// 0 counts as 1.
+	Weight int `json:"weight,omitempty"`
+	// Worker name rules of the pool, applied to the part of the username
+	// after the first dot: characters outside WorkerChars, a regexp class
+	// such as "a-zA-Z0-9_", become WorkerReplace ("_" by default), and the
+	// result is cut to WorkerMaxLength bytes.
+	WorkerChars     string `json:"worker_chars,omitempty"`
+	WorkerReplace   string `json:"worker_replace,omitempty"`
+	WorkerMaxLength int    `json:"worker_max_length,omitempty"`
+	// DialTimeoutMs bounds each connection attempt, 5000 when 0. A failed
+	// dial is retried DialRetries times after a backoff starting at
+	// BackoffMs (250) that doubles up to BackoffMaxMs (30000), with
+	// jitter. The same backoff keeps a failing target at the end of the
+	// dial order for new connections until it answers again.
+	DialTimeoutMs int `json:"dial_timeout_ms,omitempty"`
+	DialRetries   int `json:"dial_retries,omitempty"`
+	BackoffMs     int `json:"backoff_ms,omitempty"`
+	BackoffMaxMs  int `json:"backoff_max_ms,omitempty"`
+	// Socket tunes the connections to the target.
+	Socket *SocketOptions `json:"socket,omitempty"`
+	// Chained marks a target that is itself an instance of this proxy,
+	// which rewrites worker names instead; see chain.go.
+	Chained bool `json:"chained,omitempty"`
+	// TLS connects to the target over TLS; see mtls.go.
+	TLS *TargetTLS `json:"tls,omitempty"`
+	// SSH connects to the target through an SSH jump host; see
+	// sshtunnel.go.
+	SSH *SSHConfig `json:"ssh,omitempty"`
+	// HTTPProxy connects to the target through an HTTP proxy instead of
+	// the http_proxy of the config.
+	HTTPProxy *HTTPProxyConfig `json:"http_proxy,omitempty"`
+	// Solo makes the target a node to mine on solo; see solo.go.
+	Solo *SoloConfig `json:"solo,omitempty"`
+	// Aggregate shares connections to the target between its miners; see
+	// aggregate.go.
+	Aggregate *AggregateConfig `json:"aggregate,omitempty"`
+	// JobNegotiation selects who picks the transactions of the jobs:
+	// "pool", the default, accepts the pool's templates, and "local"
+	// negotiates jobs built from the templates of TemplateProvider, the
+	// host:port of a node's template provider. Targets that build or share
+	// their jobs themselves (solo, aggregate and chained ones) only take
+	// the pool's. Upstream links speak Stratum v1, which has no job
+	// negotiation, so the pool's templates stay in use either way; the
+	// policy is checked and listed by /targets for when they speak v2.
+	JobNegotiation   string `json:"job_negotiation,omitempty"`
+	TemplateProvider string `json:"template_provider,omitempty"`
+}
+
+func (t *Target) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*t = Target{Address: address}
+		return nil
+	}
+	type plain Target
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+// MarshalJSON writes targets without options back in the short string form.
+func (t Target) MarshalJSON() ([]byte, error) {
+	type plain Target
+	data, err := json.Marshal(plain(t))
+	if err != nil {
+		return nil, err
+	}
+	short, _ := json.Marshal(struct {
+		Address string `json:"address"`
+	}{t.Address})
+	if string(data) == string(short) {
+		return json.Marshal(t.Address)
+	}
+	return data, nil
+}
+
+func (t Target) String() string {
+	return t.Address
+}
+
+func validateTargets(config *Config) error {
+	switch config.TargetSelection {
+	case "", "ordered", "latency", "weighted", "split", "hash":
+	default:
+		return fmt.Errorf("unknown target_selection %q", config.TargetSelection)
+	}
+
+	for _, t := range allTargets(config) {
+		if t.Address == "" {
+			return fmt.Errorf("target without address")
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("target %s: negative weight", t.Address)
+		}
+		if t.DialTimeoutMs < 0 || t.DialRetries < 0 || t.BackoffMs < 0 || t.BackoffMaxMs < 0 {
+			return fmt.Errorf("target %s: negative dial timeout, retries or backoff", t.Address)
+		}
+		if err := validateWorkerRules(t); err != nil {
+			return err
+		}
+		if err := validateSolo(t); err != nil {
+			return err
+		}
+		if err := validateAggregate(t); err != nil {
+			return err
+		}
+		if err := validateJobNegotiation(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateJobNegotiation(t Target) error {
+	switch t.JobNegotiation {
+	case "", "pool":
+		return nil
+	case "local":
+	default:
+		return fmt.Errorf("target %s: unknown job_negotiation %q", t.Address, t.JobNegotiation)
+	}
+	switch {
+	case t.Solo != nil:
+		return fmt.Errorf("target %s: solo targets build their own jobs and cannot negotiate them", t.Address)
+	case t.Aggregate != nil:
+		return fmt.Errorf("target %s: aggregate targets share jobs between miners and cannot negotiate them", t.Address)
+	case t.Chained:
+		return fmt.Errorf("target %s: chained targets take jobs from the next proxy and cannot negotiate them", t.Address)
+	case t.TemplateProvider == "":
+		return fmt.Errorf("target %s: local job negotiation needs a template_provider", t.Address)
+	}
+	if _, _, err := net.SplitHostPort(t.TemplateProvider); err != nil {
+		return fmt.Errorf("target %s: template_provider: %v", t.Address, err)
+	}
+	return nil
+}
+
+// jobNegotiation returns the target's job negotiation policy.
+func (t Target) jobNegotiation() string {
+	if t.JobNegotiation == "" {
+		return "pool"
+	}
+	return t.JobNegotiation
+}
+
+// allTargets lists every distinct target of a config.
+func allTargets(config *Config) []Target {
+	seen := make(map[string]bool)
+	var targets []Target
+	add := func(list []Target) {
+		for _, t := range list {
+			if !seen[t.Address] {
+				seen[t.Address] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+	for _, coin := range config.Coins {
+		add(coin.Targets)
+	}
+	for _, pool := range config.VirtualPools {
+		add(pool.Targets)
+	}
+	for _, c := range config.Clients {
+		add(c.Targets)
+	}
+	for _, r := range config.Routes {
+		add(r.Targets)
+	}
+	for _, r := range config.GeoRoutes {
+		add(r.Targets)
+	}
+	return targets
+}
+
+// orderTargets returns targets in the order a client prefers them.
+func orderTargets(config *Config, targets []Target, clientIP string) []Target {
+	switch config.TargetSelection {
+	case "latency":
+		return latencies.sortByLatency(targets)
+	case "weighted":
+		return weightedOrder(targets)
+	case "split":
+		return splits.order(targets)
+	case "hash":
+		return hashOrder(targets, clientIP)
+	default:
+		return targets
+	}
+}
+
+// dialOrder returns preferred targets in the order to dial them now, with
+// unavailable ones last. They stay in the list as a last resort.
+func dialOrder(config *Config, targets []Target) []Target {
+	sorted := append([]Target(nil), targets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return !unavailable(config, sorted[i].Address) && unavailable(config, sorted[j].Address)
+	})
+	return sorted
+}
+
+// unavailable reports whether a target failed its health checks or came
+// back less than the failback delay ago, is avoided for rejecting shares or
+// backing off after failed dials.
+func unavailable(config *Config, address string) bool {
+	return health.down(address, time.Duration(config.FailbackSeconds)*time.Second) || rejects.avoided(address) ||
+		dialBackoff.waiting(address)
+}
+
+// weightedOrder draws targets one by one without replacement, each with a
+// probability proportional to its weight, so the first choice splits
+// traffic by weight and the rest remain as failover candidates.
+func weightedOrder(targets []Target) []Target {
+	remaining := append([]Target(nil), targets...)
+	ordered := make([]Target, 0, len(targets))
+	for len(remaining) > 0 {
+		total := 0
+		for _, t := range remaining {
+			total += t.weight()
+		}
+		pick := rand.Intn(total)
+		i := 0
+		for ; pick >= remaining[i].weight(); i++ {
+			pick -= remaining[i].weight()
+		}
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return ordered
+}
+
+func (t Target) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// hashOrder ranks targets by a hash of the client IP and target address
+// (rendezvous hashing). A client always gets the same order, and adding or
+// removing a target only moves the clients whose first choice it was.
+func hashOrder(targets []Target, clientIP string) []Target {
+	score := func(t Target) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(clientIP))
+		h.Write([]byte{0})
+		h.Write([]byte(t.Address))
+		return h.Sum64()
+	}
+	sorted := append([]Target(nil), targets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return score(sorted[i]) > score(sorted[j])
+	})
+	return sorted
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TelegramConfig sends alerts to a Telegram chat through a bot.
+type TelegramConfig struct {
+	BotToken string `json:"bot_token"`
+	ChatID   int64  `json:"chat_id"`
+	// Events limits the notifications to these events; empty means all.
+	Events []string `json:"events"`
+	// Commands makes the bot answer /status in the chat.
+	Commands bool `json:"commands"`
+	// APIURL is for a self-hosted Bot API server.
+	APIURL string `json:"api_url"`
+}
+
+const (
+	defaultTelegramAPIURL = "https://api.telegram.org"
+	telegramPollSeconds   = 30
+)
+
+type telegramBot struct {
+	cfg    TelegramConfig
+	client *http.Client
+}
+
+// newTelegramBot returns nil when Telegram is not configured.
+func newTelegramBot(cfg TelegramConfig) *telegramBot {
+	if cfg.BotToken == "" {
+		return nil
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = defaultTelegramAPIURL
+	}
+	return &telegramBot{cfg: cfg, client: &http.Client{Timeout: (telegramPollSeconds + 10) * time.Second}}
+}
+
+func (b *telegramBot) method(name string) string {
+	return strings.TrimSuffix(b.cfg.APIURL, "/") + "/bot" + b.cfg.BotToken + "/" + name
+}
+
+// call invokes a Bot API method and decodes its result into result.
+func (b *telegramBot) call(req *http.Request, result interface{}) error {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// The URL in the error contains the token.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s failed: %v", req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:], err)
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if !answer.OK {
+		return fmt.Errorf("%s", answer.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(answer.Result, result)
+	}
+	return nil
+}
+
+func (b *telegramBot) sendMessage(text string) error {
+	body, _ := json.Marshal(map[string]interface{}{"chat_id": b.cfg.ChatID, "text": text})
+	req, err := http.NewRequest(http.MethodPost, b.method("sendMessage"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return b.call(req, nil)
+}
+
+func (b *telegramBot) notify(e alertEvent) {
+	if err := b.sendMessage(e.Message); err != nil {
+		log.Printf("Telegram: %v", err)
+	}
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// run answers commands sent to the bot in the configured chat until stop is
+// closed. Other chats are ignored, as anyone can message a bot.
+func (b *telegramBot) run(p *proxyServer, stop <-chan struct{}) {
+	var offset int64
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		query := url.Values{"offset": {fmt.Sprint(offset)}, "timeout": {fmt.Sprint(telegramPollSeconds)}}
+		req, err := http.NewRequest(http.MethodGet, b.method("getUpdates")+"?"+query.Encode(), nil)
+		if err != nil {
+			log.Printf("Telegram: %v", err)
+			return
+		}
+		var updates []telegramUpdate
+		if err := b.call(req, &updates); err != nil {
+			log.Printf("Telegram: %v", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(telegramPollSeconds * time.Second):
+			}
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message == nil || update.Message.Chat.ID != b.cfg.ChatID {
+				continue
+			}
+			// Commands in groups may be addressed as /status@botname.
+			command, _, _ := strings.Cut(strings.TrimSpace(update.Message.Text), "@")
+			if command == "/status" {
+				if err := b.sendMessage(p.statusText()); err != nil {
+					log.Printf("Telegram: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// statusText summarizes the proxy for a chat message.
+func (p *proxyServer) statusText() string {
+	var text strings.Builder
+	if state := ha.state(); state != "" {
+		fmt.Fprintf(&text, "HA: %s\n", state)
+	}
+	fmt.Fprintf(&text, "Connections: %d\n", p.active.Load())
+	fmt.Fprintf(&text, "Workers online: %d\n", stats.onlineWorkers())
+	fmt.Fprintf(&text, "Hashrate (%d min): %s\n", hashrateWindowMinutes, formatHashrate(stats.hashrate(time.Now(), 0, hashrateWindowMinutes)))
+	if checked := health.snapshot(); len(checked) > 0 {
+		up := 0
+		var down []string
+		for _, status := range checked {
+			if status.Up {
+				up++
+			} else {
+				down = append(down, status.Address)
+			}
+		}
+		fmt.Fprintf(&text, "Targets up: %d of %d\n", up, len(checked))
+		for _, address := range down {
+			fmt.Fprintf(&text, "Down: %s\n", address)
+		}
+	}
+	return strings.TrimSuffix(text.String(), "\n")
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TracingConfig exports a trace per miner session to an OpenTelemetry
+// collector over OTLP/HTTP with JSON encoding. The session is the root span;
+// requests to the pool and failovers are its children.
+type TracingConfig struct {
+	// Endpoint is the collector's traces URL, e.g.
+	// "http://127.0.0.1:4318/v1/traces"; "" disables tracing.
+	Endpoint    string            `json:"endpoint"`
+	ServiceName string            `json:"service_name"`
+	Headers     map[string]string `json:"headers"`
+	// SampleRatio is the share of sessions traced, 1 when 0.
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+const (
+	defaultTraceServiceName = "stratum-proxy"
+	traceQueueSize          = 4096
+	traceBatchSize          = 512
+	traceFlushInterval      = 5 * time.Second
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	spanStatusOK     = 1
+	spanStatusError  = 2
+)
+
+// span is a finished span waiting for export.
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	err     string
+}
+
+// traceExporter batches spans and posts them to the collector.
+type traceExporter struct {
+	cfg     TracingConfig
+	client  *http.Client
+	queue   chan *span
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// tracer is nil when tracing is disabled.
+var tracer *traceExporter
+
+func newTraceExporter(cfg TracingConfig) *traceExporter {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultTraceServiceName
+	}
+	if cfg.SampleRatio <= 0 {
+		cfg.SampleRatio = 1
+	}
+	t := &traceExporter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *span, traceQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// add queues a finished span, dropping it if the collector cannot keep up.
+func (t *traceExporter) add(sp *span) {
+	select {
+	case t.queue <- sp:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *traceExporter) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case sp := <-t.queue:
+			if batch = append(batch, sp); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stop:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			t.export(batch)
+			return
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+// close exports the spans still queued.
+func (t *traceExporter) close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+func (t *traceExporter) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	type keyValue struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+	attributes := func(attrs map[string]string) []keyValue {
+		list := make([]keyValue, 0, len(attrs))
+		for key, value := range attrs {
+			kv := keyValue{Key: key}
+			kv.Value.StringValue = value
+			list = append(list, kv)
+		}
+		return list
+	}
+
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, sp := range batch {
+		status := map[string]interface{}{"code": spanStatusOK}
+		if sp.err != "" {
+			status = map[string]interface{}{"code": spanStatusError, "message": sp.err}
+		}
+		otlp := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        attributes(sp.attrs),
+			"status":            status,
+		}
+		if sp.parent != ([8]byte{}) {
+			otlp["parentSpanId"] = hex.EncodeToString(sp.parent[:])
+		}
+		spans = append(spans, otlp)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": attributes(map[string]string{"service.name": t.cfg.ServiceName})},
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "stratum-proxy"}, "spans": spans}},
+		}},
+	})
+
+	if err := t.post(body); err != nil {
+		log.Printf("Error exporting %d spans: %v", len(batch), err)
+	}
+	if dropped := t.dropped.Swap(0); dropped > 0 {
+		log.Printf("Dropped %d spans, the trace collector is too slow", dropped)
+	}
+}
+
+func (t *traceExporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// sessionTrace is the trace of one miner session. A nil *sessionTrace is
+// an untraced session and ignores all calls.
+type sessionTrace struct {
+	root    span
+	mu      sync.Mutex
+	pending map[string]*span // requests the pool has not answered, by id
+}
+
+// startSession starts the trace of a session, or returns nil when tracing
+// is off or the session is not sampled.
+func (t *traceExporter) startSession(clientIP string, target Target) *sessionTrace {
+	if t == nil || mathrand.Float64() >= t.cfg.SampleRatio {
+		return nil
+	}
+	tr := &sessionTrace{pending: make(map[string]*span)}
+	rand.Read(tr.root.traceID[:])
+	rand.Read(tr.root.spanID[:])
+	tr.root.name = "session"
+	tr.root.kind = spanKindServer
+	tr.root.start = time.Now()
+	tr.root.attrs = map[string]string{"client.ip": clientIP, "pool.initial": target.Address}
+	return tr
+}
+
+func (tr *sessionTrace) child(name string, kind int, start time.Time, attrs map[string]string) *span {
+	sp := &span{traceID: tr.root.traceID, parent: tr.root.spanID, name: name, kind: kind, start: start, attrs: attrs}
+	rand.Read(sp.spanID[:])
+	return sp
+}
+
+// request starts the span of a miner request sent to pool.
+func (tr *sessionTrace) request(id interface{}, method, pool string, attrs map[string]string) {
+	if tr == nil {
+		return
+	}
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	attrs["pool"] = pool
+	tr.mu.Lock()
+	if tr.pending != nil {
+		tr.pending[idKey(id)] = tr.child(method, spanKindClient, time.Now(), attrs)
+	}
+	tr.mu.Unlock()
+}
+
+// response ends the span of the request id with the answer; failure is ""
+// when it succeeded.
+func (tr *sessionTrace) response(id interface{}, failure string) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	sp, ok := tr.pending[idKey(id)]
+	delete(tr.pending, idKey(id))
+	tr.mu.Unlock()
+	if !ok {
+		return
+	}
+	sp.end = time.Now()
+	sp.err = failure
+	tracer.add(sp)
+}
+
+// event records a span that already ended, such as a failover.
+func (tr *sessionTrace) event(name string, start time.Time, attrs map[string]string, failure string) {
+	if tr == nil {
+		return
+	}
+	sp := tr.child(name, spanKindInternal, start, attrs)
+	sp.end = time.Now()
+	sp.err = failure
+	tracer.add(sp)
+}
+
+// end finishes the session span and the requests never answered.
+func (tr *sessionTrace) end(attrs map[string]string) {
+	if tr == nil {
+		return
+	}
+	now := time.Now()
+	tr.mu.Lock()
+	for _, sp := range tr.pending {
+		sp.end = now
+		sp.err = "no answer before the session ended"
+		tracer.add(sp)
+	}
+	tr.pending = nil
+	tr.mu.Unlock()
+	for key, value := range attrs {
+		tr.root.attrs[key] = value
+	}
+	tr.root.end = now
+	tracer.add(&tr.root)
+}
+
+// responseFailure describes a failed answer of the pool, or returns "".
+func responseFailure(resp *stratumResponse) string {
+	if len(resp.Error) > 0 && string(resp.Error) != "null" {
+		return string(resp.Error)
+	}
+	if string(resp.Result) == "false" {
+		return "result false"
+	}
+	return ""
+}
+
+// submitAttrs are the span attributes of a share.
+func submitAttrs(info submitInfo) map[string]string {
+	return map[string]string{
+		"worker":     info.worker,
+		"job.id":     info.job,
+		"difficulty": strconv.FormatFloat(info.difficulty, 'g', -1, 64),
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stratum traffic is counted per worker, between the miner and the proxy,
+// and per pool, between the proxy and the pool, standby connections
+// included. Sessions hand the bytes to the statistics as they go, so the
+// exports and metrics show what a farm on a metered link sends.
+
+// How often sessions add their traffic to the statistics.
+const trafficReportInterval = 10 * time.Second
+
+// trafficCounter counts the bytes of one connection and how many of them
+// the statistics have.
+type trafficCounter struct {
+	in, out                 atomic.Int64
+	reportedIn, reportedOut atomic.Int64
+}
+
+// unreported returns the bytes counted since the last call.
+func (t *trafficCounter) unreported() (in, out int64) {
+	in, out = t.in.Load(), t.out.Load()
+	return in - t.reportedIn.Swap(in), out - t.reportedOut.Swap(out)
+}
+
+// workerTraffic adds bytes received from and sent to a worker.
+func (c *statsCollector) workerTraffic(name string, in, out int64) {
+	if in == 0 && out == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := c.worker(name)
+	w.bytesIn += in
+	w.bytesOut += out
+	w.total.bytesIn += in
+	w.total.bytesOut += out
+}
+
+// poolTraffic adds bytes received from and sent to a pool.
+func (c *statsCollector) poolTraffic(address string, in, out int64) {
+	if in == 0 && out == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.pool(address)
+	p.bytesIn += in
+	p.bytesOut += out
+	p.total.bytesIn += in
+	p.total.bytesOut += out
+}
+
+// reportTraffic adds the traffic of the connection to the pool.
+func (u *upstream) reportTraffic() {
+	in, out := u.traffic.unreported()
+	stats.poolTraffic(u.target.Address, in, out)
+}
+
+// reportTraffic adds the traffic with the miner, once it named its worker,
+// and with its pools.
+func (s *session) reportTraffic() {
+	if worker, _ := s.trafficWorker.Load().(string); worker != "" {
+		in, out := s.traffic.unreported()
+		stats.workerTraffic(worker, in, out)
+	}
+	s.up.Load().reportTraffic()
+	if standby := s.standby.Load(); standby != nil {
+		standby.reportTraffic()
+	}
+}
+
+// countTraffic reports the traffic of the session every report interval
+// until it ends.
+func (s *session) countTraffic() {
+	ticker := time.NewTicker(trafficReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.reportTraffic()
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of recent job ids remembered per upstream. Older ones are kept as
+// long as the stale policies accept them, up to upstreamMaxJobs, for pools
+// that send many jobs between clean_jobs notifies.
+const (
+	upstreamJobHistory = 16
+	upstreamMaxJobs    = 64
+)
+
+// upstream is one pool connection of a session. Besides the active one a
+// session may keep a warm standby, which is subscribed and authorized like
+// the miner but only records the jobs it is sent.
+type upstream struct {
+	target  Target
+	conn    net.Conn
+	reader  *bufio.Reader
+	maxLine int
+	link    *seqLink
+	writeMu sync.Mutex
+	// capture is the traffic capture of the session, nil outside sessions.
+	capture *atomic.Pointer[trafficCapture]
+	traffic trafficCounter
+
+	mu              sync.Mutex
+	active          bool
+	extranonce1     string
+	extranonce2Size int
+	sessionID       string // subscription id, to resume the session with
+	resumed         bool   // the pool resumed the session of a lost connection
+	authorized      bool
+	difficulty      string // last mining.set_difficulty
+	notify          string // last mining.notify
+	jobs            []upstreamJob
+	generation      int // number of clean_jobs notifies seen
+	// generations is how many clean_jobs notifies back jobs are kept, -1
+	// for all; forgot is set once jobs within that were dropped for room.
+	generations int
+	forgot      bool
+}
+
+// upstreamJob is a job id and the clean_jobs generation it was sent in.
+type upstreamJob struct {
+	id         string
+	generation int
+	job        *stratumJob // nil for other than bitcoin-style jobs
+}
+
+func newUpstream(target Target, conn net.Conn, limits LimitsConfig) *upstream {
+	u := &upstream{target: target, conn: conn, reader: bufio.NewReader(conn), maxLine: limits.maxPoolMessage()}
+	if target.Sequenced {
+		u.link = newSeqLink(target.Address)
+	}
+	return u
+}
+
+func (u *upstream) write(line string) error {
+	line = u.target.sanitizeLine(line)
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	if u.link != nil {
+		if hello := u.link.open(); hello != "" {
+			u.captured(">pool", hello)
+			n, err := writeLine(u.conn, hello)
+			u.traffic.out.Add(int64(n))
+			if err != nil {
+				return err
+			}
+		}
+		line = u.link.frame(line)
+	}
+	u.captured(">pool", line)
+	n, err := writeLine(u.conn, line)
+	u.traffic.out.Add(int64(n))
+	return err
+}
+
+// writeRaw sends link control lines, which are not themselves sequenced.
+func (u *upstream) writeRaw(lines []string) error {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	for _, line := range lines {
+		u.captured(">pool", line)
+		n, err := writeLine(u.conn, line)
+		u.traffic.out.Add(int64(n))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLine returns the next message from the pool.
+func (u *upstream) readLine() (string, error) {
+	for {
+		line, err := readLine(u.reader, u.maxLine)
+		u.traffic.in.Add(int64(len(line)))
+		if err != nil {
+			return "", err
+		}
+		u.captured("pool>", line)
+		line = strings.TrimSpace(line)
+		if u.link != nil && isSeqLine(line) {
+			message, ok, replies := u.link.receive(line)
+			if err := u.writeRaw(replies); err != nil {
+				return "", err
+			}
+			if !ok {
+				continue
+			}
+			line = message
+		}
+		return line, nil
+	}
+}
+
+// Request ids the proxy uses for its own handshake on a standby connection.
+const (
+	standbyConfigureID  = 1
+	standbySubscribeID  = 2
+	standbyExtranonceID = 3
+	standbyAuthorizeID  = 4
+)
+
+// record keeps what a standby needs to take over: the handshake results and
+// the latest difficulty and job. Callers hold u.mu.
+func (u *upstream) record(line string) {
+	var msg stratumResponse
+	if json.Unmarshal([]byte(line), &msg) != nil {
+		return
+	}
+
+	switch msg.Method {
+	case "":
+		switch idKey(msg.ID) {
+		case idKey(standbySubscribeID):
+			u.noteSubscribe(&msg)
+		case idKey(standbyAuthorizeID):
+			u.authorized = msg.ok()
+		}
+	case "mining.set_extranonce":
+		if len(msg.Params) >= 2 {
+			json.Unmarshal(msg.Params[0], &u.extranonce1)
+			json.Unmarshal(msg.Params[1], &u.extranonce2Size)
+		}
+	case "mining.set_difficulty":
+		u.difficulty = line
+	case "mining.notify":
+		u.notify = line
+		u.noteJob(&msg)
+	}
+}
+
+// currentDifficulty returns the share difficulty last set by the pool, or 0
+// if it has not set one.
+func (u *upstream) currentDifficulty() float64 {
+	u.mu.Lock()
+	line := u.difficulty
+	u.mu.Unlock()
+	var msg stratumResponse
+	var difficulty float64
+	if json.Unmarshal([]byte(line), &msg) == nil && len(msg.Params) > 0 {
+		json.Unmarshal(msg.Params[0], &difficulty)
+	}
+	return difficulty
+}
+
+// noteJob remembers the job id of a mining.notify. Callers hold u.mu.
+func (u *upstream) noteJob(msg *stratumResponse) {
+	var job string
+	if len(msg.Params) == 0 || json.Unmarshal(msg.Params[0], &job) != nil {
+		return
+	}
+	var clean bool
+	if i := cleanJobsIndex(msg.Params); len(msg.Params) > i && json.Unmarshal(msg.Params[i], &clean) == nil && clean {
+		u.generation++
+	}
+	u.jobs = append(u.jobs, upstreamJob{id: job, generation: u.generation, job: parseJob(msg.Params)})
+	u.trimJobs()
+}
+
+// trimJobs drops the jobs before the last upstreamJobHistory that are more
+// clean_jobs notifies back than kept, and the oldest beyond
+// upstreamMaxJobs. Callers hold u.mu.
+func (u *upstream) trimJobs() {
+	drop := 0
+	for drop < len(u.jobs)-upstreamJobHistory && u.generations >= 0 && u.generation-u.jobs[drop].generation > u.generations {
+		drop++
+	}
+	if len(u.jobs)-drop > upstreamMaxJobs {
+		drop = len(u.jobs) - upstreamMaxJobs
+		u.forgot = true
+	}
+	u.jobs = u.jobs[drop:]
+}
+
+// jobAge returns how many clean_jobs notifies the pool sent since job, and
+// whether the job is known at all. Unknown jobs may be ones dropped for
+// room, which forgot reports.
+func (u *upstream) jobAge(job string) (age int, known, forgot bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := len(u.jobs) - 1; i >= 0; i-- {
+		if u.jobs[i].id == job {
+			return u.generation - u.jobs[i].generation, true, false
+		}
+	}
+	return 0, false, u.forgot
+}
+
+// ready reports whether a standby can take over. Callers hold u.mu.
+func (u *upstream) ready() bool {
+	return u.authorized && u.extranonce1 != "" && u.notify != ""
+}
+
+func (u *upstream) close() {
+	u.conn.Close()
+}
+
+// cleanJobsNotify returns a mining.notify with clean_jobs set, so the miner
+// drops its current work immediately.
+func cleanJobsNotify(line string) string {
+	var msg map[string]interface{}
+	if json.Unmarshal([]byte(line), &msg) != nil {
+		return line
+	}
+	params, ok := msg["params"].([]interface{})
+	if !ok || len(params) < 9 {
+		return line
+	}
+	params[8] = true
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return line
+	}
+	return string(data)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// verify is a pre-flight check for a config: it starts the proxy in-process
+// with the config, every target replaced by a fake pool, and pushes fake
+// miners through its listener. Each feature is reported as PASS, FAIL or
+// SKIP, and the command fails when any check does.
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	configPath := fs.String("c", "config.json", "Configuration to verify")
+	logPath := fs.String("l", "", "Proxy log file (default: discard)")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for each step")
+	fs.Parse(args)
+
+	closeLog, err := openCommandLog(*logPath)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+
+	// One fake pool per target, so where a miner ends up is visible.
+	pools := make(map[string]*fakePool)
+	names := make(map[*fakePool]string)
+	defer func() {
+		for _, pool := range pools {
+			pool.Close()
+		}
+	}()
+	for _, t := range allTargets(config) {
+		pool, err := startFakePool("127.0.0.1:0", time.Second)
+		if err != nil {
+			return err
+		}
+		pools[t.Address] = pool
+		names[pool] = t.Address
+	}
+	test := config.withTargets(func(t Target) Target {
+		// Fake pools speak plain stratum only.
+		return Target{Address: pools[t.Address].Addr(), Weight: t.Weight}
+	})
+	// Nothing outside this process is touched: no admin, debug, control or
+	// getwork interface, state files, clock queries, alerts, cluster or
+	// traces.
+	test.Admin = AdminConfig{}
+	test.Debug = DebugConfig{}
+	test.ControlSocket = ""
+	test.StateDir = ""
+	test.ClockCheck.NTPServer = ""
+	test.HealthCheck = HealthCheckConfig{}
+	test.ShareLog = ShareLogConfig{}
+	test.AccessLog = AccessLogConfig{}
+	test.StatsExport = StatsExportConfig{}
+	test.Alerts = AlertsConfig{}
+	test.Cluster = ClusterConfig{}
+	test.HA = HAConfig{}
+	test.Getwork = GetworkConfig{}
+	test.Tracing = TracingConfig{}
+	// The test miner knows no credentials.
+	test.MinerAuth = MinerAuthConfig{}
+	// The fake pools are local.
+	test.HTTPProxy = nil
+
+	var tlsListen bool
+	for _, address := range test.Listen {
+		tlsListen = tlsListen || isTLSAddress(address)
+	}
+	server, err := startVerifyServer(test)
+	if err != nil {
+		return err
+	}
+	defer server.stop()
+	network, address := server.listeners[0].Addr().Network(), server.listeners[0].Addr().String()
+
+	v := &verifier{network: network, address: address, timeout: *timeout, config: test, pools: pools, names: names}
+	v.checkRewrite()
+	v.checkRouting()
+	v.checkTLS(server, tlsListen)
+	v.checkFailover()
+
+	if v.failed > 0 {
+		return fmt.Errorf("%d checks failed", v.failed)
+	}
+	fmt.Println("verify: PASS")
+	return nil
+}
+
+// startVerifyServer starts the proxy on the configured listen addresses, or
+// on a free loopback port when they are in use, e.g. by the running proxy.
+// Unix sockets always get a temporary path so a live socket is not replaced,
+// virtual pools a free loopback port and tls:// addresses a plain one.
+func startVerifyServer(config *Config) (*proxyServer, error) {
+	config.VirtualPools = append([]VirtualPoolConfig(nil), config.VirtualPools...)
+	for i := range config.VirtualPools {
+		config.VirtualPools[i].Listen = "127.0.0.1:0"
+	}
+	var listen ListenList
+	for _, address := range config.Listen {
+		if strings.HasPrefix(address, "unix:") {
+			address = "unix:" + filepath.Join(os.TempDir(), fmt.Sprintf("stratum-proxy-verify-%d.sock", os.Getpid()))
+		}
+		if isTLSAddress(address) {
+			// The test miner speaks plain stratum.
+			address = "127.0.0.1:0"
+		}
+		listen = append(listen, address)
+	}
+	config.Listen = listen
+
+	server, err := newProxyServer(config)
+	if err != nil {
+		fmt.Printf("verify: cannot listen on %s (%v), using a free port instead\n", strings.Join(listen, ", "), err)
+		config.Listen = ListenList{"127.0.0.1:0"}
+		if server, err = newProxyServer(config); err != nil {
+			return nil, err
+		}
+	}
+	server.serve()
+	return server, nil
+}
+
+// withTargets returns a copy of config with every target passed through fn.
+func (c *Config) withTargets(fn func(Target) Target) *Config {
+	mapped := *c
+	mapList := func(list []Target) []Target {
+		if list == nil {
+			return nil
+		}
+		out := make([]Target, len(list))
+		for i, t := range list {
+			out[i] = fn(t)
+		}
+		return out
+	}
+	mapped.Coins = append([]CoinConfig(nil), c.Coins...)
+	for i := range mapped.Coins {
+		mapped.Coins[i].Targets = mapList(mapped.Coins[i].Targets)
+	}
+	mapped.VirtualPools = append([]VirtualPoolConfig(nil), c.VirtualPools...)
+	for i := range mapped.VirtualPools {
+		mapped.VirtualPools[i].Targets = mapList(mapped.VirtualPools[i].Targets)
+	}
+	mapped.Clients = append([]ClientConfig(nil), c.Clients...)
+	for i := range mapped.Clients {
+		mapped.Clients[i].Targets = mapList(mapped.Clients[i].Targets)
+	}
+	mapped.Routes = append([]RouteConfig(nil), c.Routes...)
+	for i := range mapped.Routes {
+		mapped.Routes[i].Targets = mapList(mapped.Routes[i].Targets)
+	}
+	mapped.GeoRoutes = append([]GeoRouteConfig(nil), c.GeoRoutes...)
+	for i := range mapped.GeoRoutes {
+		mapped.GeoRoutes[i].Targets = mapList(mapped.GeoRoutes[i].Targets)
+	}
+	mapped.indexClients()
+	return &mapped
+}
+
+type verifier struct {
+	network, address string
+	timeout          time.Duration
+	config           *Config
+	pools            map[string]*fakePool
+	names            map[*fakePool]string
+	failed           int
+}
+
+func (v *verifier) report(feature, status, format string, args ...interface{}) {
+	if status == "FAIL" {
+		v.failed++
+	}
+	fmt.Printf("verify: %s %s: %s\n", status, feature, fmt.Sprintf(format, args...))
+}
+
+// counts snapshots a counter of every pool.
+func (v *verifier) counts(counter func(p *fakePool) int64) map[*fakePool]int64 {
+	counts := make(map[*fakePool]int64)
+	for _, pool := range v.pools {
+		counts[pool] = counter(pool)
+	}
+	return counts
+}
+
+// grown returns a pool whose counter went up since before, waiting up to the
+// timeout for one, and skipping except.
+func (v *verifier) grown(before map[*fakePool]int64, counter func(p *fakePool) int64, except *fakePool) *fakePool {
+	for deadline := time.Now().Add(v.timeout); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		for pool, n := range before {
+			if pool != except && counter(pool) > n {
+				return pool
+			}
+		}
+	}
+	return nil
+}
+
+func submits(p *fakePool) int64    { return p.submits.Load() }
+func authorized(p *fakePool) int64 { return p.authorized.Load() }
+
+// session connects a fake miner as user and submits one share, returning
+// the miner and the pool the share reached.
+func (v *verifier) session(user string, extranonce bool) (*fakeMiner, *fakePool, error) {
+	m, err := dialFakeMiner(v.network, v.address, v.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.extranonce = extranonce
+	if err := m.handshake("verify/1.0", user); err != nil {
+		m.Close()
+		return nil, nil, err
+	}
+	before := v.counts(submits)
+	if _, err := m.submit(user, 1); err != nil {
+		m.Close()
+		return nil, nil, fmt.Errorf("submit: %v", err)
+	}
+	pool := v.grown(before, submits, nil)
+	if pool == nil {
+		m.Close()
+		return nil, nil, fmt.Errorf("no pool received the share")
+	}
+	return m, pool, nil
+}
+
+// expectedWorker is the worker name the proxy should use towards the pool
+// for user connecting from the loopback address.
+func (v *verifier) expectedWorker(user string) string {
+	effective := v.config.forLocation("127.0.0.1").forClient("127.0.0.1").forUser(user)
+	id := workerIdentity{ip: "127x0x0x1"}
+	if name := workerNames.lookup("127.0.0.1"); name != "" {
+		id.ip = name
+	}
+	// Through ModifyJSON, for the rewrite rules to apply.
+	line := fmt.Sprintf(`{"id":1,"method":"mining.authorize","params":[%q,"x"]}`, user)
+	return authorizedWorker(ModifyJSON(line, effective, id))
+}
+
+func (v *verifier) checkRewrite() {
+	user := "verify.worker"
+	m, pool, err := v.session(user, true)
+	if err != nil {
+		v.report("rewrite", "FAIL", "%v", err)
+		return
+	}
+	m.Close()
+	if got, want := pool.user(), v.expectedWorker(user); got != want {
+		v.report("rewrite", "FAIL", "pool %s saw worker %q, expected %q", v.names[pool], got, want)
+		return
+	}
+	v.report("rewrite", "PASS", "pool %s saw worker %q", v.names[pool], pool.user())
+}
+
+// checkTLS pushes a miner through a tls:// listener with the configured
+// certificate, opened on a free loopback port.
+func (v *verifier) checkTLS(server *proxyServer, configured bool) {
+	if !configured {
+		v.report("tls", "SKIP", "no tls:// listener configured")
+		return
+	}
+	if v.config.TLS.ClientCAFile != "" || len(v.config.TLS.ClientPins) > 0 {
+		v.report("tls", "SKIP", "the listeners require a client certificate, which the test miner has none of")
+		return
+	}
+	listener, err := listenTLS("tls://127.0.0.1:0", v.config.TLS, nil)
+	if err != nil {
+		v.report("tls", "FAIL", "cannot listen with the configured certificate: %v", err)
+		return
+	}
+	defer listener.Close()
+	go server.acceptLoop(listener)
+
+	// The handshake is checked, not the name the certificate is for.
+	dialer := &net.Dialer{Timeout: v.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		v.report("tls", "FAIL", "handshake: %v", err)
+		return
+	}
+	m := &fakeMiner{conn: conn, reader: bufio.NewReader(conn), timeout: v.timeout}
+	defer m.Close()
+	if err := m.handshake("verify/1.0", "verify.tls"); err != nil {
+		v.report("tls", "FAIL", "%v", err)
+		return
+	}
+	v.report("tls", "PASS", "miner logged in over TLS, certificate %s", certFingerprint(conn.ConnectionState().PeerCertificates[0]))
+}
+
+func (v *verifier) checkRouting() {
+	if len(v.config.Routes) == 0 {
+		v.report("routing", "SKIP", "no routes configured")
+		return
+	}
+	// Routes are remembered per client IP; start and end without one.
+	defer func() {
+		knownUsers.forget("127.0.0.1")
+	}()
+
+	for _, route := range v.config.Routes {
+		if !route.Schedule.on(time.Now()) {
+			v.report("routing", "SKIP", "route %q: not scheduled now", route.name())
+			continue
+		}
+		pattern := route.Username
+		if pattern == "" {
+			pattern = route.Wallet + ".verify"
+		}
+		if strings.ContainsAny(pattern, `[\`) {
+			v.report("routing", "SKIP", "route %q: cannot make up a matching username", route.name())
+			continue
+		}
+		user := strings.NewReplacer("*", "verify", "?", "v").Replace(pattern)
+		knownUsers.forget("127.0.0.1")
+
+		m, pool, err := v.session(user, true)
+		if err != nil {
+			v.report("routing", "FAIL", "route %q with user %q: %v", route.name(), user, err)
+			continue
+		}
+		m.Close()
+		if targets := route.targets(v.config); targets != nil && !containsTarget(targets, pool.Addr()) {
+			v.report("routing", "FAIL", "route %q with user %q reached %s", route.name(), user, v.names[pool])
+			continue
+		}
+		if got, want := pool.user(), v.expectedWorker(user); got != want {
+			v.report("routing", "FAIL", "route %q with user %q: pool saw worker %q, expected %q", route.name(), user, got, want)
+			continue
+		}
+		v.report("routing", "PASS", "route %q with user %q reached %s as %q", route.name(), user, v.names[pool], pool.user())
+	}
+}
+
+func containsTarget(targets []Target, address string) bool {
+	for _, t := range targets {
+		if t.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBackup reports whether a target group the pool belongs to has another
+// target.
+func (v *verifier) hasBackup(pool *fakePool) bool {
+	effective := v.config.forLocation("127.0.0.1").forClient("127.0.0.1")
+	for _, coin := range effective.Coins {
+		if len(coin.Targets) > 1 && containsTarget(coin.Targets, pool.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFailover takes the pool a miner is on down and checks the miner ends
+// up on another one: moved over a warm standby when configured, otherwise by
+// reconnecting. It runs last as the pool stays down.
+func (v *verifier) checkFailover() {
+	user := "verify.failover"
+	authorizedBefore := v.counts(authorized)
+	m, primary, err := v.session(user, v.config.WarmStandby)
+	if err != nil {
+		v.report("failover", "FAIL", "%v", err)
+		return
+	}
+	defer func() { m.Close() }()
+	if !v.hasBackup(primary) {
+		v.report("failover", "SKIP", "no other target to fail over to from %s", v.names[primary])
+		return
+	}
+
+	if v.config.WarmStandby {
+		if v.grown(authorizedBefore, authorized, primary) == nil {
+			v.report("failover", "FAIL", "no standby connection was opened")
+			return
+		}
+	}
+
+	primary.Close()
+	before := v.counts(submits)
+	if v.config.WarmStandby {
+		if _, err := m.waitFor("mining.set_extranonce"); err != nil {
+			v.report("failover", "FAIL", "miner was not moved off %s: %v", v.names[primary], err)
+			return
+		}
+		if ok, err := m.submit(user, 2); err != nil || !ok {
+			v.report("failover", "FAIL", "share after the move was not accepted: %v", err)
+			return
+		}
+	} else {
+		m.Close()
+		m, err = dialFakeMiner(v.network, v.address, v.timeout)
+		if err == nil {
+			err = m.handshake("verify/1.0", user)
+		}
+		if err == nil {
+			_, err = m.submit(user, 2)
+		}
+		if err != nil {
+			v.report("failover", "FAIL", "reconnect after %s went down: %v", v.names[primary], err)
+			return
+		}
+	}
+	backup := v.grown(before, submits, primary)
+	if backup == nil {
+		v.report("failover", "FAIL", "no other pool received shares after %s went down", v.names[primary])
+		return
+	}
+	how := "by reconnecting"
+	if v.config.WarmStandby {
+		how = "without reconnecting"
+	}
+	v.report("failover", "PASS", "miner moved from %s to %s %s", v.names[primary], v.names[backup], how)
+}
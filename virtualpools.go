@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// VirtualPoolConfig makes a listen address a pool of its own. Miners that
+// connect to it mine Coin on its targets and with its credentials, so an
+// operator can point each farm at a port instead of relying on coin
+// detection.
+type VirtualPoolConfig struct {
+	Name   string `json:"name"`
+	Listen string `json:"listen"`
+	// Coin is the coin profile, the default coin when "".
+	Coin string `json:"coin"`
+	// Targets replace those of the coin when set, and Miner replaces the
+	// non-empty fields of miner like a coin's miner does.
+	Targets []Target     `json:"targets,omitempty"`
+	Miner   *MinerConfig `json:"miner,omitempty"`
+}
+
+// virtualPoolListener accepts the miners of the virtual pool called pool.
+type virtualPoolListener struct {
+	net.Listener
+	pool string
+}
+
+func validateVirtualPools(config *Config) error {
+	names := make(map[string]bool)
+	addresses := make(map[string]bool)
+	for _, address := range config.Listen {
+		addresses[address] = true
+	}
+	for _, pool := range config.VirtualPools {
+		if pool.Name == "" {
+			return fmt.Errorf("virtual pool without a name")
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("virtual pool %s listed twice", pool.Name)
+		}
+		names[pool.Name] = true
+		if pool.Listen == "" {
+			return fmt.Errorf("virtual pool %s has no listen address", pool.Name)
+		}
+		if addresses[pool.Listen] {
+			return fmt.Errorf("virtual pool %s: %s is listened on already", pool.Name, pool.Listen)
+		}
+		addresses[pool.Listen] = true
+		if pool.Coin != "" && config.coin(pool.Coin) == nil {
+			return fmt.Errorf("virtual pool %s: coin %s is not configured", pool.Name, pool.Coin)
+		}
+		if len(pool.Targets) == 0 && len(config.coinTargets(pool.coin(config))) == 0 {
+			return fmt.Errorf("virtual pool %s has no targets", pool.Name)
+		}
+	}
+	return nil
+}
+
+// listenAddresses returns the addresses miners are accepted on: listen,
+// then those of the virtual pools.
+func (c *Config) listenAddresses() []string {
+	addresses := append([]string(nil), c.Listen...)
+	for _, pool := range c.VirtualPools {
+		addresses = append(addresses, pool.Listen)
+	}
+	return addresses
+}
+
+// virtualPool returns the virtual pool called name, or nil.
+func (c *Config) virtualPool(name string) *VirtualPoolConfig {
+	for i := range c.VirtualPools {
+		if c.VirtualPools[i].Name == name {
+			return &c.VirtualPools[i]
+		}
+	}
+	return nil
+}
+
+// coin returns the name of the coin the miners of the pool mine.
+func (pool *VirtualPoolConfig) coin(c *Config) string {
+	if pool.Coin != "" {
+		return pool.Coin
+	}
+	return c.defaultCoin()
+}
+
+// forVirtualPool returns the effective config for the miners of a virtual
+// pool, with its coin's rules and then its own applied to a copy.
+func (c *Config) forVirtualPool(pool *VirtualPoolConfig) *Config {
+	coin := pool.coin(c)
+	effective := *c.forCoin(coin)
+	if len(pool.Targets) > 0 {
+		effective.Coins = append([]CoinConfig(nil), effective.Coins...)
+		for i := range effective.Coins {
+			if effective.Coins[i].Name == coin {
+				effective.Coins[i].Targets = pool.Targets
+			}
+		}
+	}
+	effective.Miner = effective.Miner.with(pool.Miner)
+	return &effective
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocketConfig applies to "ws://" and "wss://" listen addresses, which
+// take miners speaking stratum over WebSocket, one message per line.
+type WebSocketConfig struct {
+	// CertFile and KeyFile are the PEM certificate and key of wss://
+	// listeners.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile, when set, makes wss:// listeners require a client
+	// certificate signed by one of its PEM CAs. The common name of the
+	// certificate takes the place of the IP in worker names.
+	ClientCAFile string `json:"client_ca_file"`
+	// Origins lists the browser origins allowed to connect, such as
+	// "https://example.com"; empty allows all.
+	Origins []string `json:"origins"`
+}
+
+const (
+	websocketGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC11B85"
+	websocketMaxMessage     = 64 << 10
+	websocketHandshakeLimit = 10 * time.Second
+)
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+func isWebSocketAddress(address string) bool {
+	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
+}
+
+func validateWebSocket(config *Config) error {
+	for _, address := range config.listenAddresses() {
+		if !isWebSocketAddress(address) {
+			continue
+		}
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid address %q", address)
+		}
+		if u.Scheme == "wss" && (config.WebSocket.CertFile == "" || config.WebSocket.KeyFile == "") {
+			return fmt.Errorf("%s needs cert_file and key_file", address)
+		}
+	}
+	return nil
+}
+
+// wsListener hands out the WebSocket connections its HTTP server upgraded.
+type wsListener struct {
+	raw    net.Listener
+	server *http.Server
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// listenWebSocket listens on a ws:// or wss:// address; a path in it is the
+// only one upgraded.
+func listenWebSocket(address string, cfg WebSocketConfig, options *SocketOptions) (net.Listener, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := listen(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	raw = options.listener(raw)
+	if u.Scheme == "wss" {
+		tlsConfig, err := serverTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile, nil)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		raw = tls.NewListener(raw, tlsConfig)
+	}
+
+	l := &wsListener{raw: raw, conns: make(chan net.Conn), done: make(chan struct{})}
+	l.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if u.Path != "" && u.Path != "/" && r.URL.Path != u.Path {
+				http.NotFound(w, r)
+				return
+			}
+			l.upgrade(w, r, cfg)
+		}),
+		ReadHeaderTimeout: websocketHandshakeLimit,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+	go l.server.Serve(raw)
+	return l, nil
+}
+
+func (l *wsListener) upgrade(w http.ResponseWriter, r *http.Request, cfg WebSocketConfig) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "stratum over WebSocket only", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && len(cfg.Origins) > 0 && !containsString(cfg.Origins, origin) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- &wsConn{Conn: conn, reader: rw.Reader}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.server.Close()
+	})
+	return nil
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.raw.Addr()
+}
+
+// clientCertName returns the common name of the certificate a wss:// or
+// tls:// client authenticated with, or "" for other clients.
+func clientCertName(conn net.Conn) string {
+	if ws, ok := conn.(*wsConn); ok {
+		conn = ws.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+// wsConn turns the messages of a WebSocket connection into lines, and the
+// lines written to it into text messages.
+type wsConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte
+	writeMu sync.Mutex
+	closed  bool
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(message) > 0 && message[len(message)-1] != '\n' {
+			message = append(message, '\n')
+		}
+		c.pending = message
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage returns the next text or binary message, answering pings on
+// the way.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			message = append(message, payload...)
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+		if len(message) > websocketMaxMessage {
+			return nil, fmt.Errorf("websocket: message over %d bytes", websocketMaxMessage)
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	masked, length := header[1]&0x80 != 0, uint64(header[1]&0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		err = errors.New("websocket: unmasked frame from client")
+		return
+	}
+	if length > websocketMaxMessage {
+		err = fmt.Errorf("websocket: frame over %d bytes", websocketMaxMessage)
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	_, err := c.Conn.Write(append(frame, payload...))
+	if opcode == wsClose {
+		c.closed = true
+	}
+	return err
+}
+
+// Write sends each line of b as a text message.
+func (c *wsConn) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if err := c.writeFrame(wsText, []byte(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}